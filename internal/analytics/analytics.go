@@ -0,0 +1,117 @@
+// Package analytics computes availability and performance statistics, such as
+// uptime, MTTR and latency percentiles, over a window of stored measurements.
+package analytics
+
+import (
+	"context"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	"github.com/SkylerRankin/network_monitor/internal/database"
+	"github.com/SkylerRankin/network_monitor/internal/optional"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	WindowDay    = "day"
+	WindowWeek   = "week"
+	WindowMonth  = "month"
+	WindowCustom = "custom"
+)
+
+// WindowStart returns the start of a named window ending now. Months are the
+// last 30 days.
+func WindowStart(window string, now time.Time) (time.Time, error) {
+	switch window {
+	case WindowDay:
+		return now.AddDate(0, 0, -1), nil
+	case WindowWeek:
+		return now.AddDate(0, 0, -7), nil
+	case WindowMonth:
+		return now.AddDate(0, 0, -30), nil
+	}
+	return time.Time{}, errors.Errorf("unknown window %q", window)
+}
+
+// Compute reads the measurements between start and end from the database and
+// summarizes them. Outages are tracked by the availability definition, and
+// last until the next measurement where the connection is up, or until the
+// end of the window.
+func Compute(ctx context.Context, db database.Database, definition config.Availability, window string, start time.Time, end time.Time, now time.Time) (*types.Stats, error) {
+	stats := &types.Stats{
+		Window: window,
+		Start:  start.UnixMilli(),
+		End:    end.UnixMilli(),
+	}
+
+	var rtts, losses, downloads, uploads []float64
+	tracker := NewTracker(definition)
+	var firstTimestamp int64
+	upCount := 0
+
+	err := db.ExportNetworkInfo(ctx, stats.Start, stats.End, false, func(info *types.NetworkInfo) error {
+		if stats.Measurements == 0 {
+			firstTimestamp = info.Timestamp
+		}
+		stats.Measurements += 1
+		if tracker.Add(info) {
+			upCount += 1
+		}
+
+		losses = append(losses, float64(info.PacketLoss))
+		if info.PingSuccessful {
+			rtts = append(rtts, float64(info.RTTMS))
+		}
+		if download, err := info.DownloadSpeed.Get(); err == nil {
+			stats.SpeedTests += 1
+			downloads = append(downloads, download)
+			uploads = append(uploads, info.UploadSpeed.Else(0))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read measurements")
+	}
+
+	observedEnd := min(stats.End, now.UnixMilli())
+	downtime := tracker.Downtime(observedEnd)
+	stats.Outages = len(tracker.Outages)
+	stats.DowntimeMS = downtime
+
+	if stats.Measurements > 0 {
+		stats.AvailabilityPercent = optional.New(100 * float64(upCount) / float64(stats.Measurements))
+	}
+	if stats.Outages > 0 {
+		stats.MTTRMS = optional.New(downtime / int64(stats.Outages))
+		uptime := max(observedEnd-firstTimestamp-downtime, 0)
+		stats.MTBFMS = optional.New(uptime / int64(stats.Outages))
+	}
+
+	stats.RTTMS = percentiles(rtts)
+	stats.PacketLossPercent = percentiles(losses)
+	stats.DownloadMbps = percentiles(downloads)
+	stats.UploadMbps = percentiles(uploads)
+	return stats, nil
+}
+
+// Returns nil if there are no values.
+func percentiles(values []float64) *types.Percentiles {
+	if len(values) == 0 {
+		return nil
+	}
+	slices.Sort(values)
+	return &types.Percentiles{
+		P50: Percentile(values, 50),
+		P95: Percentile(values, 95),
+		P99: Percentile(values, 99),
+	}
+}
+
+// Percentile returns the nearest rank percentile of sorted values.
+func Percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank-1, 0)]
+}
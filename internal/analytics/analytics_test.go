@@ -0,0 +1,173 @@
+package analytics
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	"github.com/SkylerRankin/network_monitor/internal/database/databasetest"
+	"github.com/SkylerRankin/network_monitor/internal/optional"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+)
+
+var windowStart = time.UnixMilli(1700000000000)
+
+// Returns one measurement a minute, failed where the pattern has an "x" and
+// successful with 50% packet loss where it has a "~".
+func measurements(pattern string) *databasetest.Database {
+	db := &databasetest.Database{}
+	for i, c := range pattern {
+		info := types.NetworkInfo{
+			Timestamp:      windowStart.Add(time.Duration(i) * time.Minute).UnixMilli(),
+			PingSuccessful: c != 'x',
+			RTTMS:          10 * (i + 1),
+		}
+		switch c {
+		case 'x':
+			info.PacketLoss = 100
+		case '~':
+			info.PacketLoss = 50
+		}
+		db.Measurements = append(db.Measurements, info)
+	}
+	return db
+}
+
+func compute(t *testing.T, db *databasetest.Database, definition config.Availability, minutes int) *types.Stats {
+	t.Helper()
+	end := windowStart.Add(time.Duration(minutes) * time.Minute)
+	stats, err := Compute(context.Background(), db, definition, WindowCustom, windowStart, end, end)
+	if err != nil {
+		t.Fatalf("failed to compute stats: %v", err)
+	}
+	return stats
+}
+
+func TestComputeSinglePing(t *testing.T) {
+	db := measurements("..xx....x.")
+	db.Measurements[4].DownloadSpeed = optional.New(90.0)
+	db.Measurements[4].UploadSpeed = optional.New(9.0)
+	stats := compute(t, db, config.Default().Stats.Availability, 10)
+
+	if stats.Measurements != 10 || stats.Outages != 2 {
+		t.Fatalf("expected 10 measurements and 2 outages, got %+v", stats)
+	}
+	if availability, _ := stats.AvailabilityPercent.Get(); availability != 70 {
+		t.Errorf("expected 70%% availability, got %v", availability)
+	}
+	// Down from minute 2 to 4, and from 8 to 9.
+	if stats.DowntimeMS != (3 * time.Minute).Milliseconds() {
+		t.Errorf("unexpected downtime %d", stats.DowntimeMS)
+	}
+	if mttr, _ := stats.MTTRMS.Get(); mttr != (90 * time.Second).Milliseconds() {
+		t.Errorf("unexpected MTTR %d", mttr)
+	}
+	// Observed from minute 0 to 10, with 7 minutes up.
+	if mtbf, _ := stats.MTBFMS.Get(); mtbf != (210 * time.Second).Milliseconds() {
+		t.Errorf("unexpected MTBF %d", mtbf)
+	}
+
+	if stats.RTTMS == nil || stats.RTTMS.P50 != 60 || stats.RTTMS.P99 != 100 {
+		t.Errorf("unexpected round trip times %+v", stats.RTTMS)
+	}
+	if stats.SpeedTests != 1 || stats.DownloadMbps == nil || stats.DownloadMbps.P95 != 90 || stats.UploadMbps.P50 != 9 {
+		t.Errorf("unexpected speeds %+v %+v", stats.DownloadMbps, stats.UploadMbps)
+	}
+}
+
+func TestComputeQuorum(t *testing.T) {
+	// Two of the last three pings must succeed, so single failures are ignored.
+	definition := config.Availability{QuorumWindow: 3, Quorum: 2, MaxPacketLossPercent: 100}
+	stats := compute(t, measurements(".x..x.xx..."), definition, 11)
+
+	if stats.Outages != 1 {
+		t.Fatalf("expected 1 outage, got %d", stats.Outages)
+	}
+	// Down at minutes 6 to 8, until two of the last three succeed at minute 9.
+	if stats.DowntimeMS != (3 * time.Minute).Milliseconds() {
+		t.Errorf("unexpected downtime %d", stats.DowntimeMS)
+	}
+}
+
+func TestComputeLossThreshold(t *testing.T) {
+	definition := config.Availability{QuorumWindow: 1, Quorum: 1, MaxPacketLossPercent: 20}
+	// Still down at the end of the window.
+	stats := compute(t, measurements("..~~"), definition, 5)
+
+	if stats.Outages != 1 || stats.DowntimeMS != (3*time.Minute).Milliseconds() {
+		t.Errorf("expected one 3 minute outage, got %d lasting %d", stats.Outages, stats.DowntimeMS)
+	}
+	// High loss pings still count towards round trip times.
+	if stats.RTTMS == nil || stats.RTTMS.P99 != 40 {
+		t.Errorf("unexpected round trip times %+v", stats.RTTMS)
+	}
+}
+
+func TestComputeEmpty(t *testing.T) {
+	stats := compute(t, &databasetest.Database{}, config.Default().Stats.Availability, 10)
+	if stats.AvailabilityPercent.Has() || stats.MTTRMS.Has() || stats.RTTMS != nil {
+		t.Errorf("expected empty stats, got %+v", stats)
+	}
+}
+
+func TestHeatmap(t *testing.T) {
+	// A Monday evening, and the next morning.
+	evening := time.Date(2024, 1, 1, 20, 0, 0, 0, time.UTC)
+	morning := evening.Add(12 * time.Hour)
+	db := &databasetest.Database{Measurements: []types.NetworkInfo{
+		{Timestamp: evening.UnixMilli(), PingSuccessful: true, RTTMS: 80, DownloadSpeed: optional.New(120.0)},
+		{Timestamp: evening.Add(10 * time.Minute).UnixMilli(), PingSuccessful: true, RTTMS: 60, PacketLoss: 50},
+		{Timestamp: evening.Add(20 * time.Minute).UnixMilli(), PingSuccessful: false, PacketLoss: 100},
+		{Timestamp: morning.UnixMilli(), PingSuccessful: true, RTTMS: 20, DownloadSpeed: optional.New(480.0)},
+	}}
+
+	heatmap, err := Heatmap(context.Background(), db, WindowCustom, evening, morning.Add(time.Hour), time.UTC)
+	if err != nil {
+		t.Fatalf("failed to compute heatmap: %v", err)
+	}
+	if len(heatmap.Days) != 7 || len(heatmap.Days[0]) != 24 || heatmap.TimeZone != "UTC" {
+		t.Fatalf("expected a 7 by 24 matrix, got %d days in %s", len(heatmap.Days), heatmap.TimeZone)
+	}
+
+	cell := heatmap.Days[time.Monday][20]
+	rtt, _ := cell.MedianRTTMS.Get()
+	loss, _ := cell.LossPercent.Get()
+	download, _ := cell.MedianDownloadMbps.Get()
+	if cell.Measurements != 3 || rtt != 60 || loss != 50 || cell.SpeedTests != 1 || download != 120 {
+		t.Errorf("unexpected evening cell %+v", cell)
+	}
+	if download, _ := heatmap.Days[time.Tuesday][8].MedianDownloadMbps.Get(); download != 480 {
+		t.Errorf("unexpected morning download %v", download)
+	}
+	if empty := heatmap.Days[time.Sunday][0]; empty.Measurements != 0 || empty.MedianRTTMS.Has() || empty.LossPercent.Has() {
+		t.Errorf("expected an empty cell, got %+v", empty)
+	}
+
+	// Days and hours follow the time zone.
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone database unavailable: %v", err)
+	}
+	heatmap, err = Heatmap(context.Background(), db, WindowCustom, evening, morning.Add(time.Hour), newYork)
+	if err != nil {
+		t.Fatalf("failed to compute heatmap: %v", err)
+	}
+	if heatmap.Days[time.Monday][15].Measurements != 3 || heatmap.Days[time.Tuesday][3].Measurements != 1 {
+		t.Errorf("expected measurements in New York time")
+	}
+}
+
+func TestZoneName(t *testing.T) {
+	for value, expected := range map[string]string{
+		"America/New_York":               "America/New_York",
+		":Europe/Berlin":                 "Europe/Berlin",
+		"/usr/share/zoneinfo/Asia/Tokyo": "Asia/Tokyo",
+		"../usr/share/zoneinfo/Etc/UTC":  "Etc/UTC",
+		"":                               "UTC",
+	} {
+		if name := zoneName(value); name != expected {
+			t.Errorf("expected %q to name %s, got %s", value, expected, name)
+		}
+	}
+}
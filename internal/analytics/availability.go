@@ -0,0 +1,80 @@
+package analytics
+
+import (
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	"github.com/SkylerRankin/network_monitor/internal/optional"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+)
+
+// Outage is a run of measurements where the connection was down.
+type Outage struct {
+	Start int64
+	// Time of the next measurement where the connection was up, or empty if
+	// it was still down at the last one.
+	End optional.Opt[int64]
+	// Failed pings from the start of the outage to its end.
+	FailedPings int
+}
+
+// Tracker follows whether the connection is up at each measurement, in time
+// order. The connection is down at a measurement when fewer than the quorum of
+// the recent pings succeeded.
+type Tracker struct {
+	definition config.Availability
+	// Whether each of the recent pings succeeded, oldest overwritten first.
+	recent       []bool
+	measurements int
+	Outages      []Outage
+}
+
+func NewTracker(definition config.Availability) *Tracker {
+	return &Tracker{definition: definition, recent: make([]bool, 0, definition.QuorumWindow)}
+}
+
+// Add records the next measurement and returns whether the connection was up
+// at it.
+func (t *Tracker) Add(info *types.NetworkInfo) bool {
+	succeeded := info.PingSuccessful && float64(info.PacketLoss) <= t.definition.MaxPacketLossPercent
+	if len(t.recent) < t.definition.QuorumWindow {
+		t.recent = append(t.recent, succeeded)
+	} else {
+		t.recent[t.measurements%t.definition.QuorumWindow] = succeeded
+	}
+	t.measurements += 1
+
+	successes := 0
+	for _, s := range t.recent {
+		if s {
+			successes += 1
+		}
+	}
+	// Until the window has filled, the pings before the first count as
+	// successful.
+	up := successes+t.definition.QuorumWindow-len(t.recent) >= t.definition.Quorum
+
+	var open *Outage
+	if len(t.Outages) > 0 && !t.Outages[len(t.Outages)-1].End.Has() {
+		open = &t.Outages[len(t.Outages)-1]
+	}
+	switch {
+	case up && open != nil:
+		open.End = optional.New(info.Timestamp)
+	case !up && open == nil:
+		t.Outages = append(t.Outages, Outage{Start: info.Timestamp, End: optional.Empty[int64]()})
+		open = &t.Outages[len(t.Outages)-1]
+	}
+	if !up && !succeeded {
+		open.FailedPings += 1
+	}
+	return up
+}
+
+// Downtime returns the total length of the outages, counting one still going
+// until the end time.
+func (t *Tracker) Downtime(end int64) int64 {
+	var downtime int64
+	for _, outage := range t.Outages {
+		downtime += outage.End.Else(end) - outage.Start
+	}
+	return downtime
+}
@@ -0,0 +1,110 @@
+package analytics
+
+import (
+	"context"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/database"
+	"github.com/SkylerRankin/network_monitor/internal/optional"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/pkg/errors"
+)
+
+// Values collected for one hour of the week.
+type heatmapBucket struct {
+	measurements int
+	loss         float64
+	rtts         []float64
+	downloads    []float64
+}
+
+// LocalLocation returns the server's time zone under its IANA name, since
+// time.Local is named "Local". The name comes from the TZ environment variable
+// if set, otherwise from the /etc/localtime link, falling back to time.Local
+// if neither names a zone.
+var LocalLocation = sync.OnceValue(func() *time.Location {
+	var name string
+	if tz, ok := os.LookupEnv("TZ"); ok {
+		name = zoneName(tz)
+	} else if target, err := os.Readlink("/etc/localtime"); err == nil {
+		name = zoneName(target)
+	}
+	if name != "" {
+		if location, err := time.LoadLocation(name); err == nil {
+			return location
+		}
+	}
+	return time.Local
+})
+
+// Returns the zone named by a TZ value or a path into the zone database, such
+// as ":Europe/Berlin" or "/usr/share/zoneinfo/Europe/Berlin". An empty TZ
+// means UTC.
+func zoneName(value string) string {
+	value = strings.TrimPrefix(value, ":")
+	if _, zone, found := strings.Cut(value, "zoneinfo/"); found {
+		return zone
+	}
+	if value == "" {
+		return "UTC"
+	}
+	return value
+}
+
+// Heatmap reads the measurements between start and end and summarizes them by
+// day of the week and hour of the day in the location, to show problems that
+// recur at the same time, such as evening congestion.
+func Heatmap(ctx context.Context, db database.Database, window string, start time.Time, end time.Time, location *time.Location) (*types.Heatmap, error) {
+	var buckets [7][24]heatmapBucket
+	err := db.ExportNetworkInfo(ctx, start.UnixMilli(), end.UnixMilli(), false, func(info *types.NetworkInfo) error {
+		t := time.UnixMilli(info.Timestamp).In(location)
+		bucket := &buckets[t.Weekday()][t.Hour()]
+		bucket.measurements += 1
+		bucket.loss += float64(info.PacketLoss)
+		if info.PingSuccessful {
+			bucket.rtts = append(bucket.rtts, float64(info.RTTMS))
+		}
+		if download, err := info.DownloadSpeed.Get(); err == nil {
+			bucket.downloads = append(bucket.downloads, download)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read measurements")
+	}
+
+	heatmap := &types.Heatmap{
+		Window:   window,
+		Start:    start.UnixMilli(),
+		End:      end.UnixMilli(),
+		TimeZone: location.String(),
+		Days:     make([][]types.HeatmapCell, 7),
+	}
+	for day := range buckets {
+		heatmap.Days[day] = make([]types.HeatmapCell, 24)
+		for hour, bucket := range buckets[day] {
+			cell := &heatmap.Days[day][hour]
+			cell.Measurements = bucket.measurements
+			cell.SpeedTests = len(bucket.downloads)
+			if bucket.measurements > 0 {
+				cell.LossPercent = optional.New(bucket.loss / float64(bucket.measurements))
+			}
+			cell.MedianRTTMS = median(bucket.rtts)
+			cell.MedianDownloadMbps = median(bucket.downloads)
+		}
+	}
+	return heatmap, nil
+}
+
+// Returns the nearest rank median, or empty if there are no values.
+func median(values []float64) optional.Opt[float64] {
+	if len(values) == 0 {
+		return optional.Empty[float64]()
+	}
+	slices.Sort(values)
+	return optional.New(Percentile(values, 50))
+}
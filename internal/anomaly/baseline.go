@@ -0,0 +1,137 @@
+// Package anomaly flags round trip times and speeds that deviate from their
+// usual values for the target and hour of the week, and tracks runs of them as
+// degradation incidents.
+package anomaly
+
+import (
+	"context"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/database"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Scales the median absolute deviation to estimate the standard deviation
+	// of normally distributed values.
+	madScale = 1.4826
+	// Floor on the deviation scale as a fraction of the median, so that very
+	// steady series aren't flagged for small changes.
+	minScaleFraction = 0.1
+)
+
+// Baseline is the usual value of a metric in one hour of the week.
+type Baseline struct {
+	Median float64
+	// Median absolute deviation from the median.
+	MAD     float64
+	Samples int
+}
+
+func newBaseline(values []float64) Baseline {
+	slices.Sort(values)
+	center := median(values)
+	deviations := make([]float64, len(values))
+	for i, value := range values {
+		deviations[i] = math.Abs(value - center)
+	}
+	slices.Sort(deviations)
+	return Baseline{Median: center, MAD: median(deviations), Samples: len(values)}
+}
+
+// Score returns how many scaled deviations the value is above the median,
+// negative if it's below.
+func (b Baseline) Score(value float64) float64 {
+	scale := max(madScale*b.MAD, minScaleFraction*math.Abs(b.Median))
+	if scale == 0 {
+		return 0
+	}
+	return (value - b.Median) / scale
+}
+
+// A metric of one target. Speed tests aren't tied to a target, so their target
+// is empty.
+type seriesKey struct {
+	metric string
+	target string
+}
+
+type bucketKey struct {
+	seriesKey
+	hour int
+}
+
+// A single value taken from a measurement.
+type sample struct {
+	seriesKey
+	value float64
+}
+
+// Returns the round trip time of a successful ping and the speeds of a speed
+// test.
+func samples(info *types.NetworkInfo) []sample {
+	var result []sample
+	if info.PingSuccessful {
+		result = append(result, sample{seriesKey{types.MetricRTT, info.PingHost}, float64(info.RTTMS)})
+	}
+	if download, err := info.DownloadSpeed.Get(); err == nil {
+		result = append(result,
+			sample{seriesKey{types.MetricDownload, ""}, download},
+			sample{seriesKey{types.MetricUpload, ""}, info.UploadSpeed.Else(0)})
+	}
+	return result
+}
+
+// Baselines holds a baseline for each metric, target and hour of the week.
+type Baselines struct {
+	location  *time.Location
+	baselines map[bucketKey]Baseline
+}
+
+// ComputeBaselines reads the measurements between start and end and groups
+// their values by hour of the week in the location.
+func ComputeBaselines(ctx context.Context, db database.Database, start time.Time, end time.Time, location *time.Location) (*Baselines, error) {
+	values := make(map[bucketKey][]float64)
+	err := db.ExportNetworkInfo(ctx, start.UnixMilli(), end.UnixMilli(), false, func(info *types.NetworkInfo) error {
+		hour := hourOfWeek(time.UnixMilli(info.Timestamp), location)
+		for _, sample := range samples(info) {
+			key := bucketKey{sample.seriesKey, hour}
+			values[key] = append(values[key], sample.value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read measurements")
+	}
+
+	baselines := &Baselines{location: location, baselines: make(map[bucketKey]Baseline, len(values))}
+	for key, bucket := range values {
+		baselines.baselines[key] = newBaseline(bucket)
+	}
+	return baselines, nil
+}
+
+// Get returns the baseline for the metric and target in the hour of the week
+// containing the time, and false if there were no values in it.
+func (b *Baselines) Get(metric string, target string, t time.Time) (Baseline, bool) {
+	baseline, ok := b.baselines[bucketKey{seriesKey{metric, target}, hourOfWeek(t, b.location)}]
+	return baseline, ok
+}
+
+// Returns the hours since the start of Sunday.
+func hourOfWeek(t time.Time, location *time.Location) int {
+	t = t.In(location)
+	return int(t.Weekday())*24 + t.Hour()
+}
+
+// Returns the median of sorted values.
+func median(sorted []float64) float64 {
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
@@ -0,0 +1,175 @@
+package anomaly
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/analytics"
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	"github.com/SkylerRankin/network_monitor/internal/database"
+	"github.com/SkylerRankin/network_monitor/internal/optional"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/pkg/errors"
+)
+
+// Time between recomputing the baselines from the stored measurements.
+const baselineRefreshInterval = time.Hour
+
+// Detector checks each new measurement against the baselines, opening a
+// degradation incident after a run of anomalous values and closing it after a
+// run of normal ones. It's safe for concurrent use.
+type Detector struct {
+	config   config.Anomaly
+	database database.Database
+	location *time.Location
+
+	mutex     sync.Mutex
+	baselines *Baselines
+	refreshed time.Time
+	// Nil until the open incidents have been restored from the database.
+	series map[seriesKey]*series
+}
+
+// The state of one metric of one target.
+type series struct {
+	// Whether the current run of values is anomalous, its length, and the time
+	// of its first value.
+	anomalous bool
+	run       int
+	runStart  int64
+	// The open incident, or nil.
+	open *types.Incident
+}
+
+// NewDetector returns a detector using hours of the week in the server's time
+// zone, the same as the heatmap.
+func NewDetector(c config.Anomaly, db database.Database) *Detector {
+	return &Detector{config: c, database: db, location: analytics.LocalLocation()}
+}
+
+// Observe checks the values of a stored measurement, and returns the incidents
+// that opened or closed as a result, after saving them. The baselines are
+// recomputed if they're older than an hour.
+func (d *Detector) Observe(ctx context.Context, info *types.NetworkInfo, now time.Time) ([]types.Incident, error) {
+	if d.config.BaselineWeeks == 0 {
+		return nil, nil
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.baselines == nil || now.Sub(d.refreshed) >= baselineRefreshInterval {
+		if err := d.refresh(ctx, now); err != nil {
+			return nil, err
+		}
+	}
+
+	var changed []types.Incident
+	for _, sample := range samples(info) {
+		incident := d.check(sample, info.Timestamp)
+		if incident == nil {
+			continue
+		}
+		if err := d.database.SaveIncident(ctx, incident); err != nil {
+			return changed, errors.Wrap(err, "failed to save incident")
+		}
+		changed = append(changed, *incident)
+	}
+	return changed, nil
+}
+
+// Recomputes the baselines, first restoring the incidents left open by the
+// last run so they can be closed.
+func (d *Detector) refresh(ctx context.Context, now time.Time) error {
+	start := now.AddDate(0, 0, -7*d.config.BaselineWeeks)
+
+	if d.series == nil {
+		incidents, err := d.database.GetOpenIncidents(ctx, types.IncidentKindDegradation)
+		if err != nil {
+			return errors.Wrap(err, "failed to get open incidents")
+		}
+		d.series = make(map[seriesKey]*series)
+		for _, incident := range incidents {
+			d.series[seriesKey{incident.Metric, incident.Target}] = &series{open: &incident}
+		}
+	}
+
+	baselines, err := ComputeBaselines(ctx, d.database, start, now, d.location)
+	if err != nil {
+		return errors.Wrap(err, "failed to compute baselines")
+	}
+	d.baselines = baselines
+	d.refreshed = now
+	return nil
+}
+
+// Returns the incident if the value opened or closed one, otherwise nil.
+// Values in an hour without enough history are skipped.
+func (d *Detector) check(s sample, timestamp int64) *types.Incident {
+	baseline, ok := d.baselines.Get(s.metric, s.target, time.UnixMilli(timestamp))
+	if !ok || baseline.Samples < d.config.MinSamples {
+		return nil
+	}
+	score := baseline.Score(s.value)
+	// Speeds are worse when lower, round trip times when higher.
+	if s.metric != types.MetricRTT {
+		score = -score
+	}
+	anomalous := score > d.config.Threshold
+
+	state := d.series[s.seriesKey]
+	if state == nil {
+		state = &series{}
+		d.series[s.seriesKey] = state
+	}
+	if state.run == 0 || state.anomalous != anomalous {
+		state.anomalous, state.run, state.runStart = anomalous, 0, timestamp
+	}
+	state.run += 1
+	if state.run < d.config.Consecutive {
+		return nil
+	}
+
+	if anomalous && state.open == nil {
+		state.open = &types.Incident{
+			ID:          incidentID(s, state.runStart),
+			Kind:        types.IncidentKindDegradation,
+			Target:      s.target,
+			Metric:      s.metric,
+			Start:       state.runStart,
+			End:         optional.Empty[int64](),
+			Description: describe(s, baseline),
+		}
+		incident := *state.open
+		return &incident
+	}
+	if !anomalous && state.open != nil {
+		incident := *state.open
+		incident.End = optional.New(state.runStart)
+		state.open = nil
+		return &incident
+	}
+	return nil
+}
+
+// Returns an ID unique to the metric and target, which speed tests don't have.
+func incidentID(s sample, start int64) string {
+	if s.target == "" {
+		return fmt.Sprintf("%s-%s-%d", types.IncidentKindDegradation, s.metric, start)
+	}
+	return fmt.Sprintf("%s-%s-%s-%d", types.IncidentKindDegradation, s.metric, s.target, start)
+}
+
+// Describes the value that opened an incident against its baseline.
+func describe(s sample, baseline Baseline) string {
+	switch s.metric {
+	case types.MetricRTT:
+		return fmt.Sprintf("Round trip time to %s of %.0f ms, usually %.0f ms at this time of week", s.target, s.value, baseline.Median)
+	case types.MetricDownload:
+		return fmt.Sprintf("Download speed of %.1f Mbps, usually %.1f Mbps at this time of week", s.value, baseline.Median)
+	default:
+		return fmt.Sprintf("Upload speed of %.1f Mbps, usually %.1f Mbps at this time of week", s.value, baseline.Median)
+	}
+}
@@ -0,0 +1,209 @@
+package anomaly
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	"github.com/SkylerRankin/network_monitor/internal/database/databasetest"
+	"github.com/SkylerRankin/network_monitor/internal/optional"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+)
+
+type fakeDatabase struct {
+	databasetest.Database
+	saved []types.Incident
+}
+
+func (d *fakeDatabase) GetOpenIncidents(ctx context.Context, kind string) ([]types.Incident, error) {
+	var open []types.Incident
+	for _, incident := range d.saved {
+		if incident.Kind == kind && !incident.End.Has() {
+			open = append(open, incident)
+		}
+	}
+	return open, nil
+}
+
+func (d *fakeDatabase) SaveIncident(ctx context.Context, incident *types.Incident) error {
+	d.saved = append(d.saved, *incident)
+	return nil
+}
+
+// A Monday, four weeks before the measurements under test.
+var historyStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+var now = historyStart.AddDate(0, 0, 28)
+
+// Returns four weeks of pings every ten minutes, with round trip times around
+// 20 ms, or 60 ms in the evenings, and an hourly speed test around 500 Mbps
+// down and 50 Mbps up.
+func history() *fakeDatabase {
+	db := &fakeDatabase{}
+	for i := 0; historyStart.Add(time.Duration(i) * 10 * time.Minute).Before(now); i++ {
+		timestamp := historyStart.Add(time.Duration(i) * 10 * time.Minute)
+		rtt := 20 + i%3
+		if timestamp.Hour() >= 19 && timestamp.Hour() < 23 {
+			rtt += 40
+		}
+		info := types.NetworkInfo{Timestamp: timestamp.UnixMilli(), PingSuccessful: true, PingHost: "Google", RTTMS: rtt}
+		if timestamp.Minute() == 0 {
+			info.DownloadSpeed = optional.New(500 + float64(timestamp.Day()%3)*10)
+			info.UploadSpeed = optional.New(50 + float64(timestamp.Day()%3))
+		}
+		db.Measurements = append(db.Measurements, info)
+	}
+	return db
+}
+
+func testDetector(db *fakeDatabase) *Detector {
+	detector := NewDetector(config.Anomaly{BaselineWeeks: 4, MinSamples: 4, Threshold: 3.5, Consecutive: 3}, db)
+	detector.location = time.UTC
+	return detector
+}
+
+// Observes a ping with the round trip time, and returns the incidents that
+// opened or closed.
+func observePing(t *testing.T, detector *Detector, at time.Time, rtt int) []types.Incident {
+	t.Helper()
+	info := &types.NetworkInfo{Timestamp: at.UnixMilli(), PingSuccessful: true, PingHost: "Google", RTTMS: rtt}
+	incidents, err := detector.Observe(context.Background(), info, at)
+	if err != nil {
+		t.Fatalf("failed to observe ping: %v", err)
+	}
+	return incidents
+}
+
+func TestBaselines(t *testing.T) {
+	baselines, err := ComputeBaselines(context.Background(), history(), historyStart, now, time.UTC)
+	if err != nil {
+		t.Fatalf("failed to compute baselines: %v", err)
+	}
+
+	morning, ok := baselines.Get(types.MetricRTT, "Google", now.Add(10*time.Hour))
+	if !ok || morning.Median != 21 || morning.MAD != 1 || morning.Samples != 24 {
+		t.Errorf("unexpected morning baseline %+v", morning)
+	}
+	evening, _ := baselines.Get(types.MetricRTT, "Google", now.Add(20*time.Hour))
+	if evening.Median != 61 {
+		t.Errorf("unexpected evening baseline %+v", evening)
+	}
+	download, _ := baselines.Get(types.MetricDownload, "", now.Add(10*time.Hour))
+	if download.Median != 510 || download.MAD != 5 || download.Samples != 4 {
+		t.Errorf("unexpected download baseline %+v", download)
+	}
+	if _, ok := baselines.Get(types.MetricRTT, "Cloudflare", now); ok {
+		t.Errorf("expected no baseline for an unknown target")
+	}
+}
+
+func TestDetectorLatency(t *testing.T) {
+	db := history()
+	detector := testDetector(db)
+	morning := now.Add(10 * time.Hour)
+	evening := now.Add(20 * time.Hour)
+
+	// Usual in the evening, but not in the morning.
+	for i := range 3 {
+		if incidents := observePing(t, detector, evening.Add(time.Duration(i)*time.Minute), 60); len(incidents) != 0 {
+			t.Fatalf("expected no incident for a usual evening round trip time, got %+v", incidents)
+		}
+	}
+	for i := range 2 {
+		if incidents := observePing(t, detector, morning.Add(time.Duration(i)*time.Minute), 60); len(incidents) != 0 {
+			t.Fatalf("expected no incident before 3 anomalous pings, got %+v", incidents)
+		}
+	}
+
+	opened := observePing(t, detector, morning.Add(2*time.Minute), 60)
+	if len(opened) != 1 {
+		t.Fatalf("expected an incident to open, got %+v", opened)
+	}
+	incident := opened[0]
+	if incident.ID != fmt.Sprintf("degradation-rtt-Google-%d", morning.UnixMilli()) || incident.Kind != types.IncidentKindDegradation ||
+		incident.Metric != types.MetricRTT || incident.Target != "Google" || incident.Start != morning.UnixMilli() || incident.End.Has() {
+		t.Errorf("unexpected incident %+v", incident)
+	}
+	if incident.Description != "Round trip time to Google of 60 ms, usually 21 ms at this time of week" {
+		t.Errorf("unexpected description %q", incident.Description)
+	}
+
+	// A normal ping partway through doesn't close the incident.
+	observePing(t, detector, morning.Add(3*time.Minute), 21)
+	observePing(t, detector, morning.Add(4*time.Minute), 60)
+	recovered := morning.Add(5 * time.Minute)
+	for i := range 2 {
+		if incidents := observePing(t, detector, recovered.Add(time.Duration(i)*time.Minute), 22); len(incidents) != 0 {
+			t.Fatalf("expected no change before 3 normal pings, got %+v", incidents)
+		}
+	}
+	closed := observePing(t, detector, recovered.Add(2*time.Minute), 20)
+	if len(closed) != 1 || closed[0].ID != incident.ID {
+		t.Fatalf("expected the incident to close, got %+v", closed)
+	}
+	if end, _ := closed[0].End.Get(); end != recovered.UnixMilli() {
+		t.Errorf("expected the incident to end at the first normal ping, got %d", end)
+	}
+	if len(db.saved) != 2 {
+		t.Errorf("expected the incident to be saved as it opened and closed, got %+v", db.saved)
+	}
+}
+
+func TestDetectorSpeeds(t *testing.T) {
+	detector := testDetector(history())
+	var opened []types.Incident
+	for i := range 3 {
+		at := now.Add(10*time.Hour + time.Duration(i)*10*time.Minute)
+		info := &types.NetworkInfo{
+			Timestamp:     at.UnixMilli(),
+			DownloadSpeed: optional.New(200.0),
+			UploadSpeed:   optional.New(80.0),
+		}
+		incidents, err := detector.Observe(context.Background(), info, at)
+		if err != nil {
+			t.Fatalf("failed to observe speed test: %v", err)
+		}
+		opened = append(opened, incidents...)
+	}
+
+	// Only the download is slow, and faster than usual results are fine.
+	if len(opened) != 1 || opened[0].Metric != types.MetricDownload || opened[0].Target != "" ||
+		opened[0].ID != fmt.Sprintf("degradation-download-%d", now.Add(10*time.Hour).UnixMilli()) {
+		t.Fatalf("expected a download incident, got %+v", opened)
+	}
+	if opened[0].Description != "Download speed of 200.0 Mbps, usually 510.0 Mbps at this time of week" {
+		t.Errorf("unexpected description %q", opened[0].Description)
+	}
+}
+
+func TestDetectorRestoresOpenIncidents(t *testing.T) {
+	// Either just before the restart, or before the baseline window.
+	for _, start := range []time.Time{now.Add(-time.Millisecond), historyStart.AddDate(0, 0, -7)} {
+		db := history()
+		open := types.Incident{
+			ID: fmt.Sprintf("degradation-rtt-Google-%d", start.UnixMilli()), Kind: types.IncidentKindDegradation, Target: "Google", Metric: types.MetricRTT,
+			Start: start.UnixMilli(), End: optional.Empty[int64](),
+		}
+		closed := open
+		closed.ID, closed.End = "degradation-rtt-Google-0", optional.New[int64](1)
+		db.saved = append(db.saved, closed, open)
+		detector := testDetector(db)
+
+		var changed []types.Incident
+		for i := range 3 {
+			changed = append(changed, observePing(t, detector, now.Add(time.Duration(i)*time.Minute), 21)...)
+		}
+		if len(changed) != 1 || changed[0].ID != open.ID || !changed[0].End.Has() {
+			t.Errorf("expected the incident opened at %s to close, got %+v", start, changed)
+		}
+	}
+}
+
+func TestDetectorDisabled(t *testing.T) {
+	detector := NewDetector(config.Anomaly{}, &fakeDatabase{})
+	incidents, err := detector.Observe(context.Background(), &types.NetworkInfo{PingSuccessful: true}, now)
+	if err != nil || incidents != nil {
+		t.Errorf("expected nothing while disabled, got %+v, %v", incidents, err)
+	}
+}
@@ -0,0 +1,221 @@
+// Package auth checks the credentials sent with requests, either HTTP basic
+// auth or an API token, and tracks the role of whoever sent them.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	realm = "Network monitor"
+)
+
+// Role is what an authenticated request is allowed to do. Higher roles can do
+// everything lower ones can.
+type Role int
+
+const (
+	RoleNone Role = iota
+	// Can view the UI and read from the API.
+	RoleRead
+	// Can also run probes and speed tests.
+	RoleAdmin
+)
+
+var ErrForbidden = errors.New("admin role required")
+
+func parseRole(role string) Role {
+	switch role {
+	case config.RoleRead:
+		return RoleRead
+	case config.RoleAdmin:
+		return RoleAdmin
+	default:
+		return RoleNone
+	}
+}
+
+func (r Role) String() string {
+	switch r {
+	case RoleRead:
+		return config.RoleRead
+	case RoleAdmin:
+		return config.RoleAdmin
+	default:
+		return "none"
+	}
+}
+
+type roleKey struct{}
+
+// WithRole returns a context carrying the role.
+func WithRole(ctx context.Context, role Role) context.Context {
+	return context.WithValue(ctx, roleKey{}, role)
+}
+
+// RoleFrom returns the role set by the middleware, or RoleNone if there isn't
+// one.
+func RoleFrom(ctx context.Context) Role {
+	role, _ := ctx.Value(roleKey{}).(Role)
+	return role
+}
+
+// RequireAdmin returns an error unless the context carries the admin role.
+func RequireAdmin(ctx context.Context) error {
+	if RoleFrom(ctx) < RoleAdmin {
+		return ErrForbidden
+	}
+	return nil
+}
+
+type Authenticator struct {
+	log     *slog.Logger
+	enabled bool
+	users   map[string]config.AuthUser
+	tokens  []token
+
+	mutex sync.Mutex
+	// SHA-256 of "username:password" for credentials that already passed a
+	// bcrypt comparison. Browsers send basic auth with every request, and
+	// bcrypt is deliberately too slow to run for each one.
+	verified map[[sha256.Size]byte]Role
+}
+
+type token struct {
+	hash []byte
+	role Role
+}
+
+// Compared against for unknown usernames, so they take as long to reject as
+// wrong passwords.
+var unknownUserHash = []byte("$2a$10$SSL4Zduq9N5Cahkw0QfUruaXZbnCAJ161ChxCCwI/REu/TqTTEI2G")
+
+// NewAuthenticator returns an authenticator for the configured users and tokens,
+// which must already be validated.
+func NewAuthenticator(log *slog.Logger, c config.Auth) *Authenticator {
+	a := &Authenticator{
+		log:      log,
+		enabled:  c.Enabled(),
+		users:    make(map[string]config.AuthUser),
+		verified: make(map[[sha256.Size]byte]Role),
+	}
+	for _, user := range c.Users {
+		a.users[user.Username] = user
+	}
+	for _, t := range c.Tokens {
+		hash, _ := hex.DecodeString(t.TokenSHA256)
+		a.tokens = append(a.tokens, token{hash: hash, role: parseRole(t.Role)})
+	}
+	return a
+}
+
+// Middleware rejects requests without valid credentials and sets the role of
+// the rest in their context. When authentication is disabled, every request
+// has the admin role.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.enabled {
+			next.ServeHTTP(w, r.WithContext(WithRole(r.Context(), RoleAdmin)))
+			return
+		}
+
+		role := a.authenticate(r)
+		if role == RoleNone {
+			if len(a.users) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+			}
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithRole(r.Context(), role)))
+	})
+}
+
+// Admin wraps a handler that requires the admin role.
+func Admin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := RequireAdmin(r.Context()); err != nil {
+			writeError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Writes the same error body as the REST API.
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(types.APIError{Status: status, Message: message})
+}
+
+// Returns the role for the request's credentials, or RoleNone if they're
+// missing or invalid.
+func (a *Authenticator) authenticate(r *http.Request) Role {
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		role := a.checkToken(bearer)
+		if role == RoleNone {
+			a.log.Warn("rejected api token", "address", r.RemoteAddr)
+		}
+		return role
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return RoleNone
+	}
+	role := a.checkPassword(username, password)
+	if role == RoleNone {
+		a.log.Warn("rejected password", "address", r.RemoteAddr, "username", username)
+	}
+	return role
+}
+
+func (a *Authenticator) checkToken(bearer string) Role {
+	hash := sha256.Sum256([]byte(bearer))
+	role := RoleNone
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare(hash[:], t.hash) == 1 {
+			role = t.role
+		}
+	}
+	return role
+}
+
+func (a *Authenticator) checkPassword(username, password string) Role {
+	key := sha256.Sum256([]byte(username + ":" + password))
+	a.mutex.Lock()
+	role, ok := a.verified[key]
+	a.mutex.Unlock()
+	if ok {
+		return role
+	}
+
+	user, ok := a.users[username]
+	if !ok {
+		bcrypt.CompareHashAndPassword(unknownUserHash, []byte(password))
+		return RoleNone
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return RoleNone
+	}
+
+	role = parseRole(user.Role)
+	a.mutex.Lock()
+	a.verified[key] = role
+	a.mutex.Unlock()
+	return role
+}
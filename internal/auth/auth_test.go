@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestServer(t *testing.T, c config.Auth) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /read", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, RoleFrom(r.Context()).String())
+	})
+	mux.HandleFunc("POST /admin", Admin(func(w http.ResponseWriter, r *http.Request) {}))
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server := httptest.NewServer(NewAuthenticator(log, c).Middleware(mux))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func request(t *testing.T, server *httptest.Server, method, path string, setAuth func(*http.Request)) int {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setAuth != nil {
+		setAuth(req)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestDisabledAllowsEverything(t *testing.T) {
+	server := newTestServer(t, config.Auth{})
+	if status := request(t, server, http.MethodPost, "/admin", nil); status != http.StatusOK {
+		t.Errorf("expected admin route to be open without auth, got %d", status)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenHash := sha256.Sum256([]byte("admin-token"))
+	server := newTestServer(t, config.Auth{
+		Users:  []config.AuthUser{{Username: "viewer", PasswordHash: string(hash), Role: config.RoleRead}},
+		Tokens: []config.APIToken{{Name: "script", TokenSHA256: hex.EncodeToString(tokenHash[:]), Role: config.RoleAdmin}},
+	})
+
+	viewer := func(r *http.Request) { r.SetBasicAuth("viewer", "secret") }
+	wrongPassword := func(r *http.Request) { r.SetBasicAuth("viewer", "wrong") }
+	unknownUser := func(r *http.Request) { r.SetBasicAuth("nobody", "secret") }
+	adminToken := func(r *http.Request) { r.Header.Set("Authorization", "Bearer admin-token") }
+	wrongToken := func(r *http.Request) { r.Header.Set("Authorization", "Bearer other-token") }
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		setAuth func(*http.Request)
+		status  int
+	}{
+		{"no credentials", http.MethodGet, "/read", nil, http.StatusUnauthorized},
+		{"wrong password", http.MethodGet, "/read", wrongPassword, http.StatusUnauthorized},
+		{"unknown user", http.MethodGet, "/read", unknownUser, http.StatusUnauthorized},
+		{"wrong token", http.MethodGet, "/read", wrongToken, http.StatusUnauthorized},
+		{"read user reads", http.MethodGet, "/read", viewer, http.StatusOK},
+		{"read user reads again from cache", http.MethodGet, "/read", viewer, http.StatusOK},
+		{"read user is forbidden from admin", http.MethodPost, "/admin", viewer, http.StatusForbidden},
+		{"admin token reads", http.MethodGet, "/read", adminToken, http.StatusOK},
+		{"admin token runs admin", http.MethodPost, "/admin", adminToken, http.StatusOK},
+	}
+	for _, test := range tests {
+		if status := request(t, server, test.method, test.path, test.setAuth); status != test.status {
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, status)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package certs
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testLog = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func TestSelfSignedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, err := EnsureSelfSigned(testLog, dir, []string{"netmon.lan", "192.0.2.10"})
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	ca, err := readCertificate(filepath.Join(dir, Directory, CAFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := readCertificate(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	for _, name := range []string{"localhost", "netmon.lan", "192.0.2.10", "127.0.0.1"} {
+		if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, DNSName: name}); err != nil {
+			t.Errorf("certificate not valid for %s: %v", name, err)
+		}
+	}
+
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected key to only be readable by the owner, got %v %v", info.Mode(), err)
+	}
+
+	// A second start keeps the existing certificate.
+	if _, _, err := EnsureSelfSigned(testLog, dir, []string{"netmon.lan", "192.0.2.10"}); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := readCertificate(certFile); again.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		t.Error("expected certificate to be reused")
+	}
+
+	// A new host reissues it from the same CA.
+	if _, _, err := EnsureSelfSigned(testLog, dir, []string{"other.lan"}); err != nil {
+		t.Fatal(err)
+	}
+	reissued, _ := readCertificate(certFile)
+	if reissued.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+		t.Error("expected certificate to be reissued for a new host")
+	}
+	if err := reissued.CheckSignatureFrom(ca); err != nil {
+		t.Errorf("expected reissued certificate to use the existing CA: %v", err)
+	}
+	if !covers(reissued, ca, []string{"other.lan"}, []net.IP{net.IPv6loopback}) {
+		t.Error("expected reissued certificate to cover the new host")
+	}
+}
+
+func TestReloaderPicksUpNewCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, err := EnsureSelfSigned(testLog, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader, err := NewReloader(testLog, certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := reloader.GetCertificate(nil)
+
+	if _, _, err := EnsureSelfSigned(testLog, dir, []string{"renamed.lan"}); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the change is visible even with coarse modification times.
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+
+	reloader.mutex.Lock()
+	reloader.lastCheck = time.Time{}
+	reloader.mutex.Unlock()
+	second, _ := reloader.GetCertificate(nil)
+	if second == first {
+		t.Error("expected certificate to be reloaded after the files changed")
+	}
+}
+
+func TestRenewsExpiringCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, err := EnsureSelfSigned(testLog, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the certificate with one that expires within the renewal window.
+	ca, err := readCertificate(filepath.Join(dir, Directory, CAFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey, err := readKey(filepath.Join(dir, Directory, caKeyFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, ips, err := hostNames(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := issueCertificate(certFile, keyFile, ca, caKey, names, ips, renewBefore/2); err != nil {
+		t.Fatal(err)
+	}
+	expiring, _ := readCertificate(certFile)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		keepRenewed(ctx, testLog, dir, nil, 10*time.Millisecond)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cert, err := readCertificate(certFile); err == nil && cert.SerialNumber.Cmp(expiring.SerialNumber) != 0 {
+			if time.Until(cert.NotAfter) < renewBefore {
+				t.Errorf("expected renewed certificate to be valid past the renewal window, expires %v", cert.NotAfter)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("expected expiring certificate to be renewed")
+}
@@ -0,0 +1,102 @@
+// Package certs provides the certificate for serving HTTPS, either from
+// configured files or from a generated self-signed CA.
+package certs
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Minimum time between checking the files for changes.
+	reloadCheckInterval = 10 * time.Second
+)
+
+// Reloader serves a certificate and key from files, reloading them when either
+// file changes so that renewed certificates are used without a restart.
+type Reloader struct {
+	log      *slog.Logger
+	certFile string
+	keyFile  string
+
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	// Latest modification time of the two files when they were loaded.
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// NewReloader loads the certificate and key, returning an error if they can't
+// be used.
+func NewReloader(log *slog.Logger, certFile string, keyFile string) (*Reloader, error) {
+	r := &Reloader{log: log, certFile: certFile, keyFile: keyFile}
+	modTime, err := r.modified()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTime); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TLSConfig returns a server config that uses the current certificate for each
+// handshake.
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+}
+
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if time.Since(r.lastCheck) >= reloadCheckInterval {
+		r.lastCheck = time.Now()
+		modTime, err := r.modified()
+		if err != nil {
+			r.log.Error("failed to check certificate files", "err", err)
+		} else if !modTime.Equal(r.modTime) {
+			// A failed load keeps the previous certificate. The files may be
+			// part way through being replaced, so the next check tries again.
+			if err := r.load(modTime); err != nil {
+				r.log.Error("failed to reload certificate", "err", err)
+			} else {
+				r.log.Info("reloaded certificate", "cert_file", r.certFile)
+			}
+		}
+	}
+
+	return r.certificate, nil
+}
+
+func (r *Reloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, "failed to stat certificate file")
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *Reloader) load(modTime time.Time) error {
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load certificate and key")
+	}
+	r.certificate = &certificate
+	r.modTime = modTime
+	return nil
+}
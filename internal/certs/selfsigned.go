@@ -0,0 +1,316 @@
+package certs
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Directory, within the data directory, holding the generated files.
+	Directory = "tls"
+	// CA certificate to install in browsers and operating systems.
+	CAFilename      = "ca.pem"
+	caKeyFilename   = "ca-key.pem"
+	certFilename    = "server.pem"
+	certKeyFilename = "server-key.pem"
+	caValidity      = 10 * 365 * 24 * time.Hour
+	// Browsers reject server certificates valid for longer than 398 days, even
+	// from a locally installed CA.
+	certValidity = 397 * 24 * time.Hour
+	// Server certificates are reissued once this close to expiring.
+	renewBefore = 30 * 24 * time.Hour
+	// Time between checks of a running server's certificate.
+	renewCheckInterval = 12 * time.Hour
+)
+
+// EnsureSelfSigned returns the paths of a server certificate and key in the
+// data directory, signed by a CA that's generated on first start. The server
+// certificate is reissued if it's close to expiring or doesn't cover the
+// host's current names and IP addresses, along with any extra hosts. The CA is
+// kept, so it only needs to be trusted once.
+func EnsureSelfSigned(log *slog.Logger, dataPath string, extraHosts []string) (string, string, error) {
+	dir := filepath.Join(dataPath, Directory)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", errors.Wrap(err, "failed to create certificate directory")
+	}
+
+	caCert, caKey, err := loadOrCreateCA(log, dir)
+	if err != nil {
+		return "", "", err
+	}
+
+	names, ips, err := hostNames(extraHosts)
+	if err != nil {
+		return "", "", err
+	}
+
+	certFile := filepath.Join(dir, certFilename)
+	keyFile := filepath.Join(dir, certKeyFilename)
+	if cert, err := readCertificate(certFile); err == nil && covers(cert, caCert, names, ips) {
+		return certFile, keyFile, nil
+	}
+
+	log.Info("issuing self-signed server certificate", "names", names, "ips", ips)
+	if err := issueCertificate(certFile, keyFile, caCert, caKey, names, ips, certValidity); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+// KeepSelfSignedRenewed runs EnsureSelfSigned periodically until the context
+// is done, so a long running server reissues its certificate before it
+// expires. The server picks up the new files through its Reloader.
+func KeepSelfSignedRenewed(ctx context.Context, log *slog.Logger, dataPath string, extraHosts []string) {
+	keepRenewed(ctx, log, dataPath, extraHosts, renewCheckInterval)
+}
+
+func keepRenewed(ctx context.Context, log *slog.Logger, dataPath string, extraHosts []string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// A failure keeps the current certificate, which is checked again
+			// at the next interval.
+			if _, _, err := EnsureSelfSigned(log, dataPath, extraHosts); err != nil {
+				log.Error("failed to renew self-signed certificate", "err", err)
+			}
+		}
+	}
+}
+
+// Writes a new server key and a certificate for it signed by the CA.
+func issueCertificate(certFile string, keyFile string, caCert *x509.Certificate, caKey crypto.Signer, names []string, ips []net.IP, validity time.Duration) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return errors.Wrap(err, "failed to generate server key")
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     names,
+		IPAddresses:  ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to create server certificate")
+	}
+
+	// The key is written first, since a running server reloads once the
+	// certificate changes.
+	if err := writeKey(keyFile, key); err != nil {
+		return err
+	}
+	return writePEM(certFile, "CERTIFICATE", der, 0644)
+}
+
+func loadOrCreateCA(log *slog.Logger, dir string) (*x509.Certificate, crypto.Signer, error) {
+	certFile := filepath.Join(dir, CAFilename)
+	keyFile := filepath.Join(dir, caKeyFilename)
+
+	cert, err := readCertificate(certFile)
+	if err == nil {
+		key, err := readKey(keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cert, key, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+
+	log.Info("generating self-signed certificate authority", "path", certFile)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to generate CA key")
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Network monitor CA " + hostname},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to create CA certificate")
+	}
+	if err := writeKey(keyFile, key); err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return nil, nil, err
+	}
+
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse CA certificate")
+	}
+	return cert, key, nil
+}
+
+// Returns the DNS names and IP addresses the server certificate should cover.
+// The first name is the hostname.
+func hostNames(extraHosts []string) ([]string, []net.IP, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to get hostname")
+	}
+	names := []string{hostname, "localhost"}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1).To4(), net.IPv6loopback}
+
+	addresses, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to get interface addresses")
+	}
+	for _, address := range addresses {
+		ipNet, ok := address.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ips = appendIP(ips, ipNet.IP)
+	}
+
+	for _, host := range extraHosts {
+		if ip := net.ParseIP(host); ip != nil {
+			ips = appendIP(ips, ip)
+		} else if !slices.Contains(names, host) {
+			names = append(names, host)
+		}
+	}
+	return names, ips, nil
+}
+
+func appendIP(ips []net.IP, ip net.IP) []net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if slices.ContainsFunc(ips, ip.Equal) {
+		return ips
+	}
+	return append(ips, ip)
+}
+
+// Returns whether the certificate was issued by the CA, isn't close to
+// expiring, and covers all of the names and IPs.
+func covers(cert *x509.Certificate, ca *x509.Certificate, names []string, ips []net.IP) bool {
+	if cert.CheckSignatureFrom(ca) != nil {
+		return false
+	}
+	if time.Until(cert.NotAfter) < renewBefore {
+		return false
+	}
+	for _, name := range names {
+		if !slices.Contains(cert.DNSNames, name) {
+			return false
+		}
+	}
+	for _, ip := range ips {
+		if !slices.ContainsFunc(cert.IPAddresses, ip.Equal) {
+			return false
+		}
+	}
+	return true
+}
+
+func serialNumber() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate serial number")
+	}
+	return serial, nil
+}
+
+func readCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.Errorf("no certificate in %s", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse certificate %s", path)
+	}
+	return cert, nil
+}
+
+func readKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read key")
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.Errorf("no private key in %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse key %s", path)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("unsupported key type in %s", path)
+	}
+	return signer, nil
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal key")
+	}
+	return writePEM(path, "PRIVATE KEY", der, 0600)
+}
+
+// Writes to a temporary file and renames it, so the file is never seen
+// partially written.
+func writePEM(path string, blockType string, der []byte, perm os.FileMode) error {
+	temp := path + ".tmp"
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(temp, data, perm); err != nil {
+		return errors.Wrapf(err, "failed to write %s", path)
+	}
+	if err := os.Rename(temp, path); err != nil {
+		return errors.Wrapf(err, "failed to write %s", path)
+	}
+	return nil
+}
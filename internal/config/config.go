@@ -0,0 +1,492 @@
+package config
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	configFilename = "netmon.json"
+)
+
+// Config holds the user configurable settings, read from netmon.json in the
+// assets directory. Any field missing from the file keeps its default value.
+type Config struct {
+	Speedtest Speedtest `json:"speedtest"`
+	Traffic   Traffic   `json:"traffic"`
+	Auth      Auth      `json:"auth"`
+	TLS       TLS       `json:"tls"`
+	Stats     Stats     `json:"stats"`
+	ISP       ISP       `json:"isp"`
+	Anomaly   Anomaly   `json:"anomaly"`
+}
+
+// Anomaly configures the detection of degraded latency and speeds. Results are
+// compared against a baseline for their target and hour of the week, the
+// median and median absolute deviation of the stored results in that hour.
+type Anomaly struct {
+	// Weeks of stored results the baselines are computed from. Zero disables
+	// detection.
+	BaselineWeeks int `json:"baselineWeeks"`
+	// Minimum number of results in an hour of the week before results in it
+	// are checked.
+	MinSamples int `json:"minSamples"`
+	// Results further than this many scaled median absolute deviations from the
+	// median, slower for speeds or higher for round trip times, are anomalous.
+	Threshold float64 `json:"threshold"`
+	// Number of consecutive anomalous results that open a degradation
+	// incident, and of consecutive normal results that close it.
+	Consecutive int `json:"consecutive"`
+}
+
+// ISP describes the internet plan subscribed to, so speed tests can be
+// compared against the advertised speeds.
+type ISP struct {
+	// Plans in effect over time. Each applies from its effective date until the
+	// next plan's.
+	Plans []ISPPlan `json:"plans"`
+	Alert PlanAlert `json:"alert"`
+}
+
+type ISPPlan struct {
+	Name string `json:"name"`
+	// Advertised speeds.
+	DownloadMbps float64 `json:"downloadMbps"`
+	UploadMbps   float64 `json:"uploadMbps"`
+	// Local date the plan took effect, such as "2024-01-31". Empty for a plan
+	// that applies from the start.
+	EffectiveFrom string `json:"effectiveFrom"`
+}
+
+// PlanAlert raises an incident when recent speed tests fall below the plan.
+type PlanAlert struct {
+	// Number of most recent speed tests averaged. Zero disables the alert.
+	WindowTests int `json:"windowTests"`
+	// Alerts when the average download or upload speed of the window is below
+	// this percentage of the plan.
+	ThresholdPercent float64 `json:"thresholdPercent"`
+}
+
+// Stats configures the availability statistics served by the API.
+type Stats struct {
+	Availability Availability `json:"availability"`
+}
+
+// Availability defines when the connection counts as up. Each measurement pings
+// the next target in turn, so a measurement can be judged together with the
+// pings before it, rather than one unreachable target counting as an outage.
+type Availability struct {
+	// Number of most recent pings considered at each measurement.
+	QuorumWindow int `json:"quorumWindow"`
+	// Minimum number of those pings that must succeed for the connection to
+	// count as up.
+	Quorum int `json:"quorum"`
+	// Pings that lose more than this percentage of packets count as failed,
+	// even if some replies arrived.
+	MaxPacketLossPercent float64 `json:"maxPacketLossPercent"`
+}
+
+const (
+	TLSModeOff        = "off"
+	TLSModeFiles      = "files"
+	TLSModeSelfSigned = "self-signed"
+)
+
+// TLS configures serving over HTTPS.
+type TLS struct {
+	// One of "off", "files" to use CertFile and KeyFile, or "self-signed" to
+	// generate a CA and server certificate in the data directory.
+	Mode string `json:"mode"`
+	// PEM encoded certificate chain and key. Relative paths are relative to the
+	// data directory. The files are reloaded when they change.
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// Extra DNS names or IP addresses for the self-signed certificate, in
+	// addition to the hostname and interface addresses.
+	Hosts []string `json:"hosts"`
+}
+
+const (
+	RoleRead  = "read"
+	RoleAdmin = "admin"
+)
+
+// Auth configures access to the web UI and API. When no users or tokens are
+// configured, authentication is disabled and everyone has the admin role.
+type Auth struct {
+	// Users that sign in with HTTP basic auth.
+	Users []AuthUser `json:"users"`
+	// Long lived tokens for scripts, sent as "Authorization: Bearer <token>".
+	Tokens []APIToken `json:"tokens"`
+}
+
+type AuthUser struct {
+	Username string `json:"username"`
+	// Bcrypt hash of the password.
+	PasswordHash string `json:"passwordHash"`
+	// Either "read" or "admin".
+	Role string `json:"role"`
+}
+
+type APIToken struct {
+	// Identifies the token in logs.
+	Name string `json:"name"`
+	// Hex encoded SHA-256 hash of the token. Tokens should be long and random,
+	// so a fast hash is enough.
+	TokenSHA256 string `json:"tokenSHA256"`
+	Role        string `json:"role"`
+}
+
+// Enabled returns whether any credentials are configured.
+func (a Auth) Enabled() bool {
+	return len(a.Users) > 0 || len(a.Tokens) > 0
+}
+
+// Traffic configures the interface traffic counters recorded with each ping.
+type Traffic struct {
+	// Interfaces to record. When empty, every interface except loopback is
+	// recorded.
+	Interfaces []string `json:"interfaces"`
+}
+
+const (
+	SpeedtestBackendSpeedtestNet = "speedtest.net"
+	SpeedtestBackendHTTP         = "http"
+	SpeedtestBackendIperf3       = "iperf3"
+
+	ScheduleFixed    = "fixed"
+	ScheduleAdaptive = "adaptive"
+
+	BudgetActionSkip      = "skip"
+	BudgetActionDownscale = "downscale"
+)
+
+type Speedtest struct {
+	// Backend used to run speed tests when the schedule doesn't set one. One of
+	// "speedtest.net", "http" or "iperf3".
+	Backend string `json:"backend"`
+	// When to run speed tests. "fixed" runs one every 30 network jobs, and
+	// "adaptive" runs them in response to changes in the network.
+	Schedule string           `json:"schedule"`
+	Fixed    FixedSchedule    `json:"fixed"`
+	Adaptive AdaptiveSchedule `json:"adaptive"`
+	// Speedtest.net server IDs to test against. When empty, the server with the
+	// lowest latency is used.
+	ServerIDs []int `json:"serverIDs"`
+	// Rotate through ServerIDs, using the next server for each test, rather than
+	// always using the first reachable one.
+	Rotate bool            `json:"rotate"`
+	HTTP   HTTPSpeedtest   `json:"http"`
+	Iperf3 Iperf3Speedtest `json:"iperf3"`
+	Budget DataBudget      `json:"budget"`
+}
+
+// ScheduleBackend returns the backend used by the configured schedule.
+func (s Speedtest) ScheduleBackend() string {
+	backend := s.Fixed.Backend
+	if s.Schedule == ScheduleAdaptive {
+		backend = s.Adaptive.Backend
+	}
+	if backend == "" {
+		return s.Backend
+	}
+	return backend
+}
+
+// FixedSchedule configures speed tests in fixed mode.
+type FixedSchedule struct {
+	// Backend used by this schedule. When empty, Speedtest.Backend is used.
+	Backend string `json:"backend"`
+}
+
+// AdaptiveSchedule configures when speed tests run in adaptive mode. A test is
+// triggered when an outage recovers, when ping RTT or loss deviates from its
+// baseline, or when the maximum interval has passed. Tests are held back while
+// the interface is busy with other traffic.
+type AdaptiveSchedule struct {
+	// Backend used by this schedule. When empty, Speedtest.Backend is used.
+	Backend string `json:"backend"`
+	// Minimum time between triggered tests, in minutes. Manual tests ignore
+	// this limit.
+	MinIntervalMinutes int `json:"minIntervalMinutes"`
+	// Maximum time between tests, in minutes.
+	MaxIntervalMinutes int `json:"maxIntervalMinutes"`
+	// Number of pings per host used as the baseline for RTT and loss.
+	BaselineSamples int `json:"baselineSamples"`
+	// Number of most recent pings per host compared against the baseline.
+	RecentSamples int `json:"recentSamples"`
+	// Triggers a test when the recent average RTT exceeds the baseline by this factor.
+	RTTDeviationFactor float64 `json:"rttDeviationFactor"`
+	// Triggers a test when the recent packet loss exceeds the baseline by this
+	// amount, from 0 to 1.
+	LossDeviation float64 `json:"lossDeviation"`
+	// Network interface to watch for other traffic. When empty, the busiest
+	// non-loopback interface is used.
+	Interface string `json:"interface"`
+	// Tests are held back while the interface carries more than this rate of
+	// traffic, in Mbps. Zero disables the check.
+	SaturationMbps float64 `json:"saturationMbps"`
+}
+
+// DataBudget limits the data used by speed tests, for metered connections.
+type DataBudget struct {
+	// Monthly limit on data transferred by speed tests in both directions, in
+	// megabytes. Zero disables the budget.
+	MonthlyMB int64 `json:"monthlyMB"`
+	// Day of the month, from 1 to 31, that the monthly total resets. Months
+	// shorter than the billing day reset on their last day.
+	BillingDay int `json:"billingDay"`
+	// What to do with speed tests once the budget is reached. Either "skip" to
+	// not run them, or "downscale" to run shorter tests that use less data.
+	Action string `json:"action"`
+}
+
+// HTTPSpeedtest configures the HTTP backend, which measures throughput by
+// downloading from and uploading to URLs under the user's control.
+type HTTPSpeedtest struct {
+	DownloadURL string `json:"downloadURL"`
+	UploadURL   string `json:"uploadURL"`
+	// Number of parallel connections used in each direction.
+	Streams int `json:"streams"`
+	// Time at the start of each direction that is excluded from the result, to
+	// let TCP ramp up.
+	WarmupSeconds int `json:"warmupSeconds"`
+	// Time spent measuring each direction, after the warmup.
+	DurationSeconds int `json:"durationSeconds"`
+}
+
+// Iperf3Speedtest configures the iperf3 backend, which runs TCP tests against
+// an iperf3 server.
+type Iperf3Speedtest struct {
+	Host            string `json:"host"`
+	Port            int    `json:"port"`
+	Streams         int    `json:"streams"`
+	WarmupSeconds   int    `json:"warmupSeconds"`
+	DurationSeconds int    `json:"durationSeconds"`
+}
+
+func Default() *Config {
+	return &Config{
+		Speedtest: Speedtest{
+			Backend:  SpeedtestBackendSpeedtestNet,
+			Schedule: ScheduleFixed,
+			Adaptive: AdaptiveSchedule{
+				MinIntervalMinutes: 30,
+				MaxIntervalMinutes: 6 * 60,
+				BaselineSamples:    120,
+				RecentSamples:      5,
+				RTTDeviationFactor: 2,
+				LossDeviation:      0.1,
+				Interface:          "",
+				SaturationMbps:     20,
+			},
+			ServerIDs: []int{},
+			Rotate:    false,
+			HTTP: HTTPSpeedtest{
+				Streams:         4,
+				WarmupSeconds:   2,
+				DurationSeconds: 10,
+			},
+			Iperf3: Iperf3Speedtest{
+				Port:            5201,
+				Streams:         4,
+				WarmupSeconds:   2,
+				DurationSeconds: 10,
+			},
+			Budget: DataBudget{
+				MonthlyMB:  0,
+				BillingDay: 1,
+				Action:     BudgetActionSkip,
+			},
+		},
+		Traffic: Traffic{
+			Interfaces: []string{},
+		},
+		Auth: Auth{
+			Users:  []AuthUser{},
+			Tokens: []APIToken{},
+		},
+		TLS: TLS{
+			Mode:  TLSModeOff,
+			Hosts: []string{},
+		},
+		Stats: Stats{
+			Availability: Availability{
+				QuorumWindow:         1,
+				Quorum:               1,
+				MaxPacketLossPercent: 100,
+			},
+		},
+		ISP: ISP{
+			Plans: []ISPPlan{},
+			Alert: PlanAlert{
+				WindowTests:      5,
+				ThresholdPercent: 80,
+			},
+		},
+		Anomaly: Anomaly{
+			BaselineWeeks: 4,
+			MinSamples:    8,
+			Threshold:     3.5,
+			Consecutive:   3,
+		},
+	}
+}
+
+// Load reads the config file from the given directory. If no file exists, the
+// default config is returned.
+func Load(path string) (*Config, error) {
+	c := Default()
+
+	file, err := os.Open(filepath.Join(path, configFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to open config file")
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return nil, errors.Wrap(err, "failed to decode config file")
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid config file")
+	}
+
+	return c, nil
+}
+
+func validBackend(backend string) bool {
+	return backend == SpeedtestBackendSpeedtestNet || backend == SpeedtestBackendHTTP || backend == SpeedtestBackendIperf3
+}
+
+func (c *Config) validate() error {
+	if c.Speedtest.Schedule != ScheduleFixed && c.Speedtest.Schedule != ScheduleAdaptive {
+		return errors.Errorf("speedtest.schedule must be %q or %q", ScheduleFixed, ScheduleAdaptive)
+	}
+
+	if !validBackend(c.Speedtest.Backend) {
+		return errors.Errorf("speedtest.backend must be %q, %q or %q", SpeedtestBackendSpeedtestNet, SpeedtestBackendHTTP, SpeedtestBackendIperf3)
+	}
+	if c.Speedtest.Fixed.Backend != "" && !validBackend(c.Speedtest.Fixed.Backend) {
+		return errors.Errorf("speedtest.fixed.backend must be empty, %q, %q or %q", SpeedtestBackendSpeedtestNet, SpeedtestBackendHTTP, SpeedtestBackendIperf3)
+	}
+	if c.Speedtest.Adaptive.Backend != "" && !validBackend(c.Speedtest.Adaptive.Backend) {
+		return errors.Errorf("speedtest.adaptive.backend must be empty, %q, %q or %q", SpeedtestBackendSpeedtestNet, SpeedtestBackendHTTP, SpeedtestBackendIperf3)
+	}
+
+	adaptive := c.Speedtest.Adaptive
+	if adaptive.MinIntervalMinutes < 0 || adaptive.MaxIntervalMinutes <= 0 {
+		return errors.New("speedtest.adaptive intervals must be positive")
+	}
+	if adaptive.MinIntervalMinutes > adaptive.MaxIntervalMinutes {
+		return errors.New("speedtest.adaptive.minIntervalMinutes must not be more than maxIntervalMinutes")
+	}
+	if adaptive.BaselineSamples <= 0 || adaptive.RecentSamples <= 0 {
+		return errors.New("speedtest.adaptive sample counts must be positive")
+	}
+
+	budget := c.Speedtest.Budget
+	if budget.MonthlyMB < 0 {
+		return errors.New("speedtest.budget.monthlyMB must not be negative")
+	}
+	if budget.BillingDay < 1 || budget.BillingDay > 31 {
+		return errors.New("speedtest.budget.billingDay must be between 1 and 31")
+	}
+	if budget.Action != BudgetActionSkip && budget.Action != BudgetActionDownscale {
+		return errors.Errorf("speedtest.budget.action must be %q or %q", BudgetActionSkip, BudgetActionDownscale)
+	}
+
+	usernames := make(map[string]bool)
+	for _, user := range c.Auth.Users {
+		if user.Username == "" {
+			return errors.New("auth.users must have a username")
+		}
+		if usernames[user.Username] {
+			return errors.Errorf("auth.users has duplicate username %q", user.Username)
+		}
+		usernames[user.Username] = true
+		if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+			return errors.Errorf("auth.users passwordHash for %q is not a bcrypt hash", user.Username)
+		}
+		if user.Role != RoleRead && user.Role != RoleAdmin {
+			return errors.Errorf("auth.users role for %q must be %q or %q", user.Username, RoleRead, RoleAdmin)
+		}
+	}
+
+	for _, token := range c.Auth.Tokens {
+		if hash, err := hex.DecodeString(token.TokenSHA256); err != nil || len(hash) != 32 {
+			return errors.Errorf("auth.tokens tokenSHA256 for %q must be a hex encoded SHA-256 hash", token.Name)
+		}
+		if token.Role != RoleRead && token.Role != RoleAdmin {
+			return errors.Errorf("auth.tokens role for %q must be %q or %q", token.Name, RoleRead, RoleAdmin)
+		}
+	}
+
+	switch c.TLS.Mode {
+	case TLSModeOff, TLSModeSelfSigned:
+	case TLSModeFiles:
+		if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+			return errors.New("tls.certFile and tls.keyFile are required with the files mode")
+		}
+	default:
+		return errors.Errorf("tls.mode must be %q, %q or %q", TLSModeOff, TLSModeFiles, TLSModeSelfSigned)
+	}
+
+	availability := c.Stats.Availability
+	if availability.QuorumWindow <= 0 {
+		return errors.New("stats.availability.quorumWindow must be positive")
+	}
+	if availability.Quorum <= 0 || availability.Quorum > availability.QuorumWindow {
+		return errors.New("stats.availability.quorum must be between 1 and quorumWindow")
+	}
+	if availability.MaxPacketLossPercent < 0 || availability.MaxPacketLossPercent > 100 {
+		return errors.New("stats.availability.maxPacketLossPercent must be between 0 and 100")
+	}
+
+	effectiveDates := make(map[string]bool)
+	for _, plan := range c.ISP.Plans {
+		if plan.DownloadMbps <= 0 || plan.UploadMbps <= 0 {
+			return errors.Errorf("isp.plans speeds for %q must be positive", plan.Name)
+		}
+		if plan.EffectiveFrom != "" {
+			if _, err := time.Parse(time.DateOnly, plan.EffectiveFrom); err != nil {
+				return errors.Errorf("isp.plans effectiveFrom for %q must be a date such as 2024-01-31", plan.Name)
+			}
+		}
+		if effectiveDates[plan.EffectiveFrom] {
+			return errors.Errorf("isp.plans has more than one plan effective from %q", plan.EffectiveFrom)
+		}
+		effectiveDates[plan.EffectiveFrom] = true
+	}
+	if c.ISP.Alert.WindowTests < 0 {
+		return errors.New("isp.alert.windowTests must not be negative")
+	}
+	if c.ISP.Alert.ThresholdPercent <= 0 || c.ISP.Alert.ThresholdPercent > 100 {
+		return errors.New("isp.alert.thresholdPercent must be between 0 and 100")
+	}
+
+	if c.Anomaly.BaselineWeeks < 0 {
+		return errors.New("anomaly.baselineWeeks must not be negative")
+	}
+	if c.Anomaly.MinSamples <= 0 {
+		return errors.New("anomaly.minSamples must be positive")
+	}
+	if c.Anomaly.Threshold <= 0 {
+		return errors.New("anomaly.threshold must be positive")
+	}
+	if c.Anomaly.Consecutive <= 0 {
+		return errors.New("anomaly.consecutive must be positive")
+	}
+
+	return nil
+}
@@ -0,0 +1,32 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestValidateDefault(t *testing.T) {
+	if err := Default().validate(); err != nil {
+		t.Errorf("expected the default config to be valid, got %v", err)
+	}
+}
+
+func TestValidateAdaptiveIntervals(t *testing.T) {
+	for _, test := range []struct {
+		min, max int
+		valid    bool
+	}{
+		{30, 360, true},
+		{60, 60, true},
+		{0, 60, true},
+		{-1, 60, false},
+		{30, 0, false},
+		{120, 60, false},
+	} {
+		c := Default()
+		c.Speedtest.Adaptive.MinIntervalMinutes = test.min
+		c.Speedtest.Adaptive.MaxIntervalMinutes = test.max
+		if err := c.validate(); (err == nil) != test.valid {
+			t.Errorf("expected intervals %d to %d to be valid: %v, got %v", test.min, test.max, test.valid, err)
+		}
+	}
+}
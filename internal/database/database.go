@@ -1,9 +1,12 @@
 package database
 
 import (
+	"cmp"
 	"context"
 	"database/sql"
+	"fmt"
 	"path/filepath"
+	"slices"
 
 	"github.com/SkylerRankin/network_monitor/internal/optional"
 	"github.com/SkylerRankin/network_monitor/internal/types"
@@ -17,6 +20,51 @@ const (
 type Database interface {
 	InsertNetworkInfo(context.Context, *types.NetworkInfo) error
 	GetNetworkInfoBatch(context.Context, int) (*types.NetworkInfoBatch, error)
+	// GetNetworkInfoAfterSeq returns up to limit measurements with a sequence
+	// number greater than afterSeq, oldest first.
+	GetNetworkInfoAfterSeq(ctx context.Context, afterSeq int64, limit int) (*types.NetworkInfoBatch, error)
+	// GetNetworkInfoAggregate summarizes the measurements from the start time
+	// up to the end time in buckets of bucketMS, starting at the start time.
+	GetNetworkInfoAggregate(ctx context.Context, startTime int64, endTime int64, bucketMS int64) (*types.NetworkInfoAggregate, error)
+	GetSpeedtestHistory(context.Context, int, string) ([]types.SpeedtestRecord, error)
+	InsertLANTestResult(context.Context, *types.LANTestResult) error
+	GetLANTestResults(context.Context, int) ([]types.LANTestResult, error)
+	AddDataUsage(ctx context.Context, periodStart int64, bytesDownloaded int64, bytesUploaded int64) error
+	GetDataUsage(ctx context.Context, periodStart int64) (bytesDownloaded int64, bytesUploaded int64, err error)
+	InsertInterfaceTraffic(context.Context, []types.InterfaceTraffic) error
+	GetInterfaceTraffic(context.Context, int, string) ([]types.InterfaceTraffic, error)
+	// GetTargets returns every pinged host, ordered by name.
+	GetTargets(context.Context) ([]types.Target, error)
+	// GetLatestNetworkInfo returns the most recent measurement, or nil if there
+	// are none.
+	GetLatestNetworkInfo(context.Context) (*types.NetworkInfo, error)
+	GetLastSuccessfulPing(context.Context) (optional.Opt[int64], error)
+	// GetLatestSpeedtest returns the most recent speed test result, or nil if
+	// there are none.
+	GetLatestSpeedtest(context.Context) (*types.SpeedtestRecord, error)
+	// GetRecentSpeedtests returns up to count of the most recent speed test
+	// results, oldest first.
+	GetRecentSpeedtests(ctx context.Context, count int) ([]types.SpeedtestRecord, error)
+	// GetIncidents returns the incidents that started after the start time and
+	// before the end time, oldest first. Outages are found from the
+	// measurements, and other kinds are read from those saved with
+	// SaveIncident.
+	GetIncidents(ctx context.Context, startTime int64, endTime int64) ([]types.Incident, error)
+	// SaveIncident stores an incident, replacing the end and description of
+	// one with the same ID.
+	SaveIncident(context.Context, *types.Incident) error
+	// GetOpenIncidents returns the saved incidents of the kind that haven't
+	// ended, oldest first.
+	GetOpenIncidents(ctx context.Context, kind string) ([]types.Incident, error)
+	// ExportNetworkInfo calls fn with each measurement from the start time up
+	// to the end time, oldest first, reading rows as fn consumes them. With
+	// speedTestsOnly, only measurements with a speed test are included.
+	ExportNetworkInfo(ctx context.Context, startTime int64, endTime int64, speedTestsOnly bool, fn func(*types.NetworkInfo) error) error
+	// ExportInterfaceTraffic calls fn with each traffic sample from the start
+	// time up to the end time, oldest first.
+	ExportInterfaceTraffic(ctx context.Context, startTime int64, endTime int64, fn func(*types.InterfaceTraffic) error) error
+	// Close closes the database once nothing else is using it.
+	Close() error
 }
 
 var _ Database = &database{}
@@ -26,7 +74,9 @@ type database struct {
 }
 
 func NewDatabase(ctx context.Context, path string) (Database, error) {
-	db, err := sql.Open("sqlite", filepath.Join(path, databaseFilename))
+	// Write-ahead logging lets long reads, such as exports, run alongside new
+	// measurements being written rather than blocking them.
+	db, err := sql.Open("sqlite", filepath.Join(path, databaseFilename)+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
 	if err != nil {
 		return nil, err
 	}
@@ -47,89 +97,854 @@ func NewDatabase(ctx context.Context, path string) (Database, error) {
 		return nil, err
 	}
 
+	err = addMissingColumns(ctx, db, "network", []column{
+		{name: "speedServerID", definition: "TEXT"},
+		{name: "speedServerName", definition: "TEXT"},
+		{name: "speedServerSponsor", definition: "TEXT"},
+		{name: "speedServerDistance", definition: "REAL"},
+		{name: "speedServerLatencyMS", definition: "INTEGER"},
+		{name: "speedBytesDown", definition: "INTEGER"},
+		{name: "speedBytesUp", definition: "INTEGER"},
+		{name: "seq", definition: "INTEGER"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Rows stored before sequence numbers were added are numbered in time
+	// order, after any that already have one.
+	_, err = db.ExecContext(ctx,
+		`UPDATE network SET seq = numbered.seq
+		FROM (
+			SELECT timestamp, ROW_NUMBER() OVER (ORDER BY timestamp) + (SELECT COALESCE(MAX(seq), 0) FROM network) AS seq
+			FROM network
+			WHERE seq IS NULL
+		) AS numbered
+		WHERE network.timestamp = numbered.timestamp`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to number network rows")
+	}
+
+	_, err = db.ExecContext(ctx, `CREATE UNIQUE INDEX IF NOT EXISTS network_seq ON network (seq)`)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.ExecContext(ctx,
+		`CREATE TABLE IF NOT EXISTS lan_test (
+			timestamp INTEGER NOT NULL,
+			clientIP TEXT NOT NULL,
+			userAgent TEXT NOT NULL,
+			downloadSpeed REAL NOT NULL,
+			uploadSpeed REAL NOT NULL,
+			latencyMS REAL NOT NULL
+		)`)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.ExecContext(ctx,
+		`CREATE TABLE IF NOT EXISTS data_usage (
+			periodStart INTEGER PRIMARY KEY,
+			bytesDownloaded INTEGER NOT NULL,
+			bytesUploaded INTEGER NOT NULL
+		)`)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.ExecContext(ctx,
+		`CREATE TABLE IF NOT EXISTS interface_traffic (
+			timestamp INTEGER NOT NULL,
+			interface TEXT NOT NULL,
+			rxMbps REAL NOT NULL,
+			txMbps REAL NOT NULL,
+			rxPacketsPerSecond REAL NOT NULL,
+			txPacketsPerSecond REAL NOT NULL,
+			rxErrors INTEGER NOT NULL,
+			txErrors INTEGER NOT NULL,
+			rxDrops INTEGER NOT NULL,
+			txDrops INTEGER NOT NULL,
+			PRIMARY KEY (timestamp, interface)
+		)`)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.ExecContext(ctx,
+		`CREATE TABLE IF NOT EXISTS incidents (
+			id TEXT PRIMARY KEY,
+			kind TEXT NOT NULL,
+			target TEXT NOT NULL,
+			metric TEXT NOT NULL,
+			startTime INTEGER NOT NULL,
+			endTime INTEGER,
+			description TEXT NOT NULL
+		)`)
+	if err != nil {
+		return nil, err
+	}
+
 	return database{
 		db: db,
 	}, nil
 }
 
+func (d database) Close() error {
+	return d.db.Close()
+}
+
 func (d database) InsertNetworkInfo(ctx context.Context, info *types.NetworkInfo) error {
 	pingSuccessful := 0
 	if info.PingSuccessful {
 		pingSuccessful = 1
 	}
 
-	// downloadSpeed := sql.NullFloat64{
-	// 	Float64: info.DownloadSpeed.Else(0),
-	// 	Valid:   info.DownloadSpeed.Has(),
-	// }
+	// The sequence number is assigned by a subquery in the insert itself. A
+	// single statement is its own transaction, and SQLite runs one write at a
+	// time, so no other insert can take the same number in between. The
+	// unique index on seq backs this up.
+	err := d.db.QueryRowContext(ctx,
+		`INSERT INTO network
+		(timestamp, pingHost, pingHostName, pingSuccessful, packetLoss, rttMS, downloadSpeed, uploadSpeed,
+		speedServerID, speedServerName, speedServerSponsor, speedServerDistance, speedServerLatencyMS, speedBytesDown, speedBytesUp, seq)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, (SELECT COALESCE(MAX(seq), 0) + 1 FROM network))
+		RETURNING seq;`,
+		info.Timestamp, info.PingHost, info.PingHostName, pingSuccessful, info.PacketLoss, info.RTTMS, &info.DownloadSpeed, &info.UploadSpeed,
+		&info.SpeedServerID, &info.SpeedServerName, &info.SpeedServerSponsor, &info.SpeedServerDistance, &info.SpeedServerLatencyMS, &info.SpeedBytesDown, &info.SpeedBytesUp).Scan(&info.Seq)
+	if err != nil {
+		return errors.Wrap(err, "failed to execute insert")
+	}
 
-	// uploadSpeed := sql.NullFloat64{
-	// 	Float64: info.UploadSpeed.Else(0),
-	// 	Valid:   info.DownloadSpeed.Has(),
-	// }
+	return nil
+}
 
-	// TODO: why use a transaction, no point
-	insertText :=
-		`INSERT INTO network
-		(timestamp, pingHost, pingHostName, pingSuccessful, packetLoss, rttMS, downloadSpeed, uploadSpeed) VALUES (?, ?, ?, ?, ?, ?, ?, ?);`
+func (d database) GetNetworkInfoBatch(ctx context.Context, startTime int) (*types.NetworkInfoBatch, error) {
+	rows, err := d.db.QueryContext(ctx,
+		`
+			SELECT network.seq, network.timestamp, pingHost, pingHostName, pingSuccessful, packetLoss, rttMS, downloadSpeed, uploadSpeed, traffic.mbps
+			FROM network
+			LEFT JOIN (
+				SELECT timestamp, MAX(rxMbps + txMbps) AS mbps
+				FROM interface_traffic
+				WHERE timestamp > ?
+				GROUP BY timestamp
+			) AS traffic ON traffic.timestamp = network.timestamp
+			WHERE network.timestamp > ?
+			ORDER BY network.timestamp ASC
+		`, startTime, startTime)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query networks table")
+	}
+	defer rows.Close()
 
-	// _, err := d.db.Exec(insertText, info.Timestamp, info.PingHost, info.PingHostName, pingSuccessful, info.PacketLoss, info.RTTMS, downloadSpeed, uploadSpeed)
-	_, err := d.db.Exec(insertText, info.Timestamp, info.PingHost, info.PingHostName, pingSuccessful, info.PacketLoss, info.RTTMS, &info.DownloadSpeed, &info.UploadSpeed)
+	return scanNetworkInfoBatch(rows)
+}
 
-	// tx, err := d.db.BeginTx(ctx, nil)
-	// if err != nil {
-	// 	return errors.Wrap(err, "failed to begin transaction")
-	// }
+func (d database) GetNetworkInfoAfterSeq(ctx context.Context, afterSeq int64, limit int) (*types.NetworkInfoBatch, error) {
+	rows, err := d.db.QueryContext(ctx,
+		`
+			SELECT seq, timestamp, pingHost, pingHostName, pingSuccessful, packetLoss, rttMS, downloadSpeed, uploadSpeed,
+				(SELECT MAX(rxMbps + txMbps) FROM interface_traffic WHERE interface_traffic.timestamp = network.timestamp)
+			FROM network
+			WHERE seq > ?
+			ORDER BY seq ASC
+			LIMIT ?
+		`, afterSeq, limit)
 
-	// _, err = tx.Exec(`
-	// 	INSERT INTO network
-	// 	(timestamp, pingHost, pingHostName, pingSuccessful, packetLoss, rttMS, downloadSpeed, uploadSpeed) VALUES (?, ?, ?, ?, ?, ?, ?, ?);
-	// `, info.Timestamp, info.PingHost, info.PingHostName, pingSuccessful, info.PacketLoss, info.RTTMS, downloadSpeed, uploadSpeed)
 	if err != nil {
-		return errors.Wrap(err, "failed to execute insert")
+		return nil, errors.Wrap(err, "failed to query networks table")
 	}
+	defer rows.Close()
 
-	// err = tx.Commit()
-	// if err != nil {
-	// 	return errors.Wrap(err, "failed to commit transaction")
-	// }
+	return scanNetworkInfoBatch(rows)
+}
 
-	return nil
+// Traffic is taken from the busiest interface at each measurement, as in the
+// batches. The buckets and targets are read in one transaction so that both
+// see the same measurements.
+func (d database) GetNetworkInfoAggregate(ctx context.Context, startTime int64, endTime int64, bucketMS int64) (*types.NetworkInfoAggregate, error) {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx,
+		`
+			SELECT (network.timestamp - ?) / ? AS bucket, MAX(network.seq), COUNT(*), AVG(pingSuccessful), AVG(packetLoss),
+				AVG(downloadSpeed), MIN(downloadSpeed), MAX(downloadSpeed),
+				AVG(uploadSpeed), MIN(uploadSpeed), MAX(uploadSpeed),
+				AVG(traffic.mbps), MIN(traffic.mbps), MAX(traffic.mbps)
+			FROM network
+			LEFT JOIN (
+				SELECT timestamp, MAX(rxMbps + txMbps) AS mbps
+				FROM interface_traffic
+				WHERE timestamp >= ? AND timestamp < ?
+				GROUP BY timestamp
+			) AS traffic ON traffic.timestamp = network.timestamp
+			WHERE network.timestamp >= ? AND network.timestamp < ?
+			GROUP BY bucket
+			ORDER BY bucket ASC
+		`, startTime, bucketMS, startTime, endTime, startTime, endTime)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query networks table")
+	}
+	defer rows.Close()
+
+	aggregate := types.NetworkInfoAggregate{
+		BucketMS:         bucketMS,
+		Timestamps:       make([]int64, 0),
+		Measurements:     make([]int, 0),
+		PingValues:       make([]float64, 0),
+		PacketLossValues: make([]float64, 0),
+	}
+	series := []*types.AggregateSeries{&aggregate.Download, &aggregate.Upload, &aggregate.Traffic}
+	for _, s := range series {
+		s.Mean = make([]optional.Opt[float64], 0)
+		s.Min = make([]optional.Opt[float64], 0)
+		s.Max = make([]optional.Opt[float64], 0)
+	}
+
+	// Index of each bucket with measurements, for matching the targets to them.
+	buckets := make(map[int64]int)
+	for rows.Next() {
+		var bucket, seq int64
+		var measurements int
+		var ping, packetLoss float64
+		values := make([]optional.Opt[float64], 3*len(series))
+
+		dest := []any{&bucket, &seq, &measurements, &ping, &packetLoss}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, errors.Wrap(err, "failed to scan row for aggregate values")
+		}
+
+		buckets[bucket] = len(aggregate.Timestamps)
+		aggregate.LastSeq = max(aggregate.LastSeq, seq)
+		aggregate.Timestamps = append(aggregate.Timestamps, startTime+bucket*bucketMS)
+		aggregate.Measurements = append(aggregate.Measurements, measurements)
+		aggregate.PingValues = append(aggregate.PingValues, ping)
+		aggregate.PacketLossValues = append(aggregate.PacketLossValues, packetLoss)
+		for i, s := range series {
+			s.Mean = append(s.Mean, values[3*i])
+			s.Min = append(s.Min, values[3*i+1])
+			s.Max = append(s.Max, values[3*i+2])
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate aggregate rows")
+	}
+
+	aggregate.Targets, err = getTargetAggregates(ctx, tx, startTime, endTime, bucketMS, buckets)
+	if err != nil {
+		return nil, err
+	}
+
+	return &aggregate, nil
 }
 
-func (d database) GetNetworkInfoBatch(ctx context.Context, startTime int) (*types.NetworkInfoBatch, error) {
-	rows, err := d.db.QueryContext(ctx,
+// Summarizes the pings of each target in the same buckets as
+// GetNetworkInfoAggregate, given the index of each bucket.
+func getTargetAggregates(ctx context.Context, tx *sql.Tx, startTime int64, endTime int64, bucketMS int64, buckets map[int64]int) ([]types.TargetAggregate, error) {
+	rows, err := tx.QueryContext(ctx,
 		`
-			SELECT * FROM network
-			WHERE timestamp > ?
-			ORDER BY timestamp ASC
-		`, startTime)
+			SELECT (timestamp - ?) / ? AS bucket, pingHost, AVG(packetLoss),
+				AVG(CASE WHEN pingSuccessful = 1 THEN rttMS END),
+				MIN(CASE WHEN pingSuccessful = 1 THEN rttMS END),
+				MAX(CASE WHEN pingSuccessful = 1 THEN rttMS END)
+			FROM network
+			WHERE timestamp >= ? AND timestamp < ?
+			GROUP BY pingHost, bucket
+			ORDER BY pingHost ASC, bucket ASC
+		`, startTime, bucketMS, startTime, endTime)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to query networks table")
 	}
 	defer rows.Close()
 
+	targets := make([]types.TargetAggregate, 0)
+	for rows.Next() {
+		var bucket int64
+		var name string
+		var packetLoss, mean, minimum, maximum optional.Opt[float64]
+
+		if err := rows.Scan(&bucket, &name, &packetLoss, &mean, &minimum, &maximum); err != nil {
+			return nil, errors.Wrap(err, "failed to scan row for target aggregate values")
+		}
+		i := buckets[bucket]
+
+		if len(targets) == 0 || targets[len(targets)-1].Name != name {
+			targets = append(targets, types.TargetAggregate{
+				Name: name,
+				RTTMS: types.AggregateSeries{
+					Mean: make([]optional.Opt[float64], len(buckets)),
+					Min:  make([]optional.Opt[float64], len(buckets)),
+					Max:  make([]optional.Opt[float64], len(buckets)),
+				},
+				PacketLoss: make([]optional.Opt[float64], len(buckets)),
+			})
+		}
+		target := &targets[len(targets)-1]
+		target.RTTMS.Mean[i], target.RTTMS.Min[i], target.RTTMS.Max[i] = mean, minimum, maximum
+		target.PacketLoss[i] = packetLoss
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate target aggregate rows")
+	}
+
+	return targets, nil
+}
+
+// Scans rows of seq, timestamp, ping host, ping host name, ping successful,
+// packet loss, RTT, download, upload and traffic into a batch.
+func scanNetworkInfoBatch(rows *sql.Rows) (*types.NetworkInfoBatch, error) {
 	batch := types.NetworkInfoBatch{
-		Timestamps:     make([]int64, 0),
-		PingValues:     make([]bool, 0),
-		UploadValues:   make([]optional.Opt[float64], 0),
-		DownloadValues: make([]optional.Opt[float64], 0),
+		Seqs:             make([]int64, 0),
+		Timestamps:       make([]int64, 0),
+		PingValues:       make([]bool, 0),
+		UploadValues:     make([]optional.Opt[float64], 0),
+		DownloadValues:   make([]optional.Opt[float64], 0),
+		TrafficValues:    make([]optional.Opt[float64], 0),
+		Targets:          make([]string, 0),
+		RTTValues:        make([]optional.Opt[int], 0),
+		PacketLossValues: make([]float32, 0),
 	}
 
 	for rows.Next() {
 		var info types.NetworkInfo
+		var traffic optional.Opt[float64]
 
-		err := rows.Scan(&info.Timestamp, &info.PingHost, &info.PingHostName, &info.PingSuccessful, &info.PacketLoss, &info.RTTMS, &info.DownloadSpeed, &info.UploadSpeed)
+		err := rows.Scan(&info.Seq, &info.Timestamp, &info.PingHost, &info.PingHostName, &info.PingSuccessful, &info.PacketLoss, &info.RTTMS, &info.DownloadSpeed, &info.UploadSpeed, &traffic)
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to scan row for network info values")
 		}
 
+		batch.Seqs = append(batch.Seqs, info.Seq)
 		batch.Timestamps = append(batch.Timestamps, info.Timestamp)
 		batch.PingValues = append(batch.PingValues, info.PingSuccessful)
 		batch.DownloadValues = append(batch.DownloadValues, info.DownloadSpeed)
 		batch.UploadValues = append(batch.UploadValues, info.UploadSpeed)
+		batch.TrafficValues = append(batch.TrafficValues, traffic)
+		batch.Targets = append(batch.Targets, info.PingHost)
+		batch.PacketLossValues = append(batch.PacketLossValues, info.PacketLoss)
+		if info.PingSuccessful {
+			batch.RTTValues = append(batch.RTTValues, optional.New(info.RTTMS))
+		} else {
+			batch.RTTValues = append(batch.RTTValues, optional.Empty[int]())
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate network rows")
 	}
 
 	return &batch, nil
 }
+
+// Returns the speed test results since the start time. If the server ID is not
+// empty, only results from that server are included.
+func (d database) GetSpeedtestHistory(ctx context.Context, startTime int, serverID string) ([]types.SpeedtestRecord, error) {
+	rows, err := d.db.QueryContext(ctx,
+		`
+			SELECT timestamp, downloadSpeed, uploadSpeed, speedServerID, speedServerName, speedServerSponsor, speedServerDistance, speedServerLatencyMS
+			FROM network
+			WHERE timestamp > ? AND downloadSpeed IS NOT NULL AND (? = '' OR speedServerID = ?)
+			ORDER BY timestamp ASC
+		`, startTime, serverID, serverID)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query networks table")
+	}
+	defer rows.Close()
+
+	records := make([]types.SpeedtestRecord, 0)
+	for rows.Next() {
+		var info types.NetworkInfo
+
+		err := rows.Scan(&info.Timestamp, &info.DownloadSpeed, &info.UploadSpeed, &info.SpeedServerID, &info.SpeedServerName, &info.SpeedServerSponsor, &info.SpeedServerDistance, &info.SpeedServerLatencyMS)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row for speed test values")
+		}
+
+		records = append(records, speedtestRecord(&info))
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate speed test rows")
+	}
+
+	return records, nil
+}
+
+func speedtestRecord(info *types.NetworkInfo) types.SpeedtestRecord {
+	return types.SpeedtestRecord{
+		Timestamp: info.Timestamp,
+		Download:  info.DownloadSpeed.Else(0),
+		Upload:    info.UploadSpeed.Else(0),
+		Server: types.SpeedtestServer{
+			ID:        info.SpeedServerID.Else(""),
+			Name:      info.SpeedServerName.Else(""),
+			Sponsor:   info.SpeedServerSponsor.Else(""),
+			Distance:  info.SpeedServerDistance.Else(0),
+			LatencyMS: info.SpeedServerLatencyMS.Else(0),
+		},
+	}
+}
+
+func (d database) GetLatestSpeedtest(ctx context.Context) (*types.SpeedtestRecord, error) {
+	var info types.NetworkInfo
+	err := d.db.QueryRowContext(ctx,
+		`
+			SELECT timestamp, downloadSpeed, uploadSpeed, speedServerID, speedServerName, speedServerSponsor, speedServerDistance, speedServerLatencyMS
+			FROM network
+			WHERE downloadSpeed IS NOT NULL
+			ORDER BY timestamp DESC
+			LIMIT 1
+		`).Scan(&info.Timestamp, &info.DownloadSpeed, &info.UploadSpeed, &info.SpeedServerID, &info.SpeedServerName, &info.SpeedServerSponsor, &info.SpeedServerDistance, &info.SpeedServerLatencyMS)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to query networks table")
+	}
+
+	record := speedtestRecord(&info)
+	return &record, nil
+}
+
+func (d database) GetRecentSpeedtests(ctx context.Context, count int) ([]types.SpeedtestRecord, error) {
+	rows, err := d.db.QueryContext(ctx,
+		`
+			SELECT timestamp, downloadSpeed, uploadSpeed, speedServerID, speedServerName, speedServerSponsor, speedServerDistance, speedServerLatencyMS
+			FROM network
+			WHERE downloadSpeed IS NOT NULL
+			ORDER BY timestamp DESC
+			LIMIT ?
+		`, count)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query networks table")
+	}
+	defer rows.Close()
+
+	records := make([]types.SpeedtestRecord, 0, count)
+	for rows.Next() {
+		var info types.NetworkInfo
+		err := rows.Scan(&info.Timestamp, &info.DownloadSpeed, &info.UploadSpeed, &info.SpeedServerID, &info.SpeedServerName, &info.SpeedServerSponsor, &info.SpeedServerDistance, &info.SpeedServerLatencyMS)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row for speed test values")
+		}
+		records = append(records, speedtestRecord(&info))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate speed test rows")
+	}
+
+	slices.Reverse(records)
+	return records, nil
+}
+
+func (d database) InsertLANTestResult(ctx context.Context, result *types.LANTestResult) error {
+	_, err := d.db.ExecContext(ctx,
+		`INSERT INTO lan_test
+		(timestamp, clientIP, userAgent, downloadSpeed, uploadSpeed, latencyMS) VALUES (?, ?, ?, ?, ?, ?);`,
+		result.Timestamp, result.ClientIP, result.UserAgent, result.DownloadSpeed, result.UploadSpeed, result.LatencyMS)
+	if err != nil {
+		return errors.Wrap(err, "failed to execute insert")
+	}
+
+	return nil
+}
+
+func (d database) GetLANTestResults(ctx context.Context, startTime int) ([]types.LANTestResult, error) {
+	rows, err := d.db.QueryContext(ctx,
+		`
+			SELECT timestamp, clientIP, userAgent, downloadSpeed, uploadSpeed, latencyMS
+			FROM lan_test
+			WHERE timestamp > ?
+			ORDER BY timestamp ASC
+		`, startTime)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query lan_test table")
+	}
+	defer rows.Close()
+
+	results := make([]types.LANTestResult, 0)
+	for rows.Next() {
+		var result types.LANTestResult
+
+		err := rows.Scan(&result.Timestamp, &result.ClientIP, &result.UserAgent, &result.DownloadSpeed, &result.UploadSpeed, &result.LatencyMS)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row for lan test values")
+		}
+
+		results = append(results, result)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate lan test rows")
+	}
+
+	return results, nil
+}
+
+// Adds to the data used by speed tests in the billing period starting at the
+// given time.
+func (d database) AddDataUsage(ctx context.Context, periodStart int64, bytesDownloaded int64, bytesUploaded int64) error {
+	_, err := d.db.ExecContext(ctx,
+		`INSERT INTO data_usage (periodStart, bytesDownloaded, bytesUploaded) VALUES (?, ?, ?)
+		ON CONFLICT(periodStart) DO UPDATE SET
+			bytesDownloaded = bytesDownloaded + excluded.bytesDownloaded,
+			bytesUploaded = bytesUploaded + excluded.bytesUploaded;`,
+		periodStart, bytesDownloaded, bytesUploaded)
+	if err != nil {
+		return errors.Wrap(err, "failed to execute upsert")
+	}
+
+	return nil
+}
+
+func (d database) GetDataUsage(ctx context.Context, periodStart int64) (int64, int64, error) {
+	var bytesDownloaded, bytesUploaded int64
+	err := d.db.QueryRowContext(ctx,
+		`SELECT bytesDownloaded, bytesUploaded FROM data_usage WHERE periodStart = ?`, periodStart).
+		Scan(&bytesDownloaded, &bytesUploaded)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to query data_usage table")
+	}
+
+	return bytesDownloaded, bytesUploaded, nil
+}
+
+func (d database) InsertInterfaceTraffic(ctx context.Context, traffic []types.InterfaceTraffic) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	for _, t := range traffic {
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO interface_traffic
+			(timestamp, interface, rxMbps, txMbps, rxPacketsPerSecond, txPacketsPerSecond, rxErrors, txErrors, rxDrops, txDrops)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`,
+			t.Timestamp, t.Interface, t.RxMbps, t.TxMbps, t.RxPacketsPerSecond, t.TxPacketsPerSecond, t.RxErrors, t.TxErrors, t.RxDrops, t.TxDrops)
+		if err != nil {
+			return errors.Wrap(err, "failed to execute insert")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+
+	return nil
+}
+
+// Returns the interface traffic since the start time. If the interface is not
+// empty, only traffic for that interface is included.
+func (d database) GetInterfaceTraffic(ctx context.Context, startTime int, iface string) ([]types.InterfaceTraffic, error) {
+	rows, err := d.db.QueryContext(ctx,
+		`
+			SELECT timestamp, interface, rxMbps, txMbps, rxPacketsPerSecond, txPacketsPerSecond, rxErrors, txErrors, rxDrops, txDrops
+			FROM interface_traffic
+			WHERE timestamp > ? AND (? = '' OR interface = ?)
+			ORDER BY timestamp ASC, interface ASC
+		`, startTime, iface, iface)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query interface_traffic table")
+	}
+	defer rows.Close()
+
+	traffic := make([]types.InterfaceTraffic, 0)
+	for rows.Next() {
+		var t types.InterfaceTraffic
+
+		err := rows.Scan(&t.Timestamp, &t.Interface, &t.RxMbps, &t.TxMbps, &t.RxPacketsPerSecond, &t.TxPacketsPerSecond, &t.RxErrors, &t.TxErrors, &t.RxDrops, &t.TxDrops)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row for interface traffic values")
+		}
+
+		traffic = append(traffic, t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate interface traffic rows")
+	}
+
+	return traffic, nil
+}
+
+func (d database) GetTargets(ctx context.Context) ([]types.Target, error) {
+	rows, err := d.db.QueryContext(ctx,
+		`
+			SELECT pingHost, pingHostName, COUNT(*), AVG(pingSuccessful), MIN(timestamp), MAX(timestamp)
+			FROM network
+			GROUP BY pingHost, pingHostName
+			ORDER BY pingHost ASC
+		`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query networks table")
+	}
+	defer rows.Close()
+
+	targets := make([]types.Target, 0)
+	for rows.Next() {
+		var target types.Target
+
+		err := rows.Scan(&target.Name, &target.Host, &target.Measurements, &target.Availability, &target.FirstTimestamp, &target.LastTimestamp)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row for target values")
+		}
+
+		targets = append(targets, target)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate target rows")
+	}
+
+	return targets, nil
+}
+
+func (d database) GetLatestNetworkInfo(ctx context.Context) (*types.NetworkInfo, error) {
+	var info types.NetworkInfo
+	err := d.db.QueryRowContext(ctx,
+		`
+			SELECT seq, timestamp, pingHost, pingHostName, pingSuccessful, packetLoss, rttMS, downloadSpeed, uploadSpeed,
+				speedServerID, speedServerName, speedServerSponsor, speedServerDistance, speedServerLatencyMS, speedBytesDown, speedBytesUp
+			FROM network
+			ORDER BY timestamp DESC
+			LIMIT 1
+		`).Scan(&info.Seq, &info.Timestamp, &info.PingHost, &info.PingHostName, &info.PingSuccessful, &info.PacketLoss, &info.RTTMS, &info.DownloadSpeed, &info.UploadSpeed,
+		&info.SpeedServerID, &info.SpeedServerName, &info.SpeedServerSponsor, &info.SpeedServerDistance, &info.SpeedServerLatencyMS, &info.SpeedBytesDown, &info.SpeedBytesUp)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to query networks table")
+	}
+
+	return &info, nil
+}
+
+func (d database) GetLastSuccessfulPing(ctx context.Context) (optional.Opt[int64], error) {
+	var timestamp optional.Opt[int64]
+	err := d.db.QueryRowContext(ctx, `SELECT MAX(timestamp) FROM network WHERE pingSuccessful = 1`).Scan(&timestamp)
+	if err != nil {
+		return timestamp, errors.Wrap(err, "failed to query networks table")
+	}
+
+	return timestamp, nil
+}
+
+// Outages are found as runs of consecutive failed pings. Each run is numbered
+// by the difference between a row's position among all rows and among rows
+// with the same result, which is constant within a run. An outage ends with
+// the first successful ping after it, which may be after the end time, but
+// only the failures before the end time are counted.
+func (d database) GetIncidents(ctx context.Context, startTime int64, endTime int64) ([]types.Incident, error) {
+	rows, err := d.db.QueryContext(ctx,
+		`
+			SELECT start, failures,
+				(SELECT MIN(timestamp) FROM network WHERE timestamp > outages.lastFailure AND pingSuccessful = 1)
+			FROM (
+				SELECT MIN(timestamp) AS start, MAX(timestamp) AS lastFailure, COUNT(*) AS failures
+				FROM (
+					SELECT timestamp, pingSuccessful,
+						ROW_NUMBER() OVER (ORDER BY timestamp) - ROW_NUMBER() OVER (PARTITION BY pingSuccessful ORDER BY timestamp) AS run
+					FROM network
+					WHERE timestamp > ? AND timestamp < ?
+				)
+				WHERE pingSuccessful = 0
+				GROUP BY run
+			) AS outages
+			ORDER BY start ASC
+		`, startTime, endTime)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query networks table")
+	}
+	defer rows.Close()
+
+	incidents := make([]types.Incident, 0)
+	for rows.Next() {
+		var incident types.Incident
+		var failures int
+
+		if err := rows.Scan(&incident.Start, &failures, &incident.End); err != nil {
+			return nil, errors.Wrap(err, "failed to scan row for outage values")
+		}
+
+		incident.ID = fmt.Sprintf("%s-%d", types.IncidentKindOutage, incident.Start)
+		incident.Kind = types.IncidentKindOutage
+		incident.Description = "1 failed ping"
+		if failures > 1 {
+			incident.Description = fmt.Sprintf("%d consecutive failed pings", failures)
+		}
+		incidents = append(incidents, incident)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate outage rows")
+	}
+
+	saved, err := d.getSavedIncidents(ctx, startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+	incidents = append(incidents, saved...)
+	slices.SortStableFunc(incidents, func(a, b types.Incident) int { return cmp.Compare(a.Start, b.Start) })
+
+	return incidents, nil
+}
+
+func (d database) getSavedIncidents(ctx context.Context, startTime int64, endTime int64) ([]types.Incident, error) {
+	rows, err := d.db.QueryContext(ctx,
+		`
+			SELECT id, kind, target, metric, startTime, endTime, description
+			FROM incidents
+			WHERE startTime > ? AND startTime < ?
+			ORDER BY startTime ASC
+		`, startTime, endTime)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query incidents table")
+	}
+	defer rows.Close()
+
+	return scanIncidents(rows)
+}
+
+func (d database) GetOpenIncidents(ctx context.Context, kind string) ([]types.Incident, error) {
+	rows, err := d.db.QueryContext(ctx,
+		`
+			SELECT id, kind, target, metric, startTime, endTime, description
+			FROM incidents
+			WHERE kind = ? AND endTime IS NULL
+			ORDER BY startTime ASC
+		`, kind)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query incidents table")
+	}
+	defer rows.Close()
+
+	return scanIncidents(rows)
+}
+
+// Scans rows of id, kind, target, metric, start, end and description into
+// incidents.
+func scanIncidents(rows *sql.Rows) ([]types.Incident, error) {
+	incidents := make([]types.Incident, 0)
+	for rows.Next() {
+		var incident types.Incident
+
+		err := rows.Scan(&incident.ID, &incident.Kind, &incident.Target, &incident.Metric, &incident.Start, &incident.End, &incident.Description)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row for incident values")
+		}
+
+		incidents = append(incidents, incident)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate incident rows")
+	}
+
+	return incidents, nil
+}
+
+func (d database) SaveIncident(ctx context.Context, incident *types.Incident) error {
+	_, err := d.db.ExecContext(ctx,
+		`INSERT INTO incidents (id, kind, target, metric, startTime, endTime, description) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			endTime = excluded.endTime,
+			description = excluded.description;`,
+		incident.ID, incident.Kind, incident.Target, incident.Metric, incident.Start, &incident.End, incident.Description)
+	if err != nil {
+		return errors.Wrap(err, "failed to execute upsert")
+	}
+
+	return nil
+}
+
+func (d database) ExportNetworkInfo(ctx context.Context, startTime int64, endTime int64, speedTestsOnly bool, fn func(*types.NetworkInfo) error) error {
+	rows, err := d.db.QueryContext(ctx,
+		`
+			SELECT seq, timestamp, pingHost, pingHostName, pingSuccessful, packetLoss, rttMS, downloadSpeed, uploadSpeed,
+				speedServerID, speedServerName, speedServerSponsor, speedServerDistance, speedServerLatencyMS, speedBytesDown, speedBytesUp
+			FROM network
+			WHERE timestamp >= ? AND timestamp < ? AND (? = 0 OR downloadSpeed IS NOT NULL)
+			ORDER BY timestamp ASC
+		`, startTime, endTime, speedTestsOnly)
+
+	if err != nil {
+		return errors.Wrap(err, "failed to query networks table")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var info types.NetworkInfo
+
+		err := rows.Scan(&info.Seq, &info.Timestamp, &info.PingHost, &info.PingHostName, &info.PingSuccessful, &info.PacketLoss, &info.RTTMS, &info.DownloadSpeed, &info.UploadSpeed,
+			&info.SpeedServerID, &info.SpeedServerName, &info.SpeedServerSponsor, &info.SpeedServerDistance, &info.SpeedServerLatencyMS, &info.SpeedBytesDown, &info.SpeedBytesUp)
+		if err != nil {
+			return errors.Wrap(err, "failed to scan row for network info values")
+		}
+
+		if err := fn(&info); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "failed to iterate network rows")
+	}
+
+	return nil
+}
+
+func (d database) ExportInterfaceTraffic(ctx context.Context, startTime int64, endTime int64, fn func(*types.InterfaceTraffic) error) error {
+	rows, err := d.db.QueryContext(ctx,
+		`
+			SELECT timestamp, interface, rxMbps, txMbps, rxPacketsPerSecond, txPacketsPerSecond, rxErrors, txErrors, rxDrops, txDrops
+			FROM interface_traffic
+			WHERE timestamp >= ? AND timestamp < ?
+			ORDER BY timestamp ASC, interface ASC
+		`, startTime, endTime)
+
+	if err != nil {
+		return errors.Wrap(err, "failed to query interface_traffic table")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t types.InterfaceTraffic
+
+		err := rows.Scan(&t.Timestamp, &t.Interface, &t.RxMbps, &t.TxMbps, &t.RxPacketsPerSecond, &t.TxPacketsPerSecond, &t.RxErrors, &t.TxErrors, &t.RxDrops, &t.TxDrops)
+		if err != nil {
+			return errors.Wrap(err, "failed to scan row for interface traffic values")
+		}
+
+		if err := fn(&t); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "failed to iterate interface traffic rows")
+	}
+
+	return nil
+}
@@ -0,0 +1,261 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/SkylerRankin/network_monitor/internal/optional"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+	_ "modernc.org/sqlite"
+)
+
+// Opens a database in a temporary directory, closed when the test ends.
+func newTestDatabase(t *testing.T, dir string) database {
+	t.Helper()
+
+	db, err := NewDatabase(context.Background(), dir)
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db.(database)
+}
+
+func insertNetworkInfo(t *testing.T, db database, infos ...types.NetworkInfo) {
+	t.Helper()
+	for _, info := range infos {
+		if err := db.InsertNetworkInfo(context.Background(), &info); err != nil {
+			t.Fatalf("failed to insert measurement at %d: %v", info.Timestamp, err)
+		}
+	}
+}
+
+func ping(timestamp int64, host string, successful bool) types.NetworkInfo {
+	info := types.NetworkInfo{Timestamp: timestamp, PingHost: host, PingHostName: host, PingSuccessful: successful}
+	if successful {
+		info.RTTMS = 10
+	} else {
+		info.PacketLoss = 100
+	}
+	return info
+}
+
+func speedtest(timestamp int64, host string, download float64, upload float64) types.NetworkInfo {
+	info := ping(timestamp, host, true)
+	info.DownloadSpeed = optional.New(download)
+	info.UploadSpeed = optional.New(upload)
+	return info
+}
+
+func TestGetNetworkInfoAfterSeq(t *testing.T) {
+	db := newTestDatabase(t, t.TempDir())
+	ctx := context.Background()
+
+	// Inserted out of time order, since sequence numbers follow insertion.
+	insertNetworkInfo(t, db, ping(3000, "a", true), ping(1000, "a", false), speedtest(2000, "b", 90, 10), ping(4000, "b", true))
+
+	batch, err := db.GetNetworkInfoAfterSeq(ctx, 1, 2)
+	if err != nil {
+		t.Fatalf("failed to get measurements: %v", err)
+	}
+	if !slices.Equal(batch.Seqs, []int64{2, 3}) || !slices.Equal(batch.Timestamps, []int64{1000, 2000}) {
+		t.Errorf("expected seqs 2 and 3, got %v at %v", batch.Seqs, batch.Timestamps)
+	}
+	if batch.PingValues[0] || batch.RTTValues[0].Has() || batch.DownloadValues[1].Else(0) != 90 || batch.Targets[1] != "b" {
+		t.Errorf("unexpected batch %+v", batch)
+	}
+
+	batch, err = db.GetNetworkInfoAfterSeq(ctx, 4, 10)
+	if err != nil {
+		t.Fatalf("failed to get measurements: %v", err)
+	}
+	if len(batch.Seqs) != 0 {
+		t.Errorf("expected no measurements after the last, got %v", batch.Seqs)
+	}
+}
+
+func TestSeqMigration(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	// A database from before sequence numbers were stored.
+	old, err := sql.Open("sqlite", filepath.Join(dir, databaseFilename))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	_, err = old.ExecContext(ctx,
+		`CREATE TABLE network (
+			timestamp INTEGER PRIMARY KEY,
+			pingHost TEXT NOT NULL,
+			pingHostName TEXT NOT NULL,
+			pingSuccessful INTEGER NOT NULL,
+			packetLoss REAL,
+			rttMS INTEGER,
+			downloadSpeed REAL,
+			uploadSpeed REAL
+		)`)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	_, err = old.ExecContext(ctx,
+		`INSERT INTO network (timestamp, pingHost, pingHostName, pingSuccessful, packetLoss, rttMS)
+		VALUES (3000, 'a', 'a', 1, 0, 10), (1000, 'a', 'a', 1, 0, 10), (2000, 'a', 'a', 0, 100, 0)`)
+	if err != nil {
+		t.Fatalf("failed to insert rows: %v", err)
+	}
+	old.Close()
+
+	db := newTestDatabase(t, dir)
+	insertNetworkInfo(t, db, ping(500, "a", true))
+
+	// Opening it again leaves the numbers alone.
+	db.db.Close()
+	db = newTestDatabase(t, dir)
+
+	batch, err := db.GetNetworkInfoAfterSeq(ctx, 0, 10)
+	if err != nil {
+		t.Fatalf("failed to get measurements: %v", err)
+	}
+	if !slices.Equal(batch.Seqs, []int64{1, 2, 3, 4}) || !slices.Equal(batch.Timestamps, []int64{1000, 2000, 3000, 500}) {
+		t.Errorf("expected old rows numbered in time order before new ones, got %v at %v", batch.Seqs, batch.Timestamps)
+	}
+}
+
+func TestGetIncidents(t *testing.T) {
+	db := newTestDatabase(t, t.TempDir())
+	ctx := context.Background()
+
+	insertNetworkInfo(t, db,
+		ping(1000, "a", true),
+		ping(2000, "a", false),
+		ping(3000, "b", false),
+		ping(4000, "a", true),
+		ping(5000, "a", false),
+		ping(6000, "b", true),
+		ping(7000, "a", false),
+		ping(8000, "b", false),
+		ping(9000, "a", false),
+	)
+	degradation := types.Incident{ID: "degradation-rtt-a-2500", Kind: types.IncidentKindDegradation, Target: "a", Metric: types.MetricRTT, Start: 2500, End: optional.New[int64](6500), Description: "slow"}
+	if err := db.SaveIncident(ctx, &degradation); err != nil {
+		t.Fatalf("failed to save incident: %v", err)
+	}
+
+	incidents, err := db.GetIncidents(ctx, 0, 10000)
+	if err != nil {
+		t.Fatalf("failed to get incidents: %v", err)
+	}
+	expected := []struct {
+		id          string
+		start       int64
+		end         optional.Opt[int64]
+		description string
+	}{
+		{"outage-2000", 2000, optional.New[int64](4000), "2 consecutive failed pings"},
+		{"degradation-rtt-a-2500", 2500, optional.New[int64](6500), "slow"},
+		{"outage-5000", 5000, optional.New[int64](6000), "1 failed ping"},
+		// Still failing, so it has no end.
+		{"outage-7000", 7000, optional.Empty[int64](), "3 consecutive failed pings"},
+	}
+	if len(incidents) != len(expected) {
+		t.Fatalf("expected %d incidents, got %+v", len(expected), incidents)
+	}
+	for i, e := range expected {
+		incident := incidents[i]
+		if incident.ID != e.id || incident.Start != e.start || incident.End.Has() != e.end.Has() || incident.End.Else(0) != e.end.Else(0) || incident.Description != e.description {
+			t.Errorf("expected incident %d to be %+v, got %+v", i, e, incident)
+		}
+	}
+
+	// Outages already going at the start time only count failures after it.
+	incidents, err = db.GetIncidents(ctx, 2500, 10000)
+	if err != nil {
+		t.Fatalf("failed to get incidents: %v", err)
+	}
+	if len(incidents) != 3 || incidents[0].ID != "outage-3000" || incidents[0].Description != "1 failed ping" || incidents[0].End.Else(0) != 4000 {
+		t.Errorf("unexpected incidents after 2500: %+v", incidents)
+	}
+	// Only incidents that started before the end time are returned, and they
+	// still end when the pings recovered.
+	incidents, err = db.GetIncidents(ctx, 0, 5500)
+	if err != nil {
+		t.Fatalf("failed to get incidents: %v", err)
+	}
+	if len(incidents) != 3 || incidents[2].ID != "outage-5000" || incidents[2].End.Else(0) != 6000 {
+		t.Errorf("unexpected incidents before 5500: %+v", incidents)
+	}
+}
+
+func TestGetOpenIncidents(t *testing.T) {
+	db := newTestDatabase(t, t.TempDir())
+	ctx := context.Background()
+
+	for _, incident := range []types.Incident{
+		{ID: "belowPlan-1000", Kind: types.IncidentKindBelowPlan, Start: 1000, End: optional.New[int64](2000)},
+		{ID: "belowPlan-3000", Kind: types.IncidentKindBelowPlan, Start: 3000, End: optional.Empty[int64]()},
+		{ID: "degradation-rtt-a-4000", Kind: types.IncidentKindDegradation, Start: 4000, End: optional.Empty[int64]()},
+	} {
+		if err := db.SaveIncident(ctx, &incident); err != nil {
+			t.Fatalf("failed to save incident: %v", err)
+		}
+	}
+
+	open, err := db.GetOpenIncidents(ctx, types.IncidentKindBelowPlan)
+	if err != nil {
+		t.Fatalf("failed to get open incidents: %v", err)
+	}
+	if len(open) != 1 || open[0].ID != "belowPlan-3000" {
+		t.Errorf("expected only the open below plan incident, got %+v", open)
+	}
+}
+
+func TestGetNetworkInfoAggregateTargets(t *testing.T) {
+	db := newTestDatabase(t, t.TempDir())
+
+	slow := ping(300, "a", true)
+	slow.RTTMS = 30
+	later := ping(2200, "b", true)
+	later.RTTMS = 20
+	insertNetworkInfo(t, db, ping(100, "a", true), ping(200, "b", false), slow, ping(1100, "a", false), later)
+
+	aggregate, err := db.GetNetworkInfoAggregate(context.Background(), 0, 3000, 1000)
+	if err != nil {
+		t.Fatalf("failed to get aggregate: %v", err)
+	}
+	if !slices.Equal(aggregate.Timestamps, []int64{0, 1000, 2000}) || !slices.Equal(aggregate.Measurements, []int{3, 1, 1}) {
+		t.Fatalf("unexpected buckets %v with %v measurements", aggregate.Timestamps, aggregate.Measurements)
+	}
+	if len(aggregate.Targets) != 2 || aggregate.Targets[0].Name != "a" || aggregate.Targets[1].Name != "b" {
+		t.Fatalf("expected targets a and b, got %+v", aggregate.Targets)
+	}
+
+	// Empty where the target had no successful pings, or wasn't pinged.
+	empty := optional.Empty[float64]()
+	expected := []struct {
+		mean, min, max, loss []optional.Opt[float64]
+	}{
+		{
+			mean: []optional.Opt[float64]{optional.New(20.0), empty, empty},
+			min:  []optional.Opt[float64]{optional.New(10.0), empty, empty},
+			max:  []optional.Opt[float64]{optional.New(30.0), empty, empty},
+			loss: []optional.Opt[float64]{optional.New(0.0), optional.New(100.0), empty},
+		},
+		{
+			mean: []optional.Opt[float64]{empty, empty, optional.New(20.0)},
+			min:  []optional.Opt[float64]{empty, empty, optional.New(20.0)},
+			max:  []optional.Opt[float64]{empty, empty, optional.New(20.0)},
+			loss: []optional.Opt[float64]{optional.New(100.0), empty, optional.New(0.0)},
+		},
+	}
+	equal := func(a, b optional.Opt[float64]) bool { return a.Has() == b.Has() && a.Else(0) == b.Else(0) }
+	for i, e := range expected {
+		target := aggregate.Targets[i]
+		if !slices.EqualFunc(target.RTTMS.Mean, e.mean, equal) || !slices.EqualFunc(target.RTTMS.Min, e.min, equal) ||
+			!slices.EqualFunc(target.RTTMS.Max, e.max, equal) || !slices.EqualFunc(target.PacketLoss, e.loss, equal) {
+			t.Errorf("unexpected aggregate for %s: %+v", target.Name, target)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+// Package databasetest has fakes of the database for tests in other packages.
+package databasetest
+
+import (
+	"context"
+
+	"github.com/SkylerRankin/network_monitor/internal/database"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+)
+
+// Exports measurements held in memory. Calling any method other than
+// ExportNetworkInfo panics on the nil embedded interface, so tests embed it
+// in their own fakes to add the queries they need.
+type Database struct {
+	database.Database
+	Measurements []types.NetworkInfo
+}
+
+// Calls fn with each measurement in [startTime, endTime), in the order they
+// were added, or only those with a speed test if speedTestsOnly is set.
+func (d *Database) ExportNetworkInfo(ctx context.Context, startTime int64, endTime int64, speedTestsOnly bool, fn func(*types.NetworkInfo) error) error {
+	for i := range d.Measurements {
+		info := &d.Measurements[i]
+		if info.Timestamp < startTime || info.Timestamp >= endTime || (speedTestsOnly && !info.DownloadSpeed.Has()) {
+			continue
+		}
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+type column struct {
+	name       string
+	definition string
+}
+
+// Adds any of the given columns that do not already exist in the table. This
+// lets databases created by older versions pick up new columns on startup.
+func addMissingColumns(ctx context.Context, db *sql.DB, table string, columns []column) error {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return errors.Wrap(err, "failed to query table info")
+	}
+	defer rows.Close()
+
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var (
+			cid          int
+			name         string
+			columnType   string
+			notNull      int
+			defaultValue sql.NullString
+			primaryKey   int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			return errors.Wrap(err, "failed to scan table info")
+		}
+		existing[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "failed to iterate table info")
+	}
+
+	for _, c := range columns {
+		if existing[c.name] {
+			continue
+		}
+		_, err := db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, c.name, c.definition))
+		if err != nil {
+			return errors.Wrapf(err, "failed to add column %s", c.name)
+		}
+	}
+
+	return nil
+}
@@ -2,15 +2,19 @@ package jobs
 
 import (
 	"context"
-	"encoding/json"
 	"log/slog"
 	"sync"
 	"time"
 
+	"github.com/SkylerRankin/network_monitor/internal/anomaly"
+	"github.com/SkylerRankin/network_monitor/internal/config"
 	"github.com/SkylerRankin/network_monitor/internal/database"
+	"github.com/SkylerRankin/network_monitor/internal/netdev"
 	"github.com/SkylerRankin/network_monitor/internal/network"
 	"github.com/SkylerRankin/network_monitor/internal/optional"
+	"github.com/SkylerRankin/network_monitor/internal/plan"
 	"github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/SkylerRankin/network_monitor/internal/usage"
 	websocket_client "github.com/SkylerRankin/network_monitor/internal/websocket"
 	"github.com/pkg/errors"
 )
@@ -22,84 +26,340 @@ const (
 	speedInterval = 30
 )
 
+// NetworkJob pings a host on each run, and periodically runs a speed test.
+type NetworkJob interface {
+	SchedulerJob
+	// RunPing runs a job immediately without a speed test. Returns
+	// ErrProbeRunning if a speed test or another manual job is running.
+	RunPing() (types.NetworkInfo, error)
+	// RunSpeedTest runs a job immediately with a speed test. Returns
+	// ErrProbeRunning if a speed test or another manual job is running.
+	RunSpeedTest() (types.NetworkInfo, error)
+}
+
+var (
+	ErrProbeRunning      = errors.New("a speed test or manual probe is already running")
+	ErrDataBudgetReached = errors.New("monthly data budget reached")
+)
+
+// Controls whether a job runs a speed test.
+type speedTestMode int
+
+const (
+	speedTestScheduled speedTestMode = iota
+	speedTestNever
+	speedTestAlways
+)
+
+var _ NetworkJob = &networkInfoJob{}
+
 type networkInfoJob struct {
-	ctx                  context.Context
-	log                  *slog.Logger
-	speedInterval        int
-	currentSpeedInterval int
-	intervalMutex        sync.Mutex
-	database             database.Database
-	websocket            websocket_client.WebsocketClient
+	ctx         context.Context
+	log         *slog.Logger
+	speedPolicy speedTestPolicy
+	// Separate from the speed test policy's collector, which restarts its
+	// interval after each speed test.
+	trafficCollector *netdev.Collector
+	config           *config.Config
+	speedTester      network.SpeedTester
+	// Held while a speed test or a manual job runs, so that scheduled and
+	// manual jobs don't overlap and measure each other. Scheduled jobs without
+	// a speed test keep pinging while it's held.
+	speedTestMutex sync.Mutex
+	// Only used while holding speedTestMutex.
+	planAlert *plan.Alert
+	// Whether the below plan incident left open by the last run has been
+	// restored into planAlert. Only used while holding speedTestMutex.
+	planAlertRestored bool
+	anomalies         *anomaly.Detector
+	database          database.Database
+	websocket         websocket_client.WebsocketClient
 }
 
-func NewNetworkInfoJob(ctx context.Context, log *slog.Logger, database database.Database, websocket websocket_client.WebsocketClient) (SchedulerJob, error) {
+func NewNetworkInfoJob(ctx context.Context, log *slog.Logger, config *config.Config, database database.Database, websocket websocket_client.WebsocketClient) (NetworkJob, error) {
+	speedTester, err := network.NewSpeedTester(log, config.Speedtest)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create speed tester")
+	}
+
 	return &networkInfoJob{
-		ctx:                  ctx,
-		log:                  log,
-		speedInterval:        speedInterval,
-		currentSpeedInterval: speedInterval,
-		database:             database,
-		websocket:            websocket,
+		ctx:              ctx,
+		log:              log,
+		speedPolicy:      newSpeedTestPolicy(log, config.Speedtest),
+		trafficCollector: netdev.NewCollector(),
+		config:           config,
+		speedTester:      speedTester,
+		planAlert:        plan.NewAlert(plan.NewSchedule(config.ISP)),
+		anomalies:        anomaly.NewDetector(config.Anomaly, database),
+		database:         database,
+		websocket:        websocket,
 	}, nil
 }
 
 func (j *networkInfoJob) Run() error {
-	// Multiple running jobs may attempt to update the speed interval. Lock to
-	// prevent repeated intervals.
-	j.intervalMutex.Lock()
-	runSpeedTest := j.currentSpeedInterval == 0
-	if j.currentSpeedInterval == 0 {
-		j.currentSpeedInterval = j.speedInterval
-	} else {
-		j.currentSpeedInterval -= 1
+	_, err := j.run(speedTestScheduled)
+	return err
+}
+
+func (j *networkInfoJob) RunPing() (types.NetworkInfo, error) {
+	return j.run(speedTestNever)
+}
+
+func (j *networkInfoJob) RunSpeedTest() (types.NetworkInfo, error) {
+	return j.run(speedTestAlways)
+}
+
+func (j *networkInfoJob) run(mode speedTestMode) (types.NetworkInfo, error) {
+	manual := mode != speedTestScheduled
+	if manual {
+		if !j.speedTestMutex.TryLock() {
+			return types.NetworkInfo{}, ErrProbeRunning
+		}
+		defer j.speedTestMutex.Unlock()
 	}
-	j.intervalMutex.Unlock()
 
-	ping, err := network.RunPing(j.log)
+	ping, pingErr := network.RunPing(j.log)
+	now := time.Now()
+
+	// Traffic is stored even when the ping or speed test fails, so that the
+	// traffic history doesn't have gaps during outages.
+	traffic := j.sampleTraffic(now)
+	err := j.database.InsertInterfaceTraffic(j.ctx, traffic)
 	if err != nil {
-		return errors.Wrap(err, "failed to run network ping")
+		return types.NetworkInfo{}, errors.Wrap(err, "failed to insert interface traffic")
+	}
+
+	if pingErr != nil {
+		return types.NetworkInfo{}, errors.Wrap(pingErr, "failed to run network ping")
+	}
+
+	runSpeedTest, reason := false, ""
+	switch mode {
+	case speedTestScheduled:
+		runSpeedTest, reason = j.speedPolicy.shouldRun(now, ping)
+	case speedTestAlways:
+		runSpeedTest, reason = true, "manual"
 	}
 
 	networkInfo := types.NetworkInfo{
 		PingSuccessful:       ping.Successful,
 		PingHost:             ping.Host,
 		PingHostName:         ping.HostName,
-		Timestamp:            time.Now().UnixMilli(),
+		Timestamp:            now.UnixMilli(),
 		PacketLoss:           float32(ping.PacketLoss),
 		RTTMS:                ping.RTTMS,
 		SpeedTestDescription: optional.Empty[string](),
 		DownloadSpeed:        optional.Empty[float64](),
 		UploadSpeed:          optional.Empty[float64](),
+		SpeedServerID:        optional.Empty[string](),
+		SpeedServerName:      optional.Empty[string](),
+		SpeedServerSponsor:   optional.Empty[string](),
+		SpeedServerDistance:  optional.Empty[float64](),
+		SpeedServerLatencyMS: optional.Empty[int](),
+		SpeedBytesDown:       optional.Empty[int64](),
+		SpeedBytesUp:         optional.Empty[int64](),
+	}
+
+	if runSpeedTest && !manual {
+		if j.speedTestMutex.TryLock() {
+			defer j.speedTestMutex.Unlock()
+		} else {
+			j.log.Info("skipping speed test, another speed test or manual probe is running", "reason", reason)
+			runSpeedTest = false
+		}
+	}
+
+	var speedOptions network.SpeedTestOptions
+	if runSpeedTest {
+		defer func() { j.speedPolicy.completed(time.Now(), reason) }()
+
+		budget := j.config.Speedtest.Budget
+		dataUsage, err := usage.Get(j.ctx, j.database, budget, time.Now())
+		if err != nil {
+			return types.NetworkInfo{}, errors.Wrap(err, "failed to get data usage")
+		}
+
+		if dataUsage.Exceeded {
+			if budget.Action == config.BudgetActionSkip {
+				if mode == speedTestAlways {
+					return types.NetworkInfo{}, ErrDataBudgetReached
+				}
+				j.log.Info("skipping speed test, monthly data budget reached", "used", dataUsage.BytesDownloaded+dataUsage.BytesUploaded, "budget", dataUsage.BudgetBytes)
+				runSpeedTest = false
+			} else {
+				speedOptions.Reduced = true
+			}
+		}
 	}
 
 	if runSpeedTest {
-		speedInfo, err := network.RunSpeedtest(j.ctx)
+		j.log.Info("running speed test", "reason", reason, "reduced", speedOptions.Reduced)
+		speedTestTopic := websocket_client.Topic{Probes: []string{types.ProbeSpeedtest}}
+		speedOptions.Progress = func(progress types.SpeedTestProgress) {
+			j.broadcast(websocket_client.MessageTypeSpeedTestProgress, speedTestTopic, progress)
+		}
+		speedInfo, err := j.speedTester.Run(j.ctx, speedOptions)
+		// Failed tests report the data they used before failing, which still
+		// counts against the budget.
+		usageErr := usage.Add(j.ctx, j.database, j.config.Speedtest.Budget, time.Now(), speedInfo.BytesDownloaded, speedInfo.BytesUploaded)
 		if err != nil {
-			return errors.Wrap(err, "failed to run speed test")
+			if usageErr != nil {
+				j.log.Error("failed to record data usage", "err", usageErr)
+			}
+			j.broadcast(websocket_client.MessageTypeSpeedTestProgress, speedTestTopic, types.SpeedTestProgress{Phase: types.SpeedTestPhaseFailed})
+			return types.NetworkInfo{}, errors.Wrap(err, "failed to run speed test")
+		}
+		j.broadcast(websocket_client.MessageTypeSpeedTestProgress, speedTestTopic, types.SpeedTestProgress{Phase: types.SpeedTestPhaseComplete, Percent: 100})
+
+		if usageErr != nil {
+			return types.NetworkInfo{}, errors.Wrap(usageErr, "failed to record data usage")
 		}
 
 		networkInfo.SpeedTestDescription = optional.New(speedInfo.Description)
 		networkInfo.DownloadSpeed = optional.New(speedInfo.Download)
 		networkInfo.UploadSpeed = optional.New(speedInfo.Upload)
+		networkInfo.SpeedServerID = optional.New(speedInfo.Server.ID)
+		networkInfo.SpeedServerName = optional.New(speedInfo.Server.Name)
+		networkInfo.SpeedServerSponsor = optional.New(speedInfo.Server.Sponsor)
+		networkInfo.SpeedServerDistance = optional.New(speedInfo.Server.Distance)
+		networkInfo.SpeedServerLatencyMS = optional.New(speedInfo.Server.LatencyMS)
+		networkInfo.SpeedBytesDown = optional.New(speedInfo.BytesDownloaded)
+		networkInfo.SpeedBytesUp = optional.New(speedInfo.BytesUploaded)
 	}
 
 	err = j.database.InsertNetworkInfo(j.ctx, &networkInfo)
 	if err != nil {
-		return errors.Wrap(err, "failed to insert network info")
+		return types.NetworkInfo{}, errors.Wrap(err, "failed to insert network info")
+	}
+
+	topic := websocket_client.Topic{Target: networkInfo.PingHost, Probes: []string{types.ProbePing}}
+	if runSpeedTest {
+		topic.Probes = append(topic.Probes, types.ProbeSpeedtest)
+	}
+	j.broadcast(websocket_client.MessageTypeMeasurement, topic, &types.NetworkInfoBatch{
+		Seqs:             []int64{networkInfo.Seq},
+		Timestamps:       []int64{networkInfo.Timestamp},
+		PingValues:       []bool{networkInfo.PingSuccessful},
+		UploadValues:     []optional.Opt[float64]{networkInfo.UploadSpeed},
+		DownloadValues:   []optional.Opt[float64]{networkInfo.DownloadSpeed},
+		TrafficValues:    []optional.Opt[float64]{busiestInterface(traffic)},
+		Targets:          []string{networkInfo.PingHost},
+		RTTValues:        []optional.Opt[int]{rttValue(&networkInfo)},
+		PacketLossValues: []float32{networkInfo.PacketLoss},
+	})
+
+	j.detectAnomalies(&networkInfo)
+	if runSpeedTest {
+		j.checkPlan()
+	}
+
+	return networkInfo, nil
+}
+
+// Checks the measurement against the baselines for its time of week, logging
+// and broadcasting degradations as they open and close. Failures are logged,
+// since the measurement has already been stored.
+func (j *networkInfoJob) detectAnomalies(info *types.NetworkInfo) {
+	incidents, err := j.anomalies.Observe(j.ctx, info, time.Now())
+	if err != nil {
+		j.log.Error("failed to check for anomalies", "err", err)
+	}
+
+	for _, incident := range incidents {
+		if incident.End.Has() {
+			j.log.Info("degradation ended", "incident", incident.ID)
+		} else {
+			j.log.Warn("degradation detected", "incident", incident.ID, "description", incident.Description)
+		}
+		topic := websocket_client.Topic{Probes: []string{types.ProbeSpeedtest}}
+		if incident.Metric == types.MetricRTT {
+			topic = websocket_client.Topic{Target: incident.Target, Probes: []string{types.ProbePing}}
+		}
+		j.broadcast(websocket_client.MessageTypeIncident, topic, types.NewIncidentUpdate(incident))
+	}
+}
+
+// Compares the recent speed tests against the plan, saving, logging and
+// broadcasting an incident when they fall below it or recover. Failures are
+// logged, since the result has already been stored.
+func (j *networkInfoJob) checkPlan() {
+	windowTests := j.config.ISP.Alert.WindowTests
+	if windowTests == 0 || len(j.config.ISP.Plans) == 0 {
+		return
+	}
+
+	// An incident left open by the last run is restored so it can be closed.
+	if !j.planAlertRestored {
+		open, err := j.database.GetOpenIncidents(j.ctx, types.IncidentKindBelowPlan)
+		if err != nil {
+			j.log.Error("failed to get open below plan incidents", "err", err)
+			return
+		}
+		if len(open) > 0 {
+			j.planAlert.Restore(open[len(open)-1])
+		}
+		j.planAlertRestored = true
+	}
+
+	recent, err := j.database.GetRecentSpeedtests(j.ctx, windowTests)
+	if err != nil {
+		j.log.Error("failed to get recent speed tests", "err", err)
+		return
+	}
+
+	incident := j.planAlert.Check(recent)
+	if incident == nil {
+		return
+	}
+	if err := j.database.SaveIncident(j.ctx, incident); err != nil {
+		j.log.Error("failed to save incident", "incident", incident.ID, "err", err)
+	}
+	if incident.End.Has() {
+		j.log.Info("speed tests recovered to the plan", "incident", incident.ID)
+	} else {
+		j.log.Warn("speed tests below the plan", "incident", incident.ID, "description", incident.Description)
 	}
+	j.broadcast(websocket_client.MessageTypeIncident, websocket_client.Topic{Probes: []string{types.ProbeSpeedtest}}, types.NewIncidentUpdate(*incident))
+}
 
-	batch := types.NetworkInfoBatch{
-		Timestamps:     []int64{networkInfo.Timestamp},
-		PingValues:     []bool{networkInfo.PingSuccessful},
-		UploadValues:   []optional.Opt[float64]{networkInfo.UploadSpeed},
-		DownloadValues: []optional.Opt[float64]{networkInfo.DownloadSpeed},
+// Sends a message to all websocket clients. Clients only miss out on live
+// updates if this fails, so errors are logged rather than failing the job.
+func (j *networkInfoJob) broadcast(messageType websocket_client.MessageType, topic websocket_client.Topic, payload any) {
+	if err := j.websocket.Publish(messageType, topic, payload); err != nil {
+		j.log.Error("failed to publish websocket message", "type", messageType, "err", err)
 	}
+}
 
-	batchJson, err := json.Marshal(batch)
+// Returns the traffic on the configured interfaces since the previous job. The
+// counters are not available on every platform, so failures are logged rather
+// than failing the job.
+func (j *networkInfoJob) sampleTraffic(now time.Time) []types.InterfaceTraffic {
+	traffic, err := j.trafficCollector.Sample(now)
 	if err != nil {
-		return errors.Wrap(err, "failed to marshal network ")
+		j.log.Info("failed to sample interface traffic", "err", err)
+		return []types.InterfaceTraffic{}
+	}
+
+	return netdev.Filter(traffic, j.config.Traffic.Interfaces)
+}
+
+// Returns the combined receive and transmit rate of the busiest interface.
+func busiestInterface(traffic []types.InterfaceTraffic) optional.Opt[float64] {
+	if len(traffic) == 0 {
+		return optional.Empty[float64]()
 	}
-	j.websocket.Broadcast(batchJson)
 
-	return nil
+	busiest := 0.0
+	for _, t := range traffic {
+		busiest = max(busiest, t.RxMbps+t.TxMbps)
+	}
+	return optional.New(busiest)
+}
+
+// Returns the round trip time of a successful ping, otherwise empty.
+func rttValue(info *types.NetworkInfo) optional.Opt[int] {
+	if !info.PingSuccessful {
+		return optional.Empty[int]()
+	}
+	return optional.New(info.RTTMS)
 }
@@ -0,0 +1,160 @@
+package jobs
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/types"
+	websocket_client "github.com/SkylerRankin/network_monitor/internal/websocket"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	ProbeRunning   = "running"
+	ProbeSucceeded = "succeeded"
+	ProbeFailed    = "failed"
+
+	// How long finished runs are kept for polling.
+	probeRunRetention = 1 * time.Hour
+)
+
+var (
+	ErrUnknownProbe    = errors.New("unknown probe")
+	ErrUnknownProbeRun = errors.New("unknown probe run")
+)
+
+// ProbeRun tracks a probe started on demand.
+type ProbeRun struct {
+	ID        string `json:"id"`
+	Probe     string `json:"probe"`
+	Status    string `json:"status"`
+	StartTime int64  `json:"startTime"`
+	EndTime   int64  `json:"endTime,omitempty"`
+	// Set when the run succeeds.
+	Result *types.NetworkInfo `json:"result,omitempty"`
+	// Set when the run fails.
+	Error string `json:"error,omitempty"`
+	err   error
+	done  chan struct{}
+}
+
+// Tracks on demand probe runs so they can be polled after they are started.
+type probeRunner struct {
+	mutex      sync.Mutex
+	log        *slog.Logger
+	networkJob NetworkJob
+	websocket  websocket_client.WebsocketClient
+	runs       map[string]*ProbeRun
+}
+
+func newProbeRunner(log *slog.Logger, networkJob NetworkJob, websocket websocket_client.WebsocketClient) *probeRunner {
+	return &probeRunner{
+		log:        log,
+		networkJob: networkJob,
+		websocket:  websocket,
+		runs:       make(map[string]*ProbeRun),
+	}
+}
+
+// Starts the named probe in the background and returns its run ID.
+func (p *probeRunner) start(name string) (string, error) {
+	var probe func() (types.NetworkInfo, error)
+	switch name {
+	case types.ProbePing:
+		probe = p.networkJob.RunPing
+	case types.ProbeSpeedtest:
+		probe = p.networkJob.RunSpeedTest
+	default:
+		return "", ErrUnknownProbe
+	}
+
+	run := &ProbeRun{
+		ID:        uuid.NewString(),
+		Probe:     name,
+		Status:    ProbeRunning,
+		StartTime: time.Now().UnixMilli(),
+		done:      make(chan struct{}),
+	}
+
+	// Statuses are published after releasing the lock, so a slow websocket
+	// can't hold up polling.
+	p.mutex.Lock()
+	p.removeExpired()
+	p.runs[run.ID] = run
+	started := *run
+	p.mutex.Unlock()
+	p.publish(started)
+
+	go func() {
+		result, err := probe()
+
+		p.mutex.Lock()
+		run.EndTime = time.Now().UnixMilli()
+		if err != nil {
+			run.Status = ProbeFailed
+			run.Error = err.Error()
+			run.err = err
+		} else {
+			run.Status = ProbeSucceeded
+			run.Result = &result
+		}
+		finished := *run
+		close(run.done)
+		p.mutex.Unlock()
+		p.publish(finished)
+	}()
+
+	return run.ID, nil
+}
+
+// Returns a copy of the run, so it can be read without holding the lock.
+func (p *probeRunner) get(id string) (ProbeRun, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	run, ok := p.runs[id]
+	if !ok {
+		return ProbeRun{}, ErrUnknownProbeRun
+	}
+	return *run, nil
+}
+
+// Waits for the run to finish, or for the context to be done, and returns the
+// run along with the probe's error if it failed.
+func (p *probeRunner) wait(ctx context.Context, id string) (ProbeRun, error) {
+	run, err := p.get(id)
+	if err != nil {
+		return ProbeRun{}, err
+	}
+
+	select {
+	case <-run.done:
+	case <-ctx.Done():
+		return run, ctx.Err()
+	}
+
+	run, err = p.get(id)
+	if err != nil {
+		return ProbeRun{}, err
+	}
+	return run, run.err
+}
+
+// Sends the run's status to websocket clients.
+func (p *probeRunner) publish(run ProbeRun) {
+	if err := p.websocket.Publish(websocket_client.MessageTypeProbeStatus, websocket_client.Topic{Probes: []string{run.Probe}}, &run); err != nil {
+		p.log.Error("failed to publish probe status", "id", run.ID, "err", err)
+	}
+}
+
+func (p *probeRunner) removeExpired() {
+	cutoff := time.Now().Add(-probeRunRetention).UnixMilli()
+	for id, run := range p.runs {
+		if run.Status != ProbeRunning && run.EndTime < cutoff {
+			delete(p.runs, id)
+		}
+	}
+}
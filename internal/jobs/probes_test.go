@@ -0,0 +1,180 @@
+package jobs
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/types"
+	websocket_client "github.com/SkylerRankin/network_monitor/internal/websocket"
+	"github.com/pkg/errors"
+)
+
+// Network job whose manual runs finish when the test sends their result.
+type fakeNetworkJob struct {
+	results chan error
+}
+
+func (j *fakeNetworkJob) Run() error {
+	return nil
+}
+
+func (j *fakeNetworkJob) RunPing() (types.NetworkInfo, error) {
+	err := <-j.results
+	return types.NetworkInfo{PingHost: "example.com", PingSuccessful: err == nil}, err
+}
+
+func (j *fakeNetworkJob) RunSpeedTest() (types.NetworkInfo, error) {
+	return j.RunPing()
+}
+
+// Records published probe statuses. Calling any other method panics on the nil
+// embedded interface.
+type fakeWebsocket struct {
+	websocket_client.WebsocketClient
+	mutex    sync.Mutex
+	statuses []string
+}
+
+func (w *fakeWebsocket) Publish(messageType websocket_client.MessageType, topic websocket_client.Topic, payload any) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if messageType == websocket_client.MessageTypeProbeStatus {
+		w.statuses = append(w.statuses, payload.(*ProbeRun).Status)
+	}
+	return nil
+}
+
+func (w *fakeWebsocket) published() []string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return append([]string{}, w.statuses...)
+}
+
+func newTestProbeRunner() (*probeRunner, *fakeNetworkJob, *fakeWebsocket) {
+	job := &fakeNetworkJob{results: make(chan error, 1)}
+	websocket := &fakeWebsocket{}
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return newProbeRunner(log, job, websocket), job, websocket
+}
+
+func TestProbeRunnerSucceeded(t *testing.T) {
+	runner, job, websocket := newTestProbeRunner()
+
+	id, err := runner.start(types.ProbePing)
+	if err != nil {
+		t.Fatalf("failed to start probe: %v", err)
+	}
+
+	run, err := runner.get(id)
+	if err != nil || run.Status != ProbeRunning || run.Probe != types.ProbePing || run.StartTime == 0 {
+		t.Fatalf("expected running ping, got %+v, %v", run, err)
+	}
+
+	job.results <- nil
+	run, err = runner.wait(context.Background(), id)
+	if err != nil {
+		t.Fatalf("expected run to succeed, got %v", err)
+	}
+	if run.Status != ProbeSucceeded || run.Result == nil || run.Result.PingHost != "example.com" || run.EndTime == 0 || run.Error != "" {
+		t.Errorf("unexpected run %+v", run)
+	}
+
+	if statuses := websocket.published(); len(statuses) != 2 || statuses[0] != ProbeRunning || statuses[1] != ProbeSucceeded {
+		t.Errorf("expected running and succeeded statuses, got %v", statuses)
+	}
+}
+
+func TestProbeRunnerFailed(t *testing.T) {
+	runner, job, websocket := newTestProbeRunner()
+
+	id, err := runner.start(types.ProbeSpeedtest)
+	if err != nil {
+		t.Fatalf("failed to start probe: %v", err)
+	}
+
+	job.results <- ErrProbeRunning
+	run, err := runner.wait(context.Background(), id)
+	if !errors.Is(err, ErrProbeRunning) {
+		t.Errorf("expected probe running error, got %v", err)
+	}
+	if run.Status != ProbeFailed || run.Error != ErrProbeRunning.Error() || run.Result != nil {
+		t.Errorf("unexpected run %+v", run)
+	}
+
+	if statuses := websocket.published(); len(statuses) != 2 || statuses[1] != ProbeFailed {
+		t.Errorf("expected failed status, got %v", statuses)
+	}
+}
+
+func TestProbeRunnerWaitCancelled(t *testing.T) {
+	runner, job, _ := newTestProbeRunner()
+
+	id, err := runner.start(types.ProbePing)
+	if err != nil {
+		t.Fatalf("failed to start probe: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	run, err := runner.wait(ctx, id)
+	if !errors.Is(err, context.DeadlineExceeded) || run.Status != ProbeRunning {
+		t.Errorf("expected running run with deadline error, got %+v, %v", run, err)
+	}
+
+	// The run keeps going after the waiter gives up.
+	job.results <- nil
+	if run, err := runner.wait(context.Background(), id); err != nil || run.Status != ProbeSucceeded {
+		t.Errorf("expected run to succeed, got %+v, %v", run, err)
+	}
+}
+
+func TestProbeRunnerUnknown(t *testing.T) {
+	runner, _, websocket := newTestProbeRunner()
+
+	if _, err := runner.start("traceroute"); !errors.Is(err, ErrUnknownProbe) {
+		t.Errorf("expected unknown probe error, got %v", err)
+	}
+	if _, err := runner.get("missing"); !errors.Is(err, ErrUnknownProbeRun) {
+		t.Errorf("expected unknown run error, got %v", err)
+	}
+	if _, err := runner.wait(context.Background(), "missing"); !errors.Is(err, ErrUnknownProbeRun) {
+		t.Errorf("expected unknown run error, got %v", err)
+	}
+	if statuses := websocket.published(); len(statuses) != 0 {
+		t.Errorf("expected nothing published, got %v", statuses)
+	}
+}
+
+func TestProbeRunnerRemovesExpiredRuns(t *testing.T) {
+	runner, job, _ := newTestProbeRunner()
+
+	id, err := runner.start(types.ProbePing)
+	if err != nil {
+		t.Fatalf("failed to start probe: %v", err)
+	}
+	job.results <- nil
+	if _, err := runner.wait(context.Background(), id); err != nil {
+		t.Fatalf("expected run to succeed, got %v", err)
+	}
+
+	runner.mutex.Lock()
+	runner.runs[id].EndTime = time.Now().Add(-probeRunRetention - time.Minute).UnixMilli()
+	runner.mutex.Unlock()
+
+	// Running runs are kept however old they are.
+	running, err := runner.start(types.ProbePing)
+	if err != nil {
+		t.Fatalf("failed to start probe: %v", err)
+	}
+	if _, err := runner.get(id); !errors.Is(err, ErrUnknownProbeRun) {
+		t.Errorf("expected expired run to be removed, got %v", err)
+	}
+	if _, err := runner.get(running); err != nil {
+		t.Errorf("expected new run to be kept, got %v", err)
+	}
+	job.results <- nil
+}
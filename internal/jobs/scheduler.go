@@ -2,8 +2,11 @@ package jobs
 
 import (
 	"context"
+	"encoding/json"
 	"log/slog"
 
+	"github.com/SkylerRankin/network_monitor/internal/auth"
+	websocket_client "github.com/SkylerRankin/network_monitor/internal/websocket"
 	"github.com/go-co-op/gocron/v2"
 	"github.com/pkg/errors"
 )
@@ -11,6 +14,13 @@ import (
 type Scheduler interface {
 	Start()
 	Shutdown() error
+	// RunProbe starts the named probe immediately and returns a run ID that
+	// can be polled with GetProbeRun.
+	RunProbe(name string) (string, error)
+	GetProbeRun(id string) (ProbeRun, error)
+	// WaitProbeRun blocks until the run finishes or the context is done. If the
+	// probe failed, its error is returned with the run.
+	WaitProbeRun(ctx context.Context, id string) (ProbeRun, error)
 }
 
 type SchedulerJob interface {
@@ -21,9 +31,10 @@ var _ Scheduler = &scheduler{}
 
 type scheduler struct {
 	gocronScheduler gocron.Scheduler
+	probes          *probeRunner
 }
 
-func NewScheduler(ctx context.Context, log *slog.Logger, networkJob SchedulerJob) (Scheduler, error) {
+func NewScheduler(ctx context.Context, log *slog.Logger, networkJob NetworkJob, websocket websocket_client.WebsocketClient) (Scheduler, error) {
 	s, err := gocron.NewScheduler()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create gocron scheduler")
@@ -38,8 +49,29 @@ func NewScheduler(ctx context.Context, log *slog.Logger, networkJob SchedulerJob
 		return nil, errors.Wrap(err, "failed to create job")
 	}
 
+	probes := newProbeRunner(log, networkJob, websocket)
+	websocket.RegisterCommand(websocket_client.MessageTypeRunProbe, func(ctx context.Context, payload json.RawMessage) (any, error) {
+		if err := auth.RequireAdmin(ctx); err != nil {
+			return nil, err
+		}
+
+		var request struct {
+			Probe string `json:"probe"`
+		}
+		if err := json.Unmarshal(payload, &request); err != nil {
+			return nil, errors.Wrap(err, "invalid run probe request")
+		}
+
+		id, err := probes.start(request.Probe)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"id": id}, nil
+	})
+
 	return &scheduler{
 		gocronScheduler: s,
+		probes:          probes,
 	}, nil
 }
 
@@ -53,3 +85,15 @@ func (s scheduler) Shutdown() error {
 	}
 	return nil
 }
+
+func (s scheduler) RunProbe(name string) (string, error) {
+	return s.probes.start(name)
+}
+
+func (s scheduler) GetProbeRun(id string) (ProbeRun, error) {
+	return s.probes.get(id)
+}
+
+func (s scheduler) WaitProbeRun(ctx context.Context, id string) (ProbeRun, error) {
+	return s.probes.wait(ctx, id)
+}
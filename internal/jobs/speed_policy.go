@@ -0,0 +1,259 @@
+package jobs
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	"github.com/SkylerRankin/network_monitor/internal/netdev"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+)
+
+const (
+	// Number of consecutive failed pings, across all hosts, treated as an outage.
+	outageFailureCount = 2
+	// Minimum number of baseline pings for a host before deviations are checked.
+	minBaselineSamples = 10
+
+	reasonRTTDeviation  = "rtt deviation"
+	reasonLossDeviation = "loss deviation"
+)
+
+// Decides which network jobs also run a speed test.
+type speedTestPolicy interface {
+	// Called once per job with the ping result, returns whether to run a speed
+	// test and the reason for it.
+	shouldRun(now time.Time, ping types.PingResult) (bool, string)
+	// Called after the speed test for a job has been handled, whether it ran or
+	// was skipped, with the reason it was run for. Also called after manual
+	// speed tests.
+	completed(now time.Time, reason string)
+}
+
+// Samples interface traffic, replaced in tests.
+type trafficSampler interface {
+	Sample(now time.Time) ([]types.InterfaceTraffic, error)
+	Reset()
+}
+
+func newSpeedTestPolicy(log *slog.Logger, c config.Speedtest) speedTestPolicy {
+	if c.Schedule == config.ScheduleAdaptive {
+		return &adaptiveSpeedPolicy{
+			log:       log,
+			config:    c.Adaptive,
+			history:   make(map[string][]types.PingResult),
+			collector: netdev.NewCollector(),
+		}
+	}
+
+	return &fixedSpeedPolicy{
+		speedInterval:        speedInterval,
+		currentSpeedInterval: speedInterval,
+	}
+}
+
+// Runs a speed test on every speedInterval-th job.
+type fixedSpeedPolicy struct {
+	speedInterval        int
+	currentSpeedInterval int
+	// Multiple running jobs may attempt to update the speed interval. Lock to
+	// prevent repeated intervals.
+	intervalMutex sync.Mutex
+}
+
+func (p *fixedSpeedPolicy) shouldRun(now time.Time, ping types.PingResult) (bool, string) {
+	p.intervalMutex.Lock()
+	defer p.intervalMutex.Unlock()
+
+	runSpeedTest := p.currentSpeedInterval == 0
+	if p.currentSpeedInterval == 0 {
+		p.currentSpeedInterval = p.speedInterval
+	} else {
+		p.currentSpeedInterval -= 1
+	}
+
+	return runSpeedTest, "interval"
+}
+
+func (p *fixedSpeedPolicy) completed(now time.Time, reason string) {}
+
+// Runs a speed test when something about the network changes, rather than on a
+// fixed interval. See config.AdaptiveSchedule.
+//
+// Consecutive tests triggered by RTT or loss deviations back off, doubling the
+// minimum interval each time up to the maximum interval, so that a lasting
+// change in the network isn't measured over and over. Any other test resets
+// the backoff.
+type adaptiveSpeedPolicy struct {
+	mutex  sync.Mutex
+	log    *slog.Logger
+	config config.AdaptiveSchedule
+	// Recent pings for each host, oldest first.
+	history            map[string][]types.PingResult
+	consecutiveFailure int
+	outageRecovered    bool
+	lastSpeedTest      time.Time
+	// Number of consecutive tests triggered by deviations.
+	backoff   int
+	collector trafficSampler
+}
+
+func (p *adaptiveSpeedPolicy) shouldRun(now time.Time, ping types.PingResult) (bool, string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.observePing(ping)
+	trafficMbps := p.trafficMbps(now)
+
+	reason := p.trigger(now, ping.Host)
+	if reason == "" {
+		return false, ""
+	}
+
+	// Triggers stay pending until the link is quiet enough to measure.
+	if p.config.SaturationMbps > 0 && trafficMbps > p.config.SaturationMbps {
+		p.log.Info("holding back speed test, interface is busy", "reason", reason, "traffic_mbps", trafficMbps)
+		return false, ""
+	}
+
+	return true, reason
+}
+
+func (p *adaptiveSpeedPolicy) completed(now time.Time, reason string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.lastSpeedTest = now
+	p.outageRecovered = false
+	if isDeviation(reason) {
+		p.backoff += 1
+	} else {
+		p.backoff = 0
+	}
+
+	// Restart the traffic measurement so the speed test's own traffic isn't
+	// counted as user traffic.
+	p.collector.Reset()
+	p.trafficMbps(now)
+}
+
+func (p *adaptiveSpeedPolicy) observePing(ping types.PingResult) {
+	if ping.Successful {
+		if p.consecutiveFailure >= outageFailureCount {
+			p.outageRecovered = true
+		}
+		p.consecutiveFailure = 0
+	} else {
+		p.consecutiveFailure += 1
+	}
+
+	history := append(p.history[ping.Host], ping)
+	if limit := p.config.BaselineSamples + p.config.RecentSamples; len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	p.history[ping.Host] = history
+}
+
+// Returns the reason a speed test should run, or an empty string if it
+// shouldn't.
+func (p *adaptiveSpeedPolicy) trigger(now time.Time, host string) string {
+	sinceLast := now.Sub(p.lastSpeedTest)
+	if sinceLast < p.minInterval() {
+		return ""
+	}
+
+	if p.outageRecovered {
+		return "outage recovered"
+	}
+
+	if reason := p.deviation(host); reason != "" {
+		return reason
+	}
+
+	if sinceLast >= time.Duration(p.config.MaxIntervalMinutes)*time.Minute {
+		return "max interval"
+	}
+
+	return ""
+}
+
+// Returns the minimum time between triggered tests, doubled for each
+// consecutive test triggered by a deviation and clamped to the maximum
+// interval.
+func (p *adaptiveSpeedPolicy) minInterval() time.Duration {
+	interval := time.Duration(p.config.MinIntervalMinutes) * time.Minute
+	maxInterval := time.Duration(p.config.MaxIntervalMinutes) * time.Minute
+	for i := 0; i < p.backoff && interval < maxInterval; i++ {
+		interval *= 2
+	}
+	return min(interval, maxInterval)
+}
+
+func isDeviation(reason string) bool {
+	return reason == reasonRTTDeviation || reason == reasonLossDeviation
+}
+
+// Compares the most recent pings for a host against the older ones.
+func (p *adaptiveSpeedPolicy) deviation(host string) string {
+	history := p.history[host]
+	if len(history) < p.config.RecentSamples+minBaselineSamples {
+		return ""
+	}
+
+	split := len(history) - p.config.RecentSamples
+	baselineRTT, baselineLoss := averagePing(history[:split])
+	recentRTT, recentLoss := averagePing(history[split:])
+
+	if baselineRTT > 0 && recentRTT > baselineRTT*p.config.RTTDeviationFactor {
+		return reasonRTTDeviation
+	}
+
+	if p.config.LossDeviation > 0 && recentLoss-baselineLoss > p.config.LossDeviation {
+		return reasonLossDeviation
+	}
+
+	return ""
+}
+
+// Returns the average RTT of successful pings, and the average packet loss
+// as a fraction from 0 to 1.
+func averagePing(pings []types.PingResult) (float64, float64) {
+	var rttTotal, lossTotal float64
+	successful := 0
+	for _, ping := range pings {
+		if ping.Successful {
+			rttTotal += float64(ping.RTTMS)
+			successful += 1
+		}
+		lossTotal += ping.PacketLoss / 100
+	}
+
+	rtt := 0.0
+	if successful > 0 {
+		rtt = rttTotal / float64(successful)
+	}
+	return rtt, lossTotal / float64(len(pings))
+}
+
+// Returns the traffic rate on the watched interface since the last call, in
+// Mbps. Returns 0 if the counters can't be read.
+func (p *adaptiveSpeedPolicy) trafficMbps(now time.Time) float64 {
+	traffic, err := p.collector.Sample(now)
+	if err != nil {
+		p.log.Info("failed to read interface counters", "err", err)
+		return 0
+	}
+
+	var interfaces []string
+	if p.config.Interface != "" {
+		interfaces = []string{p.config.Interface}
+	}
+
+	rate := 0.0
+	for _, t := range netdev.Filter(traffic, interfaces) {
+		rate = max(rate, t.RxMbps+t.TxMbps)
+	}
+
+	return rate
+}
@@ -0,0 +1,258 @@
+package jobs
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/pkg/errors"
+)
+
+// Returns the traffic set by the test on eth0, with heavy loopback traffic that
+// should always be ignored.
+type fakeTrafficSampler struct {
+	mbps   float64
+	err    error
+	resets int
+}
+
+func (s *fakeTrafficSampler) Sample(now time.Time) ([]types.InterfaceTraffic, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return []types.InterfaceTraffic{
+		{Interface: "eth0", RxMbps: s.mbps * 0.75, TxMbps: s.mbps * 0.25},
+		{Interface: "lo", RxMbps: 1000, TxMbps: 1000},
+	}, nil
+}
+
+func (s *fakeTrafficSampler) Reset() {
+	s.resets += 1
+}
+
+type policyStep struct {
+	// Time of the job, in minutes since the start of the test.
+	minutes int
+	// Ping RTT, 0 for a failed ping.
+	rtt     int
+	loss    float64
+	traffic float64
+	run     bool
+	reason  string
+	// Runs a manual speed test after the job.
+	manual bool
+}
+
+func TestAdaptiveSpeedPolicy(t *testing.T) {
+	defaultConfig := config.AdaptiveSchedule{
+		MinIntervalMinutes: 30,
+		MaxIntervalMinutes: 360,
+		BaselineSamples:    20,
+		RecentSamples:      3,
+		RTTDeviationFactor: 2,
+		LossDeviation:      0.1,
+		SaturationMbps:     20,
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*config.AdaptiveSchedule)
+		// Number of normal pings seen before the start, with the last speed
+		// test at the start. Without them, no speed test has run yet.
+		baseline   int
+		trafficErr error
+		steps      []policyStep
+	}{
+		{
+			name:  "first job runs a test",
+			steps: []policyStep{{minutes: 0, rtt: 10, run: true, reason: "max interval"}},
+		},
+		{
+			name:     "max interval",
+			baseline: 20,
+			steps: []policyStep{
+				{minutes: 359, rtt: 10},
+				{minutes: 360, rtt: 10, run: true, reason: "max interval"},
+				{minutes: 361, rtt: 10},
+			},
+		},
+		{
+			name:     "outage recovery waits for the min interval",
+			baseline: 20,
+			steps: []policyStep{
+				{minutes: 1, rtt: 0},
+				{minutes: 2, rtt: 0},
+				{minutes: 3, rtt: 10},
+				{minutes: 29, rtt: 10},
+				{minutes: 30, rtt: 10, run: true, reason: "outage recovered"},
+				{minutes: 61, rtt: 10},
+			},
+		},
+		{
+			name: "single failed ping isn't an outage",
+			// Failed pings would otherwise trigger a loss deviation.
+			modify:   func(c *config.AdaptiveSchedule) { c.LossDeviation = 0 },
+			baseline: 20,
+			steps: []policyStep{
+				{minutes: 30, rtt: 0},
+				{minutes: 31, rtt: 10},
+			},
+		},
+		{
+			name:     "manual tests restart the interval",
+			baseline: 20,
+			steps: []policyStep{
+				{minutes: 100, rtt: 10, manual: true},
+				{minutes: 459, rtt: 10},
+				{minutes: 460, rtt: 10, run: true, reason: "max interval"},
+			},
+		},
+		{
+			name:     "saturated link holds back tests",
+			baseline: 20,
+			steps: []policyStep{
+				{minutes: 360, rtt: 10, traffic: 50},
+				{minutes: 361, rtt: 10, traffic: 21},
+				{minutes: 362, rtt: 10, traffic: 19, run: true, reason: "max interval"},
+			},
+		},
+		{
+			name:     "saturation check disabled",
+			modify:   func(c *config.AdaptiveSchedule) { c.SaturationMbps = 0 },
+			baseline: 20,
+			steps: []policyStep{
+				{minutes: 360, rtt: 10, traffic: 500, run: true, reason: "max interval"},
+			},
+		},
+		{
+			name:       "unreadable counters don't hold back tests",
+			baseline:   20,
+			trafficErr: errors.New("no such file"),
+			steps: []policyStep{
+				{minutes: 360, rtt: 10, traffic: 500, run: true, reason: "max interval"},
+			},
+		},
+		{
+			name:     "loss deviation",
+			baseline: 20,
+			steps: []policyStep{
+				{minutes: 29, rtt: 10, loss: 50},
+				{minutes: 30, rtt: 10, loss: 50, run: true, reason: "loss deviation"},
+			},
+		},
+		{
+			name:     "deviations back off up to the max interval",
+			baseline: 20,
+			steps: []policyStep{
+				{minutes: 30, rtt: 100, run: true, reason: "rtt deviation"},
+				{minutes: 89, rtt: 100},
+				{minutes: 90, rtt: 100, run: true, reason: "rtt deviation"},
+				{minutes: 209, rtt: 100},
+				{minutes: 210, rtt: 100, run: true, reason: "rtt deviation"},
+				{minutes: 449, rtt: 100},
+				{minutes: 450, rtt: 100, run: true, reason: "rtt deviation"},
+				// Doubling again would be 480 minutes.
+				{minutes: 809, rtt: 100},
+				{minutes: 810, rtt: 100, run: true, reason: "rtt deviation"},
+			},
+		},
+		{
+			name:     "other tests reset the backoff",
+			baseline: 20,
+			steps: []policyStep{
+				{minutes: 30, rtt: 100, run: true, reason: "rtt deviation"},
+				{minutes: 31, rtt: 100, manual: true},
+				{minutes: 60, rtt: 100},
+				{minutes: 61, rtt: 100, run: true, reason: "rtt deviation"},
+			},
+		},
+		{
+			name:     "min interval clamped to the max interval",
+			modify:   func(c *config.AdaptiveSchedule) { c.MinIntervalMinutes, c.MaxIntervalMinutes = 120, 60 },
+			baseline: 20,
+			steps: []policyStep{
+				{minutes: 59, rtt: 100},
+				{minutes: 60, rtt: 100, run: true, reason: "rtt deviation"},
+				{minutes: 119, rtt: 100},
+				{minutes: 120, rtt: 100, run: true, reason: "rtt deviation"},
+			},
+		},
+		{
+			name:     "no min interval",
+			modify:   func(c *config.AdaptiveSchedule) { c.MinIntervalMinutes, c.LossDeviation = 0, 0 },
+			baseline: 20,
+			steps: []policyStep{
+				{minutes: 1, rtt: 0},
+				{minutes: 2, rtt: 0},
+				{minutes: 3, rtt: 10, run: true, reason: "outage recovered"},
+			},
+		},
+	}
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := defaultConfig
+			if test.modify != nil {
+				test.modify(&c)
+			}
+			sampler := &fakeTrafficSampler{err: test.trafficErr}
+			policy := &adaptiveSpeedPolicy{
+				log:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+				config:    c,
+				history:   make(map[string][]types.PingResult),
+				collector: sampler,
+			}
+			if test.baseline > 0 {
+				for range test.baseline {
+					policy.observePing(types.PingResult{Host: "example.com", Successful: true, RTTMS: 10})
+				}
+				policy.lastSpeedTest = start
+			}
+
+			for _, step := range test.steps {
+				now := start.Add(time.Duration(step.minutes) * time.Minute)
+				sampler.mbps = step.traffic
+
+				ping := types.PingResult{Host: "example.com", Successful: step.rtt > 0, RTTMS: step.rtt, PacketLoss: step.loss}
+				if step.rtt == 0 {
+					ping.PacketLoss = 100
+				}
+				run, reason := policy.shouldRun(now, ping)
+				if run != step.run || reason != step.reason {
+					t.Fatalf("minute %d: expected %t %q, got %t %q", step.minutes, step.run, step.reason, run, reason)
+				}
+				if step.manual {
+					run, reason = true, "manual"
+				}
+				if run {
+					resets := sampler.resets
+					policy.completed(now, reason)
+					if sampler.resets != resets+1 {
+						t.Errorf("minute %d: expected traffic measurement to restart after the test", step.minutes)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFixedSpeedPolicy(t *testing.T) {
+	policy := &fixedSpeedPolicy{speedInterval: 2, currentSpeedInterval: 2}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	var runs []bool
+	for range 6 {
+		run, _ := policy.shouldRun(now, types.PingResult{})
+		runs = append(runs, run)
+	}
+	expected := []bool{false, false, true, false, false, true}
+	for i := range expected {
+		if runs[i] != expected[i] {
+			t.Fatalf("expected runs %v, got %v", expected, runs)
+		}
+	}
+}
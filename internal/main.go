@@ -3,16 +3,19 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"log/slog"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"syscall"
 
+	"github.com/SkylerRankin/network_monitor/internal/config"
 	"github.com/SkylerRankin/network_monitor/internal/constants"
 	"github.com/SkylerRankin/network_monitor/internal/database"
 	"github.com/SkylerRankin/network_monitor/internal/jobs"
 	"github.com/SkylerRankin/network_monitor/internal/server"
+	"github.com/SkylerRankin/network_monitor/internal/types"
 	websocket_client "github.com/SkylerRankin/network_monitor/internal/websocket"
 	_ "modernc.org/sqlite"
 )
@@ -21,6 +24,18 @@ func main() {
 	log := slog.New(slog.NewTextHandler(os.Stdout, nil))
 	ctx := context.Background()
 
+	if len(os.Args) >= 2 && os.Args[1] == "report" {
+		// The report goes to stdout, so logs go to stderr.
+		log = slog.New(slog.NewTextHandler(os.Stderr, nil))
+		if err := runReport(ctx, log, os.Args[2:]); err != nil {
+			if !errors.Is(err, flag.ErrHelp) {
+				log.Error("failed to write report", "err", err)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
 	if len(os.Args) != 2 {
 		log.Error("incorrect arguments, expected 2", "args", len(os.Args))
 		return
@@ -37,27 +52,39 @@ func main() {
 		return
 	}
 
+	config, err := config.Load(assetsPath)
+	if err != nil {
+		log.Error("failed to load config", "path", assetsPath, "err", err)
+		return
+	}
+
 	database, err := database.NewDatabase(ctx, assetsPath)
 	if err != nil {
 		log.Error("failed to create database", "path", assetsPath)
 		return
 	}
 
-	websocketClient := websocket_client.NewWebsocketClient(log)
+	websocketClient := websocket_client.NewWebsocketClient(log, types.ServerHello{
+		Commit:            constants.Commit,
+		IntervalSeconds:   int(jobs.NetworkJobInterval.Seconds()),
+		SpeedtestBackend:  config.Speedtest.Backend,
+		SpeedtestSchedule: config.Speedtest.Schedule,
+		DataBudgetMB:      config.Speedtest.Budget.MonthlyMB,
+	})
 
-	networkInfoJob, err := jobs.NewNetworkInfoJob(ctx, log, database, websocketClient)
+	networkInfoJob, err := jobs.NewNetworkInfoJob(ctx, log, config, database, websocketClient)
 	if err != nil {
 		log.Error("failed to create network info job", "err", err)
 		return
 	}
 
-	scheduler, err := jobs.NewScheduler(ctx, log, networkInfoJob)
+	scheduler, err := jobs.NewScheduler(ctx, log, networkInfoJob, websocketClient)
 	if err != nil {
 		log.Error("failed to create job scheduler", "err", err)
 		return
 	}
 
-	server := server.NewServer(ctx, log, assetsPath, database, websocketClient)
+	server := server.NewServer(ctx, log, assetsPath, config, database, scheduler, websocketClient)
 
 	log.Info("starting network monitor", "assets_path", assetsPath, "commit", constants.Commit)
 
@@ -74,6 +101,9 @@ func main() {
 	websocketClient.Shutdown()
 	scheduler.Shutdown()
 	server.Shutdown()
+	if err := database.Close(); err != nil {
+		log.Error("failed to close database", "err", err)
+	}
 
 	log.Info("exiting network monitor")
 }
@@ -0,0 +1,96 @@
+package netdev
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/constants"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+)
+
+// Collector samples interface counters and computes the traffic between
+// consecutive samples.
+type Collector struct {
+	mutex sync.Mutex
+	// Reads the current counters, replaced in tests.
+	read         func() (map[string]Counters, error)
+	previous     map[string]Counters
+	previousTime time.Time
+}
+
+func NewCollector() *Collector {
+	return &Collector{read: Read}
+}
+
+// Sample reads the counters and returns the traffic on each interface since the
+// previous sample. The first sample, and the first after a reset, returns no
+// traffic.
+func (c *Collector) Sample(now time.Time) ([]types.InterfaceTraffic, error) {
+	counters, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	previous, previousTime := c.previous, c.previousTime
+	c.previous, c.previousTime = counters, now
+	if previous == nil {
+		return []types.InterfaceTraffic{}, nil
+	}
+
+	return Traffic(previous, counters, now.Sub(previousTime), now.UnixMilli()), nil
+}
+
+// Reset discards the previous sample, so the next sample starts a new interval.
+func (c *Collector) Reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.previous = nil
+}
+
+// Traffic computes the rates for each interface between two sets of counters,
+// sorted by interface name. Interfaces missing from either set, or whose
+// counters went backwards from being recreated, are skipped.
+func Traffic(previous, current map[string]Counters, elapsed time.Duration, timestamp int64) []types.InterfaceTraffic {
+	traffic := make([]types.InterfaceTraffic, 0, len(current))
+	seconds := elapsed.Seconds()
+	if seconds <= 0 {
+		return traffic
+	}
+
+	for name, c := range current {
+		p, ok := previous[name]
+		if !ok || c.RxBytes < p.RxBytes || c.TxBytes < p.TxBytes || c.RxPackets < p.RxPackets || c.TxPackets < p.TxPackets {
+			continue
+		}
+
+		traffic = append(traffic, types.InterfaceTraffic{
+			Timestamp:          timestamp,
+			Interface:          name,
+			RxMbps:             float64(c.RxBytes-p.RxBytes) / seconds * constants.BytesToMbps,
+			TxMbps:             float64(c.TxBytes-p.TxBytes) / seconds * constants.BytesToMbps,
+			RxPacketsPerSecond: float64(c.RxPackets-p.RxPackets) / seconds,
+			TxPacketsPerSecond: float64(c.TxPackets-p.TxPackets) / seconds,
+			RxErrors:           delta(p.RxErrors, c.RxErrors),
+			TxErrors:           delta(p.TxErrors, c.TxErrors),
+			RxDrops:            delta(p.RxDrops, c.RxDrops),
+			TxDrops:            delta(p.TxDrops, c.TxDrops),
+		})
+	}
+
+	sort.Slice(traffic, func(i, j int) bool {
+		return traffic[i].Interface < traffic[j].Interface
+	})
+
+	return traffic
+}
+
+func delta(previous, current uint64) int64 {
+	if current < previous {
+		return 0
+	}
+	return int64(current - previous)
+}
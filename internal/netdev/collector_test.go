@@ -0,0 +1,108 @@
+package netdev
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/pkg/errors"
+)
+
+func mustParse(t *testing.T, input string) map[string]Counters {
+	t.Helper()
+	counters, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	return counters
+}
+
+func TestTraffic(t *testing.T) {
+	previous, current := mustParse(t, procNetDev), mustParse(t, procNetDevLater)
+	traffic := Traffic(previous, current, 10*time.Second, 1000)
+
+	// wlan0 was recreated, so its counters went backwards, and tun0 is new.
+	if len(traffic) != 2 || traffic[0].Interface != "eth0" || traffic[1].Interface != "lo" {
+		t.Fatalf("expected eth0 and lo sorted by name, got %+v", traffic)
+	}
+
+	expected := types.InterfaceTraffic{
+		Timestamp:          1000,
+		Interface:          "eth0",
+		RxMbps:             2,
+		TxMbps:             1,
+		RxPacketsPerSecond: 200,
+		TxPacketsPerSecond: 100,
+		RxErrors:           0,
+		TxErrors:           0,
+		RxDrops:            3,
+		TxDrops:            0,
+	}
+	if traffic[0] != expected {
+		t.Errorf("expected %+v, got %+v", expected, traffic[0])
+	}
+
+	if traffic := Traffic(previous, current, 0, 1000); len(traffic) != 0 {
+		t.Errorf("expected no traffic over an empty interval, got %+v", traffic)
+	}
+}
+
+func TestCollectorSample(t *testing.T) {
+	inputs := []string{procNetDev, procNetDevLater, procNetDevLater}
+	readErr := error(nil)
+	collector := &Collector{read: func() (map[string]Counters, error) {
+		if readErr != nil {
+			return nil, readErr
+		}
+		counters := mustParse(t, inputs[0])
+		inputs = inputs[1:]
+		return counters, nil
+	}}
+	start := time.UnixMilli(1_000_000)
+
+	traffic, err := collector.Sample(start)
+	if err != nil || len(traffic) != 0 {
+		t.Fatalf("expected no traffic from the first sample, got %+v, %v", traffic, err)
+	}
+
+	traffic, err = collector.Sample(start.Add(10 * time.Second))
+	if err != nil {
+		t.Fatalf("failed to sample: %v", err)
+	}
+	if len(traffic) != 2 || traffic[0].RxMbps != 2 || traffic[0].Timestamp != 1_010_000 {
+		t.Errorf("unexpected traffic %+v", traffic)
+	}
+
+	readErr = errors.New("no such file")
+	if _, err := collector.Sample(start.Add(20 * time.Second)); err == nil {
+		t.Errorf("expected read error")
+	}
+	readErr = nil
+
+	// A reset starts a new interval, so the unchanged counters aren't compared
+	// against the ones from before it.
+	collector.Reset()
+	if traffic, err := collector.Sample(start.Add(30 * time.Second)); err != nil || len(traffic) != 0 {
+		t.Errorf("expected no traffic after a reset, got %+v, %v", traffic, err)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	traffic := []types.InterfaceTraffic{{Interface: "eth0"}, {Interface: "lo"}, {Interface: "wlan0"}}
+
+	names := func(traffic []types.InterfaceTraffic) string {
+		var names []string
+		for _, t := range traffic {
+			names = append(names, t.Interface)
+		}
+		return strings.Join(names, ",")
+	}
+
+	if included := names(Filter(traffic, nil)); included != "eth0,wlan0" {
+		t.Errorf("expected every interface except loopback, got %s", included)
+	}
+	if included := names(Filter(traffic, []string{"lo", "wlan0", "missing"})); included != "lo,wlan0" {
+		t.Errorf("expected configured interfaces, got %s", included)
+	}
+}
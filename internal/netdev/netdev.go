@@ -0,0 +1,112 @@
+package netdev
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	procNetDevPath = "/proc/net/dev"
+	// Number of counter fields on each interface line, 8 for receive and 8 for
+	// transmit.
+	fieldCount = 16
+)
+
+// Counters holds the cumulative traffic counters for a network interface.
+type Counters struct {
+	Interface string
+	RxBytes   uint64
+	RxPackets uint64
+	RxErrors  uint64
+	RxDrops   uint64
+	TxBytes   uint64
+	TxPackets uint64
+	TxErrors  uint64
+	TxDrops   uint64
+}
+
+// Read returns the current counters for every interface, keyed by name.
+func Read() (map[string]Counters, error) {
+	file, err := os.Open(procNetDevPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open "+procNetDevPath)
+	}
+	defer file.Close()
+
+	return Parse(file)
+}
+
+// Parse reads interface counters in the /proc/net/dev format.
+func Parse(r io.Reader) (map[string]Counters, error) {
+	counters := make(map[string]Counters)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		name, values, found := strings.Cut(scanner.Text(), ":")
+		// The two header lines don't contain a colon.
+		if !found {
+			continue
+		}
+
+		fields := strings.Fields(values)
+		if len(fields) < fieldCount {
+			return nil, errors.Errorf("expected %d fields for interface %s, got %d", fieldCount, name, len(fields))
+		}
+
+		parsed := make([]uint64, fieldCount)
+		for i := range parsed {
+			value, err := strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to parse field %d for interface %s", i, name)
+			}
+			parsed[i] = value
+		}
+
+		name = strings.TrimSpace(name)
+		counters[name] = Counters{
+			Interface: name,
+			RxBytes:   parsed[0],
+			RxPackets: parsed[1],
+			RxErrors:  parsed[2],
+			RxDrops:   parsed[3],
+			TxBytes:   parsed[8],
+			TxPackets: parsed[9],
+			TxErrors:  parsed[10],
+			TxDrops:   parsed[11],
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read interface counters")
+	}
+
+	return counters, nil
+}
+
+// IsLoopback reports whether the interface is the loopback device.
+func IsLoopback(name string) bool {
+	return name == "lo"
+}
+
+// Filter returns the traffic on the given interfaces, or on every interface
+// except loopback when none are given.
+func Filter(traffic []types.InterfaceTraffic, interfaces []string) []types.InterfaceTraffic {
+	included := make([]types.InterfaceTraffic, 0, len(traffic))
+	for _, t := range traffic {
+		if len(interfaces) > 0 && !slices.Contains(interfaces, t.Interface) {
+			continue
+		}
+		if len(interfaces) == 0 && IsLoopback(t.Interface) {
+			continue
+		}
+		included = append(included, t)
+	}
+	return included
+}
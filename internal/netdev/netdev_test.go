@@ -0,0 +1,69 @@
+package netdev
+
+import (
+	"strings"
+	"testing"
+)
+
+// Counters from /proc/net/dev, followed by the same interfaces ten seconds later.
+const (
+	procNetDev = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:  123456     100    0    0    0     0          0         0   123456     100    0    0    0     0       0          0
+  eth0: 1000000    2000    1    2    0     0          0        10   500000    1500    3    4    0     0       0          0
+ wlan0: 9000000     900    0    0    0     0          0         0   900000     900    0    0    0     0       0          0
+`
+	procNetDevLater = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:  223456     200    0    0    0     0          0         0   223456     200    0    0    0     0       0          0
+  eth0: 3500000    4000    1    5    0     0          0        10  1750000    2500    3    4    0     0       0          0
+ wlan0:      10       1    0    0    0     0          0         0       10       1    0    0    0     0       0          0
+  tun0:    5000      10    0    0    0     0          0         0     5000      10    0    0    0     0       0          0
+`
+)
+
+func TestParse(t *testing.T) {
+	counters, err := Parse(strings.NewReader(procNetDev))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	if len(counters) != 3 {
+		t.Fatalf("expected 3 interfaces, got %d", len(counters))
+	}
+	expected := Counters{
+		Interface: "eth0",
+		RxBytes:   1000000,
+		RxPackets: 2000,
+		RxErrors:  1,
+		RxDrops:   2,
+		TxBytes:   500000,
+		TxPackets: 1500,
+		TxErrors:  3,
+		TxDrops:   4,
+	}
+	if counters["eth0"] != expected {
+		t.Errorf("expected %+v, got %+v", expected, counters["eth0"])
+	}
+	if counters["lo"].RxBytes != 123456 || counters["wlan0"].TxPackets != 900 {
+		t.Errorf("unexpected counters %+v", counters)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	inputs := map[string]string{
+		"missing fields": "  eth0: 1 2 3 4\n",
+		"not a number":   "  eth0: 1 2 3 4 5 6 7 8 nine 10 11 12 13 14 15 16\n",
+		"negative":       "  eth0: -1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16\n",
+	}
+	for name, input := range inputs {
+		if _, err := Parse(strings.NewReader(input)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	counters, err := Parse(strings.NewReader("Inter-|   Receive\n face |bytes\n"))
+	if err != nil || len(counters) != 0 {
+		t.Errorf("expected no interfaces from headers alone, got %v, %v", counters, err)
+	}
+}
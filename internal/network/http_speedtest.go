@@ -0,0 +1,131 @@
+package network
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	. "github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Size of the body sent by each upload request.
+	httpUploadRequestSize = 32 * 1024 * 1024
+)
+
+type httpSpeedTester struct {
+	client      *http.Client
+	downloadURL string
+	uploadURL   string
+	streams     int
+	warmup      time.Duration
+	duration    time.Duration
+}
+
+// NewHTTPSpeedTester returns a speed tester that repeatedly downloads from and
+// uploads to the configured URLs over parallel connections. The download URL
+// should serve a large response, and the upload URL should accept and discard
+// POST bodies.
+func NewHTTPSpeedTester(c config.HTTPSpeedtest) (SpeedTester, error) {
+	if _, err := url.ParseRequestURI(c.DownloadURL); err != nil {
+		return nil, errors.Wrap(err, "invalid http speed test download url")
+	}
+	if _, err := url.ParseRequestURI(c.UploadURL); err != nil {
+		return nil, errors.Wrap(err, "invalid http speed test upload url")
+	}
+	if c.Streams <= 0 || c.DurationSeconds <= 0 || c.WarmupSeconds < 0 {
+		return nil, errors.New("http speed test streams and duration must be positive")
+	}
+
+	return &httpSpeedTester{
+		client:      &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: c.Streams, DisableCompression: true}},
+		downloadURL: c.DownloadURL,
+		uploadURL:   c.UploadURL,
+		streams:     c.Streams,
+		warmup:      time.Duration(c.WarmupSeconds) * time.Second,
+		duration:    time.Duration(c.DurationSeconds) * time.Second,
+	}, nil
+}
+
+func (t *httpSpeedTester) Run(ctx context.Context, options SpeedTestOptions) (SpeedResult, error) {
+	streams, duration := scaleTest(t.streams, t.duration, options)
+	progress := newProgressReporter(options)
+
+	progress.start(SpeedTestPhaseDownload)
+	download, err := measureThroughput(ctx, streams, t.warmup, duration, t.download, progress)
+	if err != nil {
+		return SpeedResult{BytesDownloaded: download.totalBytes()}, errors.Wrap(err, "failed to run download test")
+	}
+
+	progress.start(SpeedTestPhaseUpload)
+	upload, err := measureThroughput(ctx, streams, t.warmup, duration, t.upload, progress)
+	if err != nil {
+		return SpeedResult{BytesDownloaded: download.totalBytes(), BytesUploaded: upload.totalBytes()}, errors.Wrap(err, "failed to run upload test")
+	}
+
+	host := ""
+	if u, err := url.Parse(t.downloadURL); err == nil {
+		host = u.Host
+	}
+
+	return SpeedResult{
+		Successful:  true,
+		Description: "http " + t.downloadURL,
+		Download:    download.mbps,
+		Upload:      upload.mbps,
+		Server: SpeedtestServer{
+			Name: host,
+			Host: host,
+		},
+		BytesDownloaded: download.totalBytes(),
+		BytesUploaded:   upload.totalBytes(),
+	}, nil
+}
+
+func (t *httpSpeedTester) download(ctx context.Context, _ int, counter *atomic.Int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.downloadURL, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to create download request")
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to send download request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("download request returned status %d", resp.StatusCode)
+	}
+
+	_, err = io.Copy(io.Discard, &countingReader{reader: resp.Body, counter: counter})
+	return err
+}
+
+func (t *httpSpeedTester) upload(ctx context.Context, _ int, counter *atomic.Int64) error {
+	body := &countingReader{reader: io.LimitReader(&uploadReader{}, httpUploadRequestSize), counter: counter}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.uploadURL, body)
+	if err != nil {
+		return errors.Wrap(err, "failed to create upload request")
+	}
+	req.ContentLength = httpUploadRequestSize
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to send upload request")
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("upload request returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
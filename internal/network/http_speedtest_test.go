@@ -0,0 +1,142 @@
+package network
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/config"
+)
+
+func newTestServer(t *testing.T, downloaded, uploaded *atomic.Int64) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /download", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(w, io.LimitReader(&uploadReader{}, 4*1024*1024))
+		downloaded.Add(n)
+	})
+	mux.HandleFunc("POST /upload", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		uploaded.Add(n)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHTTPSpeedTester(t *testing.T) {
+	var downloaded, uploaded atomic.Int64
+	server := newTestServer(t, &downloaded, &uploaded)
+
+	tester, err := NewHTTPSpeedTester(config.HTTPSpeedtest{
+		DownloadURL:     server.URL + "/download",
+		UploadURL:       server.URL + "/upload",
+		Streams:         3,
+		WarmupSeconds:   0,
+		DurationSeconds: 1,
+	})
+	if err != nil {
+		t.Fatalf("failed to create tester: %v", err)
+	}
+
+	result, err := tester.Run(context.Background(), SpeedTestOptions{})
+	if err != nil {
+		t.Fatalf("failed to run test: %v", err)
+	}
+
+	if !result.Successful {
+		t.Errorf("expected successful result")
+	}
+	if result.Download <= 0 || result.Upload <= 0 {
+		t.Errorf("expected positive speeds, got download %f upload %f", result.Download, result.Upload)
+	}
+	if downloaded.Load() == 0 || uploaded.Load() == 0 {
+		t.Errorf("expected data transferred, got downloaded %d uploaded %d", downloaded.Load(), uploaded.Load())
+	}
+}
+
+func TestHTTPSpeedTesterErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(server.Close)
+
+	tester, err := NewHTTPSpeedTester(config.HTTPSpeedtest{
+		DownloadURL:     server.URL + "/download",
+		UploadURL:       server.URL + "/upload",
+		Streams:         2,
+		DurationSeconds: 1,
+	})
+	if err != nil {
+		t.Fatalf("failed to create tester: %v", err)
+	}
+
+	if _, err := tester.Run(context.Background(), SpeedTestOptions{}); err == nil {
+		t.Errorf("expected error for missing download url")
+	}
+}
+
+func TestHTTPSpeedTesterFailedUpload(t *testing.T) {
+	var downloaded, uploaded atomic.Int64
+	server := newTestServer(t, &downloaded, &uploaded)
+
+	tester, err := NewHTTPSpeedTester(config.HTTPSpeedtest{
+		DownloadURL:     server.URL + "/download",
+		UploadURL:       server.URL + "/missing",
+		Streams:         1,
+		DurationSeconds: 1,
+	})
+	if err != nil {
+		t.Fatalf("failed to create tester: %v", err)
+	}
+
+	// The data downloaded before the failure is still reported.
+	result, err := tester.Run(context.Background(), SpeedTestOptions{})
+	if err == nil {
+		t.Fatalf("expected error for missing upload url")
+	}
+	if result.Successful || result.BytesDownloaded == 0 {
+		t.Errorf("expected failed result with bytes downloaded, got %+v", result)
+	}
+}
+
+func TestNewHTTPSpeedTesterInvalidConfig(t *testing.T) {
+	configs := []config.HTTPSpeedtest{
+		{DownloadURL: "", UploadURL: "http://localhost/upload", Streams: 1, DurationSeconds: 1},
+		{DownloadURL: "http://localhost/download", UploadURL: "http://localhost/upload", Streams: 0, DurationSeconds: 1},
+		{DownloadURL: "http://localhost/download", UploadURL: "http://localhost/upload", Streams: 1, DurationSeconds: 0},
+	}
+
+	for _, c := range configs {
+		if _, err := NewHTTPSpeedTester(c); err == nil {
+			t.Errorf("expected error for config %+v", c)
+		}
+	}
+}
+
+func TestMeasureThroughputDiscardsWarmup(t *testing.T) {
+	// Each stream transfers a large burst during the warmup and then a steady
+	// trickle, so including the warmup would inflate the result.
+	result, err := measureThroughput(context.Background(), 2, 100*time.Millisecond, 200*time.Millisecond, func(ctx context.Context, _ int, counter *atomic.Int64) error {
+		counter.Add(1_000_000_000)
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(10 * time.Millisecond):
+				counter.Add(1000)
+			}
+		}
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to measure throughput: %v", err)
+	}
+
+	if result.mbps <= 0 || result.mbps > 10 {
+		t.Errorf("expected warmup burst to be discarded, got %f Mbps", result.mbps)
+	}
+	if len(result.streamBytes) != 2 || result.totalBytes() < 2_000_000_000 {
+		t.Errorf("expected stream totals to include warmup, got %v", result.streamBytes)
+	}
+}
@@ -0,0 +1,342 @@
+package network
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	. "github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/pkg/errors"
+)
+
+// Control channel states from the iperf3 protocol.
+const (
+	iperf3TestStart       = 1
+	iperf3TestRunning     = 2
+	iperf3TestEnd         = 4
+	iperf3ParamExchange   = 9
+	iperf3CreateStreams   = 10
+	iperf3ServerTerminate = 11
+	iperf3ExchangeResults = 13
+	iperf3DisplayResults  = 14
+	iperf3Done            = 16
+	iperf3AccessDenied    = -1
+	iperf3ServerError     = -2
+)
+
+const (
+	iperf3CookieLength   = 37
+	iperf3CookieAlphabet = "abcdefghijklmnopqrstuvwxyz234567"
+	iperf3BlockSize      = 128 * 1024
+	iperf3MaxJSONLength  = 1024 * 1024
+	iperf3DialTimeout    = 10 * time.Second
+)
+
+type iperf3SpeedTester struct {
+	address  string
+	streams  int
+	warmup   time.Duration
+	duration time.Duration
+}
+
+// NewIperf3SpeedTester returns a speed tester that runs TCP tests against an
+// iperf3 server, one in reverse mode for download and one for upload.
+func NewIperf3SpeedTester(c config.Iperf3Speedtest) (SpeedTester, error) {
+	if c.Host == "" {
+		return nil, errors.New("iperf3 speed test host is required")
+	}
+	if c.Streams <= 0 || c.DurationSeconds <= 0 || c.WarmupSeconds < 0 {
+		return nil, errors.New("iperf3 speed test streams and duration must be positive")
+	}
+
+	return &iperf3SpeedTester{
+		address:  net.JoinHostPort(c.Host, strconv.Itoa(c.Port)),
+		streams:  c.Streams,
+		warmup:   time.Duration(c.WarmupSeconds) * time.Second,
+		duration: time.Duration(c.DurationSeconds) * time.Second,
+	}, nil
+}
+
+func (t *iperf3SpeedTester) Run(ctx context.Context, options SpeedTestOptions) (SpeedResult, error) {
+	streams, duration := scaleTest(t.streams, t.duration, options)
+	progress := newProgressReporter(options)
+
+	progress.start(SpeedTestPhaseDownload)
+	download, err := t.runTest(ctx, streams, duration, true, progress)
+	if err != nil {
+		return SpeedResult{BytesDownloaded: download.totalBytes()}, errors.Wrap(err, "failed to run download test")
+	}
+
+	progress.start(SpeedTestPhaseUpload)
+	upload, err := t.runTest(ctx, streams, duration, false, progress)
+	if err != nil {
+		return SpeedResult{BytesDownloaded: download.totalBytes(), BytesUploaded: upload.totalBytes()}, errors.Wrap(err, "failed to run upload test")
+	}
+
+	return SpeedResult{
+		Successful:  true,
+		Description: "iperf3 " + t.address,
+		Download:    download.mbps,
+		Upload:      upload.mbps,
+		Server: SpeedtestServer{
+			Name: t.address,
+			Host: t.address,
+		},
+		BytesDownloaded: download.totalBytes(),
+		BytesUploaded:   upload.totalBytes(),
+	}, nil
+}
+
+type iperf3Params struct {
+	TCP           bool   `json:"tcp"`
+	Omit          int    `json:"omit"`
+	Time          int    `json:"time"`
+	Parallel      int    `json:"parallel"`
+	Reverse       bool   `json:"reverse,omitempty"`
+	Len           int    `json:"len"`
+	PacingTimer   int    `json:"pacing_timer"`
+	ClientVersion string `json:"client_version"`
+}
+
+type iperf3StreamResult struct {
+	ID          int     `json:"id"`
+	Bytes       int64   `json:"bytes"`
+	Retransmits int     `json:"retransmits"`
+	Jitter      float64 `json:"jitter"`
+	Errors      int     `json:"errors"`
+	Packets     int     `json:"packets"`
+	StartTime   float64 `json:"start_time"`
+	EndTime     float64 `json:"end_time"`
+}
+
+type iperf3Results struct {
+	CPUUtilTotal         float64              `json:"cpu_util_total"`
+	CPUUtilUser          float64              `json:"cpu_util_user"`
+	CPUUtilSystem        float64              `json:"cpu_util_system"`
+	SenderHasRetransmits int                  `json:"sender_has_retransmits"`
+	Streams              []iperf3StreamResult `json:"streams"`
+}
+
+// Runs a single iperf3 test. In reverse mode the server sends data to the
+// client, otherwise the client sends to the server. Failures after the data
+// streams start still return the bytes transferred.
+func (t *iperf3SpeedTester) runTest(ctx context.Context, streams int, duration time.Duration, reverse bool, progress *progressReporter) (throughput, error) {
+	dialer := net.Dialer{Timeout: iperf3DialTimeout}
+	control, err := dialer.DialContext(ctx, "tcp", t.address)
+	if err != nil {
+		return throughput{}, errors.Wrap(err, "failed to connect to iperf3 server")
+	}
+	defer control.Close()
+	stop := context.AfterFunc(ctx, func() { control.Close() })
+	defer stop()
+
+	cookie, err := newIperf3Cookie()
+	if err != nil {
+		return throughput{}, err
+	}
+	if _, err := control.Write(cookie); err != nil {
+		return throughput{}, errors.Wrap(err, "failed to send cookie")
+	}
+
+	if err := expectIperf3State(control, iperf3ParamExchange); err != nil {
+		return throughput{}, err
+	}
+
+	params := iperf3Params{
+		TCP:           true,
+		Time:          int((t.warmup + duration).Seconds()),
+		Parallel:      streams,
+		Reverse:       reverse,
+		Len:           iperf3BlockSize,
+		PacingTimer:   1000,
+		ClientVersion: "3.16",
+	}
+	if err := writeIperf3JSON(control, params); err != nil {
+		return throughput{}, errors.Wrap(err, "failed to send parameters")
+	}
+
+	if err := expectIperf3State(control, iperf3CreateStreams); err != nil {
+		return throughput{}, err
+	}
+
+	conns := make([]net.Conn, 0, streams)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for range streams {
+		conn, err := dialer.DialContext(ctx, "tcp", t.address)
+		if err != nil {
+			return throughput{}, errors.Wrap(err, "failed to open data stream")
+		}
+		conns = append(conns, conn)
+		if _, err := conn.Write(cookie); err != nil {
+			return throughput{}, errors.Wrap(err, "failed to send data stream cookie")
+		}
+	}
+
+	if err := expectIperf3State(control, iperf3TestStart); err != nil {
+		return throughput{}, err
+	}
+	if err := expectIperf3State(control, iperf3TestRunning); err != nil {
+		return throughput{}, err
+	}
+
+	start := time.Now()
+	result, err := measureThroughput(ctx, streams, t.warmup, duration, func(ctx context.Context, stream int, counter *atomic.Int64) error {
+		conn := conns[stream]
+		stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+		defer stop()
+
+		buffer := make([]byte, iperf3BlockSize)
+		if !reverse {
+			copy(buffer, uploadChunk)
+		}
+		for {
+			var n int
+			var err error
+			if reverse {
+				n, err = conn.Read(buffer)
+			} else {
+				n, err = conn.Write(buffer)
+			}
+			counter.Add(int64(n))
+			if err != nil {
+				return err
+			}
+		}
+	}, progress)
+	if err != nil {
+		return result, err
+	}
+	elapsed := time.Since(start).Seconds()
+
+	// The server keeps sending until it reads the end of the test, so drain the
+	// data streams to avoid it blocking on a full window.
+	if reverse {
+		for _, conn := range conns {
+			conn.SetDeadline(time.Time{})
+			go io.Copy(io.Discard, conn)
+		}
+	}
+
+	if err := writeIperf3State(control, iperf3TestEnd); err != nil {
+		return result, err
+	}
+
+	if err := expectIperf3State(control, iperf3ExchangeResults); err != nil {
+		return result, err
+	}
+
+	results := iperf3Results{SenderHasRetransmits: -1}
+	for i, bytes := range result.streamBytes {
+		results.Streams = append(results.Streams, iperf3StreamResult{
+			ID:          iperf3StreamID(i),
+			Bytes:       bytes,
+			Retransmits: -1,
+			EndTime:     elapsed,
+		})
+	}
+	if err := writeIperf3JSON(control, results); err != nil {
+		return result, errors.Wrap(err, "failed to send results")
+	}
+
+	var serverResults iperf3Results
+	if err := readIperf3JSON(control, &serverResults); err != nil {
+		return result, errors.Wrap(err, "failed to read server results")
+	}
+
+	if err := expectIperf3State(control, iperf3DisplayResults); err != nil {
+		return result, err
+	}
+	if err := writeIperf3State(control, iperf3Done); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// Stream IDs are assigned the same way as the reference implementation, which
+// skips 2: the first stream is 1, and the rest start at 3.
+func iperf3StreamID(index int) int {
+	if index == 0 {
+		return 1
+	}
+	return index + 2
+}
+
+func newIperf3Cookie() ([]byte, error) {
+	random := make([]byte, iperf3CookieLength-1)
+	if _, err := rand.Read(random); err != nil {
+		return nil, errors.Wrap(err, "failed to generate cookie")
+	}
+
+	cookie := make([]byte, iperf3CookieLength)
+	for i, b := range random {
+		cookie[i] = iperf3CookieAlphabet[int(b)%len(iperf3CookieAlphabet)]
+	}
+	return cookie, nil
+}
+
+func writeIperf3State(conn net.Conn, state int8) error {
+	if _, err := conn.Write([]byte{byte(state)}); err != nil {
+		return errors.Wrapf(err, "failed to send state %d", state)
+	}
+	return nil
+}
+
+func expectIperf3State(conn net.Conn, expected int8) error {
+	buffer := make([]byte, 1)
+	if _, err := io.ReadFull(conn, buffer); err != nil {
+		return errors.Wrapf(err, "failed to read state, expected %d", expected)
+	}
+
+	switch state := int8(buffer[0]); state {
+	case expected:
+		return nil
+	case iperf3AccessDenied:
+		return errors.New("iperf3 server denied access, it may be busy with another test")
+	case iperf3ServerError:
+		return errors.New("iperf3 server error")
+	case iperf3ServerTerminate:
+		return errors.New("iperf3 server terminated the test")
+	default:
+		return errors.Errorf("unexpected iperf3 state %d, expected %d", state, expected)
+	}
+}
+
+// JSON messages are sent with a 4 byte big endian length prefix.
+func writeIperf3JSON(conn net.Conn, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	message := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	_, err = conn.Write(append(message, data...))
+	return err
+}
+
+func readIperf3JSON(conn net.Conn, value any) error {
+	var length uint32
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return err
+	}
+	if length > iperf3MaxJSONLength {
+		return errors.Errorf("iperf3 message too large: %d bytes", length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
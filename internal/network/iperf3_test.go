@@ -0,0 +1,361 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	"github.com/pkg/errors"
+)
+
+// Session recorded by the fake iperf3 server.
+type iperf3Session struct {
+	cookie        []byte
+	streamCookies [][]byte
+	params        iperf3Params
+	clientResults iperf3Results
+	// Bytes the server sent, in reverse mode, or received.
+	bytes int64
+	done  bool
+	err   error
+}
+
+// Fake iperf3 server that follows the server side of the control protocol for
+// TCP tests. Each control connection is handled as one test, in order.
+type fakeIperf3Server struct {
+	listener net.Listener
+	// Replaces the state sent at the given step of the protocol, to simulate
+	// server failures. Steps are the states in the order the server sends
+	// them, starting with iperf3ParamExchange.
+	replaceStep  int
+	replaceState int8
+	sessions     chan *iperf3Session
+}
+
+func newFakeIperf3Server(t *testing.T) *fakeIperf3Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := &fakeIperf3Server{listener: listener, replaceStep: -1, sessions: make(chan *iperf3Session, 10)}
+	t.Cleanup(func() { listener.Close() })
+	go server.serve()
+	return server
+}
+
+func (s *fakeIperf3Server) tester(streams int, duration time.Duration) *iperf3SpeedTester {
+	return &iperf3SpeedTester{
+		address:  s.listener.Addr().String(),
+		streams:  streams,
+		duration: duration,
+	}
+}
+
+func (s *fakeIperf3Server) serve() {
+	for {
+		control, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		session := &iperf3Session{}
+		session.err = s.handle(control, session)
+		control.Close()
+		s.sessions <- session
+	}
+}
+
+// Waits for the given number of sessions to finish on the server.
+func (s *fakeIperf3Server) recorded(t *testing.T, count int) []*iperf3Session {
+	t.Helper()
+	sessions := make([]*iperf3Session, 0, count)
+	for range count {
+		select {
+		case session := <-s.sessions:
+			sessions = append(sessions, session)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %d sessions, got %d", count, len(sessions))
+		}
+	}
+	return sessions
+}
+
+func (s *fakeIperf3Server) handle(control net.Conn, session *iperf3Session) error {
+	step := 0
+	sendState := func(state int8) error {
+		if step == s.replaceStep {
+			state = s.replaceState
+		}
+		step += 1
+		if err := writeIperf3State(control, state); err != nil {
+			return err
+		}
+		if state < 0 || state == iperf3ServerTerminate {
+			return errors.Errorf("sent state %d", state)
+		}
+		return nil
+	}
+
+	session.cookie = make([]byte, iperf3CookieLength)
+	if _, err := io.ReadFull(control, session.cookie); err != nil {
+		return errors.Wrap(err, "failed to read cookie")
+	}
+
+	if err := sendState(iperf3ParamExchange); err != nil {
+		return err
+	}
+	if err := readIperf3JSON(control, &session.params); err != nil {
+		return errors.Wrap(err, "failed to read params")
+	}
+
+	if err := sendState(iperf3CreateStreams); err != nil {
+		return err
+	}
+	streams := make([]net.Conn, 0, session.params.Parallel)
+	defer func() {
+		for _, stream := range streams {
+			stream.Close()
+		}
+	}()
+	for range session.params.Parallel {
+		stream, err := s.listener.Accept()
+		if err != nil {
+			return errors.Wrap(err, "failed to accept stream")
+		}
+		streams = append(streams, stream)
+		cookie := make([]byte, iperf3CookieLength)
+		if _, err := io.ReadFull(stream, cookie); err != nil {
+			return errors.Wrap(err, "failed to read stream cookie")
+		}
+		session.streamCookies = append(session.streamCookies, cookie)
+	}
+
+	if err := sendState(iperf3TestStart); err != nil {
+		return err
+	}
+	if err := sendState(iperf3TestRunning); err != nil {
+		return err
+	}
+
+	var transferred atomic.Int64
+	var wg sync.WaitGroup
+	for _, stream := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var n int64
+			if session.params.Reverse {
+				n, _ = io.Copy(stream, &uploadReader{})
+			} else {
+				n, _ = io.Copy(io.Discard, stream)
+			}
+			transferred.Add(n)
+		}()
+	}
+
+	err := expectIperf3State(control, iperf3TestEnd)
+	for _, stream := range streams {
+		stream.Close()
+	}
+	wg.Wait()
+	session.bytes = transferred.Load()
+	if err != nil {
+		return err
+	}
+
+	if err := sendState(iperf3ExchangeResults); err != nil {
+		return err
+	}
+	if err := readIperf3JSON(control, &session.clientResults); err != nil {
+		return errors.Wrap(err, "failed to read client results")
+	}
+	if err := writeIperf3JSON(control, iperf3Results{Streams: []iperf3StreamResult{{ID: 1, Bytes: session.bytes}}}); err != nil {
+		return err
+	}
+
+	if err := sendState(iperf3DisplayResults); err != nil {
+		return err
+	}
+	if err := expectIperf3State(control, iperf3Done); err != nil {
+		return err
+	}
+	session.done = true
+	return nil
+}
+
+func TestIperf3SpeedTester(t *testing.T) {
+	server := newFakeIperf3Server(t)
+
+	result, err := server.tester(2, 300*time.Millisecond).Run(context.Background(), SpeedTestOptions{})
+	if err != nil {
+		t.Fatalf("failed to run test: %v", err)
+	}
+	if !result.Successful || result.Download <= 0 || result.Upload <= 0 {
+		t.Errorf("expected successful result with positive speeds, got %+v", result)
+	}
+	if result.BytesDownloaded == 0 || result.BytesUploaded == 0 {
+		t.Errorf("expected data transferred, got downloaded %d uploaded %d", result.BytesDownloaded, result.BytesUploaded)
+	}
+
+	sessions := server.recorded(t, 2)
+	for i, session := range sessions {
+		if session.err != nil || !session.done {
+			t.Fatalf("session %d: expected completed session, got %v", i, session.err)
+		}
+
+		// The control cookie is printable and shared by the data streams.
+		if !bytes.Equal(session.cookie[:iperf3CookieLength-1], bytes.ToLower(session.cookie[:iperf3CookieLength-1])) || session.cookie[iperf3CookieLength-1] != 0 {
+			t.Errorf("session %d: unexpected cookie %q", i, session.cookie)
+		}
+		for _, cookie := range session.streamCookies {
+			if !bytes.Equal(cookie, session.cookie) {
+				t.Errorf("session %d: expected stream cookie %q, got %q", i, session.cookie, cookie)
+			}
+		}
+
+		params := session.params
+		if !params.TCP || params.Parallel != 2 || params.Len != iperf3BlockSize || params.Reverse != (i == 0) {
+			t.Errorf("session %d: unexpected params %+v", i, params)
+		}
+
+		streams := session.clientResults.Streams
+		if len(streams) != 2 || streams[0].ID != 1 || streams[1].ID != 3 {
+			t.Fatalf("session %d: unexpected stream results %+v", i, streams)
+		}
+		if streams[0].Bytes <= 0 || streams[1].Bytes <= 0 || streams[0].EndTime <= 0 {
+			t.Errorf("session %d: expected stream bytes and times, got %+v", i, streams)
+		}
+	}
+
+	// The client counts everything it read, but the server may have written
+	// more into buffers before the streams closed.
+	if download := sessions[0]; result.BytesDownloaded > download.bytes {
+		t.Errorf("expected at most %d bytes downloaded, got %d", download.bytes, result.BytesDownloaded)
+	}
+	if upload := sessions[1]; result.BytesUploaded < upload.bytes {
+		t.Errorf("expected at least %d bytes uploaded, got %d", upload.bytes, result.BytesUploaded)
+	}
+}
+
+func TestIperf3SpeedTesterServerStates(t *testing.T) {
+	tests := []struct {
+		name  string
+		step  int
+		state int8
+		err   string
+		// Whether data was transferred before the failure.
+		transferred bool
+	}{
+		{"access denied", 0, iperf3AccessDenied, "denied access", false},
+		{"server error creating streams", 1, iperf3ServerError, "iperf3 server error", false},
+		{"terminated while starting", 2, iperf3ServerTerminate, "terminated the test", false},
+		{"unexpected state", 3, iperf3DisplayResults, "unexpected iperf3 state 14, expected 2", false},
+		{"error exchanging results", 4, iperf3ServerError, "iperf3 server error", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newFakeIperf3Server(t)
+			server.replaceStep, server.replaceState = test.step, test.state
+
+			result, err := server.tester(1, 100*time.Millisecond).Run(context.Background(), SpeedTestOptions{})
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected error containing %q, got %v", test.err, err)
+			}
+			if transferred := result.BytesDownloaded > 0; transferred != test.transferred {
+				t.Errorf("expected data transferred %t, got %d bytes", test.transferred, result.BytesDownloaded)
+			}
+			if err != nil && !strings.HasPrefix(err.Error(), "failed to run download test") {
+				t.Errorf("expected download test to fail, got %v", err)
+			}
+		})
+	}
+}
+
+func TestIperf3SpeedTesterUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	tester := &iperf3SpeedTester{address: address, streams: 1, duration: time.Second}
+	if _, err := tester.Run(context.Background(), SpeedTestOptions{}); err == nil || !strings.Contains(err.Error(), "failed to connect to iperf3 server") {
+		t.Errorf("expected connection error, got %v", err)
+	}
+}
+
+func TestIperf3SpeedTesterCancelled(t *testing.T) {
+	server := newFakeIperf3Server(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := server.tester(1, 10*time.Second).Run(ctx, SpeedTestOptions{}); err == nil {
+		t.Errorf("expected cancelled test to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected cancelled test to stop early, took %s", elapsed)
+	}
+}
+
+func TestReadIperf3JSON(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go writeIperf3JSON(server, iperf3Results{Streams: []iperf3StreamResult{{ID: 3, Bytes: 1024, EndTime: 1.5}}})
+	var results iperf3Results
+	if err := readIperf3JSON(client, &results); err != nil {
+		t.Fatalf("failed to read results: %v", err)
+	}
+	if len(results.Streams) != 1 || results.Streams[0].ID != 3 || results.Streams[0].Bytes != 1024 || results.Streams[0].EndTime != 1.5 {
+		t.Errorf("unexpected results %+v", results)
+	}
+
+	go server.Write(binary.BigEndian.AppendUint32(nil, iperf3MaxJSONLength+1))
+	if err := readIperf3JSON(client, &results); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("expected message too large error, got %v", err)
+	}
+}
+
+func TestIperf3StreamID(t *testing.T) {
+	for index, expected := range []int{1, 3, 4, 5} {
+		if id := iperf3StreamID(index); id != expected {
+			t.Errorf("expected stream %d to have id %d, got %d", index, expected, id)
+		}
+	}
+}
+
+func TestNewIperf3SpeedTester(t *testing.T) {
+	valid := config.Iperf3Speedtest{Host: "iperf.example.com", Port: 5201, Streams: 4, WarmupSeconds: 2, DurationSeconds: 10}
+	tester, err := NewIperf3SpeedTester(valid)
+	if err != nil {
+		t.Fatalf("failed to create tester: %v", err)
+	}
+	if address := tester.(*iperf3SpeedTester).address; address != "iperf.example.com:5201" {
+		t.Errorf("expected address iperf.example.com:5201, got %q", address)
+	}
+
+	invalid := []func(*config.Iperf3Speedtest){
+		func(c *config.Iperf3Speedtest) { c.Host = "" },
+		func(c *config.Iperf3Speedtest) { c.Streams = 0 },
+		func(c *config.Iperf3Speedtest) { c.DurationSeconds = 0 },
+		func(c *config.Iperf3Speedtest) { c.WarmupSeconds = -1 },
+	}
+	for i, modify := range invalid {
+		c := valid
+		modify(&c)
+		if _, err := NewIperf3SpeedTester(c); err == nil {
+			t.Errorf("config %d: expected error", i)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package network
 
 import (
 	"log/slog"
+	"sync"
 	"time"
 
 	"github.com/SkylerRankin/network_monitor/internal/constants"
@@ -10,14 +11,20 @@ import (
 	probing "github.com/prometheus-community/pro-bing"
 )
 
-var nextPingConfigIndex = 0
+var (
+	nextPingConfigIndex = 0
+	// Pings may be run on demand while a scheduled ping is running.
+	pingConfigMutex sync.Mutex
+)
 
 func RunPing(log *slog.Logger) (PingResult, error) {
+	pingConfigMutex.Lock()
 	c := constants.PingConfigs[nextPingConfigIndex]
 	nextPingConfigIndex += 1
 	if nextPingConfigIndex == len(constants.PingConfigs) {
 		nextPingConfigIndex = 0
 	}
+	pingConfigMutex.Unlock()
 
 	startTime := time.Now().UnixMilli()
 
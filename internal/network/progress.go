@@ -0,0 +1,83 @@
+package network
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/SkylerRankin/network_monitor/internal/types"
+)
+
+const (
+	// Minimum time between progress updates within a phase.
+	progressInterval = 500 * time.Millisecond
+)
+
+// Share of the whole test taken by each phase, used to turn progress within a
+// phase into overall progress.
+var phaseRanges = map[string][2]float64{
+	SpeedTestPhaseServer:   {0, 5},
+	SpeedTestPhaseLatency:  {5, 10},
+	SpeedTestPhaseDownload: {10, 55},
+	SpeedTestPhaseUpload:   {55, 100},
+}
+
+// Reports speed test progress to the options' callback, limiting how often
+// updates are sent. Safe to use when no callback is set.
+type progressReporter struct {
+	mutex    sync.Mutex
+	callback func(SpeedTestProgress)
+	phase    string
+	started  time.Time
+	lastSent time.Time
+}
+
+func newProgressReporter(options SpeedTestOptions) *progressReporter {
+	return &progressReporter{callback: options.Progress}
+}
+
+// Starts a new phase, which is always reported.
+func (r *progressReporter) start(phase string) {
+	r.mutex.Lock()
+	r.phase = phase
+	r.started = time.Now()
+	r.mutex.Unlock()
+	r.send(phase, 0, 0, true)
+}
+
+// Returns the time since the current phase started.
+func (r *progressReporter) elapsed() time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return time.Since(r.started)
+}
+
+// Reports the fraction of the current phase done, from 0 to 1, and the current
+// rate.
+func (r *progressReporter) update(fraction, mbps float64) {
+	r.mutex.Lock()
+	phase := r.phase
+	r.mutex.Unlock()
+	r.send(phase, fraction, mbps, false)
+}
+
+func (r *progressReporter) send(phase string, fraction, mbps float64, force bool) {
+	if r == nil || r.callback == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	if !force && time.Since(r.lastSent) < progressInterval {
+		r.mutex.Unlock()
+		return
+	}
+	r.lastSent = time.Now()
+	r.mutex.Unlock()
+
+	phaseRange := phaseRanges[phase]
+	fraction = min(max(fraction, 0), 1)
+	r.callback(SpeedTestProgress{
+		Phase:   phase,
+		Mbps:    mbps,
+		Percent: phaseRange[0] + (phaseRange[1]-phaseRange[0])*fraction,
+	})
+}
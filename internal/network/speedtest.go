@@ -2,44 +2,189 @@ package network
 
 import (
 	"context"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/SkylerRankin/network_monitor/internal/config"
 	"github.com/SkylerRankin/network_monitor/internal/constants"
 	. "github.com/SkylerRankin/network_monitor/internal/types"
 	"github.com/pkg/errors"
 	"github.com/showwin/speedtest-go/speedtest"
 )
 
-func RunSpeedtest(ctx context.Context) (SpeedResult, error) {
+const (
+	// Length of each direction of a test, set by the library.
+	defaultCaptureTime = 15 * time.Second
+	// Length of each direction of a reduced test.
+	reducedCaptureTime = 5 * time.Second
+)
+
+// Runs speed tests against speedtest.net servers.
+type speedtestNetTester struct {
+	log      *slog.Logger
+	config   config.Speedtest
+	rotation serverRotation
+}
+
+func (t *speedtestNetTester) Run(ctx context.Context, options SpeedTestOptions) (SpeedResult, error) {
 	var speedtestClient = speedtest.New()
-	serverList, err := speedtestClient.FetchServers()
+	captureTime := defaultCaptureTime
+	if options.Reduced {
+		captureTime = reducedCaptureTime
+		speedtestClient.SetCaptureTime(captureTime)
+		speedtestClient.SetNThread(1)
+	}
+
+	progress := newProgressReporter(options)
+	onRate := func(rate speedtest.ByteRate) {
+		progress.update(progress.elapsed().Seconds()/captureTime.Seconds(), rate.Mbps())
+	}
+	speedtestClient.SetCallbackDownload(onRate)
+	speedtestClient.SetCallbackUpload(onRate)
+
+	progress.start(SpeedTestPhaseServer)
+	server, pinned, err := t.selectServer(ctx, speedtestClient)
 	if err != nil {
-		return SpeedResult{}, errors.Wrap(err, "failed to fetch servers")
+		return SpeedResult{}, err
 	}
 
-	targets, err := serverList.FindServer([]int{})
+	progress.start(SpeedTestPhaseLatency)
+	err = server.PingTestContext(ctx, nil)
+	if err != nil && pinned {
+		// A configured server can be listed but not respond, which would
+		// otherwise fail every test until the configuration changes.
+		t.log.Warn("configured speed test server unreachable, selecting a server automatically", "server", server.ID, "err", err)
+		if server, err = closestSpeedtestServer(ctx, speedtestClient); err != nil {
+			return SpeedResult{}, err
+		}
+		err = server.PingTestContext(ctx, nil)
+	}
 	if err != nil {
-		return SpeedResult{}, errors.Wrap(err, "failed to find server")
+		return SpeedResult{}, errors.Wrap(err, "failed to run latency test")
 	}
 
-	if len(targets) == 0 {
-		return SpeedResult{}, errors.New("no speed test servers reachable")
+	// Failed tests still report the bytes transferred.
+	transferred := func() SpeedResult {
+		return SpeedResult{
+			BytesDownloaded: speedtestClient.GetTotalDownload(),
+			BytesUploaded:   speedtestClient.GetTotalUpload(),
+		}
 	}
 
-	server := targets[0]
-	err = server.DownloadTest()
+	progress.start(SpeedTestPhaseDownload)
+	err = server.DownloadTestContext(ctx)
 	if err != nil {
-		return SpeedResult{}, errors.Wrap(err, "failed to run download test")
+		return transferred(), errors.Wrap(err, "failed to run download test")
 	}
 
-	err = server.UploadTest()
+	progress.start(SpeedTestPhaseUpload)
+	err = server.UploadTestContext(ctx)
 	if err != nil {
-		return SpeedResult{}, errors.Wrap(err, "failed to run upload test")
+		return transferred(), errors.Wrap(err, "failed to run upload test")
 	}
 
 	return SpeedResult{
-		Successful:  true,
-		Description: server.String(),
-		Download:    float64(server.DLSpeed) * constants.BytesToMbps,
-		Upload:      float64(server.ULSpeed) * constants.BytesToMbps,
+		Successful:      true,
+		Description:     server.String(),
+		Download:        float64(server.DLSpeed) * constants.BytesToMbps,
+		Upload:          float64(server.ULSpeed) * constants.BytesToMbps,
+		Server:          toSpeedtestServer(server),
+		BytesDownloaded: speedtestClient.GetTotalDownload(),
+		BytesUploaded:   speedtestClient.GetTotalUpload(),
 	}, nil
 }
+
+// FetchSpeedtestServers returns the speedtest.net servers available to this
+// host, sorted by distance.
+func FetchSpeedtestServers(ctx context.Context) ([]SpeedtestServer, error) {
+	serverList, err := speedtest.New().FetchServerListContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch servers")
+	}
+
+	servers := make([]SpeedtestServer, 0, len(serverList))
+	for _, server := range serverList {
+		servers = append(servers, toSpeedtestServer(server))
+	}
+
+	return servers, nil
+}
+
+// Selects the server to test against. Configured server IDs are tried in order,
+// starting from the next server in the rotation if rotation is enabled. If none
+// of them are found, the lowest latency server is used instead. Returns whether
+// the server was one of the configured ones.
+func (t *speedtestNetTester) selectServer(ctx context.Context, client *speedtest.Speedtest) (*speedtest.Server, bool, error) {
+	serverIDs := t.config.ServerIDs
+	if t.config.Rotate {
+		serverIDs = t.rotation.order(serverIDs)
+	}
+
+	for _, id := range serverIDs {
+		server, err := client.FetchServerByIDContext(ctx, strconv.Itoa(id))
+		if err == nil {
+			return server, true, nil
+		}
+		t.log.Warn("failed to fetch configured speed test server", "server", id, "err", err)
+	}
+
+	server, err := closestSpeedtestServer(ctx, client)
+	return server, false, err
+}
+
+// Returns the lowest latency server available to this host.
+func closestSpeedtestServer(ctx context.Context, client *speedtest.Speedtest) (*speedtest.Server, error) {
+	serverList, err := client.FetchServerListContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch servers")
+	}
+
+	targets, err := serverList.FindServer([]int{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find server")
+	}
+
+	if len(targets) == 0 {
+		return nil, errors.New("no speed test servers reachable")
+	}
+
+	return targets[0], nil
+}
+
+// Rotates the starting server across tests. Manual and scheduled tests can
+// select servers at the same time.
+type serverRotation struct {
+	mutex sync.Mutex
+	next  int
+}
+
+// Returns the server IDs starting from the next server in the rotation, and
+// advances the rotation.
+func (r *serverRotation) order(serverIDs []int) []int {
+	if len(serverIDs) == 0 {
+		return serverIDs
+	}
+
+	r.mutex.Lock()
+	start := r.next % len(serverIDs)
+	r.next = start + 1
+	r.mutex.Unlock()
+
+	rotated := make([]int, 0, len(serverIDs))
+	rotated = append(rotated, serverIDs[start:]...)
+	return append(rotated, serverIDs[:start]...)
+}
+
+func toSpeedtestServer(server *speedtest.Server) SpeedtestServer {
+	return SpeedtestServer{
+		ID:        server.ID,
+		Name:      server.Name,
+		Sponsor:   server.Sponsor,
+		Country:   server.Country,
+		Host:      server.Host,
+		Distance:  server.Distance,
+		LatencyMS: int(server.Latency.Milliseconds()),
+	}
+}
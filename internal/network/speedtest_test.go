@@ -0,0 +1,59 @@
+package network
+
+import (
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestServerRotation(t *testing.T) {
+	var rotation serverRotation
+	serverIDs := []int{1, 2, 3}
+
+	expected := [][]int{{1, 2, 3}, {2, 3, 1}, {3, 1, 2}, {1, 2, 3}}
+	for i, want := range expected {
+		if got := rotation.order(serverIDs); !slices.Equal(got, want) {
+			t.Errorf("rotation %d: expected %v, got %v", i, want, got)
+		}
+	}
+	if !slices.Equal(serverIDs, []int{1, 2, 3}) {
+		t.Errorf("expected configured servers to be unchanged, got %v", serverIDs)
+	}
+
+	// Fewer servers than the previous rotation position.
+	if got := rotation.order([]int{4, 5}); !slices.Equal(got, []int{5, 4}) {
+		t.Errorf("expected [5 4], got %v", got)
+	}
+	if got := rotation.order(nil); len(got) != 0 {
+		t.Errorf("expected no servers, got %v", got)
+	}
+}
+
+func TestServerRotationConcurrent(t *testing.T) {
+	var rotation serverRotation
+	serverIDs := []int{1, 2, 3, 4}
+	const runs = 400
+
+	starts := make(chan int, runs)
+	var wg sync.WaitGroup
+	for range runs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			starts <- rotation.order(serverIDs)[0]
+		}()
+	}
+	wg.Wait()
+	close(starts)
+
+	// Each server starts an equal share of the runs.
+	counts := map[int]int{}
+	for start := range starts {
+		counts[start] += 1
+	}
+	for _, id := range serverIDs {
+		if counts[id] != runs/len(serverIDs) {
+			t.Errorf("expected server %d to start %d runs, got %d", id, runs/len(serverIDs), counts[id])
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package network
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	"github.com/SkylerRankin/network_monitor/internal/constants"
+	. "github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Size of the generated data written repeatedly by upload tests.
+	uploadChunkSize = 128 * 1024
+	// Fraction of the configured duration used by reduced tests.
+	reducedDurationFactor = 3
+)
+
+// SpeedTester measures the download and upload speed of the connection.
+type SpeedTester interface {
+	// Run runs a speed test. When the test fails, the result still has the
+	// bytes transferred before the failure, since they count against the data
+	// budget.
+	Run(ctx context.Context, options SpeedTestOptions) (SpeedResult, error)
+}
+
+type SpeedTestOptions struct {
+	// Run a shorter test with fewer connections, to use less data.
+	Reduced bool
+	// Called with the progress of the test as it runs. May be nil.
+	Progress func(SpeedTestProgress)
+}
+
+// NewSpeedTester returns the speed tester for the backend of the configured
+// schedule.
+func NewSpeedTester(log *slog.Logger, c config.Speedtest) (SpeedTester, error) {
+	switch backend := c.ScheduleBackend(); backend {
+	case config.SpeedtestBackendSpeedtestNet, "":
+		return &speedtestNetTester{log: log, config: c}, nil
+	case config.SpeedtestBackendHTTP:
+		return NewHTTPSpeedTester(c.HTTP)
+	case config.SpeedtestBackendIperf3:
+		return NewIperf3SpeedTester(c.Iperf3)
+	default:
+		return nil, errors.Errorf("unknown speed test backend %q", backend)
+	}
+}
+
+// RandomData returns size bytes of random data for test transfers. Random data
+// is used so that transfers can't be shortened by compression anywhere along
+// the path.
+func RandomData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(rand.IntN(256))
+	}
+	return data
+}
+
+var uploadChunk = RandomData(uploadChunkSize)
+
+// Reader that endlessly repeats the upload chunk.
+type uploadReader struct {
+	offset int
+}
+
+func (r *uploadReader) Read(b []byte) (int, error) {
+	n := copy(b, uploadChunk[r.offset:])
+	r.offset = (r.offset + n) % len(uploadChunk)
+	return n, nil
+}
+
+// Reader that adds the number of bytes read to a counter.
+type countingReader struct {
+	reader  io.Reader
+	counter *atomic.Int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	r.counter.Add(int64(n))
+	return n, err
+}
+
+// transferFunc moves data on a single stream until the context is done,
+// adding the number of bytes transferred to the counter as it goes.
+type transferFunc func(ctx context.Context, stream int, counter *atomic.Int64) error
+
+type throughput struct {
+	mbps float64
+	// Total bytes transferred by each stream, including the warmup.
+	streamBytes []int64
+}
+
+func (t throughput) totalBytes() int64 {
+	var total int64
+	for _, b := range t.streamBytes {
+		total += b
+	}
+	return total
+}
+
+// Runs the transfer on each stream for the warmup and duration, and returns the
+// rate measured after the warmup. The transfer is called repeatedly until the
+// test ends. If any stream fails, the test is stopped and the error returned
+// along with the bytes transferred.
+// Progress is reported to the reporter's current phase, which may be nil.
+func measureThroughput(ctx context.Context, streams int, warmup, duration time.Duration, transfer transferFunc, progress *progressReporter) (throughput, error) {
+	testCtx, cancel := context.WithTimeout(ctx, warmup+duration)
+	defer cancel()
+
+	counters := make([]atomic.Int64, streams)
+	errs := make(chan error, streams)
+	var wg sync.WaitGroup
+	for i := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for testCtx.Err() == nil {
+				err := transfer(testCtx, i, &counters[i])
+				if err != nil && testCtx.Err() == nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+	sum := func() int64 {
+		var total int64
+		for i := range counters {
+			total += counters[i].Load()
+		}
+		return total
+	}
+
+	start := time.Now()
+	progressDone := make(chan struct{})
+	go func() {
+		defer close(progressDone)
+		reportProgress(testCtx, progress, start, warmup+duration, sum)
+	}()
+
+	select {
+	case <-time.After(warmup):
+	case <-testCtx.Done():
+	}
+	warmupBytes := sum()
+	warmupEnd := time.Now()
+
+	<-testCtx.Done()
+	<-progressDone
+	measuredBytes := sum() - warmupBytes
+	elapsed := time.Since(warmupEnd)
+	wg.Wait()
+
+	result := throughput{streamBytes: make([]int64, streams)}
+	for i := range counters {
+		result.streamBytes[i] = counters[i].Load()
+	}
+
+	// Failed tests have no rate, but still report the bytes transferred.
+	close(errs)
+	if err := <-errs; err != nil {
+		return result, err
+	}
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+
+	if elapsed > 0 {
+		result.mbps = float64(measuredBytes) / elapsed.Seconds() * constants.BytesToMbps
+	}
+
+	return result, nil
+}
+
+// Reports the rate over each progress interval until the context is done.
+func reportProgress(ctx context.Context, progress *progressReporter, start time.Time, total time.Duration, sum func() int64) {
+	if progress == nil {
+		return
+	}
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	lastBytes, lastTime := int64(0), start
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			bytes := sum()
+			mbps := float64(bytes-lastBytes) / now.Sub(lastTime).Seconds() * constants.BytesToMbps
+			progress.update(now.Sub(start).Seconds()/total.Seconds(), mbps)
+			lastBytes, lastTime = bytes, now
+		}
+	}
+}
+
+// Returns the stream count and duration to use for a test, taking reduced
+// tests into account.
+func scaleTest(streams int, duration time.Duration, options SpeedTestOptions) (int, time.Duration) {
+	if !options.Reduced {
+		return streams, duration
+	}
+	return 1, max(duration/reducedDurationFactor, time.Second)
+}
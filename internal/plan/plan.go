@@ -0,0 +1,180 @@
+// Package plan compares speed test results against the internet plan in effect
+// at the time, and raises an incident when recent results fall below it.
+package plan
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	"github.com/SkylerRankin/network_monitor/internal/optional"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+)
+
+// Schedule is the plans in effect over time.
+type Schedule struct {
+	// Ordered by effective date.
+	plans []types.Plan
+	alert config.PlanAlert
+}
+
+// NewSchedule returns the configured plans. Effective dates are local dates,
+// and are checked when the config is loaded.
+func NewSchedule(isp config.ISP) *Schedule {
+	plans := make([]types.Plan, 0, len(isp.Plans))
+	for _, plan := range isp.Plans {
+		var effectiveFrom int64
+		if plan.EffectiveFrom != "" {
+			date, _ := time.ParseInLocation(time.DateOnly, plan.EffectiveFrom, time.Local)
+			effectiveFrom = date.UnixMilli()
+		}
+		plans = append(plans, types.Plan{
+			Name:          plan.Name,
+			DownloadMbps:  plan.DownloadMbps,
+			UploadMbps:    plan.UploadMbps,
+			EffectiveFrom: effectiveFrom,
+		})
+	}
+	slices.SortFunc(plans, func(a, b types.Plan) int { return cmp.Compare(a.EffectiveFrom, b.EffectiveFrom) })
+	return &Schedule{plans: plans, alert: isp.Alert}
+}
+
+// Plans returns every plan, oldest first.
+func (s *Schedule) Plans() []types.Plan {
+	return s.plans
+}
+
+// At returns the plan in effect at the time in unix milliseconds, or nil if
+// there was none.
+func (s *Schedule) At(timestamp int64) *types.Plan {
+	for i := len(s.plans) - 1; i >= 0; i-- {
+		if s.plans[i].EffectiveFrom <= timestamp {
+			return &s.plans[i]
+		}
+	}
+	return nil
+}
+
+// Compare returns the speeds as a percentage of the plan in effect at the time
+// in unix milliseconds, or nil if there was none.
+func (s *Schedule) Compare(timestamp int64, download float64, upload float64) *types.PlanComparison {
+	plan := s.At(timestamp)
+	if plan == nil {
+		return nil
+	}
+	return &types.PlanComparison{
+		Name:            plan.Name,
+		DownloadMbps:    plan.DownloadMbps,
+		UploadMbps:      plan.UploadMbps,
+		DownloadPercent: 100 * download / plan.DownloadMbps,
+		UploadPercent:   100 * upload / plan.UploadMbps,
+	}
+}
+
+// Annotate sets the plan comparison of each record.
+func (s *Schedule) Annotate(records []types.SpeedtestRecord) {
+	for i := range records {
+		records[i].Plan = s.Compare(records[i].Timestamp, records[i].Download, records[i].Upload)
+	}
+}
+
+// Status returns the plans and how the recent speed tests, oldest first,
+// compare to them.
+func (s *Schedule) Status(recent []types.SpeedtestRecord, now time.Time) *types.PlanStatus {
+	status := &types.PlanStatus{
+		Plans:                 s.plans,
+		Current:               s.At(now.UnixMilli()),
+		AlertWindowTests:      s.alert.WindowTests,
+		AlertThresholdPercent: s.alert.ThresholdPercent,
+	}
+	download, upload, ok := s.average(recent)
+	if ok {
+		status.RecentDownloadPercent = optional.New(download)
+		status.RecentUploadPercent = optional.New(upload)
+		status.BelowPlan = download < s.alert.ThresholdPercent || upload < s.alert.ThresholdPercent
+	}
+	return status
+}
+
+// Returns the average percentage of the plan reached by the last window of
+// speed tests. False if the alert is disabled or there aren't enough tests
+// with a plan.
+func (s *Schedule) average(recent []types.SpeedtestRecord) (float64, float64, bool) {
+	if s.alert.WindowTests == 0 || len(recent) < s.alert.WindowTests {
+		return 0, 0, false
+	}
+
+	var download, upload float64
+	for _, record := range recent[len(recent)-s.alert.WindowTests:] {
+		comparison := s.Compare(record.Timestamp, record.Download, record.Upload)
+		if comparison == nil {
+			return 0, 0, false
+		}
+		download += comparison.DownloadPercent
+		upload += comparison.UploadPercent
+	}
+	return download / float64(s.alert.WindowTests), upload / float64(s.alert.WindowTests), true
+}
+
+// Alert tracks whether recent speed tests are below the plan. It's not safe for
+// concurrent use.
+type Alert struct {
+	schedule *Schedule
+	// The open incident, or nil.
+	open *types.Incident
+}
+
+func NewAlert(schedule *Schedule) *Alert {
+	return &Alert{schedule: schedule}
+}
+
+// Restore reopens an incident left open by the last run, so that it's closed
+// once the speed tests recover rather than opened again.
+func (a *Alert) Restore(incident types.Incident) {
+	a.open = &incident
+}
+
+// Check compares the recent speed tests, oldest first, against the plan. It
+// returns an incident when one opens, starting at the test that brought the
+// average below the threshold, or closes, ending at the test that brought it
+// back up. Otherwise it returns nil.
+func (a *Alert) Check(recent []types.SpeedtestRecord) *types.Incident {
+	download, upload, ok := a.schedule.average(recent)
+	if !ok {
+		return nil
+	}
+	threshold := a.schedule.alert.ThresholdPercent
+	below := download < threshold || upload < threshold
+	latest := recent[len(recent)-1].Timestamp
+
+	if below && a.open == nil {
+		var directions []string
+		if download < threshold {
+			directions = append(directions, fmt.Sprintf("download %.0f%%", download))
+		}
+		if upload < threshold {
+			directions = append(directions, fmt.Sprintf("upload %.0f%%", upload))
+		}
+		a.open = &types.Incident{
+			ID:    fmt.Sprintf("%s-%d", types.IncidentKindBelowPlan, latest),
+			Kind:  types.IncidentKindBelowPlan,
+			Start: latest,
+			End:   optional.Empty[int64](),
+			Description: fmt.Sprintf("Last %d speed tests averaged %s of the plan, below %.0f%%",
+				a.schedule.alert.WindowTests, strings.Join(directions, " and "), threshold),
+		}
+		incident := *a.open
+		return &incident
+	}
+
+	if !below && a.open != nil {
+		incident := *a.open
+		incident.End = optional.New(latest)
+		a.open = nil
+		return &incident
+	}
+	return nil
+}
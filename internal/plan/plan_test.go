@@ -0,0 +1,123 @@
+package plan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+)
+
+var upgrade = time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)
+
+func testSchedule(windowTests int) *Schedule {
+	return NewSchedule(config.ISP{
+		// Out of order, to check they're sorted.
+		Plans: []config.ISPPlan{
+			{Name: "Gigabit", DownloadMbps: 1000, UploadMbps: 50, EffectiveFrom: "2024-03-01"},
+			{Name: "Basic", DownloadMbps: 200, UploadMbps: 10},
+		},
+		Alert: config.PlanAlert{WindowTests: windowTests, ThresholdPercent: 80},
+	})
+}
+
+// Returns one speed test an hour after the upgrade for each download speed,
+// with the upload at the plan speed.
+func speedTests(downloads ...float64) []types.SpeedtestRecord {
+	var records []types.SpeedtestRecord
+	for i, download := range downloads {
+		records = append(records, types.SpeedtestRecord{
+			Timestamp: upgrade.Add(time.Duration(i) * time.Hour).UnixMilli(),
+			Download:  download,
+			Upload:    50,
+		})
+	}
+	return records
+}
+
+func TestScheduleAt(t *testing.T) {
+	schedule := testSchedule(0)
+
+	if plan := schedule.At(upgrade.UnixMilli() - 1); plan == nil || plan.Name != "Basic" {
+		t.Errorf("expected the basic plan before the upgrade, got %+v", plan)
+	}
+	if plan := schedule.At(upgrade.UnixMilli()); plan == nil || plan.Name != "Gigabit" {
+		t.Errorf("expected the gigabit plan from the upgrade, got %+v", plan)
+	}
+	if plan := NewSchedule(config.ISP{}).At(upgrade.UnixMilli()); plan != nil {
+		t.Errorf("expected no plan without any configured, got %+v", plan)
+	}
+
+	comparison := schedule.Compare(upgrade.UnixMilli()-1, 150, 10)
+	if comparison == nil || comparison.DownloadPercent != 75 || comparison.UploadPercent != 100 {
+		t.Errorf("unexpected comparison %+v", comparison)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	schedule := testSchedule(2)
+
+	status := schedule.Status(speedTests(900, 600, 500), upgrade)
+	if status.Current == nil || status.Current.Name != "Gigabit" || len(status.Plans) != 2 {
+		t.Errorf("unexpected plans %+v", status)
+	}
+	if download, _ := status.RecentDownloadPercent.Get(); download != 55 || !status.BelowPlan {
+		t.Errorf("expected the last two tests to average 55%% and be below the plan, got %+v", status)
+	}
+
+	if status := schedule.Status(speedTests(900), upgrade); status.RecentDownloadPercent.Has() || status.BelowPlan {
+		t.Errorf("expected no average with too few tests, got %+v", status)
+	}
+}
+
+func TestAlert(t *testing.T) {
+	alert := NewAlert(testSchedule(2))
+	var results []types.SpeedtestRecord
+	check := func(download float64) *types.Incident {
+		results = append(results, types.SpeedtestRecord{
+			Timestamp: upgrade.Add(time.Duration(len(results)) * time.Hour).UnixMilli(),
+			Download:  download,
+			Upload:    50,
+		})
+		return alert.Check(results)
+	}
+
+	if incident := check(1000); incident != nil {
+		t.Fatalf("expected no incident with too few tests, got %+v", incident)
+	}
+	if incident := check(900); incident != nil {
+		t.Fatalf("expected no incident at 95%%, got %+v", incident)
+	}
+
+	opened := check(500)
+	if opened == nil || opened.Kind != types.IncidentKindBelowPlan || opened.End.Has() {
+		t.Fatalf("expected an open incident, got %+v", opened)
+	}
+	if opened.Start != results[2].Timestamp || opened.Description != "Last 2 speed tests averaged download 70% of the plan, below 80%" {
+		t.Errorf("unexpected incident %+v", opened)
+	}
+	if incident := check(600); incident != nil {
+		t.Errorf("expected no change while still below, got %+v", incident)
+	}
+
+	closed := check(1100)
+	if closed == nil || closed.ID != opened.ID {
+		t.Fatalf("expected the incident to close, got %+v", closed)
+	}
+	if end, _ := closed.End.Get(); end != results[4].Timestamp {
+		t.Errorf("expected the incident to end at the last test, got %d", end)
+	}
+}
+
+func TestAlertRestore(t *testing.T) {
+	alert := NewAlert(testSchedule(2))
+	alert.Restore(types.Incident{ID: "belowPlan-1", Kind: types.IncidentKindBelowPlan, Start: 1})
+
+	if incident := alert.Check(speedTests(500, 600)); incident != nil {
+		t.Errorf("expected the restored incident to stay open, got %+v", incident)
+	}
+	closed := alert.Check(speedTests(1000, 1000))
+	if closed == nil || closed.ID != "belowPlan-1" || !closed.End.Has() {
+		t.Errorf("expected the restored incident to close, got %+v", closed)
+	}
+}
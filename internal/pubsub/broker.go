@@ -0,0 +1,308 @@
+// Package pubsub fans published messages out to subscribers, each with its own
+// bounded queue, so a slow subscriber never holds up publishers or other
+// subscribers.
+package pubsub
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// A subscriber's queue filled up with a message that can't be dropped, so
+	// it was disconnected.
+	ErrSlowSubscriber = errors.New("subscriber fell too far behind")
+	// The subscriber was removed by Unsubscribe or Close.
+	ErrUnsubscribed = errors.New("unsubscribed")
+	// Subscribe was called after Close.
+	ErrClosed = errors.New("broker closed")
+)
+
+// Message is a value along with its sequence number. Sequence numbers start at
+// 1 and increase by one for each published message. Messages sent to a single
+// subscriber have sequence number 0.
+type Message[T any] struct {
+	Seq   uint64
+	Value T
+}
+
+// Broker delivers published messages to every subscriber whose filter accepts
+// them. Publishing never blocks: when a subscriber's queue is full, droppable
+// messages are dropped for that subscriber and any other message disconnects
+// it, closing its channel.
+type Broker[T any] struct {
+	mutex       sync.Mutex
+	subscribers map[*Subscriber[T]]bool
+	// Recent published messages, oldest first, for replay.
+	history     []Message[T]
+	historySize int
+	seq         uint64
+	droppable   func(T) bool
+	closed      bool
+
+	published    atomic.Uint64
+	dropped      atomic.Uint64
+	disconnected atomic.Uint64
+}
+
+// NewBroker returns a broker that keeps the last historySize messages for
+// replay. Messages that droppable returns true for are dropped rather than
+// disconnecting slow subscribers. It may be nil.
+func NewBroker[T any](historySize int, droppable func(T) bool) *Broker[T] {
+	if droppable == nil {
+		droppable = func(T) bool { return false }
+	}
+	return &Broker[T]{
+		subscribers: make(map[*Subscriber[T]]bool),
+		historySize: historySize,
+		droppable:   droppable,
+	}
+}
+
+type Subscriber[T any] struct {
+	name  string
+	queue chan Message[T]
+	// Only used while holding the broker's lock.
+	filter func(T) bool
+	closed bool
+	// Set before the queue is closed.
+	err     error
+	dropped atomic.Uint64
+}
+
+// Messages returns the subscriber's queue. It's closed when the subscriber is
+// removed, after which Err returns the reason.
+func (s *Subscriber[T]) Messages() <-chan Message[T] {
+	return s.queue
+}
+
+// Err returns why the subscriber was removed, once Messages is closed.
+func (s *Subscriber[T]) Err() error {
+	return s.err
+}
+
+type SubscribeOptions[T any] struct {
+	// Identifies the subscriber in stats, such as the client's address.
+	Name      string
+	QueueSize int
+	// Filters published messages. Nil accepts everything.
+	Filter func(T) bool
+	// If set, called with the sequence number of the last published message,
+	// and the result is queued before any published message.
+	Greeting func(seq uint64) (T, error)
+	// If set, published messages after this sequence number are replayed.
+	ReplayAfter *uint64
+}
+
+type ReplayResult struct {
+	Replayed int
+	// False if some of the requested messages are no longer kept.
+	Complete bool
+}
+
+// Subscribe adds a subscriber. Nothing published while subscribing is missed or
+// delivered twice. Returns ErrClosed once the broker is closed.
+func (b *Broker[T]) Subscribe(options SubscribeOptions[T]) (*Subscriber[T], ReplayResult, error) {
+	subscriber := &Subscriber[T]{
+		name:   options.Name,
+		queue:  make(chan Message[T], options.QueueSize),
+		filter: options.Filter,
+	}
+	if subscriber.filter == nil {
+		subscriber.filter = func(T) bool { return true }
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return nil, ReplayResult{}, ErrClosed
+	}
+
+	var greeting T
+	if options.Greeting != nil {
+		var err error
+		if greeting, err = options.Greeting(b.seq); err != nil {
+			return nil, ReplayResult{}, err
+		}
+	}
+
+	b.subscribers[subscriber] = true
+	if options.Greeting != nil && !b.deliver(subscriber, Message[T]{Value: greeting}) {
+		return nil, ReplayResult{}, subscriber.err
+	}
+
+	result := ReplayResult{Complete: true}
+	if options.ReplayAfter != nil {
+		result = b.replay(subscriber, *options.ReplayAfter)
+	}
+	return subscriber, result, nil
+}
+
+// Unsubscribe removes the subscriber and closes its queue. Safe to call more
+// than once.
+func (b *Broker[T]) Unsubscribe(subscriber *Subscriber[T]) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.remove(subscriber, ErrUnsubscribed)
+}
+
+// SetFilter replaces the subscriber's filter for messages published from now on.
+func (b *Broker[T]) SetFilter(subscriber *Subscriber[T], filter func(T) bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if filter == nil {
+		filter = func(T) bool { return true }
+	}
+	subscriber.filter = filter
+}
+
+// Replay queues the kept messages after the sequence number that pass the
+// subscriber's filter. They are queued before anything published afterwards.
+func (b *Broker[T]) Replay(subscriber *Subscriber[T], after uint64) ReplayResult {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.replay(subscriber, after)
+}
+
+func (b *Broker[T]) replay(subscriber *Subscriber[T], after uint64) ReplayResult {
+	result := ReplayResult{Complete: true}
+	if len(b.history) > 0 && b.history[0].Seq > after+1 {
+		result.Complete = false
+	}
+
+	for _, message := range b.history {
+		if message.Seq > after && subscriber.filter(message.Value) {
+			if b.deliver(subscriber, message) {
+				result.Replayed += 1
+			}
+		}
+	}
+	return result
+}
+
+// Send queues a message for a single subscriber, with sequence number 0.
+// Returns false if it wasn't queued.
+func (b *Broker[T]) Send(subscriber *Subscriber[T], value T) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.deliver(subscriber, Message[T]{Value: value})
+}
+
+// Publish assigns the next sequence number, builds the message with it and
+// delivers it. Builders run one at a time, in sequence order. If build fails,
+// the sequence number is not used.
+func (b *Broker[T]) Publish(build func(seq uint64) (T, error)) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	value, err := build(b.seq + 1)
+	if err != nil {
+		return err
+	}
+	b.seq += 1
+	b.published.Add(1)
+
+	message := Message[T]{Seq: b.seq, Value: value}
+	if b.historySize > 0 {
+		b.history = append(b.history, message)
+		if len(b.history) > b.historySize {
+			b.history = b.history[len(b.history)-b.historySize:]
+		}
+	}
+
+	for subscriber := range b.subscribers {
+		if subscriber.filter(value) {
+			b.deliver(subscriber, message)
+		}
+	}
+	return nil
+}
+
+// Queues the message without blocking, applying the slow subscriber policy if
+// the queue is full. Must hold the lock.
+func (b *Broker[T]) deliver(subscriber *Subscriber[T], message Message[T]) bool {
+	if subscriber.closed {
+		return false
+	}
+
+	select {
+	case subscriber.queue <- message:
+		return true
+	default:
+	}
+
+	if b.droppable(message.Value) {
+		subscriber.dropped.Add(1)
+		b.dropped.Add(1)
+	} else {
+		b.disconnected.Add(1)
+		b.remove(subscriber, ErrSlowSubscriber)
+	}
+	return false
+}
+
+// Must hold the lock.
+func (b *Broker[T]) remove(subscriber *Subscriber[T], err error) {
+	if subscriber.closed {
+		return
+	}
+	subscriber.closed = true
+	subscriber.err = err
+	delete(b.subscribers, subscriber)
+	close(subscriber.queue)
+}
+
+// Close removes every subscriber and refuses new ones. Publishing afterwards
+// still succeeds, with nobody to deliver to.
+func (b *Broker[T]) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	for subscriber := range b.subscribers {
+		b.remove(subscriber, ErrUnsubscribed)
+	}
+}
+
+type Stats struct {
+	Seq         uint64 `json:"seq"`
+	Published   uint64 `json:"published"`
+	Subscribers int    `json:"subscribers"`
+	// Messages dropped for slow subscribers.
+	Dropped uint64 `json:"dropped"`
+	// Subscribers disconnected for being slow.
+	Disconnected uint64            `json:"disconnected"`
+	Queues       []SubscriberStats `json:"queues"`
+}
+
+type SubscriberStats struct {
+	Name     string `json:"name"`
+	Depth    int    `json:"depth"`
+	Capacity int    `json:"capacity"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+// Stats returns counters for the broker and the queue depth of each subscriber.
+func (b *Broker[T]) Stats() Stats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stats := Stats{
+		Seq:          b.seq,
+		Published:    b.published.Load(),
+		Subscribers:  len(b.subscribers),
+		Dropped:      b.dropped.Load(),
+		Disconnected: b.disconnected.Load(),
+		Queues:       make([]SubscriberStats, 0, len(b.subscribers)),
+	}
+	for subscriber := range b.subscribers {
+		stats.Queues = append(stats.Queues, SubscriberStats{
+			Name:     subscriber.name,
+			Depth:    len(subscriber.queue),
+			Capacity: cap(subscriber.queue),
+			Dropped:  subscriber.dropped.Load(),
+		})
+	}
+	return stats
+}
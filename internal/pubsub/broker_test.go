@@ -0,0 +1,246 @@
+package pubsub
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func publish(t *testing.T, broker *Broker[int], value int) {
+	t.Helper()
+	if err := broker.Publish(func(uint64) (int, error) { return value, nil }); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+}
+
+func subscribe(t *testing.T, broker *Broker[int], options SubscribeOptions[int]) *Subscriber[int] {
+	t.Helper()
+	subscriber, _, err := broker.Subscribe(options)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	return subscriber
+}
+
+// Reads messages until the queue is closed, checking that sequence numbers
+// increase by one each time.
+func readContiguous(t *testing.T, subscriber *Subscriber[int], first uint64) uint64 {
+	t.Helper()
+	expected := first
+	for message := range subscriber.Messages() {
+		if message.Seq != expected {
+			t.Errorf("expected seq %d, got %d", expected, message.Seq)
+			return expected
+		}
+		expected += 1
+	}
+	return expected - first
+}
+
+func TestConcurrentPublishersAndSubscribers(t *testing.T) {
+	const publishers, perPublisher, subscribers = 8, 250, 4
+	total := uint64(publishers * perPublisher)
+	broker := NewBroker[int](0, nil)
+
+	counts := make([]uint64, subscribers)
+	var readers sync.WaitGroup
+	for i := range subscribers {
+		subscriber := subscribe(t, broker, SubscribeOptions[int]{QueueSize: int(total)})
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			counts[i] = readContiguous(t, subscriber, 1)
+		}()
+	}
+
+	var writers sync.WaitGroup
+	for i := range publishers {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for j := range perPublisher {
+				publish(t, broker, i*perPublisher+j)
+			}
+		}()
+	}
+	writers.Wait()
+	broker.Close()
+	readers.Wait()
+
+	for i, count := range counts {
+		if count != total {
+			t.Errorf("subscriber %d received %d of %d messages", i, count, total)
+		}
+	}
+	if stats := broker.Stats(); stats.Seq != total || stats.Published != total {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestSlowSubscriberIsDisconnected(t *testing.T) {
+	broker := NewBroker[int](0, nil)
+	slow := subscribe(t, broker, SubscribeOptions[int]{Name: "slow", QueueSize: 2})
+	fast := subscribe(t, broker, SubscribeOptions[int]{Name: "fast", QueueSize: 100})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 10 {
+			publish(t, broker, i)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing blocked on a slow subscriber")
+	}
+
+	if received := readContiguous(t, slow, 1); received != 2 {
+		t.Errorf("expected slow subscriber to get its queue before disconnecting, got %d", received)
+	}
+	if !errors.Is(slow.Err(), ErrSlowSubscriber) {
+		t.Errorf("expected slow subscriber error, got %v", slow.Err())
+	}
+
+	stats := broker.Stats()
+	if stats.Subscribers != 1 || stats.Disconnected != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if len(stats.Queues) != 1 || stats.Queues[0].Name != "fast" || stats.Queues[0].Depth != 10 || stats.Queues[0].Capacity != 100 {
+		t.Errorf("unexpected queue stats %+v", stats.Queues)
+	}
+
+	broker.Unsubscribe(fast)
+	if received := readContiguous(t, fast, 1); received != 10 {
+		t.Errorf("expected fast subscriber to get every message, got %d", received)
+	}
+	if !errors.Is(fast.Err(), ErrUnsubscribed) {
+		t.Errorf("expected unsubscribed error, got %v", fast.Err())
+	}
+}
+
+func TestDroppableMessagesAreDropped(t *testing.T) {
+	// Negative values are droppable.
+	broker := NewBroker(0, func(value int) bool { return value < 0 })
+	subscriber := subscribe(t, broker, SubscribeOptions[int]{QueueSize: 1})
+
+	publish(t, broker, -1)
+	publish(t, broker, -2)
+	publish(t, broker, -3)
+
+	stats := broker.Stats()
+	if stats.Subscribers != 1 || stats.Dropped != 2 || stats.Queues[0].Dropped != 2 {
+		t.Errorf("expected two dropped messages and no disconnect, got %+v", stats)
+	}
+	if message := <-subscriber.Messages(); message.Value != -1 {
+		t.Errorf("expected first message to be kept, got %d", message.Value)
+	}
+
+	publish(t, broker, 4)
+	publish(t, broker, 5)
+	if stats := broker.Stats(); stats.Subscribers != 0 || stats.Disconnected != 1 {
+		t.Errorf("expected non-droppable message to disconnect, got %+v", stats)
+	}
+}
+
+func TestSubscribeDuringPublishing(t *testing.T) {
+	const total = 2000
+	broker := NewBroker[int](total, nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range total {
+			publish(t, broker, i)
+		}
+	}()
+
+	// Subscribing partway through with a replay from the start must give every
+	// message exactly once, in order.
+	time.Sleep(time.Millisecond)
+	after := uint64(0)
+	subscriber := subscribe(t, broker, SubscribeOptions[int]{QueueSize: total, ReplayAfter: &after})
+	<-done
+	broker.Unsubscribe(subscriber)
+
+	if received := readContiguous(t, subscriber, 1); received != total {
+		t.Errorf("expected %d messages, got %d", total, received)
+	}
+}
+
+func TestGreetingAndFilter(t *testing.T) {
+	broker := NewBroker[int](10, nil)
+	publish(t, broker, 1)
+	publish(t, broker, 2)
+
+	subscriber := subscribe(t, broker, SubscribeOptions[int]{
+		QueueSize: 10,
+		Filter:    func(value int) bool { return value%2 == 0 },
+		Greeting:  func(seq uint64) (int, error) { return int(seq) * 100, nil },
+	})
+	publish(t, broker, 3)
+	publish(t, broker, 4)
+	broker.SetFilter(subscriber, nil)
+	publish(t, broker, 5)
+	if !broker.Send(subscriber, 6) {
+		t.Error("expected direct message to be queued")
+	}
+	broker.Unsubscribe(subscriber)
+
+	expected := []Message[int]{{Seq: 0, Value: 200}, {Seq: 4, Value: 4}, {Seq: 5, Value: 5}, {Seq: 0, Value: 6}}
+	for _, want := range expected {
+		if got := <-subscriber.Messages(); got != want {
+			t.Errorf("expected %+v, got %+v", want, got)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	broker := NewBroker[int](3, nil)
+	for i := range 5 {
+		publish(t, broker, i)
+	}
+
+	subscriber := subscribe(t, broker, SubscribeOptions[int]{QueueSize: 10})
+	if result := broker.Replay(subscriber, 3); result.Replayed != 2 || !result.Complete {
+		t.Errorf("unexpected replay result %+v", result)
+	}
+	if result := broker.Replay(subscriber, 0); result.Replayed != 3 || result.Complete {
+		t.Errorf("expected incomplete replay once history is dropped, got %+v", result)
+	}
+}
+
+func TestPublishBuildError(t *testing.T) {
+	broker := NewBroker[int](10, nil)
+	err := broker.Publish(func(uint64) (int, error) { return 0, errors.New("failed") })
+	if err == nil {
+		t.Error("expected build error to be returned")
+	}
+
+	publish(t, broker, 1)
+	if stats := broker.Stats(); stats.Seq != 1 {
+		t.Errorf("expected failed publish not to use a sequence number, got %d", stats.Seq)
+	}
+}
+
+func TestClose(t *testing.T) {
+	broker := NewBroker[int](10, nil)
+	subscriber := subscribe(t, broker, SubscribeOptions[int]{QueueSize: 1})
+	broker.Close()
+
+	if _, ok := <-subscriber.Messages(); ok || !errors.Is(subscriber.Err(), ErrUnsubscribed) {
+		t.Errorf("expected subscriber to be removed, got %v", subscriber.Err())
+	}
+	if _, _, err := broker.Subscribe(SubscribeOptions[int]{QueueSize: 1}); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected closed error, got %v", err)
+	}
+
+	// Publishers and removed subscribers don't block once nobody is listening.
+	publish(t, broker, 1)
+	broker.Unsubscribe(subscriber)
+	if broker.Send(subscriber, 2) {
+		t.Error("expected send to a removed subscriber to fail")
+	}
+}
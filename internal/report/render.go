@@ -0,0 +1,216 @@
+package report
+
+import (
+	_ "embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"math"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	FormatHTML     = "html"
+	FormatMarkdown = "markdown"
+
+	dateFormat     = "Mon 2 Jan 2006"
+	dateTimeFormat = "2006-01-02 15:04:05 MST"
+
+	chartWidth  = 720
+	chartHeight = 220
+	chartLeft   = 52
+	chartRight  = 12
+	chartTop    = 14
+	chartBottom = 30
+	// At most this many period labels are drawn under a chart.
+	chartMaxLabels = 12
+)
+
+var (
+	//go:embed report.html
+	htmlSource string
+	//go:embed report.md
+	markdownSource string
+
+	formatFuncs = map[string]any{
+		"number":   func(v float64) string { return fmt.Sprintf("%.1f", v) },
+		"integer":  func(v float64) string { return fmt.Sprintf("%.0f", v) },
+		"percent":  func(v float64) string { return fmt.Sprintf("%.1f%%", v) },
+		"date":     func(t time.Time) string { return t.Format(dateFormat) },
+		"datetime": func(t time.Time) string { return t.Format(dateTimeFormat) },
+		"duration": formatDuration,
+	}
+
+	htmlTemplate = htmltemplate.Must(htmltemplate.New("report").
+			Funcs(formatFuncs).
+			Funcs(htmltemplate.FuncMap{"charts": charts}).
+			Parse(htmlSource))
+	markdownTemplate = texttemplate.Must(texttemplate.New("report").Funcs(formatFuncs).Parse(markdownSource))
+)
+
+// Render writes the report as a standalone HTML page, with inline styles and
+// SVG charts, or as Markdown.
+func Render(w io.Writer, report *Report, format string) error {
+	var err error
+	switch format {
+	case FormatHTML:
+		err = htmlTemplate.Execute(w, report)
+	case FormatMarkdown:
+		err = markdownTemplate.Execute(w, report)
+	default:
+		return errors.Errorf("unknown report format %q", format)
+	}
+	return errors.Wrap(err, "failed to render report")
+}
+
+// ContentType returns the media type of a rendered report.
+func ContentType(format string) string {
+	if format == FormatMarkdown {
+		return "text/markdown; charset=utf-8"
+	}
+	return "text/html; charset=utf-8"
+}
+
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	hours := int(d.Hours())
+	minutes := int(d.Minutes()) % 60
+	seconds := int(d.Seconds()) % 60
+	switch {
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	case minutes > 0:
+		return fmt.Sprintf("%dm %ds", minutes, seconds)
+	default:
+		return fmt.Sprintf("%ds", seconds)
+	}
+}
+
+// A horizontal reference line drawn across a chart.
+type chartLine struct {
+	label string
+	value float64
+}
+
+// Returns the SVG charts of the per period statistics.
+func charts(report *Report) []htmltemplate.HTML {
+	labels := make([]string, len(report.Periods))
+	download := make([]float64, len(report.Periods))
+	upload := make([]float64, len(report.Periods))
+	rtt := make([]float64, len(report.Periods))
+	loss := make([]float64, len(report.Periods))
+	// Periods without speed tests or measurements have no bar.
+	hasSpeedTests := make([]bool, len(report.Periods))
+	hasMeasurements := make([]bool, len(report.Periods))
+	for i, period := range report.Periods {
+		labels[i] = period.Start.Format("2 Jan")
+		download[i] = period.Stats.Download.P50
+		upload[i] = period.Stats.Upload.P50
+		rtt[i] = period.Stats.RTT.P95
+		loss[i] = period.Stats.PacketLoss.Mean
+		hasSpeedTests[i] = period.Stats.SpeedTests > 0
+		hasMeasurements[i] = period.Stats.Measurements > 0
+	}
+
+	options := report.Options
+	planLines := func(plan float64) []chartLine {
+		if plan == 0 {
+			return nil
+		}
+		return []chartLine{
+			{label: "plan", value: plan},
+			{label: fmt.Sprintf("%.0f%%", options.ThresholdPercent), value: plan * options.ThresholdPercent / 100},
+		}
+	}
+
+	return []htmltemplate.HTML{
+		barChart("Median download (Mbps)", labels, download, hasSpeedTests, planLines(options.PlanDownloadMbps)),
+		barChart("Median upload (Mbps)", labels, upload, hasSpeedTests, planLines(options.PlanUploadMbps)),
+		barChart("95th percentile round trip time (ms)", labels, rtt, hasMeasurements, nil),
+		barChart("Mean packet loss (%)", labels, loss, hasMeasurements, nil),
+	}
+}
+
+func barChart(title string, labels []string, values []float64, present []bool, lines []chartLine) htmltemplate.HTML {
+	maxValue := 0.0
+	for i, value := range values {
+		if present[i] {
+			maxValue = max(maxValue, value)
+		}
+	}
+	for _, line := range lines {
+		maxValue = max(maxValue, line.value)
+	}
+	maxValue = niceCeiling(maxValue * 1.05)
+
+	plotWidth := float64(chartWidth - chartLeft - chartRight)
+	plotHeight := float64(chartHeight - chartTop - chartBottom)
+	y := func(value float64) float64 {
+		return chartTop + plotHeight - value/maxValue*plotHeight
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<figure><figcaption>%s</figcaption>`, htmltemplate.HTMLEscapeString(title))
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" role="img" aria-label="%s">`,
+		chartWidth, chartHeight, htmltemplate.HTMLEscapeString(title))
+
+	// Grid lines, with the value of each.
+	for i := 0; i <= 4; i++ {
+		value := maxValue * float64(i) / 4
+		fmt.Fprintf(&b, `<line class="grid" x1="%d" x2="%d" y1="%.1f" y2="%.1f"/>`, chartLeft, chartWidth-chartRight, y(value), y(value))
+		fmt.Fprintf(&b, `<text class="axis" x="%d" y="%.1f" text-anchor="end">%s</text>`, chartLeft-6, y(value)+4, axisValue(value))
+	}
+
+	if len(values) > 0 {
+		slot := plotWidth / float64(len(values))
+		barWidth := max(slot*0.7, 1)
+		labelEvery := int(math.Ceil(float64(len(values)) / chartMaxLabels))
+		for i, value := range values {
+			x := chartLeft + slot*float64(i)
+			if present[i] {
+				fmt.Fprintf(&b, `<rect class="bar" x="%.1f" y="%.1f" width="%.1f" height="%.1f"><title>%s: %s</title></rect>`,
+					x+(slot-barWidth)/2, y(value), barWidth, y(0)-y(value),
+					htmltemplate.HTMLEscapeString(labels[i]), axisValue(value))
+			}
+			if i%labelEvery == 0 {
+				fmt.Fprintf(&b, `<text class="axis" x="%.1f" y="%d" text-anchor="middle">%s</text>`,
+					x+slot/2, chartHeight-chartBottom+16, htmltemplate.HTMLEscapeString(labels[i]))
+			}
+		}
+	}
+
+	for _, line := range lines {
+		fmt.Fprintf(&b, `<line class="reference" x1="%d" x2="%d" y1="%.1f" y2="%.1f"/>`, chartLeft, chartWidth-chartRight, y(line.value), y(line.value))
+		fmt.Fprintf(&b, `<text class="reference-label" x="%d" y="%.1f" text-anchor="end">%s %s</text>`,
+			chartWidth-chartRight, y(line.value)-4, htmltemplate.HTMLEscapeString(line.label), axisValue(line.value))
+	}
+
+	b.WriteString(`</svg></figure>`)
+	return htmltemplate.HTML(b.String())
+}
+
+// Rounds up to 1, 2 or 5 times a power of ten, so grid lines fall on readable
+// values.
+func niceCeiling(value float64) float64 {
+	if value <= 0 {
+		return 1
+	}
+	magnitude := math.Pow(10, math.Floor(math.Log10(value)))
+	for _, step := range []float64{1, 2, 5, 10} {
+		if value <= step*magnitude {
+			return step * magnitude
+		}
+	}
+	return 10 * magnitude
+}
+
+func axisValue(value float64) string {
+	if value == math.Trunc(value) {
+		return fmt.Sprintf("%.0f", value)
+	}
+	return fmt.Sprintf("%.1f", value)
+}
@@ -0,0 +1,188 @@
+// Package report summarizes stored measurements over a date range, as evidence
+// of the service an ISP is providing, and renders the summary as standalone
+// HTML or Markdown.
+package report
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/analytics"
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	"github.com/SkylerRankin/network_monitor/internal/database"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	PeriodDay  = "day"
+	PeriodWeek = "week"
+
+	// Default length of the range, ending now, when no start is given.
+	DefaultRangeDays = 30
+	// Default percentage of the plan speed a test must reach.
+	DefaultThresholdPercent = 80
+	// Ranges up to this long are broken down by day when no period is given,
+	// and longer ones by week.
+	autoPeriodMaxDays = 31
+)
+
+type Options struct {
+	Start time.Time
+	End   time.Time
+	// Advertised plan speeds. Zero if unknown, which leaves out the
+	// comparison for that direction.
+	PlanDownloadMbps float64
+	PlanUploadMbps   float64
+	// Speed tests below this percentage of the plan speed are counted.
+	ThresholdPercent float64
+	// PeriodDay or PeriodWeek. Chosen from the length of the range if empty.
+	Period string
+	// When the connection counts as up, as for the stats. The default
+	// definition if zero.
+	Availability config.Availability
+}
+
+// Validate fills in defaults and checks the options.
+func (o *Options) Validate() error {
+	if !o.End.After(o.Start) {
+		return errors.New("end must be after start")
+	}
+	if o.PlanDownloadMbps < 0 || o.PlanUploadMbps < 0 {
+		return errors.New("plan speeds must not be negative")
+	}
+	if o.ThresholdPercent == 0 {
+		o.ThresholdPercent = DefaultThresholdPercent
+	} else if o.ThresholdPercent < 0 || o.ThresholdPercent > 100 {
+		return errors.New("threshold must be between 0 and 100 percent")
+	}
+
+	if o.Availability == (config.Availability{}) {
+		o.Availability = config.Default().Stats.Availability
+	}
+
+	switch o.Period {
+	case PeriodDay, PeriodWeek:
+	case "":
+		o.Period = PeriodDay
+		if o.End.Sub(o.Start) > autoPeriodMaxDays*24*time.Hour {
+			o.Period = PeriodWeek
+		}
+	default:
+		return errors.Errorf("period must be %q or %q", PeriodDay, PeriodWeek)
+	}
+	return nil
+}
+
+type Report struct {
+	Options   Options
+	Generated time.Time
+	Summary   Stats
+	// Every day or week in the range, including those without measurements.
+	Periods []Period
+	Outages []Outage
+	// Total and mean length of the outages.
+	Downtime time.Duration
+	MTTR     time.Duration
+}
+
+type Period struct {
+	Start time.Time
+	Stats Stats
+}
+
+type Outage struct {
+	Start    time.Time
+	End      time.Time
+	Duration time.Duration
+	// The outage hadn't ended by the end of the report, so End is the end of
+	// the report or the time it was generated.
+	Ongoing     bool
+	Description string
+}
+
+// Build reads the measurements in the range from the database. Measurements
+// are read from a cursor, so only the values needed for the statistics are
+// held in memory. Availability and outages follow the availability definition,
+// the same as the stats.
+func Build(ctx context.Context, db database.Database, options Options, now time.Time) (*Report, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	report := &Report{Options: options, Generated: now}
+	var periodStarts []time.Time
+	for start := periodStart(options.Start, options.Period); start.Before(options.End); start = nextPeriod(start, options.Period) {
+		periodStarts = append(periodStarts, start)
+	}
+	periods := make([]accumulator, len(periodStarts))
+	var summary accumulator
+	tracker := analytics.NewTracker(options.Availability)
+
+	index := 0
+	err := db.ExportNetworkInfo(ctx, options.Start.UnixMilli(), options.End.UnixMilli(), false, func(info *types.NetworkInfo) error {
+		timestamp := time.UnixMilli(info.Timestamp).In(options.Start.Location())
+		// Measurements arrive in time order, so the period only moves forward.
+		for index+1 < len(periodStarts) && !timestamp.Before(periodStarts[index+1]) {
+			index += 1
+		}
+		up := tracker.Add(info)
+		summary.add(info, up, &options)
+		periods[index].add(info, up, &options)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read measurements")
+	}
+
+	report.Summary = summary.stats()
+	for i, start := range periodStarts {
+		report.Periods = append(report.Periods, Period{Start: start, Stats: periods[i].stats()})
+	}
+
+	reportEnd := options.End
+	if now.Before(reportEnd) {
+		reportEnd = now
+	}
+	for _, outage := range tracker.Outages {
+		o := Outage{Start: time.UnixMilli(outage.Start).In(options.Start.Location()), Description: describeOutage(outage)}
+		if end, err := outage.End.Get(); err == nil {
+			o.End = time.UnixMilli(end).In(options.Start.Location())
+		} else {
+			o.End = reportEnd
+			o.Ongoing = true
+		}
+		o.Duration = o.End.Sub(o.Start)
+		report.Outages = append(report.Outages, o)
+	}
+	report.Downtime = time.Duration(tracker.Downtime(reportEnd.UnixMilli())) * time.Millisecond
+	if len(report.Outages) > 0 {
+		report.MTTR = report.Downtime / time.Duration(len(report.Outages))
+	}
+
+	return report, nil
+}
+
+func describeOutage(outage analytics.Outage) string {
+	if outage.FailedPings == 1 {
+		return "1 failed ping"
+	}
+	return fmt.Sprintf("%d failed pings", outage.FailedPings)
+}
+
+func periodStart(t time.Time, period string) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	if period == PeriodWeek {
+		// Weeks start on Monday.
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	}
+	return day
+}
+
+func nextPeriod(start time.Time, period string) time.Time {
+	if period == PeriodWeek {
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 0, 1)
+}
@@ -0,0 +1,199 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	"github.com/SkylerRankin/network_monitor/internal/database/databasetest"
+	"github.com/SkylerRankin/network_monitor/internal/optional"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+)
+
+var reportStart = time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+
+func ping(offset time.Duration, successful bool, rtt int) types.NetworkInfo {
+	info := types.NetworkInfo{
+		Timestamp:      reportStart.Add(offset).UnixMilli(),
+		PingHost:       "Google",
+		PingHostName:   "8.8.8.8",
+		PingSuccessful: successful,
+		RTTMS:          rtt,
+	}
+	if !successful {
+		info.PacketLoss = 100
+	}
+	return info
+}
+
+func speedtest(offset time.Duration, download float64, upload float64) types.NetworkInfo {
+	info := ping(offset, true, 20)
+	info.DownloadSpeed = optional.New(download)
+	info.UploadSpeed = optional.New(upload)
+	return info
+}
+
+func testReport(t *testing.T, options Options) *Report {
+	db := &databasetest.Database{Measurements: []types.NetworkInfo{
+		ping(time.Hour, true, 10),
+		ping(2*time.Hour, false, 0),
+		ping(2*time.Hour+90*time.Second, true, 20),
+		speedtest(3*time.Hour, 95, 9),
+		ping(26*time.Hour, true, 30),
+		speedtest(27*time.Hour, 50, 10),
+		ping(47*time.Hour, false, 0),
+		ping(47*time.Hour+30*time.Minute, false, 0),
+		// After the end of the two day reports.
+		ping(72*time.Hour, true, 10),
+	}}
+
+	report, err := Build(context.Background(), db, options, reportStart.Add(100*time.Hour))
+	if err != nil {
+		t.Fatalf("failed to build report: %v", err)
+	}
+	return report
+}
+
+func TestBuild(t *testing.T) {
+	report := testReport(t, Options{
+		Start:            reportStart,
+		End:              reportStart.Add(48 * time.Hour),
+		PlanDownloadMbps: 100,
+		PlanUploadMbps:   10,
+	})
+
+	if report.Options.Period != PeriodDay || report.Options.ThresholdPercent != DefaultThresholdPercent {
+		t.Errorf("unexpected defaults %+v", report.Options)
+	}
+
+	summary := report.Summary
+	if summary.Measurements != 8 || summary.SpeedTests != 2 {
+		t.Errorf("unexpected counts %+v", summary)
+	}
+	if summary.Availability != 62.5 {
+		t.Errorf("expected 62.5%% availability, got %v", summary.Availability)
+	}
+	if summary.DownloadBelowPlan != 1 || summary.DownloadBelowPlanPercent != 50 {
+		t.Errorf("expected 1 download below plan, got %d (%v%%)", summary.DownloadBelowPlan, summary.DownloadBelowPlanPercent)
+	}
+	if summary.UploadBelowPlan != 0 {
+		t.Errorf("expected no uploads below plan, got %d", summary.UploadBelowPlan)
+	}
+	if rtt := summary.RTT; rtt.Count != 5 || rtt.P50 != 20 || rtt.P95 != 30 || rtt.Min != 10 || rtt.Mean != 20 {
+		t.Errorf("unexpected round trip times %+v", rtt)
+	}
+	if loss := summary.PacketLoss; loss.Mean != 37.5 || loss.P50 != 0 || loss.Max != 100 {
+		t.Errorf("unexpected packet loss %+v", loss)
+	}
+
+	if len(report.Periods) != 2 {
+		t.Fatalf("expected 2 days, got %d", len(report.Periods))
+	}
+	if first := report.Periods[0].Stats; first.Measurements != 4 || first.SpeedTests != 1 || first.DownloadBelowPlan != 0 {
+		t.Errorf("unexpected first day %+v", first)
+	}
+	if second := report.Periods[1]; !second.Start.Equal(reportStart.AddDate(0, 0, 1)) || second.Stats.Measurements != 4 || second.Stats.DownloadBelowPlan != 1 {
+		t.Errorf("unexpected second day %+v", second)
+	}
+
+	if len(report.Outages) != 2 {
+		t.Fatalf("expected 2 outages in the range, got %d", len(report.Outages))
+	}
+	if outage := report.Outages[0]; outage.Duration != 90*time.Second || outage.Ongoing || outage.Description != "1 failed ping" {
+		t.Errorf("unexpected first outage %+v", outage)
+	}
+	// Still going at the end of the report, so cut off there.
+	if outage := report.Outages[1]; outage.Duration != time.Hour || !outage.Ongoing || outage.Description != "2 failed pings" {
+		t.Errorf("unexpected second outage %+v", outage)
+	}
+	if report.Downtime != time.Hour+90*time.Second || report.MTTR != 30*time.Minute+45*time.Second {
+		t.Errorf("unexpected downtime %v and MTTR %v", report.Downtime, report.MTTR)
+	}
+}
+
+func TestBuildQuorum(t *testing.T) {
+	// One failed ping of the last two isn't an outage.
+	report := testReport(t, Options{
+		Start:        reportStart,
+		End:          reportStart.Add(48 * time.Hour),
+		Availability: config.Availability{QuorumWindow: 2, Quorum: 1, MaxPacketLossPercent: 100},
+	})
+
+	if report.Summary.Availability != 87.5 {
+		t.Errorf("expected 87.5%% availability, got %v", report.Summary.Availability)
+	}
+	if len(report.Outages) != 1 || report.Outages[0].Duration != 30*time.Minute || !report.Outages[0].Ongoing {
+		t.Errorf("expected only the second failure in a row to start an outage, got %+v", report.Outages)
+	}
+}
+
+func TestBuildWeeks(t *testing.T) {
+	// Wednesday to the Monday after next.
+	report := testReport(t, Options{
+		Start:  reportStart.AddDate(0, 0, 2),
+		End:    reportStart.AddDate(0, 0, 14),
+		Period: PeriodWeek,
+	})
+
+	if len(report.Periods) != 2 {
+		t.Fatalf("expected 2 weeks, got %d", len(report.Periods))
+	}
+	for i, period := range report.Periods {
+		if expected := reportStart.AddDate(0, 0, 7*i); !period.Start.Equal(expected) {
+			t.Errorf("expected week %d to start %v, got %v", i, expected, period.Start)
+		}
+	}
+	// Only the ping on Thursday is inside the range.
+	if measurements := report.Periods[0].Stats.Measurements; measurements != 1 {
+		t.Errorf("expected 1 measurement in the first week, got %d", measurements)
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	long := Options{Start: reportStart, End: reportStart.AddDate(0, 2, 0)}
+	if err := long.Validate(); err != nil || long.Period != PeriodWeek {
+		t.Errorf("expected weeks for a long range, got %q (%v)", long.Period, err)
+	}
+
+	for _, options := range []Options{
+		{Start: reportStart, End: reportStart},
+		{Start: reportStart, End: reportStart.Add(time.Hour), ThresholdPercent: 150},
+		{Start: reportStart, End: reportStart.Add(time.Hour), PlanDownloadMbps: -1},
+		{Start: reportStart, End: reportStart.Add(time.Hour), Period: "month"},
+	} {
+		if err := options.Validate(); err == nil {
+			t.Errorf("expected an error for %+v", options)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	report := testReport(t, Options{
+		Start:            reportStart,
+		End:              reportStart.Add(48 * time.Hour),
+		PlanDownloadMbps: 100,
+	})
+
+	var html bytes.Buffer
+	if err := Render(&html, report, FormatHTML); err != nil {
+		t.Fatalf("failed to render HTML: %v", err)
+	}
+	for _, expected := range []string{"<svg", "Below 80.0% of plan", "1 of 2 (50.0%)", "2 failed pings", "1m 30s"} {
+		if !strings.Contains(html.String(), expected) {
+			t.Errorf("expected HTML to contain %q", expected)
+		}
+	}
+
+	var markdown bytes.Buffer
+	if err := Render(&markdown, report, FormatMarkdown); err != nil {
+		t.Fatalf("failed to render Markdown: %v", err)
+	}
+	for _, expected := range []string{"# Network report", "| Download (Mbps) | 100.0 | 50.0 | 72.5 |", "| Mon 4 Mar 2024 | 75.0% |", "| ongoing | 1h 0m |", "| Mean time to recovery | 30m 45s |"} {
+		if !strings.Contains(markdown.String(), expected) {
+			t.Errorf("expected Markdown to contain %q", expected)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package report
+
+import (
+	"slices"
+
+	"github.com/SkylerRankin/network_monitor/internal/analytics"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+)
+
+// Stats summarizes the measurements in a range.
+type Stats struct {
+	Measurements int
+	// Percentage of measurements where the connection was up, by the
+	// availability definition.
+	Availability float64
+	SpeedTests   int
+	Download     Distribution
+	Upload       Distribution
+	// Speed tests below the threshold percentage of the plan speed. Only
+	// counted when the plan speed is known.
+	DownloadBelowPlan        int
+	UploadBelowPlan          int
+	DownloadBelowPlanPercent float64
+	UploadBelowPlanPercent   float64
+	// Round trip time of successful pings, in milliseconds.
+	RTT Distribution
+	// Packet loss percentage of each ping.
+	PacketLoss Distribution
+}
+
+// Distribution of a set of values. Count is 0 if there were none, in which case
+// the other fields are 0.
+type Distribution struct {
+	Count int
+	Min   float64
+	Mean  float64
+	P50   float64
+	P95   float64
+	P99   float64
+	Max   float64
+}
+
+// Collects the values for one range's statistics.
+type accumulator struct {
+	measurements      int
+	up                int
+	downloadBelowPlan int
+	uploadBelowPlan   int
+	downloads         []float64
+	uploads           []float64
+	rtts              []float64
+	packetLosses      []float64
+}
+
+// Adds a measurement, and whether the connection was up at it.
+func (a *accumulator) add(info *types.NetworkInfo, up bool, options *Options) {
+	a.measurements += 1
+	if up {
+		a.up += 1
+	}
+	a.packetLosses = append(a.packetLosses, float64(info.PacketLoss))
+	if info.PingSuccessful {
+		a.rtts = append(a.rtts, float64(info.RTTMS))
+	}
+
+	download, err := info.DownloadSpeed.Get()
+	if err != nil {
+		return
+	}
+	upload := info.UploadSpeed.Else(0)
+	a.downloads = append(a.downloads, download)
+	a.uploads = append(a.uploads, upload)
+	if options.PlanDownloadMbps > 0 && download < options.PlanDownloadMbps*options.ThresholdPercent/100 {
+		a.downloadBelowPlan += 1
+	}
+	if options.PlanUploadMbps > 0 && upload < options.PlanUploadMbps*options.ThresholdPercent/100 {
+		a.uploadBelowPlan += 1
+	}
+}
+
+func (a *accumulator) stats() Stats {
+	stats := Stats{
+		Measurements:      a.measurements,
+		SpeedTests:        len(a.downloads),
+		Download:          distribution(a.downloads),
+		Upload:            distribution(a.uploads),
+		DownloadBelowPlan: a.downloadBelowPlan,
+		UploadBelowPlan:   a.uploadBelowPlan,
+		RTT:               distribution(a.rtts),
+		PacketLoss:        distribution(a.packetLosses),
+	}
+	if a.measurements > 0 {
+		stats.Availability = 100 * float64(a.up) / float64(a.measurements)
+	}
+	if stats.SpeedTests > 0 {
+		stats.DownloadBelowPlanPercent = 100 * float64(a.downloadBelowPlan) / float64(stats.SpeedTests)
+		stats.UploadBelowPlanPercent = 100 * float64(a.uploadBelowPlan) / float64(stats.SpeedTests)
+	}
+	return stats
+}
+
+func distribution(values []float64) Distribution {
+	if len(values) == 0 {
+		return Distribution{}
+	}
+
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	sum := 0.0
+	for _, value := range sorted {
+		sum += value
+	}
+	return Distribution{
+		Count: len(sorted),
+		Min:   sorted[0],
+		Mean:  sum / float64(len(sorted)),
+		P50:   analytics.Percentile(sorted, 50),
+		P95:   analytics.Percentile(sorted, 95),
+		P99:   analytics.Percentile(sorted, 99),
+		Max:   sorted[len(sorted)-1],
+	}
+}
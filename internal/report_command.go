@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	"github.com/SkylerRankin/network_monitor/internal/database"
+	"github.com/SkylerRankin/network_monitor/internal/plan"
+	"github.com/SkylerRankin/network_monitor/internal/report"
+	"github.com/pkg/errors"
+)
+
+// Writes the ISP report for a range of the stored measurements, without
+// starting the monitor. Run as "netmon report [flags] <assetsPath>".
+func runReport(ctx context.Context, log *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("report", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: netmon report [flags] <assetsPath>")
+		flags.PrintDefaults()
+	}
+	from := flags.String("from", "", "start of the range, as a UTC date (2006-01-02), RFC 3339 time or unix milliseconds (default 30 days ago)")
+	to := flags.String("to", "", "end of the range, exclusive, in the same formats as -from (default now)")
+	format := flags.String("format", report.FormatHTML, "output format, html or markdown")
+	out := flags.String("out", "", "file to write the report to (default stdout)")
+	period := flags.String("period", "", "breakdown of the range, day or week (default day for up to 31 days, otherwise week)")
+	var options report.Options
+	flags.Float64Var(&options.PlanDownloadMbps, "plan-download", 0, "advertised download speed in Mbps (default from the configured plan)")
+	flags.Float64Var(&options.PlanUploadMbps, "plan-upload", 0, "advertised upload speed in Mbps (default from the configured plan)")
+	flags.Float64Var(&options.ThresholdPercent, "threshold", 0, "percentage of the plan speed a speed test must reach (default from the config)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("expected the assets path")
+	}
+	if *format != report.FormatHTML && *format != report.FormatMarkdown {
+		return errors.Errorf("unknown format %q", *format)
+	}
+
+	now := time.Now()
+	var err error
+	if options.Start, err = parseReportTime(*from, now.AddDate(0, 0, -report.DefaultRangeDays)); err != nil {
+		return errors.Wrap(err, "invalid -from")
+	}
+	if options.End, err = parseReportTime(*to, now); err != nil {
+		return errors.Wrap(err, "invalid -to")
+	}
+	options.Period = *period
+
+	assetsPath, err := filepath.Abs(flags.Arg(0))
+	if err != nil {
+		return errors.Wrap(err, "failed to get assets absolute path")
+	}
+	if _, err := os.Stat(assetsPath); err != nil {
+		return errors.Wrap(err, "assets path does not exist")
+	}
+
+	// Speeds and threshold not given as flags come from the plan in effect at
+	// the end of the range.
+	config, err := config.Load(assetsPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to load config")
+	}
+	if options.ThresholdPercent == 0 {
+		options.ThresholdPercent = config.ISP.Alert.ThresholdPercent
+	}
+	options.Availability = config.Stats.Availability
+	if plan := plan.NewSchedule(config.ISP).At(options.End.UnixMilli()); plan != nil {
+		if options.PlanDownloadMbps == 0 {
+			options.PlanDownloadMbps = plan.DownloadMbps
+		}
+		if options.PlanUploadMbps == 0 {
+			options.PlanUploadMbps = plan.UploadMbps
+		}
+	}
+	if err := options.Validate(); err != nil {
+		return err
+	}
+	db, err := database.NewDatabase(ctx, assetsPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to open database")
+	}
+	defer db.Close()
+
+	result, err := report.Build(ctx, db, options, now)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return errors.Wrap(err, "failed to create output file")
+		}
+		defer file.Close()
+		w = file
+	}
+	if err := report.Render(w, result, *format); err != nil {
+		return err
+	}
+
+	log.Info("wrote report", "from", options.Start, "to", options.End, "measurements", result.Summary.Measurements, "outages", len(result.Outages))
+	return nil
+}
+
+// Parses a UTC date, an RFC 3339 time or unix milliseconds, like the API's
+// time parameters, returning the default if the value is empty. Times are in
+// UTC, so the report's days are the same as the API's.
+func parseReportTime(value string, defaultTime time.Time) (time.Time, error) {
+	if value == "" {
+		return defaultTime.UTC(), nil
+	}
+	if parsed, err := strconv.ParseInt(value, 10, 64); err == nil && parsed >= 0 {
+		return time.UnixMilli(parsed).UTC(), nil
+	}
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return parsed.UTC(), nil
+		}
+	}
+	return time.Time{}, errors.Errorf("%q isn't a date, RFC 3339 time or unix milliseconds", value)
+}
@@ -0,0 +1,507 @@
+package server
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/analytics"
+	"github.com/SkylerRankin/network_monitor/internal/auth"
+	"github.com/SkylerRankin/network_monitor/internal/constants"
+	"github.com/SkylerRankin/network_monitor/internal/jobs"
+	"github.com/SkylerRankin/network_monitor/internal/network"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/SkylerRankin/network_monitor/internal/usage"
+	websocket_client "github.com/SkylerRankin/network_monitor/internal/websocket"
+	"github.com/pkg/errors"
+)
+
+const (
+	apiVersion = 1
+	apiPrefix  = "/api/v1/"
+	// Default range of speed test history returned when no start time is given.
+	defaultSpeedtestHistoryDays = 30
+	// Default range of interface traffic returned when no start time is given.
+	defaultTrafficDays = 1
+	// Default range of measurements returned when no start time or sequence
+	// number is given.
+	defaultMeasurementsDays = 1
+	// Default range of incidents returned when no start time is given.
+	defaultIncidentsDays = 30
+	// Default and maximum number of measurements returned by one request.
+	defaultMeasurementsLimit = 1000
+	maxMeasurementsLimit     = 10000
+	// Default and maximum number of buckets in aggregated measurements.
+	defaultAggregatePoints = 1000
+	maxAggregatePoints     = 10000
+)
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+type route struct {
+	pattern string
+	handler http.HandlerFunc
+}
+
+// Every REST API route. Each one is documented in openapi.json.
+func (s *server) apiRouteTable() []route {
+	return []route{
+		{"GET /api/v1/openapi.json", s.handleOpenAPI},
+		{"GET /api/v1/version", s.handleVersion},
+		{"GET /api/v1/status", s.handleStatus},
+		{"GET /api/v1/targets", s.handleTargets},
+		{"GET /api/v1/measurements", s.handleMeasurements},
+		{"GET /api/v1/measurements/aggregate", s.handleMeasurementsAggregate},
+		{"GET /api/v1/incidents", s.handleIncidents},
+		{"GET /api/v1/stats", s.handleStats},
+		{"GET /api/v1/heatmap", s.handleHeatmap},
+		{"GET /api/v1/speedtest/servers", s.handleSpeedtestServers},
+		{"GET /api/v1/speedtest/history", s.handleSpeedtestHistory},
+		{"GET /api/v1/plan", s.handlePlan},
+		{"POST /api/v1/probes/{name}/run", auth.Admin(s.handleProbeRun)},
+		{"GET /api/v1/probes/runs/{id}", s.handleProbeRunGet},
+		{"GET /api/v1/usage", s.handleUsage},
+		{"GET /api/v1/traffic", s.handleTraffic},
+		{"GET /api/v1/export", s.handleExport},
+		{"GET /api/v1/report", s.handleReport},
+		{"GET /api/v1/stream", s.handleStream},
+		{"GET /api/v1/stream/stats", s.handleStreamStats},
+		{"GET /api/v1/lan/download", s.handleLANDownload},
+		{"POST /api/v1/lan/upload", s.handleLANUpload},
+		{"GET /api/v1/lan/echo", s.handleLANEcho},
+		{"GET /api/v1/lan/results", s.handleLANResultsGet},
+		{"POST /api/v1/lan/results", s.handleLANResultsPost},
+	}
+}
+
+// Serves the REST API, answering unknown paths and methods with JSON errors
+// rather than the plain text ones from the mux.
+func (s *server) apiRoutes() http.Handler {
+	mux := http.NewServeMux()
+	for _, route := range s.apiRouteTable() {
+		mux.HandleFunc(route.pattern, route.handler)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		var allowed []string
+		for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+			probe := r.WithContext(r.Context())
+			probe.Method = method
+			if _, pattern := mux.Handler(probe); pattern != "" {
+				allowed = append(allowed, method)
+			}
+		}
+
+		if len(allowed) == 0 {
+			s.writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		for _, method := range allowed {
+			w.Header().Add("Allow", method)
+		}
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	})
+}
+
+func (s *server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(openAPIDocument)))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(openAPIDocument); err != nil {
+		s.log.Error("failed to write response", "err", err)
+	}
+}
+
+func (s *server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, types.Version{
+		Commit:          constants.Commit,
+		APIVersion:      apiVersion,
+		ProtocolVersion: websocket_client.ProtocolVersion,
+	})
+}
+
+func (s *server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := s.status(r.Context())
+	if err != nil {
+		s.log.Error("failed to get status", "err", err)
+		s.writeError(w, http.StatusInternalServerError, "failed to get status")
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, status)
+}
+
+// Returns the current state of the network, shared by the API and the status
+// page.
+func (s *server) status(ctx context.Context) (*types.Status, error) {
+	status := types.Status{StartedAt: s.startedAt.UnixMilli()}
+
+	var err error
+	if status.LastMeasurement, err = s.database.GetLatestNetworkInfo(ctx); err != nil {
+		return nil, errors.Wrap(err, "failed to get latest measurement from database")
+	}
+	if status.LastSuccessfulPing, err = s.database.GetLastSuccessfulPing(ctx); err != nil {
+		return nil, errors.Wrap(err, "failed to get last successful ping from database")
+	}
+	if status.LastSpeedTest, err = s.database.GetLatestSpeedtest(ctx); err != nil {
+		return nil, errors.Wrap(err, "failed to get latest speed test from database")
+	}
+	if status.LastSpeedTest != nil {
+		status.LastSpeedTest.Plan = s.plans.Compare(status.LastSpeedTest.Timestamp, status.LastSpeedTest.Download, status.LastSpeedTest.Upload)
+	}
+	status.Online = status.LastMeasurement != nil && status.LastMeasurement.PingSuccessful
+
+	return &status, nil
+}
+
+func (s *server) handleTargets(w http.ResponseWriter, r *http.Request) {
+	targets, err := s.database.GetTargets(r.Context())
+	if err != nil {
+		s.log.Error("failed to get targets from database", "err", err)
+		s.writeError(w, http.StatusInternalServerError, "failed to get targets")
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, targets)
+}
+
+// Returns the "window" ending now, "day", "week" or "month", or the "from"
+// and "to" times for a custom window. A custom window starts at the start of
+// the default window if "from" is missing.
+func windowParams(r *http.Request, defaultWindow string, now time.Time) (string, time.Time, time.Time, error) {
+	query := r.URL.Query()
+	window := query.Get("window")
+	if window == "" {
+		window = defaultWindow
+		if query.Has("from") || query.Has("to") {
+			window = analytics.WindowCustom
+		}
+	}
+
+	if window != analytics.WindowCustom {
+		start, err := analytics.WindowStart(window, now)
+		if err != nil {
+			return "", time.Time{}, time.Time{}, errors.New("invalid window parameter")
+		}
+		return window, start, now, nil
+	}
+
+	defaultStart, err := analytics.WindowStart(defaultWindow, now)
+	if err != nil {
+		return "", time.Time{}, time.Time{}, err
+	}
+	startTime, err := timeParam(r, "from", defaultStart)
+	if err != nil {
+		return "", time.Time{}, time.Time{}, err
+	}
+	endTime, err := timeParam(r, "to", now)
+	if err != nil {
+		return "", time.Time{}, time.Time{}, err
+	}
+	if endTime <= startTime {
+		return "", time.Time{}, time.Time{}, errors.New("to must be after from")
+	}
+	return window, time.UnixMilli(startTime), time.UnixMilli(endTime), nil
+}
+
+// Returns availability and performance statistics over a "window" ending now,
+// "day", "week" or "month", or between the "from" and "to" times for a custom
+// window.
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	window, start, end, err := windowParams(r, analytics.WindowDay, now)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	stats, err := analytics.Compute(r.Context(), s.database, s.config.Stats.Availability, window, start, end, now)
+	if err != nil {
+		s.log.Error("failed to compute stats", "window", window, "err", err)
+		s.writeError(w, http.StatusInternalServerError, "failed to compute stats")
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, stats)
+}
+
+// Returns median round trip time, packet loss and median download speed for
+// each hour of the week, over a window selected like the stats. Days and hours
+// are in the "tz" time zone, by default the server's.
+func (s *server) handleHeatmap(w http.ResponseWriter, r *http.Request) {
+	window, start, end, err := windowParams(r, analytics.WindowWeek, time.Now())
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	location := analytics.LocalLocation()
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		if location, err = time.LoadLocation(tz); err != nil {
+			s.writeError(w, http.StatusBadRequest, "invalid tz parameter")
+			return
+		}
+	}
+
+	heatmap, err := analytics.Heatmap(r.Context(), s.database, window, start, end, location)
+	if err != nil {
+		s.log.Error("failed to compute heatmap", "window", window, "err", err)
+		s.writeError(w, http.StatusInternalServerError, "failed to compute heatmap")
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, heatmap)
+}
+
+// Returns incidents that started between the "from" and "to" times in unix
+// milliseconds.
+func (s *server) handleIncidents(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	startTime, err := timeParam(r, "from", now.AddDate(0, 0, -defaultIncidentsDays))
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	endTime, err := timeParam(r, "to", now)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if endTime <= startTime {
+		s.writeError(w, http.StatusBadRequest, "to must be after from")
+		return
+	}
+
+	incidents, err := s.database.GetIncidents(r.Context(), startTime, endTime)
+	if err != nil {
+		s.log.Error("failed to get incidents from database", "err", err)
+		s.writeError(w, http.StatusInternalServerError, "failed to get incidents")
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, incidents)
+}
+
+func (s *server) handleSpeedtestServers(w http.ResponseWriter, r *http.Request) {
+	servers, err := network.FetchSpeedtestServers(r.Context())
+	if err != nil {
+		s.log.Error("failed to fetch speed test servers", "err", err)
+		s.writeError(w, http.StatusBadGateway, "failed to fetch speed test servers")
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, servers)
+}
+
+// Returns speed test results, optionally filtered to a single server with the
+// "server" query parameter. The "from" parameter sets the start time in unix
+// milliseconds.
+func (s *server) handleSpeedtestHistory(w http.ResponseWriter, r *http.Request) {
+	startTime, err := timeParam(r, "from", time.Now().AddDate(0, 0, -defaultSpeedtestHistoryDays))
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	history, err := s.database.GetSpeedtestHistory(r.Context(), int(startTime), r.URL.Query().Get("server"))
+	if err != nil {
+		s.log.Error("failed to get speed test history from database", "err", err)
+		s.writeError(w, http.StatusInternalServerError, "failed to get speed test history")
+		return
+	}
+	s.plans.Annotate(history)
+
+	s.writeJSON(w, http.StatusOK, history)
+}
+
+// Returns the configured internet plans and how the recent speed tests compare
+// to them.
+func (s *server) handlePlan(w http.ResponseWriter, r *http.Request) {
+	var recent []types.SpeedtestRecord
+	if windowTests := s.config.ISP.Alert.WindowTests; windowTests > 0 {
+		var err error
+		if recent, err = s.database.GetRecentSpeedtests(r.Context(), windowTests); err != nil {
+			s.log.Error("failed to get recent speed tests from database", "err", err)
+			s.writeError(w, http.StatusInternalServerError, "failed to get plan")
+			return
+		}
+	}
+
+	s.writeJSON(w, http.StatusOK, s.plans.Status(recent, time.Now()))
+}
+
+// Returns the recorded interface traffic, optionally filtered to a single
+// interface with the "interface" query parameter. The "from" parameter sets the
+// start time in unix milliseconds.
+func (s *server) handleTraffic(w http.ResponseWriter, r *http.Request) {
+	startTime, err := timeParam(r, "from", time.Now().AddDate(0, 0, -defaultTrafficDays))
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	traffic, err := s.database.GetInterfaceTraffic(r.Context(), int(startTime), r.URL.Query().Get("interface"))
+	if err != nil {
+		s.log.Error("failed to get interface traffic from database", "err", err)
+		s.writeError(w, http.StatusInternalServerError, "failed to get interface traffic")
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, traffic)
+}
+
+// Returns stored measurements, either those after the "from" time in unix
+// milliseconds, or up to "limit" of those after the "after_seq" sequence
+// number. The latter lets clients fill in what they missed while disconnected,
+// requesting until fewer than "limit" measurements are returned.
+func (s *server) handleMeasurements(w http.ResponseWriter, r *http.Request) {
+	if !r.URL.Query().Has("after_seq") {
+		startTime, err := timeParam(r, "from", time.Now().AddDate(0, 0, -defaultMeasurementsDays))
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		batch, err := s.database.GetNetworkInfoBatch(r.Context(), int(startTime))
+		if err != nil {
+			s.log.Error("failed to get measurements from database", "err", err)
+			s.writeError(w, http.StatusInternalServerError, "failed to get measurements")
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, batch)
+		return
+	}
+
+	afterSeq, err := strconv.ParseInt(r.URL.Query().Get("after_seq"), 10, 64)
+	if err != nil || afterSeq < 0 {
+		s.writeError(w, http.StatusBadRequest, "invalid after_seq parameter")
+		return
+	}
+
+	limit := defaultMeasurementsLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxMeasurementsLimit {
+			s.writeError(w, http.StatusBadRequest, "invalid limit parameter")
+			return
+		}
+		limit = parsed
+	}
+
+	batch, err := s.database.GetNetworkInfoAfterSeq(r.Context(), afterSeq, limit)
+	if err != nil {
+		s.log.Error("failed to get measurements from database", "err", err)
+		s.writeError(w, http.StatusInternalServerError, "failed to get measurements")
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, batch)
+}
+
+// Returns the measurements from the "from" time up to the "to" time summarized
+// in about "points" buckets, so that long ranges can be charted. Buckets are
+// never shorter than the interval between measurements, and start at a
+// multiple of their length so that they stay the same as the range moves.
+func (s *server) handleMeasurementsAggregate(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	startTime, err := timeParam(r, "from", now.AddDate(0, 0, -defaultMeasurementsDays))
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	endTime, err := timeParam(r, "to", now)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if endTime <= startTime {
+		s.writeError(w, http.StatusBadRequest, "to must be after from")
+		return
+	}
+
+	points := defaultAggregatePoints
+	if value := r.URL.Query().Get("points"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxAggregatePoints {
+			s.writeError(w, http.StatusBadRequest, "invalid points parameter")
+			return
+		}
+		points = parsed
+	}
+
+	bucketMS := max((endTime-startTime+int64(points)-1)/int64(points), jobs.NetworkJobInterval.Milliseconds())
+	startTime -= startTime % bucketMS
+
+	aggregate, err := s.database.GetNetworkInfoAggregate(r.Context(), startTime, endTime, bucketMS)
+	if err != nil {
+		s.log.Error("failed to get aggregated measurements from database", "err", err)
+		s.writeError(w, http.StatusInternalServerError, "failed to get measurements")
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, aggregate)
+}
+
+// Returns the data used by speed tests in the current billing period.
+func (s *server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	dataUsage, err := usage.Get(r.Context(), s.database, s.config.Speedtest.Budget, time.Now())
+	if err != nil {
+		s.log.Error("failed to get data usage", "err", err)
+		s.writeError(w, http.StatusInternalServerError, "failed to get data usage")
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, dataUsage)
+}
+
+// Parses a time from the query parameter as unix milliseconds, an RFC 3339
+// time or a UTC date, returning the default if it's missing.
+func timeParam(r *http.Request, name string, defaultTime time.Time) (int64, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return defaultTime.UnixMilli(), nil
+	}
+	if parsed, err := strconv.ParseInt(value, 10, 64); err == nil && parsed >= 0 {
+		return parsed, nil
+	}
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return parsed.UnixMilli(), nil
+		}
+	}
+	return 0, errors.Errorf("invalid %s parameter", name)
+}
+
+func (s *server) writeJSON(w http.ResponseWriter, status int, value any) {
+	jsonData, err := json.Marshal(value)
+	if err != nil {
+		s.log.Error("failed to marshal response", "err", err)
+		s.writeError(w, http.StatusInternalServerError, "failed to marshal response")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(jsonData)))
+	// Responses describe the current state of the network, so are never
+	// reused.
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if _, err := w.Write(jsonData); err != nil {
+		s.log.Error("failed to write response", "err", err)
+	}
+}
+
+// Writes an error response with the same shape for every API error.
+func (s *server) writeError(w http.ResponseWriter, status int, message string) {
+	s.writeJSON(w, status, types.APIError{Status: status, Message: message})
+}
@@ -0,0 +1,515 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/auth"
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	"github.com/SkylerRankin/network_monitor/internal/database"
+	"github.com/SkylerRankin/network_monitor/internal/database/databasetest"
+	"github.com/SkylerRankin/network_monitor/internal/optional"
+	"github.com/SkylerRankin/network_monitor/internal/plan"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/pkg/errors"
+	_ "modernc.org/sqlite"
+)
+
+// Implements the queries used by the API handlers under test. Calling any
+// other method panics on the nil embedded interface.
+type fakeDatabase struct {
+	databasetest.Database
+	err error
+
+	batch          *types.NetworkInfoBatch
+	startTime      int
+	afterSeq       int64
+	limit          int
+	aggregate      *types.NetworkInfoAggregate
+	aggregateArgs  [3]int64
+	latest         *types.NetworkInfo
+	lastPing       optional.Opt[int64]
+	speedtest      *types.SpeedtestRecord
+	recent         []types.SpeedtestRecord
+	targets        []types.Target
+	incidents      []types.Incident
+	incidentsRange [2]int64
+	traffic        []types.InterfaceTraffic
+	lanResults     []types.LANTestResult
+}
+
+func (d *fakeDatabase) GetNetworkInfoBatch(ctx context.Context, startTime int) (*types.NetworkInfoBatch, error) {
+	d.startTime = startTime
+	return d.batch, d.err
+}
+
+func (d *fakeDatabase) GetNetworkInfoAfterSeq(ctx context.Context, afterSeq int64, limit int) (*types.NetworkInfoBatch, error) {
+	d.afterSeq, d.limit = afterSeq, limit
+	return d.batch, d.err
+}
+
+func (d *fakeDatabase) GetNetworkInfoAggregate(ctx context.Context, startTime int64, endTime int64, bucketMS int64) (*types.NetworkInfoAggregate, error) {
+	d.aggregateArgs = [3]int64{startTime, endTime, bucketMS}
+	return d.aggregate, d.err
+}
+
+func (d *fakeDatabase) GetLatestNetworkInfo(context.Context) (*types.NetworkInfo, error) {
+	return d.latest, d.err
+}
+
+func (d *fakeDatabase) GetLastSuccessfulPing(context.Context) (optional.Opt[int64], error) {
+	return d.lastPing, d.err
+}
+
+func (d *fakeDatabase) GetLatestSpeedtest(context.Context) (*types.SpeedtestRecord, error) {
+	return d.speedtest, d.err
+}
+
+func (d *fakeDatabase) GetRecentSpeedtests(ctx context.Context, count int) ([]types.SpeedtestRecord, error) {
+	return d.recent[max(len(d.recent)-count, 0):], d.err
+}
+
+func (d *fakeDatabase) GetTargets(context.Context) ([]types.Target, error) {
+	return d.targets, d.err
+}
+
+func (d *fakeDatabase) GetIncidents(ctx context.Context, startTime int64, endTime int64) ([]types.Incident, error) {
+	d.incidentsRange = [2]int64{startTime, endTime}
+	return d.incidents, d.err
+}
+
+func (d *fakeDatabase) ExportNetworkInfo(ctx context.Context, startTime int64, endTime int64, speedTestsOnly bool, fn func(*types.NetworkInfo) error) error {
+	if d.err != nil {
+		return d.err
+	}
+	return d.Database.ExportNetworkInfo(ctx, startTime, endTime, speedTestsOnly, fn)
+}
+
+func (d *fakeDatabase) ExportInterfaceTraffic(ctx context.Context, startTime int64, endTime int64, fn func(*types.InterfaceTraffic) error) error {
+	for i := range d.traffic {
+		if err := fn(&d.traffic[i]); err != nil {
+			return err
+		}
+	}
+	return d.err
+}
+
+func (d *fakeDatabase) InsertLANTestResult(ctx context.Context, result *types.LANTestResult) error {
+	if d.err == nil {
+		d.lanResults = append(d.lanResults, *result)
+	}
+	return d.err
+}
+
+func (d *fakeDatabase) GetLANTestResults(ctx context.Context, startTime int) ([]types.LANTestResult, error) {
+	d.startTime = startTime
+	return d.lanResults, d.err
+}
+
+func newTestServer(db database.Database, authConfig config.Auth) *server {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	c := config.Default()
+	c.Auth = authConfig
+	return &server{
+		ctx:       context.Background(),
+		log:       log,
+		config:    c,
+		auth:      auth.NewAuthenticator(log, authConfig),
+		database:  db,
+		plans:     plan.NewSchedule(c.ISP),
+		startedAt: time.UnixMilli(1000),
+	}
+}
+
+func get(t *testing.T, s *server, method string, target string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	res := httptest.NewRecorder()
+	s.routes().ServeHTTP(res, req)
+	return res
+}
+
+func decode[T any](t *testing.T, res *httptest.ResponseRecorder) T {
+	t.Helper()
+	if contentType := res.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("expected json content type, got %q", contentType)
+	}
+	var value T
+	if err := json.Unmarshal(res.Body.Bytes(), &value); err != nil {
+		t.Fatalf("failed to decode %q: %v", res.Body.String(), err)
+	}
+	return value
+}
+
+func expectError(t *testing.T, res *httptest.ResponseRecorder, status int, message string) {
+	t.Helper()
+	if res.Code != status {
+		t.Errorf("expected status %d, got %d", status, res.Code)
+	}
+	body := decode[types.APIError](t, res)
+	if body.Status != status || body.Message != message {
+		t.Errorf("expected error %d %q, got %+v", status, message, body)
+	}
+}
+
+func TestMeasurements(t *testing.T) {
+	db := &fakeDatabase{batch: &types.NetworkInfoBatch{Seqs: []int64{4, 5}, Timestamps: []int64{40, 50}}}
+	s := newTestServer(db, config.Auth{})
+
+	res := get(t, s, http.MethodGet, "/api/v1/measurements?from=1234", nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.Code)
+	}
+	if length := res.Header().Get("Content-Length"); length != strconv.Itoa(res.Body.Len()) {
+		t.Errorf("expected content length %d, got %q", res.Body.Len(), length)
+	}
+	if batch := decode[types.NetworkInfoBatch](t, res); len(batch.Seqs) != 2 || batch.Timestamps[1] != 50 {
+		t.Errorf("unexpected batch %+v", batch)
+	}
+	if db.startTime != 1234 {
+		t.Errorf("expected start time 1234, got %d", db.startTime)
+	}
+
+	res = get(t, s, http.MethodGet, "/api/v1/measurements?after_seq=3&limit=2", nil)
+	if res.Code != http.StatusOK || db.afterSeq != 3 || db.limit != 2 {
+		t.Errorf("expected after_seq query, got %d with %d, %d", res.Code, db.afterSeq, db.limit)
+	}
+
+	expectError(t, get(t, s, http.MethodGet, "/api/v1/measurements?from=yesterday", nil), http.StatusBadRequest, "invalid from parameter")
+	expectError(t, get(t, s, http.MethodGet, "/api/v1/measurements?after_seq=-1", nil), http.StatusBadRequest, "invalid after_seq parameter")
+	expectError(t, get(t, s, http.MethodGet, "/api/v1/measurements?after_seq=0&limit=100000", nil), http.StatusBadRequest, "invalid limit parameter")
+
+	db.err = errors.New("disk full")
+	expectError(t, get(t, s, http.MethodGet, "/api/v1/measurements", nil), http.StatusInternalServerError, "failed to get measurements")
+}
+
+func TestMeasurementsAfterSeqStored(t *testing.T) {
+	db, err := database.NewDatabase(context.Background(), t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	defer db.Close()
+	for _, timestamp := range []int64{1000, 2000, 3000} {
+		info := types.NetworkInfo{Timestamp: timestamp, PingHost: "1.1.1.1", PingHostName: "cloudflare", PingSuccessful: true, RTTMS: 10}
+		if err := db.InsertNetworkInfo(context.Background(), &info); err != nil {
+			t.Fatalf("failed to insert measurement: %v", err)
+		}
+	}
+	s := newTestServer(db, config.Auth{})
+
+	// Resuming pages through everything stored after the last seq seen.
+	var seqs []int64
+	afterSeq := int64(0)
+	for {
+		res := get(t, s, http.MethodGet, fmt.Sprintf("/api/v1/measurements?after_seq=%d&limit=2", afterSeq), nil)
+		if res.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", res.Code)
+		}
+		batch := decode[struct {
+			Seqs []int64 `json:"seqs"`
+		}](t, res)
+		if len(batch.Seqs) == 0 {
+			break
+		}
+		seqs = append(seqs, batch.Seqs...)
+		afterSeq = batch.Seqs[len(batch.Seqs)-1]
+	}
+	if !slices.Equal(seqs, []int64{1, 2, 3}) {
+		t.Errorf("expected seqs 1 to 3, got %v", seqs)
+	}
+}
+
+func TestMeasurementsAggregate(t *testing.T) {
+	db := &fakeDatabase{aggregate: &types.NetworkInfoAggregate{
+		BucketMS:   60000,
+		LastSeq:    9,
+		Timestamps: []int64{0, 60000},
+		PingValues: []float64{1, 0.5},
+		Download: types.AggregateSeries{
+			Mean: []optional.Opt[float64]{optional.Empty[float64](), optional.New(100.0)},
+		},
+		Targets: []types.TargetAggregate{{
+			Name:       "Google",
+			RTTMS:      types.AggregateSeries{Mean: []optional.Opt[float64]{optional.New(20.0), optional.Empty[float64]()}},
+			PacketLoss: []optional.Opt[float64]{optional.New(0.0), optional.New(100.0)},
+		}},
+	}}
+	s := newTestServer(db, config.Auth{})
+
+	res := get(t, s, http.MethodGet, "/api/v1/measurements/aggregate?from=0&to=3600000&points=60", nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.Code)
+	}
+	aggregate := decode[struct {
+		LastSeq  int64     `json:"lastSeq"`
+		Ping     []float64 `json:"ping"`
+		Download struct {
+			Mean []*float64 `json:"mean"`
+		} `json:"download"`
+		Targets []struct {
+			Name  string `json:"name"`
+			RTTMS struct {
+				Mean []*float64 `json:"mean"`
+			} `json:"rttMS"`
+			PacketLoss []float64 `json:"packetLoss"`
+		} `json:"targets"`
+	}](t, res)
+	if aggregate.LastSeq != 9 || len(aggregate.Ping) != 2 || aggregate.Download.Mean[0] != nil || *aggregate.Download.Mean[1] != 100 {
+		t.Errorf("unexpected aggregate %+v", aggregate)
+	}
+	if target := aggregate.Targets[0]; target.Name != "Google" || *target.RTTMS.Mean[0] != 20 || target.RTTMS.Mean[1] != nil || target.PacketLoss[1] != 100 {
+		t.Errorf("unexpected target aggregate %+v", target)
+	}
+	if db.aggregateArgs != [3]int64{0, 3600000, 60000} {
+		t.Errorf("expected one minute buckets, got %v", db.aggregateArgs)
+	}
+
+	// Buckets start at a multiple of their length, and are never shorter than
+	// the interval between measurements.
+	get(t, s, http.MethodGet, "/api/v1/measurements/aggregate?from=100000&to=200000&points=1000", nil)
+	if db.aggregateArgs != [3]int64{90000, 200000, 30000} {
+		t.Errorf("expected aligned 30 second buckets, got %v", db.aggregateArgs)
+	}
+
+	expectError(t, get(t, s, http.MethodGet, "/api/v1/measurements/aggregate?from=2000&to=1000", nil), http.StatusBadRequest, "to must be after from")
+	expectError(t, get(t, s, http.MethodGet, "/api/v1/measurements/aggregate?points=0", nil), http.StatusBadRequest, "invalid points parameter")
+	expectError(t, get(t, s, http.MethodGet, "/api/v1/measurements/aggregate?points=100000", nil), http.StatusBadRequest, "invalid points parameter")
+
+	db.err = errors.New("disk full")
+	expectError(t, get(t, s, http.MethodGet, "/api/v1/measurements/aggregate", nil), http.StatusInternalServerError, "failed to get measurements")
+}
+
+func TestStatus(t *testing.T) {
+	db := &fakeDatabase{}
+	s := newTestServer(db, config.Auth{})
+
+	res := get(t, s, http.MethodGet, "/api/v1/status", nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.Code)
+	}
+	var empty map[string]any
+	if err := json.Unmarshal(res.Body.Bytes(), &empty); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"lastMeasurement", "lastSuccessfulPing", "lastSpeedTest"} {
+		if value, ok := empty[field]; !ok || value != nil {
+			t.Errorf("expected %s to be null before any measurements, got %v", field, value)
+		}
+	}
+
+	db.latest = &types.NetworkInfo{Seq: 9, PingSuccessful: true, PingHost: "Google", Timestamp: 90}
+	db.lastPing = optional.New[int64](90)
+	db.speedtest = &types.SpeedtestRecord{Timestamp: 80, Download: 100}
+	// Decoded separately since optional values can't be unmarshaled.
+	status := decode[struct {
+		Online             bool
+		LastMeasurement    *types.NetworkInfo
+		LastSuccessfulPing int64
+		LastSpeedTest      *types.SpeedtestRecord
+		StartedAt          int64
+	}](t, get(t, s, http.MethodGet, "/api/v1/status", nil))
+	if !status.Online || status.LastMeasurement.Seq != 9 || status.LastSuccessfulPing != 90 || status.LastSpeedTest.Download != 100 || status.StartedAt != 1000 {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestTargetsAndIncidents(t *testing.T) {
+	db := &fakeDatabase{
+		targets:   []types.Target{{Name: "Google", Host: "8.8.8.8", Measurements: 10, Availability: 0.9}},
+		incidents: []types.Incident{{ID: "outage-5", Kind: types.IncidentKindOutage, Start: 5}},
+	}
+	s := newTestServer(db, config.Auth{})
+
+	targets := decode[[]types.Target](t, get(t, s, http.MethodGet, "/api/v1/targets", nil))
+	if len(targets) != 1 || targets[0].Host != "8.8.8.8" {
+		t.Errorf("unexpected targets %+v", targets)
+	}
+
+	res := get(t, s, http.MethodGet, "/api/v1/incidents?from=3&to=9", nil)
+	if !strings.Contains(res.Body.String(), `"end":null`) {
+		t.Errorf("expected ongoing incident to have a null end, got %s", res.Body.String())
+	}
+	if db.incidentsRange != [2]int64{3, 9} {
+		t.Errorf("expected incidents from 3 to 9, got %v", db.incidentsRange)
+	}
+	expectError(t, get(t, s, http.MethodGet, "/api/v1/incidents?from=9&to=3", nil), http.StatusBadRequest, "to must be after from")
+}
+
+func TestStats(t *testing.T) {
+	db := &fakeDatabase{Database: databasetest.Database{Measurements: []types.NetworkInfo{
+		{Timestamp: 1000, PingSuccessful: true, RTTMS: 20},
+		{Timestamp: 2000, PingSuccessful: false, PacketLoss: 100},
+		{Timestamp: 3000, PingSuccessful: true, RTTMS: 30},
+	}}}
+	s := newTestServer(db, config.Auth{})
+
+	stats := decode[struct {
+		Window              string
+		Measurements        int
+		AvailabilityPercent float64
+		Outages             int
+		MTTRMS              int64
+		RTTMS               *types.Percentiles
+	}](t, get(t, s, http.MethodGet, "/api/v1/stats?from=0&to=4000", nil))
+	if stats.Window != "custom" || stats.Measurements != 3 || stats.Outages != 1 || stats.MTTRMS != 1000 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if stats.RTTMS == nil || stats.RTTMS.P50 != 20 || stats.RTTMS.P99 != 30 {
+		t.Errorf("unexpected round trip times %+v", stats.RTTMS)
+	}
+
+	res := get(t, s, http.MethodGet, "/api/v1/stats?window=week", nil)
+	if !strings.Contains(res.Body.String(), `"availabilityPercent":null`) {
+		t.Errorf("expected no availability in the last week, got %s", res.Body.String())
+	}
+
+	expectError(t, get(t, s, http.MethodGet, "/api/v1/stats?window=year", nil), http.StatusBadRequest, "invalid window parameter")
+	expectError(t, get(t, s, http.MethodGet, "/api/v1/stats?from=4000&to=1000", nil), http.StatusBadRequest, "to must be after from")
+}
+
+func TestHeatmap(t *testing.T) {
+	// A Tuesday at 21:00 UTC.
+	db := &fakeDatabase{Database: databasetest.Database{Measurements: []types.NetworkInfo{
+		{Timestamp: 1700600400000, PingSuccessful: true, RTTMS: 90, DownloadSpeed: optional.New(50.0)},
+	}}}
+	s := newTestServer(db, config.Auth{})
+
+	heatmap := decode[struct {
+		Window   string
+		TimeZone string
+		Days     [][]struct {
+			Measurements       int
+			MedianRTTMS        *float64
+			MedianDownloadMbps *float64
+		}
+	}](t, get(t, s, http.MethodGet, "/api/v1/heatmap?from=2023-11-20&to=2023-11-27&tz=UTC", nil))
+	if heatmap.Window != "custom" || heatmap.TimeZone != "UTC" || len(heatmap.Days) != 7 {
+		t.Fatalf("unexpected heatmap %+v", heatmap)
+	}
+	cell := heatmap.Days[2][21]
+	if cell.Measurements != 1 || cell.MedianRTTMS == nil || *cell.MedianRTTMS != 90 || *cell.MedianDownloadMbps != 50 {
+		t.Errorf("unexpected cell %+v", cell)
+	}
+	if heatmap.Days[2][20].MedianRTTMS != nil {
+		t.Errorf("expected an empty cell, got %+v", heatmap.Days[2][20])
+	}
+
+	expectError(t, get(t, s, http.MethodGet, "/api/v1/heatmap?tz=Mars/Olympus", nil), http.StatusBadRequest, "invalid tz parameter")
+	expectError(t, get(t, s, http.MethodGet, "/api/v1/heatmap?window=year", nil), http.StatusBadRequest, "invalid window parameter")
+}
+
+func TestPlan(t *testing.T) {
+	db := &fakeDatabase{recent: []types.SpeedtestRecord{
+		{Timestamp: 1000, Download: 100, Upload: 20},
+		{Timestamp: 2000, Download: 50, Upload: 20},
+		{Timestamp: 3000, Download: 60, Upload: 20},
+	}}
+	s := newTestServer(db, config.Auth{})
+	isp := config.ISP{
+		Plans: []config.ISPPlan{{Name: "Fiber", DownloadMbps: 100, UploadMbps: 20}},
+		Alert: config.PlanAlert{WindowTests: 2, ThresholdPercent: 80},
+	}
+	s.config.ISP = isp
+	s.plans = plan.NewSchedule(isp)
+
+	status := decode[struct {
+		Current               *types.Plan
+		RecentDownloadPercent float64
+		RecentUploadPercent   float64
+		BelowPlan             bool
+	}](t, get(t, s, http.MethodGet, "/api/v1/plan", nil))
+	if status.Current == nil || status.Current.Name != "Fiber" {
+		t.Errorf("expected the fiber plan, got %+v", status.Current)
+	}
+	if status.RecentDownloadPercent != 55 || status.RecentUploadPercent != 100 || !status.BelowPlan {
+		t.Errorf("unexpected recent averages %+v", status)
+	}
+
+	db.speedtest = &db.recent[2]
+	lastSpeedTest := decode[struct{ LastSpeedTest types.SpeedtestRecord }](t, get(t, s, http.MethodGet, "/api/v1/status", nil)).LastSpeedTest
+	if lastSpeedTest.Plan == nil || lastSpeedTest.Plan.DownloadPercent != 60 {
+		t.Errorf("expected the speed test against the plan, got %+v", lastSpeedTest.Plan)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	version := decode[types.Version](t, get(t, newTestServer(&fakeDatabase{}, config.Auth{}), http.MethodGet, "/api/v1/version", nil))
+	if version.APIVersion != apiVersion || version.ProtocolVersion == 0 {
+		t.Errorf("unexpected version %+v", version)
+	}
+}
+
+func TestUnknownRoutes(t *testing.T) {
+	s := newTestServer(&fakeDatabase{}, config.Auth{})
+
+	expectError(t, get(t, s, http.MethodGet, "/api/v1/nothing", nil), http.StatusNotFound, "not found")
+
+	res := get(t, s, http.MethodDelete, "/api/v1/targets", nil)
+	expectError(t, res, http.StatusMethodNotAllowed, "method not allowed")
+	if allow := res.Header().Get("Allow"); allow != http.MethodGet {
+		t.Errorf("expected Allow header GET, got %q", allow)
+	}
+}
+
+func TestAuthErrors(t *testing.T) {
+	hash := sha256.Sum256([]byte("reader"))
+	s := newTestServer(&fakeDatabase{}, config.Auth{
+		Tokens: []config.APIToken{{Name: "reader", TokenSHA256: hex.EncodeToString(hash[:]), Role: config.RoleRead}},
+	})
+	reader := http.Header{"Authorization": {"Bearer reader"}}
+
+	expectError(t, get(t, s, http.MethodGet, "/api/v1/version", nil), http.StatusUnauthorized, "unauthorized")
+	if res := get(t, s, http.MethodGet, "/api/v1/version", reader); res.Code != http.StatusOK {
+		t.Errorf("expected reader to get version, got %d", res.Code)
+	}
+	expectError(t, get(t, s, http.MethodPost, "/api/v1/probes/speedtest/run", reader), http.StatusForbidden, auth.ErrForbidden.Error())
+}
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	s := newTestServer(&fakeDatabase{}, config.Auth{})
+	res := get(t, s, http.MethodGet, "/api/v1/openapi.json", nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.Code)
+	}
+
+	var document struct {
+		OpenAPI string                               `json:"openapi"`
+		Paths   map[string]map[string]map[string]any `json:"paths"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &document); err != nil {
+		t.Fatalf("invalid openapi document: %v", err)
+	}
+	if !strings.HasPrefix(document.OpenAPI, "3.") {
+		t.Errorf("expected openapi 3, got %q", document.OpenAPI)
+	}
+
+	documented := 0
+	for _, operations := range document.Paths {
+		documented += len(operations)
+	}
+	routes := s.apiRouteTable()
+	if documented != len(routes) {
+		t.Errorf("expected %d documented operations, got %d", len(routes), documented)
+	}
+	for _, route := range routes {
+		method, path, _ := strings.Cut(route.pattern, " ")
+		if _, ok := document.Paths[path][strings.ToLower(method)]; !ok {
+			t.Errorf("route %q is not documented", route.pattern)
+		}
+	}
+}
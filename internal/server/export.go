@@ -0,0 +1,292 @@
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/optional"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	exportFormatCSV    = "csv"
+	exportFormatNDJSON = "ndjson"
+
+	exportKindMeasurements = "measurements"
+	exportKindSpeedtests   = "speedtests"
+	exportKindTraffic      = "traffic"
+
+	// Default range exported when no start time is given.
+	defaultExportDays = 30
+	// ISO-8601 in UTC, with milliseconds.
+	exportTimeFormat = "2006-01-02T15:04:05.000Z"
+)
+
+// Column names include the unit of their values.
+var (
+	measurementExportColumns = []string{
+		"time", "seq", "target", "target_host", "ping_successful", "packet_loss_percent", "rtt_ms",
+		"download_mbps", "upload_mbps", "speed_server_id", "speed_server_name", "speed_server_sponsor",
+		"speed_server_distance_km", "speed_server_latency_ms", "speed_bytes_down", "speed_bytes_up",
+	}
+	speedtestExportColumns = []string{
+		"time", "download_mbps", "upload_mbps", "server_id", "server_name", "server_sponsor",
+		"server_distance_km", "server_latency_ms", "bytes_down", "bytes_up", "plan_download_mbps", "plan_upload_mbps",
+		"download_percent_of_plan", "upload_percent_of_plan",
+	}
+	trafficExportColumns = []string{
+		"time", "interface", "rx_mbps", "tx_mbps", "rx_packets_per_second", "tx_packets_per_second",
+		"rx_errors", "tx_errors", "rx_drops", "tx_drops",
+	}
+)
+
+// Streams stored rows as CSV or NDJSON, straight from the database cursor.
+// Rows are selected by "kind", between the "from" and "to" times.
+func (s *server) handleExport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = exportFormatCSV
+	} else if format != exportFormatCSV && format != exportFormatNDJSON {
+		s.writeError(w, http.StatusBadRequest, "invalid format parameter")
+		return
+	}
+
+	kind := query.Get("kind")
+	if kind == "" {
+		kind = exportKindMeasurements
+	} else if kind != exportKindMeasurements && kind != exportKindSpeedtests && kind != exportKindTraffic {
+		s.writeError(w, http.StatusBadRequest, "invalid kind parameter")
+		return
+	}
+
+	now := time.Now()
+	startTime, err := timeParam(r, "from", now.AddDate(0, 0, -defaultExportDays))
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	endTime, err := timeParam(r, "to", now)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if endTime <= startTime {
+		s.writeError(w, http.StatusBadRequest, "to must be after from")
+		return
+	}
+
+	// Nothing is sent until the first row is written, so an error before then
+	// can still be reported with a status.
+	body := &trackingWriter{w: w}
+	var writer exportWriter
+	if format == exportFormatCSV {
+		writer = &csvExportWriter{writer: csv.NewWriter(body)}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		writer = &ndjsonExportWriter{w: body}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	filename := fmt.Sprintf("netmon-%s-%s-%s.%s", kind, exportFilenameDate(startTime), exportFilenameDate(endTime), format)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+
+	switch kind {
+	case exportKindMeasurements:
+		err = writer.header(measurementExportColumns)
+		if err == nil {
+			err = s.database.ExportNetworkInfo(r.Context(), startTime, endTime, false, func(info *types.NetworkInfo) error {
+				return writer.row(measurementExportRow(info))
+			})
+		}
+	case exportKindSpeedtests:
+		err = writer.header(speedtestExportColumns)
+		if err == nil {
+			err = s.database.ExportNetworkInfo(r.Context(), startTime, endTime, true, func(info *types.NetworkInfo) error {
+				return writer.row(s.speedtestExportRow(info))
+			})
+		}
+	case exportKindTraffic:
+		err = writer.header(trafficExportColumns)
+		if err == nil {
+			err = s.database.ExportInterfaceTraffic(r.Context(), startTime, endTime, func(traffic *types.InterfaceTraffic) error {
+				return writer.row(trafficExportRow(traffic))
+			})
+		}
+	}
+	if err == nil {
+		err = writer.flush()
+	}
+
+	switch {
+	case err == nil:
+	case r.Context().Err() != nil:
+		// Client went away part way through the download.
+	case !body.written:
+		s.log.Error("failed to export", "kind", kind, "err", err)
+		w.Header().Del("Content-Disposition")
+		s.writeError(w, http.StatusInternalServerError, "failed to export")
+	default:
+		// The status has already been sent, so the response is cut short.
+		s.log.Error("failed part way through export", "kind", kind, "err", err)
+	}
+}
+
+func measurementExportRow(info *types.NetworkInfo) []any {
+	return []any{
+		exportTime(info.Timestamp), info.Seq, info.PingHost, info.PingHostName, info.PingSuccessful, info.PacketLoss, info.RTTMS,
+		optionalValue(info.DownloadSpeed), optionalValue(info.UploadSpeed), optionalValue(info.SpeedServerID),
+		optionalValue(info.SpeedServerName), optionalValue(info.SpeedServerSponsor), optionalValue(info.SpeedServerDistance),
+		optionalValue(info.SpeedServerLatencyMS), optionalValue(info.SpeedBytesDown), optionalValue(info.SpeedBytesUp),
+	}
+}
+
+// The plan columns are empty when no plan was in effect at the time.
+func (s *server) speedtestExportRow(info *types.NetworkInfo) []any {
+	row := []any{
+		exportTime(info.Timestamp), optionalValue(info.DownloadSpeed), optionalValue(info.UploadSpeed),
+		optionalValue(info.SpeedServerID), optionalValue(info.SpeedServerName), optionalValue(info.SpeedServerSponsor),
+		optionalValue(info.SpeedServerDistance), optionalValue(info.SpeedServerLatencyMS),
+		optionalValue(info.SpeedBytesDown), optionalValue(info.SpeedBytesUp),
+	}
+	comparison := s.plans.Compare(info.Timestamp, info.DownloadSpeed.Else(0), info.UploadSpeed.Else(0))
+	if comparison == nil {
+		return append(row, nil, nil, nil, nil)
+	}
+	return append(row, comparison.DownloadMbps, comparison.UploadMbps, comparison.DownloadPercent, comparison.UploadPercent)
+}
+
+func trafficExportRow(t *types.InterfaceTraffic) []any {
+	return []any{
+		exportTime(t.Timestamp), t.Interface, t.RxMbps, t.TxMbps, t.RxPacketsPerSecond, t.TxPacketsPerSecond,
+		t.RxErrors, t.TxErrors, t.RxDrops, t.TxDrops,
+	}
+}
+
+func exportTime(timestamp int64) string {
+	return time.UnixMilli(timestamp).UTC().Format(exportTimeFormat)
+}
+
+func exportFilenameDate(timestamp int64) string {
+	return time.UnixMilli(timestamp).UTC().Format("20060102")
+}
+
+// Returns nil for a missing value, which is exported as an empty CSV field or
+// a JSON null.
+func optionalValue[T any](o optional.Opt[T]) any {
+	value, err := o.Get()
+	if err != nil {
+		return nil
+	}
+	return value
+}
+
+type exportWriter interface {
+	header(columns []string) error
+	row(values []any) error
+	flush() error
+}
+
+type csvExportWriter struct {
+	writer *csv.Writer
+	record []string
+}
+
+func (c *csvExportWriter) header(columns []string) error {
+	c.record = make([]string, len(columns))
+	return c.writer.Write(columns)
+}
+
+func (c *csvExportWriter) row(values []any) error {
+	for i, value := range values {
+		switch v := value.(type) {
+		case nil:
+			c.record[i] = ""
+		case string:
+			c.record[i] = v
+		case float32:
+			c.record[i] = strconv.FormatFloat(float64(v), 'f', -1, 32)
+		case float64:
+			c.record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			c.record[i] = fmt.Sprint(v)
+		}
+	}
+	return c.writer.Write(c.record)
+}
+
+func (c *csvExportWriter) flush() error {
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+// Writes one JSON object per line, with the columns as keys in order.
+type ndjsonExportWriter struct {
+	w      io.Writer
+	keys   [][]byte
+	buffer bytes.Buffer
+}
+
+func (n *ndjsonExportWriter) header(columns []string) error {
+	n.keys = make([][]byte, len(columns))
+	for i, column := range columns {
+		key, err := json.Marshal(column)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode column")
+		}
+		n.keys[i] = key
+	}
+	return nil
+}
+
+func (n *ndjsonExportWriter) row(values []any) error {
+	n.buffer.WriteByte('{')
+	for i, value := range values {
+		if i > 0 {
+			n.buffer.WriteByte(',')
+		}
+		n.buffer.Write(n.keys[i])
+		n.buffer.WriteByte(':')
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode value")
+		}
+		n.buffer.Write(encoded)
+	}
+	n.buffer.WriteString("}\n")
+
+	// Rows are written in batches rather than one small write each.
+	if n.buffer.Len() >= 32*1024 {
+		return n.flush()
+	}
+	return nil
+}
+
+func (n *ndjsonExportWriter) flush() error {
+	if n.buffer.Len() == 0 {
+		return nil
+	}
+	_, err := n.w.Write(n.buffer.Bytes())
+	n.buffer.Reset()
+	return err
+}
+
+// Records whether anything has been written to the response.
+type trackingWriter struct {
+	w       io.Writer
+	written bool
+}
+
+func (t *trackingWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		t.written = true
+	}
+	return t.w.Write(p)
+}
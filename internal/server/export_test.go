@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	"github.com/SkylerRankin/network_monitor/internal/database/databasetest"
+	"github.com/SkylerRankin/network_monitor/internal/optional"
+	"github.com/SkylerRankin/network_monitor/internal/plan"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/pkg/errors"
+)
+
+func exportTestDatabase() *fakeDatabase {
+	return &fakeDatabase{Database: databasetest.Database{
+		Measurements: []types.NetworkInfo{
+			{Seq: 1, Timestamp: 1700000000000, PingHost: "Google", PingHostName: "8.8.8.8", PingSuccessful: true, PacketLoss: 0, RTTMS: 12},
+			{
+				Seq: 2, Timestamp: 1700000030500, PingHost: "Cloudflare, Inc", PingHostName: "1.1.1.1", PingSuccessful: false, PacketLoss: 100,
+				DownloadSpeed: optional.New(95.5), UploadSpeed: optional.New(10.25), SpeedServerName: optional.New("Server"),
+			},
+		},
+	}}
+}
+
+func TestExportCSV(t *testing.T) {
+	s := newTestServer(exportTestDatabase(), config.Auth{})
+	res := get(t, s, http.MethodGet, "/api/v1/export?from=2023-11-14&to=1800000000000", nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if contentType := res.Header().Get("Content-Type"); contentType != "text/csv; charset=utf-8" {
+		t.Errorf("unexpected content type %q", contentType)
+	}
+	if disposition := res.Header().Get("Content-Disposition"); disposition != `attachment; filename="netmon-measurements-20231114-20270115.csv"` {
+		t.Errorf("unexpected content disposition %q", disposition)
+	}
+
+	expected := strings.Join([]string{
+		"time,seq,target,target_host,ping_successful,packet_loss_percent,rtt_ms,download_mbps,upload_mbps,speed_server_id,speed_server_name,speed_server_sponsor,speed_server_distance_km,speed_server_latency_ms,speed_bytes_down,speed_bytes_up",
+		"2023-11-14T22:13:20.000Z,1,Google,8.8.8.8,true,0,12,,,,,,,,,",
+		`2023-11-14T22:13:50.500Z,2,"Cloudflare, Inc",1.1.1.1,false,100,0,95.5,10.25,,Server,,,,,`,
+		"",
+	}, "\n")
+	if res.Body.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, res.Body.String())
+	}
+}
+
+func TestExportNDJSON(t *testing.T) {
+	s := newTestServer(exportTestDatabase(), config.Auth{})
+	s.plans = plan.NewSchedule(config.ISP{Plans: []config.ISPPlan{{Name: "Fiber", DownloadMbps: 100, UploadMbps: 20}}})
+	res := get(t, s, http.MethodGet, "/api/v1/export?format=ndjson&kind=speedtests&from=0", nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+
+	expected := `{"time":"2023-11-14T22:13:50.500Z","download_mbps":95.5,"upload_mbps":10.25,"server_id":null,"server_name":"Server",` +
+		`"server_sponsor":null,"server_distance_km":null,"server_latency_ms":null,"bytes_down":null,"bytes_up":null,` +
+		`"plan_download_mbps":100,"plan_upload_mbps":20,"download_percent_of_plan":95.5,"upload_percent_of_plan":51.25}` + "\n"
+	if res.Body.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, res.Body.String())
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	db := exportTestDatabase()
+	s := newTestServer(db, config.Auth{})
+
+	expectError(t, get(t, s, http.MethodGet, "/api/v1/export?format=xml", nil), http.StatusBadRequest, "invalid format parameter")
+	expectError(t, get(t, s, http.MethodGet, "/api/v1/export?kind=everything", nil), http.StatusBadRequest, "invalid kind parameter")
+	expectError(t, get(t, s, http.MethodGet, "/api/v1/export?from=10&to=5", nil), http.StatusBadRequest, "to must be after from")
+
+	db.err = errors.New("disk full")
+	res := get(t, s, http.MethodGet, "/api/v1/export", nil)
+	expectError(t, res, http.StatusInternalServerError, "failed to export")
+	if disposition := res.Header().Get("Content-Disposition"); disposition != "" {
+		t.Errorf("expected no attachment for an error, got %q", disposition)
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/constants"
+	"github.com/SkylerRankin/network_monitor/internal/network"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Size of the generated data written repeatedly for download tests.
+	lanChunkSize = 64 * 1024
+	// Default and maximum sizes for a single download or upload test.
+	defaultLANTestBytes = 25 * 1024 * 1024
+	maxLANTestBytes     = 1024 * 1024 * 1024
+	// Default range of LAN test results returned when no start time is given.
+	defaultLANHistoryDays = 7
+)
+
+var lanChunk = network.RandomData(lanChunkSize)
+
+var echoUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+func (s *server) handleLANPage(w http.ResponseWriter, r *http.Request) {
+	s.executeTemplate(w, "lan.html", types.IndexTemplateData{Commit: constants.Commit})
+}
+
+// Streams generated data to the client. The "bytes" query parameter sets the
+// size of the response.
+func (s *server) handleLANDownload(w http.ResponseWriter, r *http.Request) {
+	size := int64(defaultLANTestBytes)
+	if value := r.URL.Query().Get("bytes"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed <= 0 || parsed > maxLANTestBytes {
+			s.writeError(w, http.StatusBadRequest, "invalid bytes parameter")
+			return
+		}
+		size = parsed
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	for remaining := size; remaining > 0; {
+		n := min(remaining, lanChunkSize)
+		if _, err := w.Write(lanChunk[:n]); err != nil {
+			// Client closed the connection, likely due to cancelling the test.
+			return
+		}
+		remaining -= n
+	}
+}
+
+// Reads and discards the request body, reporting how much was received.
+func (s *server) handleLANUpload(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	received, err := io.Copy(io.Discard, http.MaxBytesReader(w, r.Body, maxLANTestBytes))
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "failed to read upload")
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]int64{
+		"bytes":      received,
+		"durationMS": time.Since(start).Milliseconds(),
+	})
+}
+
+// Echoes every websocket message back to the sender, for measuring round trip
+// latency from the browser.
+func (s *server) handleLANEcho(w http.ResponseWriter, r *http.Request) {
+	conn, err := echoUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.log.Error("failed to upgrade lan echo connection", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := conn.WriteMessage(messageType, message); err != nil {
+			return
+		}
+	}
+}
+
+// Stores a result measured by the browser test page. The timestamp, client IP
+// and user agent are filled in by the server.
+func (s *server) handleLANResultsPost(w http.ResponseWriter, r *http.Request) {
+	var result types.LANTestResult
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&result); err != nil {
+		s.writeError(w, http.StatusBadRequest, "invalid result")
+		return
+	}
+	if result.DownloadSpeed < 0 || result.UploadSpeed < 0 || result.LatencyMS < 0 {
+		s.writeError(w, http.StatusBadRequest, "invalid result")
+		return
+	}
+
+	result.Timestamp = time.Now().UnixMilli()
+	result.UserAgent = r.UserAgent()
+	result.ClientIP = r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		result.ClientIP = host
+	}
+
+	if err := s.database.InsertLANTestResult(r.Context(), &result); err != nil {
+		s.log.Error("failed to insert lan test result", "err", err)
+		s.writeError(w, http.StatusInternalServerError, "failed to store result")
+		return
+	}
+
+	s.writeJSON(w, http.StatusCreated, result)
+}
+
+func (s *server) handleLANResultsGet(w http.ResponseWriter, r *http.Request) {
+	startTime, err := timeParam(r, "from", time.Now().AddDate(0, 0, -defaultLANHistoryDays))
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	results, err := s.database.GetLANTestResults(r.Context(), int(startTime))
+	if err != nil {
+		s.log.Error("failed to get lan test results from database", "err", err)
+		s.writeError(w, http.StatusInternalServerError, "failed to get lan test results")
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, results)
+}
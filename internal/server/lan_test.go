@@ -0,0 +1,117 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+func post(t *testing.T, s *server, target string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	req.RemoteAddr = "192.168.1.20:50000"
+	req.Header.Set("User-Agent", "test-agent")
+	res := httptest.NewRecorder()
+	s.routes().ServeHTTP(res, req)
+	return res
+}
+
+func TestLANDownload(t *testing.T) {
+	s := newTestServer(&fakeDatabase{}, config.Auth{})
+
+	res := get(t, s, http.MethodGet, "/api/v1/lan/download?bytes=200000", nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.Code)
+	}
+	if res.Body.Len() != 200000 || res.Header().Get("Content-Length") != "200000" {
+		t.Errorf("expected 200000 bytes, got %d with length %q", res.Body.Len(), res.Header().Get("Content-Length"))
+	}
+
+	for _, bytes := range []string{"0", "-1", "lots", "2147483648"} {
+		expectError(t, get(t, s, http.MethodGet, "/api/v1/lan/download?bytes="+bytes, nil), http.StatusBadRequest, "invalid bytes parameter")
+	}
+}
+
+func TestLANUpload(t *testing.T) {
+	s := newTestServer(&fakeDatabase{}, config.Auth{})
+
+	res := post(t, s, "/api/v1/lan/upload", strings.Repeat("x", 5000))
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.Code)
+	}
+	if body := decode[map[string]int64](t, res); body["bytes"] != 5000 {
+		t.Errorf("expected 5000 bytes received, got %v", body)
+	}
+}
+
+func TestLANResults(t *testing.T) {
+	db := &fakeDatabase{}
+	s := newTestServer(db, config.Auth{})
+
+	res := post(t, s, "/api/v1/lan/results", `{"download": 940.5, "upload": 910, "latencyMS": 1.2, "clientIP": "10.0.0.1"}`)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", res.Code)
+	}
+	result := decode[types.LANTestResult](t, res)
+	if result.DownloadSpeed != 940.5 || result.UploadSpeed != 910 || result.LatencyMS != 1.2 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if result.ClientIP != "192.168.1.20" || result.UserAgent != "test-agent" || result.Timestamp == 0 {
+		t.Errorf("expected server filled client details, got %+v", result)
+	}
+	if len(db.lanResults) != 1 {
+		t.Fatalf("expected one stored result, got %d", len(db.lanResults))
+	}
+
+	for _, body := range []string{
+		`not json`,
+		`{"download": -1, "upload": 910, "latencyMS": 1}`,
+		`{"download": 940, "upload": -910, "latencyMS": 1}`,
+		`{"download": 940, "upload": 910, "latencyMS": -0.5}`,
+	} {
+		expectError(t, post(t, s, "/api/v1/lan/results", body), http.StatusBadRequest, "invalid result")
+	}
+	if len(db.lanResults) != 1 {
+		t.Errorf("expected invalid results not to be stored, got %d", len(db.lanResults))
+	}
+
+	res = get(t, s, http.MethodGet, "/api/v1/lan/results?from=1000", nil)
+	if results := decode[[]types.LANTestResult](t, res); len(results) != 1 || db.startTime != 1000 {
+		t.Errorf("expected stored result from 1000, got %+v from %d", results, db.startTime)
+	}
+
+	db.err = errors.New("disk full")
+	expectError(t, post(t, s, "/api/v1/lan/results", `{"download": 1}`), http.StatusInternalServerError, "failed to store result")
+	expectError(t, get(t, s, http.MethodGet, "/api/v1/lan/results", nil), http.StatusInternalServerError, "failed to get lan test results")
+}
+
+func TestLANEcho(t *testing.T) {
+	s := newTestServer(&fakeDatabase{}, config.Auth{})
+	httpServer := httptest.NewServer(s.routes())
+	defer httpServer.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/api/v1/lan/echo", nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	for _, message := range []string{"1", "ping 2"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		messageType, echoed, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		if messageType != websocket.TextMessage || string(echoed) != message {
+			t.Errorf("expected %q echoed, got %q", message, echoed)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/SkylerRankin/network_monitor/internal/jobs"
+	"github.com/pkg/errors"
+)
+
+// Runs a probe immediately. With "wait=true" the response is sent once the
+// probe finishes, otherwise the run is returned straight away to be polled.
+func (s *server) handleProbeRun(w http.ResponseWriter, r *http.Request) {
+	id, err := s.scheduler.RunProbe(r.PathValue("name"))
+	if errors.Is(err, jobs.ErrUnknownProbe) {
+		s.writeError(w, http.StatusNotFound, "unknown probe")
+		return
+	} else if err != nil {
+		s.log.Error("failed to start probe", "err", err)
+		s.writeError(w, http.StatusInternalServerError, "failed to start probe")
+		return
+	}
+
+	if r.URL.Query().Get("wait") != "true" {
+		run, err := s.scheduler.GetProbeRun(id)
+		if err != nil {
+			s.writeError(w, http.StatusInternalServerError, "failed to get probe run")
+			return
+		}
+		w.Header().Set("Location", "/api/v1/probes/runs/"+id)
+		s.writeJSON(w, http.StatusAccepted, run)
+		return
+	}
+
+	run, err := s.scheduler.WaitProbeRun(r.Context(), id)
+	switch {
+	case err == nil:
+		s.writeJSON(w, http.StatusOK, run)
+	case errors.Is(err, jobs.ErrProbeRunning), errors.Is(err, jobs.ErrDataBudgetReached):
+		s.writeJSON(w, http.StatusConflict, run)
+	case r.Context().Err() != nil:
+		// Client went away, the probe keeps running in the background.
+	default:
+		s.writeJSON(w, http.StatusInternalServerError, run)
+	}
+}
+
+func (s *server) handleProbeRunGet(w http.ResponseWriter, r *http.Request) {
+	run, err := s.scheduler.GetProbeRun(r.PathValue("id"))
+	if errors.Is(err, jobs.ErrUnknownProbeRun) {
+		s.writeError(w, http.StatusNotFound, "unknown probe run")
+		return
+	} else if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "failed to get probe run")
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, run)
+}
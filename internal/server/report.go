@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/report"
+)
+
+// Renders the ISP report between the "from" and "to" times, as HTML or
+// Markdown. The advertised plan speeds and threshold default to the plan in
+// effect at the end of the range, and can be overridden with parameters.
+func (s *server) handleReport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = report.FormatHTML
+	} else if format != report.FormatHTML && format != report.FormatMarkdown {
+		s.writeError(w, http.StatusBadRequest, "invalid format parameter")
+		return
+	}
+
+	now := time.Now()
+	startTime, err := timeParam(r, "from", now.AddDate(0, 0, -report.DefaultRangeDays))
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	endTime, err := timeParam(r, "to", now)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	options := report.Options{
+		// Days and weeks are broken down in UTC, like the time parameters.
+		Start:            time.UnixMilli(startTime).UTC(),
+		End:              time.UnixMilli(endTime).UTC(),
+		ThresholdPercent: s.config.ISP.Alert.ThresholdPercent,
+		Period:           query.Get("period"),
+		Availability:     s.config.Stats.Availability,
+	}
+	if plan := s.plans.At(endTime); plan != nil {
+		options.PlanDownloadMbps, options.PlanUploadMbps = plan.DownloadMbps, plan.UploadMbps
+	}
+	for name, value := range map[string]*float64{
+		"plan_download": &options.PlanDownloadMbps,
+		"plan_upload":   &options.PlanUploadMbps,
+		"threshold":     &options.ThresholdPercent,
+	} {
+		if query.Has(name) {
+			if *value, err = strconv.ParseFloat(query.Get(name), 64); err != nil {
+				s.writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s parameter", name))
+				return
+			}
+		}
+	}
+	if err := options.Validate(); err != nil {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := report.Build(r.Context(), s.database, options, now)
+	if err != nil {
+		s.log.Error("failed to build report", "err", err)
+		s.writeError(w, http.StatusInternalServerError, "failed to build report")
+		return
+	}
+
+	var body bytes.Buffer
+	if err := report.Render(&body, result, format); err != nil {
+		s.log.Error("failed to render report", "err", err)
+		s.writeError(w, http.StatusInternalServerError, "failed to render report")
+		return
+	}
+
+	extension := "html"
+	if format == report.FormatMarkdown {
+		extension = "md"
+	}
+	filename := fmt.Sprintf("netmon-report-%s-%s.%s", exportFilenameDate(startTime), exportFilenameDate(endTime), extension)
+	w.Header().Set("Content-Type", report.ContentType(format))
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.Header().Set("Content-Disposition", `inline; filename="`+filename+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(body.Bytes()); err != nil {
+		s.log.Error("failed to write response", "err", err)
+	}
+}
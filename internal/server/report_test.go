@@ -0,0 +1,35 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/SkylerRankin/network_monitor/internal/config"
+)
+
+func TestReport(t *testing.T) {
+	s := newTestServer(exportTestDatabase(), config.Auth{})
+	res := get(t, s, http.MethodGet, "/api/v1/report?format=markdown&from=2023-11-14&to=2023-11-15&plan_download=100", nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if contentType := res.Header().Get("Content-Type"); contentType != "text/markdown; charset=utf-8" {
+		t.Errorf("unexpected content type %q", contentType)
+	}
+	if disposition := res.Header().Get("Content-Disposition"); disposition != `inline; filename="netmon-report-20231114-20231115.md"` {
+		t.Errorf("unexpected content disposition %q", disposition)
+	}
+	if body := res.Body.String(); !strings.Contains(body, "| Download (Mbps) | 100.0 | 95.5 |") {
+		t.Errorf("expected the speed test in the report, got %s", body)
+	}
+
+	res = get(t, s, http.MethodGet, "/api/v1/report?from=2023-11-14&to=2023-11-15", nil)
+	if contentType := res.Header().Get("Content-Type"); res.Code != http.StatusOK || contentType != "text/html; charset=utf-8" {
+		t.Errorf("expected an HTML report, got %d %q", res.Code, contentType)
+	}
+
+	expectError(t, get(t, s, http.MethodGet, "/api/v1/report?format=pdf", nil), http.StatusBadRequest, "invalid format parameter")
+	expectError(t, get(t, s, http.MethodGet, "/api/v1/report?plan_upload=fast", nil), http.StatusBadRequest, "invalid plan_upload parameter")
+	expectError(t, get(t, s, http.MethodGet, "/api/v1/report?threshold=120", nil), http.StatusBadRequest, "threshold must be between 0 and 100 percent")
+}
@@ -2,15 +2,18 @@ package server
 
 import (
 	"context"
-	"encoding/json"
+	"html/template"
 	"log/slog"
 	"net/http"
 	"path/filepath"
-	"text/template"
 	"time"
 
+	"github.com/SkylerRankin/network_monitor/internal/auth"
+	"github.com/SkylerRankin/network_monitor/internal/config"
 	"github.com/SkylerRankin/network_monitor/internal/constants"
 	"github.com/SkylerRankin/network_monitor/internal/database"
+	"github.com/SkylerRankin/network_monitor/internal/jobs"
+	"github.com/SkylerRankin/network_monitor/internal/plan"
 	"github.com/SkylerRankin/network_monitor/internal/types"
 	websocket_client "github.com/SkylerRankin/network_monitor/internal/websocket"
 )
@@ -28,31 +31,47 @@ type server struct {
 	ctx             context.Context
 	log             *slog.Logger
 	assetsPath      string
+	config          *config.Config
+	auth            *auth.Authenticator
 	server          *http.Server
 	database        database.Database
+	scheduler       jobs.Scheduler
 	websocketClient websocket_client.WebsocketClient
+	plans           *plan.Schedule
+	startedAt       time.Time
 }
 
-func NewServer(ctx context.Context, log *slog.Logger, assetsPath string, database database.Database, websocketClient websocket_client.WebsocketClient) Server {
+func NewServer(ctx context.Context, log *slog.Logger, assetsPath string, config *config.Config, database database.Database, scheduler jobs.Scheduler, websocketClient websocket_client.WebsocketClient) Server {
 	return &server{
 		ctx:             ctx,
 		log:             log,
 		assetsPath:      assetsPath,
+		config:          config,
+		auth:            auth.NewAuthenticator(log, config.Auth),
 		database:        database,
+		scheduler:       scheduler,
 		websocketClient: websocketClient,
+		plans:           plan.NewSchedule(config.ISP),
+		startedAt:       time.Now(),
 	}
 }
 
 func (s *server) Listen() {
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(s.assetsPath))))
-	http.HandleFunc("/", s.handleRoot)
-	http.HandleFunc("/batch", s.handleBatch)
-	http.HandleFunc("/ws", s.handleWebsocket)
+	s.server = &http.Server{Addr: port, Handler: s.routes()}
 
-	s.server = &http.Server{Addr: port}
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		s.log.Error("failed to set up tls", "err", err)
+		return
+	}
+	s.server.TLSConfig = tlsConfig
 
-	s.log.Info("http server listening", "port", port)
-	err := s.server.ListenAndServe()
+	s.log.Info("http server listening", "port", port, "auth", s.config.Auth.Enabled(), "tls", s.config.TLS.Mode)
+	if tlsConfig != nil {
+		err = s.server.ListenAndServeTLS("", "")
+	} else {
+		err = s.server.ListenAndServe()
+	}
 	if err != nil {
 		s.log.Error("http server exited with error", "err", err)
 	} else {
@@ -60,52 +79,50 @@ func (s *server) Listen() {
 	}
 }
 
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/static/", http.StripPrefix("/static/", s.staticHandler()))
+	mux.HandleFunc("/", s.handleRoot)
+	mux.HandleFunc("/ws", s.handleWebsocket)
+	mux.HandleFunc("GET /ca.pem", s.handleCACertificate)
+	mux.HandleFunc("GET /lan", s.handleLANPage)
+	mux.HandleFunc("GET /status", s.handleStatusPage)
+	mux.Handle(apiPrefix, s.apiRoutes())
+	return s.auth.Middleware(mux)
+}
+
 func (s *server) Shutdown() error {
 	return s.server.Shutdown(s.ctx)
 }
 
 func (s *server) handleRoot(w http.ResponseWriter, r *http.Request) {
-	t, err := template.ParseFiles(filepath.Join(s.assetsPath, "templates", "index.html"))
+	s.executeTemplate(w, "index.html", types.IndexTemplateData{Commit: constants.Commit})
+}
+
+func (s *server) executeTemplate(w http.ResponseWriter, name string, data any) {
+	t, err := template.ParseFiles(filepath.Join(s.assetsPath, "templates", name))
 	if err != nil {
 		// TODO: format/wrap error strings instead of using raw error message
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	data := types.IndexTemplateData{Commit: constants.Commit}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	err = t.Execute(w, data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-func (s *server) handleBatch(w http.ResponseWriter, r *http.Request) {
-	// Get 1 day worth of data from database
-	startTime := time.Now().AddDate(0, 0, -1).UnixMilli()
-	batch, err := s.database.GetNetworkInfoBatch(s.ctx, int(startTime))
-
-	if err != nil {
-		s.log.Error("failed to get batch from database", "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	jsonData, err := json.Marshal(batch)
-	if err != nil {
-		s.log.Error("failed to marshal batch", "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+func (s *server) handleStream(w http.ResponseWriter, r *http.Request) {
+	if err := s.websocketClient.HandleStream(w, r, s.database.GetNetworkInfoAfterSeq); err != nil {
+		s.log.Error("failed to handle event stream", "err", err)
 	}
+}
 
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	// TODO: Set content length header
-	w.Header().Set("Content-Length", "")
-	_, err = w.Write(jsonData)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+// Returns the live update clients and how far behind each one is.
+func (s *server) handleStreamStats(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, s.websocketClient.Stats())
 }
 
 func (s *server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/constants"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+)
+
+const (
+	// Seconds between the status page reloading itself.
+	statusPageRefreshSeconds = 60
+	// Range of the status page sparkline, and the number of buckets it's
+	// drawn from.
+	sparklineRange  = 24 * time.Hour
+	sparklinePoints = 96
+	sparklineWidth  = 300
+	sparklineHeight = 60
+)
+
+// Data for the status page template.
+type statusPageData struct {
+	Commit         string
+	RefreshSeconds int
+	// Drops the details and headings, for small displays.
+	Compact bool
+	Now     time.Time
+	Status  *types.Status
+	// When the network was last online, zero before the first successful ping.
+	LastOnline    time.Time
+	OpenIncidents []types.Incident
+	Sparkline     template.HTML
+}
+
+// Time converts unix milliseconds to a time.
+func (d statusPageData) Time(ms int64) time.Time {
+	return time.UnixMilli(ms)
+}
+
+// Ago describes how long before the page was rendered a time was.
+func (d statusPageData) Ago(t time.Time) string {
+	elapsed := d.Now.Sub(t)
+	switch {
+	case elapsed < time.Minute:
+		return "just now"
+	case elapsed < time.Hour:
+		return fmt.Sprintf("%dm ago", int(elapsed.Minutes()))
+	case elapsed < 24*time.Hour:
+		return fmt.Sprintf("%dh %dm ago", int(elapsed.Hours()), int(elapsed.Minutes())%60)
+	default:
+		return fmt.Sprintf("%dd ago", int(elapsed.Hours()/24))
+	}
+}
+
+// Renders the current state, last speed test, open incidents and a sparkline
+// of the last day entirely on the server, for displays that can't run the
+// dashboard. The page reloads itself, and "compact" drops the details for
+// small screens.
+func (s *server) handleStatusPage(w http.ResponseWriter, r *http.Request) {
+	compact := false
+	if value := r.URL.Query().Get("compact"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "invalid compact parameter", http.StatusBadRequest)
+			return
+		}
+		compact = parsed
+	} else {
+		compact = r.URL.Query().Has("compact")
+	}
+
+	now := time.Now()
+	data := statusPageData{
+		Commit:         constants.Commit,
+		RefreshSeconds: statusPageRefreshSeconds,
+		Compact:        compact,
+		Now:            now,
+	}
+
+	var err error
+	if data.Status, err = s.status(r.Context()); err != nil {
+		s.log.Error("failed to get status", "err", err)
+		http.Error(w, "failed to get status", http.StatusInternalServerError)
+		return
+	}
+	if lastOnline, err := data.Status.LastSuccessfulPing.Get(); err == nil {
+		data.LastOnline = time.UnixMilli(lastOnline)
+	}
+
+	incidents, err := s.database.GetIncidents(r.Context(), now.AddDate(0, 0, -defaultIncidentsDays).UnixMilli(), now.UnixMilli())
+	if err != nil {
+		s.log.Error("failed to get incidents from database", "err", err)
+		http.Error(w, "failed to get incidents", http.StatusInternalServerError)
+		return
+	}
+	// Newest first.
+	for i := len(incidents) - 1; i >= 0; i-- {
+		if !incidents[i].End.Has() {
+			data.OpenIncidents = append(data.OpenIncidents, incidents[i])
+		}
+	}
+
+	start := now.Add(-sparklineRange).UnixMilli()
+	bucketMS := max(sparklineRange.Milliseconds()/sparklinePoints, 1)
+	aggregate, err := s.database.GetNetworkInfoAggregate(r.Context(), start, now.UnixMilli(), bucketMS)
+	if err != nil {
+		s.log.Error("failed to get aggregated measurements from database", "err", err)
+		http.Error(w, "failed to get measurements", http.StatusInternalServerError)
+		return
+	}
+	data.Sparkline = sparkline(aggregate, start, now.UnixMilli())
+
+	s.executeTemplate(w, "status.html", &data)
+}
+
+// Draws the mean round trip time across targets as a line, with a red bar
+// under each bucket with failed pings, as high as the fraction that failed.
+func sparkline(aggregate *types.NetworkInfoAggregate, start int64, end int64) template.HTML {
+	rtts := make([]float64, len(aggregate.Timestamps))
+	present := make([]bool, len(aggregate.Timestamps))
+	maxRTT := 0.0
+	for i := range aggregate.Timestamps {
+		sum, count := 0.0, 0
+		for _, target := range aggregate.Targets {
+			if rtt, err := target.RTTMS.Mean[i].Get(); err == nil {
+				sum += rtt
+				count += 1
+			}
+		}
+		if count > 0 {
+			rtts[i], present[i] = sum/float64(count), true
+			maxRTT = max(maxRTT, rtts[i])
+		}
+	}
+	maxRTT = max(maxRTT*1.1, 1)
+
+	x := func(timestamp int64) float64 {
+		return float64(timestamp-start) / float64(end-start) * sparklineWidth
+	}
+	y := func(rtt float64) float64 {
+		return sparklineHeight - rtt/maxRTT*sparklineHeight
+	}
+	slot := float64(aggregate.BucketMS) / float64(end-start) * sparklineWidth
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg class="sparkline" xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" role="img" aria-label="Round trip time over the last %d hours">`,
+		sparklineWidth, sparklineHeight, int(sparklineRange.Hours()))
+	for i, ping := range aggregate.PingValues {
+		if ping < 1 {
+			height := (1 - ping) * sparklineHeight
+			fmt.Fprintf(&b, `<rect class="failed" x="%.1f" y="%.1f" width="%.1f" height="%.1f"/>`,
+				x(aggregate.Timestamps[i]), sparklineHeight-height, max(slot, 1), height)
+		}
+	}
+
+	// Buckets without round trip times break the line.
+	var points []string
+	flush := func() {
+		if len(points) > 0 {
+			fmt.Fprintf(&b, `<polyline class="rtt" points="%s"/>`, strings.Join(points, " "))
+			points = nil
+		}
+	}
+	for i, timestamp := range aggregate.Timestamps {
+		if !present[i] {
+			flush()
+			continue
+		}
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x(timestamp)+slot/2, y(rtts[i])))
+	}
+	flush()
+
+	// The round trip time at the top of the chart.
+	fmt.Fprintf(&b, `<text class="label" x="2" y="10">%.0f ms</text>`, maxRTT)
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
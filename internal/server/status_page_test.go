@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	"github.com/SkylerRankin/network_monitor/internal/optional"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/pkg/errors"
+)
+
+func statusPageTestServer(db *fakeDatabase) *server {
+	s := newTestServer(db, config.Auth{})
+	s.assetsPath = "../../static"
+	return s
+}
+
+func TestStatusPage(t *testing.T) {
+	now := time.Now()
+	db := &fakeDatabase{
+		latest: &types.NetworkInfo{
+			Timestamp: now.Add(-10 * time.Minute).UnixMilli(), PingHost: "Google", PingSuccessful: false, PacketLoss: 100,
+		},
+		lastPing:  optional.New(now.Add(-2 * time.Hour).UnixMilli()),
+		speedtest: &types.SpeedtestRecord{Timestamp: now.Add(-time.Hour).UnixMilli(), Download: 450, Upload: 20},
+		incidents: []types.Incident{
+			{ID: "outage-1", Kind: types.IncidentKindOutage, Start: 1, End: optional.New[int64](2), Description: "Closed"},
+			{ID: "outage-2", Kind: types.IncidentKindOutage, Start: now.Add(-10 * time.Minute).UnixMilli(), Description: "12 consecutive <failed> pings"},
+		},
+		aggregate: &types.NetworkInfoAggregate{
+			BucketMS:   15 * 60 * 1000,
+			Timestamps: []int64{now.Add(-time.Hour).UnixMilli(), now.Add(-30 * time.Minute).UnixMilli()},
+			PingValues: []float64{1, 0.5},
+			Targets: []types.TargetAggregate{{
+				Name:  "Google",
+				RTTMS: types.AggregateSeries{Mean: []optional.Opt[float64]{optional.New(20.0), optional.New(40.0)}},
+			}},
+		},
+	}
+	s := statusPageTestServer(db)
+
+	res := get(t, s, http.MethodGet, "/status", nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if contentType := res.Header().Get("Content-Type"); contentType != "text/html; charset=utf-8" {
+		t.Errorf("expected html content type, got %q", contentType)
+	}
+	body := res.Body.String()
+	for _, expected := range []string{
+		`<meta http-equiv="refresh" content="60">`,
+		`<p class="state">Offline</p>`,
+		"Last online 2h 0m ago",
+		"450 / 20 Mbps",
+		// Descriptions are escaped, and closed incidents left out.
+		"12 consecutive &lt;failed&gt; pings, since 10m ago",
+		`<polyline class="rtt"`,
+		`<rect class="failed"`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected the page to contain %q, got %s", expected, body)
+		}
+	}
+	if strings.Contains(body, "Closed") {
+		t.Errorf("expected closed incidents to be left out")
+	}
+
+	compact := get(t, s, http.MethodGet, "/status?compact", nil).Body.String()
+	if !strings.Contains(compact, `<body class="compact">`) || strings.Contains(compact, "<h2>") {
+		t.Errorf("expected a compact page without headings, got %s", compact)
+	}
+
+	if res := get(t, s, http.MethodGet, "/status?compact=maybe", nil); res.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid compact parameter, got %d", res.Code)
+	}
+
+	db.err = errors.New("disk full")
+	if res := get(t, s, http.MethodGet, "/status", nil); res.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", res.Code)
+	}
+}
+
+func TestStatusPageWithoutMeasurements(t *testing.T) {
+	s := statusPageTestServer(&fakeDatabase{aggregate: &types.NetworkInfoAggregate{}})
+
+	res := get(t, s, http.MethodGet, "/status", nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	body := res.Body.String()
+	if !strings.Contains(body, "No measurements yet") || !strings.Contains(body, "No speed tests yet") {
+		t.Errorf("unexpected empty page %s", body)
+	}
+}
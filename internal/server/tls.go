@@ -0,0 +1,76 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/SkylerRankin/network_monitor/internal/certs"
+	"github.com/SkylerRankin/network_monitor/internal/config"
+)
+
+// Returns the TLS config for the configured mode, or nil when serving plain
+// HTTP.
+func (s *server) tlsConfig() (*tls.Config, error) {
+	var certFile, keyFile string
+	switch s.config.TLS.Mode {
+	case config.TLSModeFiles:
+		certFile = s.dataFile(s.config.TLS.CertFile)
+		keyFile = s.dataFile(s.config.TLS.KeyFile)
+	case config.TLSModeSelfSigned:
+		var err error
+		certFile, keyFile, err = certs.EnsureSelfSigned(s.log, s.assetsPath, s.config.TLS.Hosts)
+		if err != nil {
+			return nil, err
+		}
+		go certs.KeepSelfSignedRenewed(s.ctx, s.log, s.assetsPath, s.config.TLS.Hosts)
+	default:
+		return nil, nil
+	}
+
+	reloader, err := certs.NewReloader(s.log, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return reloader.TLSConfig(), nil
+}
+
+func (s *server) dataFile(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(s.assetsPath, path)
+}
+
+// Serves the generated CA certificate, to be installed on devices that view
+// the dashboard.
+func (s *server) handleCACertificate(w http.ResponseWriter, r *http.Request) {
+	if s.config.TLS.Mode != config.TLSModeSelfSigned {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("Content-Disposition", `attachment; filename="netmon-ca.pem"`)
+	http.ServeFile(w, r, filepath.Join(s.assetsPath, certs.Directory, certs.CAFilename))
+}
+
+// Subdirectories of the assets directory served under /static/. Everything
+// else there, such as the config, the database and the generated certificates,
+// is private.
+var staticDirectories = []string{"css", "js", "templates"}
+
+// Serves files from the public subdirectories of the assets directory.
+func (s *server) staticHandler() http.Handler {
+	files := http.FileServer(http.Dir(s.assetsPath))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(filepath.ToSlash(filepath.Clean("/"+r.URL.Path)), "/")
+		directory, _, _ := strings.Cut(path, "/")
+		if !slices.Contains(staticDirectories, directory) {
+			http.NotFound(w, r)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
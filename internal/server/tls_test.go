@@ -0,0 +1,45 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SkylerRankin/network_monitor/internal/config"
+)
+
+func TestStaticFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"css/style.css", "js/script.js", "templates/lan.html", "netmon.json", "netmon.db", "netmon.db-wal", "netmon.db-shm", "certs/ca.pem"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+	s := newTestServer(&fakeDatabase{}, config.Auth{})
+	s.assetsPath = dir
+
+	for _, target := range []string{"/static/css/style.css", "/static/js/script.js", "/static/templates/lan.html"} {
+		if res := get(t, s, http.MethodGet, target, nil); res.Code != http.StatusOK {
+			t.Errorf("expected %s to be served, got %d", target, res.Code)
+		}
+	}
+
+	private := []string{
+		"/static/netmon.json",
+		"/static/netmon.db",
+		"/static/netmon.db-wal",
+		"/static/netmon.db-shm",
+		"/static/certs/ca.pem",
+		"/static/",
+	}
+	for _, target := range private {
+		if res := get(t, s, http.MethodGet, target, nil); res.Code != http.StatusNotFound {
+			t.Errorf("expected %s to be hidden, got %d", target, res.Code)
+		}
+	}
+}
@@ -3,21 +3,93 @@ package types
 import "github.com/SkylerRankin/network_monitor/internal/optional"
 
 type NetworkInfo struct {
-	PingSuccessful       bool
-	PingHost             string
-	PingHostName         string
-	Timestamp            int64
-	PacketLoss           float32
-	RTTMS                int
-	SpeedTestDescription optional.Opt[string]
-	DownloadSpeed        optional.Opt[float64]
-	UploadSpeed          optional.Opt[float64]
+	// Increases by one for each stored measurement, so clients can resume
+	// from the last one they saw.
+	Seq                  int64                 `json:"seq"`
+	PingSuccessful       bool                  `json:"pingSuccessful"`
+	PingHost             string                `json:"pingHost"`
+	PingHostName         string                `json:"pingHostName"`
+	Timestamp            int64                 `json:"timestamp"`
+	PacketLoss           float32               `json:"packetLoss"`
+	RTTMS                int                   `json:"rttMS"`
+	SpeedTestDescription optional.Opt[string]  `json:"speedTestDescription"`
+	DownloadSpeed        optional.Opt[float64] `json:"download"`
+	UploadSpeed          optional.Opt[float64] `json:"upload"`
+	SpeedServerID        optional.Opt[string]  `json:"speedServerID"`
+	SpeedServerName      optional.Opt[string]  `json:"speedServerName"`
+	SpeedServerSponsor   optional.Opt[string]  `json:"speedServerSponsor"`
+	SpeedServerDistance  optional.Opt[float64] `json:"speedServerDistance"`
+	SpeedServerLatencyMS optional.Opt[int]     `json:"speedServerLatencyMS"`
+	SpeedBytesDown       optional.Opt[int64]   `json:"speedBytesDown"`
+	SpeedBytesUp         optional.Opt[int64]   `json:"speedBytesUp"`
 }
 
 type SpeedResult struct {
 	Successful       bool
 	Description      string
 	Download, Upload float64
+	Server           SpeedtestServer
+	// Bytes transferred by the test in each direction.
+	BytesDownloaded, BytesUploaded int64
+}
+
+type SpeedtestServer struct {
+	ID        string  `json:"id"`
+	Name      string  `json:"name"`
+	Sponsor   string  `json:"sponsor"`
+	Country   string  `json:"country"`
+	Host      string  `json:"host"`
+	Distance  float64 `json:"distance"`
+	LatencyMS int     `json:"latencyMS"`
+}
+
+type SpeedtestRecord struct {
+	Timestamp int64           `json:"timestamp"`
+	Download  float64         `json:"download"`
+	Upload    float64         `json:"upload"`
+	Server    SpeedtestServer `json:"server"`
+	// Nil when no plan was in effect at the time of the test.
+	Plan *PlanComparison `json:"plan"`
+}
+
+// Plan is an internet plan and the date it took effect.
+type Plan struct {
+	Name         string  `json:"name"`
+	DownloadMbps float64 `json:"downloadMbps"`
+	UploadMbps   float64 `json:"uploadMbps"`
+	// Start of the day the plan took effect in unix milliseconds, or 0 if it
+	// applies from the start.
+	EffectiveFrom int64 `json:"effectiveFrom"`
+}
+
+// PlanComparison is a speed test result measured against the plan in effect
+// at the time.
+type PlanComparison struct {
+	Name         string  `json:"name"`
+	DownloadMbps float64 `json:"downloadMbps"`
+	UploadMbps   float64 `json:"uploadMbps"`
+	// Measured speeds as a percentage of the plan's.
+	DownloadPercent float64 `json:"downloadPercent"`
+	UploadPercent   float64 `json:"uploadPercent"`
+}
+
+// PlanStatus is the configured plans and how recent speed tests compare to
+// them.
+type PlanStatus struct {
+	// Oldest first.
+	Plans []Plan `json:"plans"`
+	// Nil when no plan is in effect.
+	Current *Plan `json:"current"`
+	// Number of recent speed tests averaged for the alert, and the percentage of
+	// the plan they must reach.
+	AlertWindowTests      int     `json:"alertWindowTests"`
+	AlertThresholdPercent float64 `json:"alertThresholdPercent"`
+	// Average of the recent speed tests as a percentage of their plans. Empty
+	// until there are enough tests with a plan.
+	RecentDownloadPercent optional.Opt[float64] `json:"recentDownloadPercent"`
+	RecentUploadPercent   optional.Opt[float64] `json:"recentUploadPercent"`
+	// Whether either recent average is below the alert threshold.
+	BelowPlan bool `json:"belowPlan"`
 }
 
 type PingResult struct {
@@ -30,10 +102,277 @@ type PingResult struct {
 }
 
 type NetworkInfoBatch struct {
+	Seqs           []int64                 `json:"seqs"`
 	Timestamps     []int64                 `json:"timestamps"`
 	PingValues     []bool                  `json:"ping"`
 	UploadValues   []optional.Opt[float64] `json:"upload"`
 	DownloadValues []optional.Opt[float64] `json:"download"`
+	// Combined receive and transmit rate of the busiest interface, in Mbps.
+	TrafficValues []optional.Opt[float64] `json:"traffic"`
+	// Name of the target pinged by each measurement.
+	Targets []string `json:"targets"`
+	// Empty when the ping failed.
+	RTTValues        []optional.Opt[int] `json:"rttMS"`
+	PacketLossValues []float32           `json:"packetLoss"`
+}
+
+// NetworkInfoAggregate summarizes measurements in equal time buckets, so that
+// long ranges can be charted without sending every measurement.
+type NetworkInfoAggregate struct {
+	// Length of each bucket in milliseconds.
+	BucketMS int64 `json:"bucketMS"`
+	// Highest sequence number included, or 0 without measurements.
+	LastSeq int64 `json:"lastSeq"`
+	// Start of each bucket, oldest first. Buckets without measurements are left
+	// out.
+	Timestamps   []int64 `json:"timestamps"`
+	Measurements []int   `json:"measurements"`
+	// Fraction of successful pings in each bucket, from 0 to 1.
+	PingValues []float64 `json:"ping"`
+	// Mean packet loss percentage in each bucket, across every target.
+	PacketLossValues []float64 `json:"packetLoss"`
+	// Values are empty in buckets without speed tests or traffic samples.
+	Download AggregateSeries `json:"download"`
+	Upload   AggregateSeries `json:"upload"`
+	Traffic  AggregateSeries `json:"traffic"`
+	// Each target pinged in the range, ordered by name.
+	Targets []TargetAggregate `json:"targets"`
+}
+
+// TargetAggregate summarizes the pings of one target in the same buckets as
+// the NetworkInfoAggregate containing it.
+type TargetAggregate struct {
+	Name string `json:"name"`
+	// Round trip times of successful pings, empty in buckets where every ping
+	// to the target failed or it wasn't pinged.
+	RTTMS AggregateSeries `json:"rttMS"`
+	// Mean packet loss percentage, empty in buckets where the target wasn't
+	// pinged.
+	PacketLoss []optional.Opt[float64] `json:"packetLoss"`
+}
+
+// AggregateSeries is the mean, minimum and maximum of a value in each bucket,
+// so that spikes aren't averaged away.
+type AggregateSeries struct {
+	Mean []optional.Opt[float64] `json:"mean"`
+	Min  []optional.Opt[float64] `json:"min"`
+	Max  []optional.Opt[float64] `json:"max"`
+}
+
+// InterfaceTraffic is the traffic on a network interface over one sample
+// interval. Errors and drops are counts within the interval.
+type InterfaceTraffic struct {
+	Timestamp          int64   `json:"timestamp"`
+	Interface          string  `json:"interface"`
+	RxMbps             float64 `json:"rxMbps"`
+	TxMbps             float64 `json:"txMbps"`
+	RxPacketsPerSecond float64 `json:"rxPacketsPerSecond"`
+	TxPacketsPerSecond float64 `json:"txPacketsPerSecond"`
+	RxErrors           int64   `json:"rxErrors"`
+	TxErrors           int64   `json:"txErrors"`
+	RxDrops            int64   `json:"rxDrops"`
+	TxDrops            int64   `json:"txDrops"`
+}
+
+type LANTestResult struct {
+	Timestamp     int64   `json:"timestamp"`
+	ClientIP      string  `json:"clientIP"`
+	UserAgent     string  `json:"userAgent"`
+	DownloadSpeed float64 `json:"download"`
+	UploadSpeed   float64 `json:"upload"`
+	LatencyMS     float64 `json:"latencyMS"`
+}
+
+type DataUsage struct {
+	PeriodStart     int64 `json:"periodStart"`
+	PeriodEnd       int64 `json:"periodEnd"`
+	BytesDownloaded int64 `json:"bytesDownloaded"`
+	BytesUploaded   int64 `json:"bytesUploaded"`
+	// Zero when no budget is configured.
+	BudgetBytes int64 `json:"budgetBytes"`
+	Exceeded    bool  `json:"exceeded"`
+}
+
+// Sent to websocket clients when they connect.
+type ServerHello struct {
+	Commit string `json:"commit"`
+	// Seconds between network jobs.
+	IntervalSeconds   int    `json:"intervalSeconds"`
+	SpeedtestBackend  string `json:"speedtestBackend"`
+	SpeedtestSchedule string `json:"speedtestSchedule"`
+	// Monthly speed test data budget, 0 if unlimited.
+	DataBudgetMB int64 `json:"dataBudgetMB"`
+}
+
+// Progress of a running speed test.
+type SpeedTestProgress struct {
+	Phase string `json:"phase"`
+	// Current rate of the download or upload phase, 0 in other phases.
+	Mbps float64 `json:"mbps"`
+	// Progress through the whole test, from 0 to 100.
+	Percent float64 `json:"percent"`
+}
+
+const (
+	SpeedTestPhaseServer   = "server"
+	SpeedTestPhaseLatency  = "latency"
+	SpeedTestPhaseDownload = "download"
+	SpeedTestPhaseUpload   = "upload"
+	SpeedTestPhaseComplete = "complete"
+	SpeedTestPhaseFailed   = "failed"
+)
+
+// Sent to websocket clients when an incident opens or ends.
+type IncidentUpdate struct {
+	Incident
+	// IncidentOpened or IncidentEnded.
+	Change string `json:"change"`
+}
+
+const (
+	IncidentOpened = "opened"
+	IncidentEnded  = "ended"
+)
+
+// Returns the update for an incident returned by a detector, which is ended
+// once its end time is set. It's a pointer so the optional end time marshals.
+func NewIncidentUpdate(incident Incident) *IncidentUpdate {
+	if incident.End.Has() {
+		return &IncidentUpdate{Incident: incident, Change: IncidentEnded}
+	}
+	return &IncidentUpdate{Incident: incident, Change: IncidentOpened}
+}
+
+// Target is a host that's pinged, with a summary of its stored measurements.
+type Target struct {
+	Name         string `json:"name"`
+	Host         string `json:"host"`
+	Measurements int64  `json:"measurements"`
+	// Fraction of measurements where the ping succeeded, from 0 to 1.
+	Availability   float64 `json:"availability"`
+	FirstTimestamp int64   `json:"firstTimestamp"`
+	LastTimestamp  int64   `json:"lastTimestamp"`
+}
+
+// Probes, as named in on demand runs and in websocket topics.
+const (
+	ProbePing      = "ping"
+	ProbeSpeedtest = "speedtest"
+)
+
+const (
+	// Consecutive failed pings, across every target.
+	IncidentKindOutage = "outage"
+	// Recent speed tests averaging below the configured percentage of the plan.
+	IncidentKindBelowPlan = "belowPlan"
+	// Round trip times or speeds deviating from their baseline for the hour of
+	// the week, while the connection is still up.
+	IncidentKindDegradation = "degradation"
+)
+
+const (
+	MetricRTT      = "rtt"
+	MetricDownload = "download"
+	MetricUpload   = "upload"
+)
+
+// Incident is a period where the network wasn't working as expected.
+type Incident struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// Empty when every target was affected.
+	Target string `json:"target"`
+	// MetricRTT, MetricDownload or MetricUpload for degradations, otherwise
+	// empty.
+	Metric string `json:"metric"`
+	Start  int64  `json:"start"`
+	// Unset while the incident is ongoing.
+	End         optional.Opt[int64] `json:"end"`
+	Description string              `json:"description"`
+}
+
+// Status is a summary of the current state of the network.
+type Status struct {
+	// Whether the latest ping succeeded.
+	Online bool `json:"online"`
+	// Nil before the first measurement.
+	LastMeasurement    *NetworkInfo        `json:"lastMeasurement"`
+	LastSuccessfulPing optional.Opt[int64] `json:"lastSuccessfulPing"`
+	// Nil before the first speed test.
+	LastSpeedTest *SpeedtestRecord `json:"lastSpeedTest"`
+	// Time the server started, in unix milliseconds.
+	StartedAt int64 `json:"startedAt"`
+}
+
+// Stats summarizes the connection's availability and performance over a window.
+type Stats struct {
+	// "day", "week" or "month" for the period ending now, or "custom".
+	Window string `json:"window"`
+	// Bounds of the window in unix milliseconds, end exclusive.
+	Start        int64 `json:"start"`
+	End          int64 `json:"end"`
+	Measurements int   `json:"measurements"`
+	// Percentage of measurements where the connection was up, by the configured
+	// definition. Empty without measurements.
+	AvailabilityPercent optional.Opt[float64] `json:"availabilityPercent"`
+	// Periods where the connection was down, and their total length.
+	Outages    int   `json:"outages"`
+	DowntimeMS int64 `json:"downtimeMS"`
+	// Mean time to recovery and mean time between failures. Empty without
+	// outages.
+	MTTRMS     optional.Opt[int64] `json:"mttrMS"`
+	MTBFMS     optional.Opt[int64] `json:"mtbfMS"`
+	SpeedTests int                 `json:"speedTests"`
+	// Nil when there are no values in the window.
+	RTTMS             *Percentiles `json:"rttMS"`
+	PacketLossPercent *Percentiles `json:"packetLossPercent"`
+	DownloadMbps      *Percentiles `json:"downloadMbps"`
+	UploadMbps        *Percentiles `json:"uploadMbps"`
+}
+
+// Heatmap summarizes measurements by day of the week and hour of the day.
+type Heatmap struct {
+	// "day", "week" or "month" for the period ending now, or "custom".
+	Window string `json:"window"`
+	// Bounds of the period in unix milliseconds, end exclusive.
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	// IANA time zone the days and hours are in.
+	TimeZone string `json:"timeZone"`
+	// Indexed by day of the week, starting on Sunday, then by hour of the day.
+	Days [][]HeatmapCell `json:"days"`
+}
+
+// HeatmapCell summarizes the measurements in one hour of the week. Values are
+// empty when there were no measurements to summarize.
+type HeatmapCell struct {
+	Measurements int `json:"measurements"`
+	// Median round trip time of the successful pings.
+	MedianRTTMS optional.Opt[float64] `json:"medianRTTMS"`
+	// Mean packet loss, where failed pings count as 100%.
+	LossPercent        optional.Opt[float64] `json:"lossPercent"`
+	SpeedTests         int                   `json:"speedTests"`
+	MedianDownloadMbps optional.Opt[float64] `json:"medianDownloadMbps"`
+}
+
+type Percentiles struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+type Version struct {
+	Commit string `json:"commit"`
+	// Version of the REST API, as in the /api/v<n> path prefix.
+	APIVersion int `json:"apiVersion"`
+	// Version of the websocket and event stream message envelope.
+	ProtocolVersion int `json:"protocolVersion"`
+}
+
+// APIError is the body of every error response from the REST API.
+type APIError struct {
+	Status  int    `json:"status"`
+	Message string `json:"error"`
 }
 
 type IndexTemplateData struct {
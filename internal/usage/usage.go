@@ -0,0 +1,61 @@
+package usage
+
+import (
+	"context"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	"github.com/SkylerRankin/network_monitor/internal/database"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	bytesPerMB = 1000 * 1000
+)
+
+// Period returns the start and end of the billing period containing the given
+// time. Periods start at midnight on the billing day, in the time's location.
+// In months shorter than the billing day, the period starts on the last day of
+// the month.
+func Period(now time.Time, billingDay int) (time.Time, time.Time) {
+	start := periodStart(now.Year(), now.Month(), billingDay, now.Location())
+	if now.Before(start) {
+		start = periodStart(now.Year(), now.Month()-1, billingDay, now.Location())
+	}
+	return start, periodStart(start.Year(), start.Month()+1, billingDay, now.Location())
+}
+
+// Returns the start of the billing period in the given month. Months outside
+// of 1 to 12 wrap into the neighbouring years, as with time.Date.
+func periodStart(year int, month time.Month, billingDay int, location *time.Location) time.Time {
+	// Day 0 of the next month is the last day of this one.
+	lastDay := time.Date(year, month+1, 0, 0, 0, 0, 0, location).Day()
+	return time.Date(year, month, min(billingDay, lastDay), 0, 0, 0, 0, location)
+}
+
+// Get returns the data used by speed tests in the current billing period.
+func Get(ctx context.Context, db database.Database, budget config.DataBudget, now time.Time) (types.DataUsage, error) {
+	start, end := Period(now, budget.BillingDay)
+
+	bytesDownloaded, bytesUploaded, err := db.GetDataUsage(ctx, start.UnixMilli())
+	if err != nil {
+		return types.DataUsage{}, errors.Wrap(err, "failed to get data usage")
+	}
+
+	budgetBytes := budget.MonthlyMB * bytesPerMB
+	return types.DataUsage{
+		PeriodStart:     start.UnixMilli(),
+		PeriodEnd:       end.UnixMilli(),
+		BytesDownloaded: bytesDownloaded,
+		BytesUploaded:   bytesUploaded,
+		BudgetBytes:     budgetBytes,
+		Exceeded:        budgetBytes > 0 && bytesDownloaded+bytesUploaded >= budgetBytes,
+	}, nil
+}
+
+// Add records data used by a speed test in the current billing period.
+func Add(ctx context.Context, db database.Database, budget config.DataBudget, now time.Time, bytesDownloaded, bytesUploaded int64) error {
+	start, _ := Period(now, budget.BillingDay)
+	return db.AddDataUsage(ctx, start.UnixMilli(), bytesDownloaded, bytesUploaded)
+}
@@ -0,0 +1,119 @@
+package usage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/config"
+	"github.com/SkylerRankin/network_monitor/internal/database"
+)
+
+func TestPeriod(t *testing.T) {
+	date := func(year int, month time.Month, day int, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name       string
+		now        time.Time
+		billingDay int
+		start, end time.Time
+	}{
+		{"first of the month", date(2024, 5, 20, 12), 1, date(2024, 5, 1, 0), date(2024, 6, 1, 0)},
+		{"on the billing day", date(2024, 5, 15, 0), 15, date(2024, 5, 15, 0), date(2024, 6, 15, 0)},
+		{"before the billing day", date(2024, 5, 14, 23), 15, date(2024, 4, 15, 0), date(2024, 5, 15, 0)},
+		{"rolls back over the year", date(2024, 1, 3, 0), 10, date(2023, 12, 10, 0), date(2024, 1, 10, 0)},
+		{"rolls forward over the year", date(2024, 12, 20, 0), 10, date(2024, 12, 10, 0), date(2025, 1, 10, 0)},
+		{"clamped to the end of february", date(2024, 3, 5, 0), 31, date(2024, 2, 29, 0), date(2024, 3, 31, 0)},
+		{"clamped in a non leap year", date(2023, 2, 28, 6), 30, date(2023, 2, 28, 0), date(2023, 3, 30, 0)},
+		{"ends on a clamped day", date(2024, 1, 31, 0), 31, date(2024, 1, 31, 0), date(2024, 2, 29, 0)},
+		{"clamped to a 30 day month", date(2024, 4, 30, 12), 31, date(2024, 4, 30, 0), date(2024, 5, 31, 0)},
+		{"before a clamped start", date(2024, 4, 29, 12), 31, date(2024, 3, 31, 0), date(2024, 4, 30, 0)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start, end := Period(test.now, test.billingDay)
+			if !start.Equal(test.start) || !end.Equal(test.end) {
+				t.Errorf("expected %s to %s, got %s to %s", test.start, test.end, start, end)
+			}
+		})
+	}
+}
+
+func TestPeriodLocation(t *testing.T) {
+	location := time.FixedZone("UTC-5", -5*60*60)
+
+	// Still the 1st locally, but already the 2nd in UTC.
+	now := time.Date(2024, 6, 1, 22, 0, 0, 0, location)
+	start, _ := Period(now, 2)
+	if expected := time.Date(2024, 5, 2, 0, 0, 0, 0, location); !start.Equal(expected) {
+		t.Errorf("expected %s, got %s", expected, start)
+	}
+}
+
+// Stores usage totals keyed by period start. Calling any other method panics
+// on the nil embedded interface.
+type fakeDatabase struct {
+	database.Database
+	usage map[int64][2]int64
+}
+
+func (d *fakeDatabase) GetDataUsage(ctx context.Context, periodStart int64) (int64, int64, error) {
+	return d.usage[periodStart][0], d.usage[periodStart][1], nil
+}
+
+func (d *fakeDatabase) AddDataUsage(ctx context.Context, periodStart int64, bytesDownloaded int64, bytesUploaded int64) error {
+	total := d.usage[periodStart]
+	d.usage[periodStart] = [2]int64{total[0] + bytesDownloaded, total[1] + bytesUploaded}
+	return nil
+}
+
+func TestAddAndGet(t *testing.T) {
+	db := &fakeDatabase{usage: map[int64][2]int64{}}
+	budget := config.DataBudget{MonthlyMB: 10, BillingDay: 15}
+	ctx := context.Background()
+
+	before := time.Date(2024, 5, 14, 12, 0, 0, 0, time.UTC)
+	after := time.Date(2024, 5, 15, 12, 0, 0, 0, time.UTC)
+	for _, add := range []struct {
+		now      time.Time
+		down, up int64
+	}{
+		{before, 6_000_000, 1_000_000},
+		{after, 4_000_000, 1_000_000},
+		{after, 4_000_000, 1_000_000},
+	} {
+		if err := Add(ctx, db, budget, add.now, add.down, add.up); err != nil {
+			t.Fatalf("failed to add usage: %v", err)
+		}
+	}
+
+	usage, err := Get(ctx, db, budget, after)
+	if err != nil {
+		t.Fatalf("failed to get usage: %v", err)
+	}
+	if usage.BytesDownloaded != 8_000_000 || usage.BytesUploaded != 2_000_000 || usage.BudgetBytes != 10_000_000 {
+		t.Errorf("expected only the current period's usage, got %+v", usage)
+	}
+	if !usage.Exceeded {
+		t.Errorf("expected budget to be exceeded at exactly the limit")
+	}
+	if usage.PeriodStart != after.Truncate(24*time.Hour).UnixMilli() || usage.PeriodEnd != time.Date(2024, 6, 15, 0, 0, 0, 0, time.UTC).UnixMilli() {
+		t.Errorf("unexpected period %d to %d", usage.PeriodStart, usage.PeriodEnd)
+	}
+
+	usage, err = Get(ctx, db, budget, before)
+	if err != nil {
+		t.Fatalf("failed to get usage: %v", err)
+	}
+	if usage.BytesDownloaded != 6_000_000 || usage.Exceeded {
+		t.Errorf("expected previous period under budget, got %+v", usage)
+	}
+
+	budget.MonthlyMB = 0
+	if usage, _ := Get(ctx, db, budget, after); usage.Exceeded || usage.BudgetBytes != 0 {
+		t.Errorf("expected no budget, got %+v", usage)
+	}
+}
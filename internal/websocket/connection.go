@@ -0,0 +1,102 @@
+package websocket_client
+
+import (
+	"context"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/pubsub"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Messages queued for a client before it's considered too slow. Large
+	// enough to hold a full backfill.
+	sendBufferSize = historySize + 64
+	// Time allowed to write a message to the client.
+	writeTimeout = 10 * time.Second
+	// Time allowed between pongs from the client before it's considered gone.
+	pongTimeout = 60 * time.Second
+	// Must be less than pongTimeout, so a pong can arrive in time.
+	pingInterval = pongTimeout * 9 / 10
+	// Largest message accepted from a client.
+	maxClientMessageSize = 4096
+)
+
+// A single websocket connection. Each connection has a goroutine that reads
+// commands and one that writes queued messages, since gorilla connections
+// support one concurrent reader and one concurrent writer.
+type connection struct {
+	// Carries the values of the request that opened the connection, such as
+	// the client's role, to command handlers.
+	ctx        context.Context
+	ws         *websocket.Conn
+	subscriber *pubsub.Subscriber[outgoingMessage]
+}
+
+func (c *connection) address() string {
+	return c.ws.RemoteAddr().String()
+}
+
+// Writes queued messages and keepalive pings until the subscriber is removed
+// or a write fails.
+func (c *connection) writeLoop(client *websocketClient) {
+	ticker := time.NewTicker(pingInterval)
+	defer func() {
+		ticker.Stop()
+		client.broker.Unsubscribe(c.subscriber)
+		c.ws.Close()
+	}()
+
+	for {
+		select {
+		case message, ok := <-c.subscriber.Messages():
+			c.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if !ok {
+				if errors.Is(c.subscriber.Err(), pubsub.ErrSlowSubscriber) {
+					client.log.Info("dropping slow connection", "address", c.address())
+				}
+				c.ws.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.ws.WriteMessage(websocket.TextMessage, message.Value.data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := c.ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Reads commands from the client until the connection closes or stops
+// answering pings, then unsubscribes it.
+func (c *connection) readLoop(client *websocketClient) {
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer func() {
+		cancel()
+		client.broker.Unsubscribe(c.subscriber)
+		client.log.Info("unregistered connection", "address", c.address())
+		c.ws.Close()
+	}()
+
+	c.ws.SetReadLimit(maxClientMessageSize)
+	c.ws.SetReadDeadline(time.Now().Add(pongTimeout))
+	c.ws.SetPongHandler(func(string) error {
+		return c.ws.SetReadDeadline(time.Now().Add(pongTimeout))
+	})
+
+	for {
+		_, message, err := c.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				client.log.Info("websocket connection closed", "address", c.address(), "err", err)
+			}
+			return
+		}
+		c.ws.SetReadDeadline(time.Now().Add(pongTimeout))
+		client.handleMessage(ctx, c, message)
+	}
+}
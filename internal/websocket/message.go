@@ -0,0 +1,165 @@
+package websocket_client
+
+import (
+	"encoding/json"
+	"slices"
+
+	"github.com/pkg/errors"
+)
+
+// Version of the message envelope and payloads. Bumped when a change would
+// break existing clients.
+const ProtocolVersion = 1
+
+type MessageType string
+
+const (
+	// Sent to each client when it connects. Payload is types.ServerHello.
+	MessageTypeHello MessageType = "hello"
+	// A new measurement. Payload is types.NetworkInfoBatch.
+	MessageTypeMeasurement MessageType = "measurement"
+	// A detected incident opened or ended. Payload is types.IncidentUpdate.
+	MessageTypeIncident MessageType = "incident"
+	// An on demand probe run started or finished. Payload is jobs.ProbeRun.
+	MessageTypeProbeStatus MessageType = "probeStatus"
+	// Progress of a running speed test. Payload is types.SpeedTestProgress.
+	MessageTypeSpeedTestProgress MessageType = "speedTestProgress"
+	// Reply to a command from a client. Payload is CommandResult.
+	MessageTypeCommandResult MessageType = "commandResult"
+)
+
+// Commands sent by clients.
+const (
+	// Replaces the client's subscription. Payload is Subscription.
+	MessageTypeSubscribe MessageType = "subscribe"
+	// Replays broadcast messages the client missed, for example while
+	// reconnecting. Payload is BackfillRequest, result is BackfillResult.
+	MessageTypeBackfill MessageType = "backfill"
+	// Runs a probe immediately. Payload is {"probe": name}, result is
+	// {"id": runID}.
+	MessageTypeRunProbe MessageType = "runProbe"
+)
+
+var messageTypes = map[MessageType]bool{
+	MessageTypeHello:             true,
+	MessageTypeMeasurement:       true,
+	MessageTypeIncident:          true,
+	MessageTypeProbeStatus:       true,
+	MessageTypeSpeedTestProgress: true,
+	MessageTypeCommandResult:     true,
+	MessageTypeSubscribe:         true,
+	MessageTypeBackfill:          true,
+	MessageTypeRunProbe:          true,
+}
+
+var (
+	ErrUnknownMessageType = errors.New("unknown message type")
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrUnknownCommand     = errors.New("unknown command")
+)
+
+// Message is the envelope for everything sent over the websocket, in both
+// directions. Seq increases by one for each broadcast message, so clients can
+// tell if they missed any. Hello carries the seq of the last broadcast message,
+// and other messages sent to a single client have seq 0.
+type Message struct {
+	Type    MessageType `json:"type"`
+	Version int         `json:"version"`
+	Seq     uint64      `json:"seq"`
+	// Set by clients on commands, and copied to the result.
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Topic describes what a broadcast message is about, so it can be matched
+// against subscriptions. Empty fields match every subscription.
+type Topic struct {
+	// Ping host the message is about.
+	Target string
+	// Probe kinds the message is about, such as "ping" or "speedtest".
+	Probes []string
+}
+
+// Subscription filters the broadcast messages sent to a client. Empty fields
+// match everything, so the zero value receives every message.
+type Subscription struct {
+	Types   []MessageType `json:"types"`
+	Targets []string      `json:"targets"`
+	Probes  []string      `json:"probes"`
+}
+
+func (s Subscription) filter() func(outgoingMessage) bool {
+	return func(message outgoingMessage) bool {
+		return s.matches(message.messageType, message.topic)
+	}
+}
+
+func (s Subscription) matches(messageType MessageType, topic Topic) bool {
+	if len(s.Types) > 0 && !slices.Contains(s.Types, messageType) {
+		return false
+	}
+	if len(s.Targets) > 0 && topic.Target != "" && !slices.Contains(s.Targets, topic.Target) {
+		return false
+	}
+	if len(s.Probes) > 0 && len(topic.Probes) > 0 && !slices.ContainsFunc(topic.Probes, func(probe string) bool {
+		return slices.Contains(s.Probes, probe)
+	}) {
+		return false
+	}
+	return true
+}
+
+type BackfillRequest struct {
+	AfterSeq uint64 `json:"afterSeq"`
+}
+
+type BackfillResult struct {
+	Replayed int `json:"replayed"`
+	// False if some of the requested messages are no longer kept, in which
+	// case the client should reload its data instead.
+	Complete bool `json:"complete"`
+}
+
+type CommandResult struct {
+	ID     string `json:"id"`
+	Result any    `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// EncodeMessage marshals the payload and wraps it in an envelope.
+func EncodeMessage(messageType MessageType, seq uint64, payload any) ([]byte, error) {
+	if !messageTypes[messageType] {
+		return nil, errors.Wrapf(ErrUnknownMessageType, "%q", messageType)
+	}
+
+	payloadJson, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to marshal %s payload", messageType)
+	}
+
+	return json.Marshal(Message{
+		Type:    messageType,
+		Version: ProtocolVersion,
+		Seq:     seq,
+		Payload: payloadJson,
+	})
+}
+
+// DecodeMessage parses an envelope, leaving the payload to be decoded based on
+// the message type. The envelope is returned along with version and type
+// errors, so that a reply can echo its ID.
+func DecodeMessage(data []byte) (Message, error) {
+	var message Message
+	if err := json.Unmarshal(data, &message); err != nil {
+		return Message{}, errors.Wrap(err, "failed to unmarshal message")
+	}
+
+	if message.Version != ProtocolVersion {
+		return message, errors.Wrapf(ErrUnsupportedVersion, "%d", message.Version)
+	}
+	if !messageTypes[message.Type] {
+		return message, errors.Wrapf(ErrUnknownMessageType, "%q", message.Type)
+	}
+
+	return message, nil
+}
@@ -0,0 +1,150 @@
+package websocket_client
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/SkylerRankin/network_monitor/internal/optional"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/pkg/errors"
+)
+
+func TestEncodeMessage(t *testing.T) {
+	data, err := EncodeMessage(MessageTypeSpeedTestProgress, 7, types.SpeedTestProgress{Phase: types.SpeedTestPhaseDownload, Mbps: 12.5, Percent: 30})
+	if err != nil {
+		t.Fatalf("failed to encode message: %v", err)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("failed to unmarshal message: %v", err)
+	}
+
+	expected := map[string]string{
+		"type":    `"speedTestProgress"`,
+		"version": "1",
+		"seq":     "7",
+		"payload": `{"phase":"download","mbps":12.5,"percent":30}`,
+	}
+	if len(fields) != len(expected) {
+		t.Errorf("expected fields %v, got %s", expected, data)
+	}
+	for name, value := range expected {
+		if string(fields[name]) != value {
+			t.Errorf("expected %s to be %s, got %s", name, value, fields[name])
+		}
+	}
+}
+
+func TestEncodeMessageUnknownType(t *testing.T) {
+	_, err := EncodeMessage("status", 1, nil)
+	if !errors.Is(err, ErrUnknownMessageType) {
+		t.Errorf("expected unknown message type error, got %v", err)
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	data, err := EncodeMessage(MessageTypeHello, 3, types.ServerHello{Commit: "abc123", IntervalSeconds: 30})
+	if err != nil {
+		t.Fatalf("failed to encode message: %v", err)
+	}
+
+	message, err := DecodeMessage(data)
+	if err != nil {
+		t.Fatalf("failed to decode message: %v", err)
+	}
+	if message.Type != MessageTypeHello || message.Version != ProtocolVersion || message.Seq != 3 {
+		t.Errorf("unexpected envelope %+v", message)
+	}
+
+	var hello types.ServerHello
+	if err := json.Unmarshal(message.Payload, &hello); err != nil {
+		t.Fatalf("failed to unmarshal payload: %v", err)
+	}
+	if hello.Commit != "abc123" || hello.IntervalSeconds != 30 {
+		t.Errorf("unexpected payload %+v", hello)
+	}
+}
+
+func TestDecodeMessageErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected error
+	}{
+		{"unsupported version", `{"type":"measurement","version":2,"id":"a","payload":{}}`, ErrUnsupportedVersion},
+		{"missing version", `{"type":"measurement","id":"a","payload":{}}`, ErrUnsupportedVersion},
+		{"unknown type", `{"type":"status","version":1,"id":"a","payload":{}}`, ErrUnknownMessageType},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := DecodeMessage([]byte(test.data))
+			if !errors.Is(err, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, err)
+			}
+			if message.ID != "a" {
+				t.Errorf("expected the ID to be returned with the error, got %q", message.ID)
+			}
+		})
+	}
+
+	if _, err := DecodeMessage([]byte("not json")); err == nil {
+		t.Error("expected error for invalid json")
+	}
+}
+
+func TestPublishAssignsSequenceNumbers(t *testing.T) {
+	client := NewWebsocketClient(slog.New(slog.NewTextHandler(io.Discard, nil)), types.ServerHello{}).(*websocketClient)
+	subscriber, _, err := client.subscribe("test", Subscription{}, nil)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	<-subscriber.Messages()
+
+	for range 3 {
+		if err := client.Publish(MessageTypeMeasurement, Topic{}, types.NetworkInfoBatch{}); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+	if err := client.Publish("status", Topic{}, nil); err == nil {
+		t.Error("expected error publishing unknown message type")
+	}
+
+	for expected := uint64(1); expected <= 3; expected++ {
+		message, err := DecodeMessage((<-subscriber.Messages()).Value.data)
+		if err != nil {
+			t.Fatalf("failed to decode message: %v", err)
+		}
+		if message.Seq != expected {
+			t.Errorf("expected seq %d, got %d", expected, message.Seq)
+		}
+	}
+	if len(subscriber.Messages()) != 0 {
+		t.Errorf("expected failed publish not to be sent")
+	}
+}
+
+func TestEncodeIncidentUpdate(t *testing.T) {
+	incident := types.Incident{ID: "outage-1", Kind: "outage", Start: 1000, End: optional.New[int64](2000), Description: "No network"}
+	data, err := EncodeMessage(MessageTypeIncident, 1, types.NewIncidentUpdate(incident))
+	if err != nil {
+		t.Fatalf("failed to encode message: %v", err)
+	}
+
+	message, err := DecodeMessage(data)
+	if err != nil {
+		t.Fatalf("failed to decode message: %v", err)
+	}
+	expected := `{"id":"outage-1","kind":"outage","target":"","metric":"","start":1000,"end":2000,"description":"No network","change":"ended"}`
+	if string(message.Payload) != expected {
+		t.Errorf("expected payload %s, got %s", expected, message.Payload)
+	}
+
+	incident.End = optional.Empty[int64]()
+	if update := types.NewIncidentUpdate(incident); update.Change != types.IncidentOpened {
+		t.Errorf("expected ongoing incident to be opened, got %q", update.Change)
+	}
+}
@@ -0,0 +1,195 @@
+package websocket_client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/optional"
+	"github.com/SkylerRankin/network_monitor/internal/pubsub"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Stored measurements loaded at a time when a client resumes.
+	streamBackfillPageSize = 1000
+)
+
+// The client went away, which isn't an error for the stream.
+var errStreamClosed = errors.New("event stream closed")
+
+// Sends broadcast messages as server-sent events. Each event's type is the
+// message type and its data is the same envelope sent over the websocket.
+// Measurement events have the stored measurement's sequence number as their
+// ID, and other events have none, so the last event ID is always the last
+// measurement received. Clients resuming with Last-Event-ID are sent the
+// measurements stored after it, before any live events. The "types", "targets"
+// and "probes" query parameters take comma separated lists, and work like a
+// websocket subscription.
+func (c *websocketClient) HandleStream(w http.ResponseWriter, r *http.Request, measurementsAfter MeasurementsAfter) error {
+	subscription := Subscription{
+		Targets: splitList(r.URL.Query().Get("targets")),
+		Probes:  splitList(r.URL.Query().Get("probes")),
+	}
+	for _, messageType := range splitList(r.URL.Query().Get("types")) {
+		subscription.Types = append(subscription.Types, MessageType(messageType))
+	}
+
+	resumeAfter := optional.Empty[int64]()
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		if parsed, err := strconv.ParseInt(lastEventID, 10, 64); err == nil && parsed >= 0 {
+			resumeAfter = optional.New(parsed)
+		}
+	}
+
+	// Subscribing before loading stored measurements means none are missed
+	// between the two, and ones sent both ways are skipped below.
+	subscriber, _, err := c.subscribe(r.RemoteAddr, subscription, nil)
+	if err != nil {
+		return err
+	}
+	defer c.broker.Unsubscribe(subscriber)
+
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stops nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(frame string) error {
+		controller.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := w.Write([]byte(frame)); err != nil {
+			return errStreamClosed
+		}
+		return errors.Wrap(controller.Flush(), "failed to flush event stream")
+	}
+	err = c.streamEvents(r.Context(), subscriber, send, subscription, measurementsAfter, resumeAfter)
+	if errors.Is(err, errStreamClosed) {
+		return nil
+	}
+	return err
+}
+
+// Sends the hello queued by subscribing, then the missed measurements when
+// resuming, then live events until the context is done or the subscriber is
+// removed.
+func (c *websocketClient) streamEvents(ctx context.Context, subscriber *pubsub.Subscriber[outgoingMessage], send func(string) error, subscription Subscription, measurementsAfter MeasurementsAfter, resumeAfter optional.Opt[int64]) error {
+	// When resuming, the hello has no ID since the missed measurements come
+	// after it.
+	hello, ok := <-subscriber.Messages()
+	if !ok {
+		return nil
+	}
+	if err := send(formatEvent(hello.Value, !resumeAfter.Has())); err != nil {
+		return err
+	}
+
+	// Sequence number of the last measurement sent.
+	var sentSeq int64
+	if resumeAfter.Has() {
+		var err error
+		if sentSeq, err = c.sendStoredMeasurements(ctx, send, subscription, measurementsAfter, resumeAfter.Else(0)); err != nil {
+			return err
+		}
+	}
+
+	// Comments keep proxies from closing idle streams.
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		var frame string
+		select {
+		case <-ctx.Done():
+			return nil
+		case message, ok := <-subscriber.Messages():
+			if !ok {
+				return nil
+			}
+			if message.Value.messageType == MessageTypeMeasurement && message.Value.measurementSeq <= sentSeq {
+				continue
+			}
+			frame = formatEvent(message.Value, false)
+			sentSeq = max(sentSeq, message.Value.measurementSeq)
+		case <-ticker.C:
+			frame = ": keepalive\n\n"
+		}
+
+		if err := send(frame); err != nil {
+			return err
+		}
+	}
+}
+
+// Sends the stored measurements after the sequence number that match the
+// subscription, one event each, and returns the last sequence number sent.
+func (c *websocketClient) sendStoredMeasurements(ctx context.Context, send func(string) error, subscription Subscription, measurementsAfter MeasurementsAfter, afterSeq int64) (int64, error) {
+	for {
+		batch, err := measurementsAfter(ctx, afterSeq, streamBackfillPageSize)
+		if err != nil {
+			return afterSeq, errors.Wrap(err, "failed to load missed measurements")
+		}
+
+		for i, seq := range batch.Seqs {
+			afterSeq = seq
+			row := measurementRow(batch, i)
+			topic := Topic{Target: row.Targets[0], Probes: []string{types.ProbePing}}
+			if row.DownloadValues[0].Has() {
+				topic.Probes = append(topic.Probes, types.ProbeSpeedtest)
+			}
+			if !subscription.matches(MessageTypeMeasurement, topic) {
+				continue
+			}
+
+			data, err := EncodeMessage(MessageTypeMeasurement, 0, row)
+			if err != nil {
+				return afterSeq, err
+			}
+			if err := send(formatEvent(outgoingMessage{messageType: MessageTypeMeasurement, data: data, measurementSeq: seq}, true)); err != nil {
+				return afterSeq, err
+			}
+		}
+
+		if len(batch.Seqs) < streamBackfillPageSize {
+			return afterSeq, nil
+		}
+	}
+}
+
+// Returns a batch holding only the measurement at index i.
+func measurementRow(batch *types.NetworkInfoBatch, i int) *types.NetworkInfoBatch {
+	return &types.NetworkInfoBatch{
+		Seqs:             batch.Seqs[i : i+1],
+		Timestamps:       batch.Timestamps[i : i+1],
+		PingValues:       batch.PingValues[i : i+1],
+		UploadValues:     batch.UploadValues[i : i+1],
+		DownloadValues:   batch.DownloadValues[i : i+1],
+		TrafficValues:    batch.TrafficValues[i : i+1],
+		Targets:          batch.Targets[i : i+1],
+		RTTValues:        batch.RTTValues[i : i+1],
+		PacketLossValues: batch.PacketLossValues[i : i+1],
+	}
+}
+
+// Formats a message as an event. Measurements have their sequence number as
+// the ID, as does the hello if the stream starts from it.
+func formatEvent(message outgoingMessage, helloID bool) string {
+	var event strings.Builder
+	if message.measurementSeq > 0 && (message.messageType == MessageTypeMeasurement || helloID) {
+		fmt.Fprintf(&event, "id: %d\n", message.measurementSeq)
+	}
+	fmt.Fprintf(&event, "event: %s\ndata: %s\n\n", message.messageType, message.data)
+	return event.String()
+}
+
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
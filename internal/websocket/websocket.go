@@ -2,110 +2,226 @@ package websocket_client
 
 import (
 	"context"
+	"encoding/json"
 	"log/slog"
 	"net/http"
-	"time"
 
+	"github.com/SkylerRankin/network_monitor/internal/pubsub"
+	"github.com/SkylerRankin/network_monitor/internal/types"
 	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 )
 
 const (
-	bufferSize  = 10
-	readTimeout = 10 * time.Second
+	// Number of broadcast messages kept for clients to backfill after
+	// reconnecting.
+	historySize = 1000
 )
 
 type WebsocketClient interface {
 	Listen(context.Context)
 	HandleConnection(w http.ResponseWriter, r *http.Request) error
-	Broadcast([]byte)
+	// HandleStream sends the same messages as a server-sent event stream,
+	// until the request is done. Resuming clients are sent the measurements
+	// they missed from measurementsAfter.
+	HandleStream(w http.ResponseWriter, r *http.Request, measurementsAfter MeasurementsAfter) error
+	// Publish sends a message to all connected clients subscribed to the topic.
+	// It never blocks on slow clients.
+	Publish(messageType MessageType, topic Topic, payload any) error
+	// RegisterCommand sets the handler for a command sent by clients. Must be
+	// called before Listen.
+	RegisterCommand(messageType MessageType, handler CommandHandler)
+	// Stats returns the number of connected clients and their queue depths.
+	Stats() pubsub.Stats
 	Shutdown() error
 }
 
+// MeasurementsAfter returns up to limit stored measurements with a sequence
+// number greater than afterSeq, oldest first, like
+// database.Database.GetNetworkInfoAfterSeq.
+type MeasurementsAfter func(ctx context.Context, afterSeq int64, limit int) (*types.NetworkInfoBatch, error)
+
+// CommandHandler handles a command sent by a client. The result, or error, is
+// sent back to the client that sent it. The context has the values of the
+// request that opened the connection.
+type CommandHandler func(ctx context.Context, payload json.RawMessage) (any, error)
+
 var _ WebsocketClient = &websocketClient{}
 
 type websocketClient struct {
-	log         *slog.Logger
-	upgrader    websocket.Upgrader
-	connections map[*websocket.Conn]bool
-	broadcast   chan []byte
-	register    chan *websocket.Conn
-	unregister  chan *websocket.Conn
+	log      *slog.Logger
+	upgrader websocket.Upgrader
+	broker   *pubsub.Broker[outgoingMessage]
+	hello    types.ServerHello
+	commands map[MessageType]CommandHandler
+	// Sequence number of the last stored measurement published. Only used
+	// while the broker is building a message.
+	measurementSeq int64
 }
 
-func NewWebsocketClient(log *slog.Logger) WebsocketClient {
+// An encoded message queued for a client, along with what's needed to filter
+// and frame it.
+type outgoingMessage struct {
+	messageType MessageType
+	topic       Topic
+	data        []byte
+	// Sequence number of the last stored measurement included, or for a
+	// hello, the last one published before it. 0 if there is none.
+	measurementSeq int64
+}
+
+func NewWebsocketClient(log *slog.Logger, hello types.ServerHello) WebsocketClient {
 	return &websocketClient{
 		log: log,
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
 		},
-		connections: make(map[*websocket.Conn]bool),
-		broadcast:   make(chan []byte, bufferSize),
-		register:    make(chan *websocket.Conn, bufferSize),
-		unregister:  make(chan *websocket.Conn, bufferSize),
+		// Progress updates are superseded by the next one, so slow clients
+		// miss them rather than being disconnected.
+		broker: pubsub.NewBroker(historySize, func(message outgoingMessage) bool {
+			return message.messageType == MessageTypeSpeedTestProgress
+		}),
+		hello:    hello,
+		commands: make(map[MessageType]CommandHandler),
 	}
 }
 
-func (c websocketClient) Listen(ctx context.Context) {
-	exit := false
-	for !exit {
-		select {
-		case <-ctx.Done():
-			exit = true
-		case conn := <-c.register:
-			if _, ok := c.connections[conn]; ok {
-				c.log.Info("not registering already registered connection", "address", conn.RemoteAddr().String())
-			} else {
-				c.log.Info("registered connection", "address", conn.RemoteAddr().String())
-				c.connections[conn] = true
-			}
-		case conn := <-c.unregister:
-			if _, ok := c.connections[conn]; ok {
-				c.log.Info("unregistered connection", "address", conn.RemoteAddr().String())
-				delete(c.connections, conn)
-			} else {
-				c.log.Info("attempted to unregister unregistered connection", "address", conn.RemoteAddr().String())
-			}
-		case message := <-c.broadcast:
-			brokenConnections := make([]*websocket.Conn, 0)
-			for conn := range c.connections {
-				conn.SetReadDeadline(time.Now().Add(readTimeout))
-				err := conn.WriteMessage(websocket.TextMessage, message)
-				if err != nil {
-					c.log.Info("broadcast message failed", "err", err)
-					brokenConnections = append(brokenConnections, conn)
-				}
-			}
-
-			// Unregister connections that are not accepting data
-			for _, conn := range brokenConnections {
-				c.unregister <- conn
-			}
-		}
-	}
+// Listen disconnects every client once the context is done.
+func (c *websocketClient) Listen(ctx context.Context) {
+	<-ctx.Done()
+	c.broker.Close()
 }
 
-func (c websocketClient) HandleConnection(w http.ResponseWriter, r *http.Request) error {
-	conn, err := c.upgrader.Upgrade(w, r, nil)
+func (c *websocketClient) HandleConnection(w http.ResponseWriter, r *http.Request) error {
+	ws, err := c.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return errors.Wrap(err, "failed to upgrade http connection to websocket")
 	}
 
-	c.register <- conn
+	subscriber, _, err := c.subscribe(ws.RemoteAddr().String(), Subscription{}, nil)
+	if err != nil {
+		ws.Close()
+		return err
+	}
+	c.log.Info("registered connection", "address", ws.RemoteAddr().String())
+
+	// The request's context is canceled once this returns, but its values are
+	// still needed by command handlers.
+	conn := &connection{ctx: context.WithoutCancel(r.Context()), ws: ws, subscriber: subscriber}
+	go conn.writeLoop(c)
+	go conn.readLoop(c)
 	return nil
 }
 
-func (c websocketClient) Broadcast(bytes []byte) {
-	c.broadcast <- bytes
+// Adds a subscriber that receives a hello first, carrying the sequence number
+// of the last published message so the client knows where its stream starts.
+func (c *websocketClient) subscribe(name string, subscription Subscription, replayAfter *uint64) (*pubsub.Subscriber[outgoingMessage], pubsub.ReplayResult, error) {
+	return c.broker.Subscribe(pubsub.SubscribeOptions[outgoingMessage]{
+		Name:      name,
+		QueueSize: sendBufferSize,
+		Filter:    subscription.filter(),
+		Greeting: func(seq uint64) (outgoingMessage, error) {
+			data, err := EncodeMessage(MessageTypeHello, seq, c.hello)
+			return outgoingMessage{messageType: MessageTypeHello, data: data, measurementSeq: c.measurementSeq}, err
+		},
+		ReplayAfter: replayAfter,
+	})
+}
+
+func (c *websocketClient) Publish(messageType MessageType, topic Topic, payload any) error {
+	// The broker holds its lock while building the message, so only the
+	// envelope is encoded there. Delivery never blocks on a slow client.
+	payloadJson, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal %s payload", messageType)
+	}
+	measurementSeq := lastMeasurementSeq(payload)
+	return c.broker.Publish(func(seq uint64) (outgoingMessage, error) {
+		data, err := EncodeMessage(messageType, seq, json.RawMessage(payloadJson))
+		if err == nil && measurementSeq > 0 {
+			c.measurementSeq = measurementSeq
+		}
+		return outgoingMessage{messageType: messageType, topic: topic, data: data, measurementSeq: measurementSeq}, err
+	})
+}
+
+// Returns the sequence number of the last stored measurement in a measurement
+// payload, or 0 for other payloads.
+func lastMeasurementSeq(payload any) int64 {
+	var seqs []int64
+	switch batch := payload.(type) {
+	case *types.NetworkInfoBatch:
+		seqs = batch.Seqs
+	case types.NetworkInfoBatch:
+		seqs = batch.Seqs
+	}
+	if len(seqs) == 0 {
+		return 0
+	}
+	return seqs[len(seqs)-1]
+}
+
+func (c *websocketClient) RegisterCommand(messageType MessageType, handler CommandHandler) {
+	c.commands[messageType] = handler
+}
+
+func (c *websocketClient) Stats() pubsub.Stats {
+	return c.broker.Stats()
 }
 
-func (c websocketClient) Shutdown() error {
-	for conn := range c.connections {
-		if conn != nil {
-			conn.Close()
+// Handles a message read from a client, queueing the reply behind anything
+// already sent to it.
+func (c *websocketClient) handleMessage(ctx context.Context, conn *connection, data []byte) {
+	message, err := DecodeMessage(data)
+	if err != nil {
+		c.reply(conn, message.ID, nil, err)
+		return
+	}
+
+	switch message.Type {
+	case MessageTypeSubscribe:
+		var subscription Subscription
+		if err := json.Unmarshal(message.Payload, &subscription); err != nil {
+			c.reply(conn, message.ID, nil, errors.Wrap(err, "invalid subscription"))
+			return
+		}
+		c.broker.SetFilter(conn.subscriber, subscription.filter())
+		c.reply(conn, message.ID, subscription, nil)
+	case MessageTypeBackfill:
+		var backfill BackfillRequest
+		if err := json.Unmarshal(message.Payload, &backfill); err != nil {
+			c.reply(conn, message.ID, nil, errors.Wrap(err, "invalid backfill request"))
+			return
 		}
+		result := c.broker.Replay(conn.subscriber, backfill.AfterSeq)
+		c.reply(conn, message.ID, BackfillResult{Replayed: result.Replayed, Complete: result.Complete}, nil)
+	default:
+		handler, ok := c.commands[message.Type]
+		if !ok {
+			c.reply(conn, message.ID, nil, errors.Wrapf(ErrUnknownCommand, "%q", message.Type))
+			return
+		}
+		result, err := handler(ctx, message.Payload)
+		c.reply(conn, message.ID, result, err)
+	}
+}
+
+func (c *websocketClient) reply(conn *connection, id string, result any, err error) {
+	commandResult := CommandResult{ID: id, Result: result}
+	if err != nil {
+		commandResult.Error = err.Error()
 	}
 
+	data, err := EncodeMessage(MessageTypeCommandResult, 0, commandResult)
+	if err != nil {
+		c.log.Error("failed to encode command result", "id", id, "err", err)
+		return
+	}
+	c.broker.Send(conn.subscriber, outgoingMessage{messageType: MessageTypeCommandResult, data: data})
+}
+
+func (c *websocketClient) Shutdown() error {
+	c.broker.Close()
 	return nil
 }
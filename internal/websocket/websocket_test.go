@@ -0,0 +1,362 @@
+package websocket_client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkylerRankin/network_monitor/internal/optional"
+	"github.com/SkylerRankin/network_monitor/internal/pubsub"
+	"github.com/SkylerRankin/network_monitor/internal/types"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// Starts a client behind a test server and returns it with a connected
+// websocket that has already received its hello.
+func newTestConnection(t *testing.T) (WebsocketClient, *websocket.Conn) {
+	t.Helper()
+
+	client, conn := dialTestClient(t)
+	hello := readMessage(t, conn)
+	if hello.Type != MessageTypeHello {
+		t.Fatalf("expected hello, got %s", hello.Type)
+	}
+	return client, conn
+}
+
+// Starts a client behind a test server and returns it with a connected
+// websocket that hasn't read anything yet.
+func dialTestClient(t *testing.T) (WebsocketClient, *websocket.Conn) {
+	t.Helper()
+
+	client := NewWebsocketClient(slog.New(slog.NewTextHandler(io.Discard, nil)), types.ServerHello{Commit: "abc123"})
+	client.RegisterCommand(MessageTypeRunProbe, func(ctx context.Context, payload json.RawMessage) (any, error) {
+		var request struct {
+			Probe string `json:"probe"`
+		}
+		if err := json.Unmarshal(payload, &request); err != nil {
+			return nil, err
+		}
+		if request.Probe != "ping" {
+			return nil, errors.New("unknown probe")
+		}
+		return map[string]string{"id": "run-1"}, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go client.Listen(ctx)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := client.HandleConnection(w, r); err != nil {
+			t.Errorf("failed to handle connection: %v", err)
+		}
+	}))
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		server.Close()
+		cancel()
+	})
+	return client, conn
+}
+
+func readMessage(t *testing.T, conn *websocket.Conn) Message {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	message, err := DecodeMessage(data)
+	if err != nil {
+		t.Fatalf("failed to decode message: %v", err)
+	}
+	return message
+}
+
+func sendCommand(t *testing.T, conn *websocket.Conn, messageType MessageType, id string, payload string) CommandResult {
+	t.Helper()
+
+	err := conn.WriteJSON(Message{Type: messageType, Version: ProtocolVersion, ID: id, Payload: json.RawMessage(payload)})
+	if err != nil {
+		t.Fatalf("failed to send command: %v", err)
+	}
+
+	message := readMessage(t, conn)
+	if message.Type != MessageTypeCommandResult {
+		t.Fatalf("expected command result, got %s", message.Type)
+	}
+	var result CommandResult
+	if err := json.Unmarshal(message.Payload, &result); err != nil {
+		t.Fatalf("failed to unmarshal command result: %v", err)
+	}
+	if result.ID != id {
+		t.Errorf("expected result for %s, got %s", id, result.ID)
+	}
+	return result
+}
+
+func TestSubscription(t *testing.T) {
+	client, conn := newTestConnection(t)
+
+	result := sendCommand(t, conn, MessageTypeSubscribe, "1", `{"targets":["1.1.1.1"],"probes":["ping"]}`)
+	if result.Error != "" {
+		t.Fatalf("failed to subscribe: %s", result.Error)
+	}
+
+	client.Publish(MessageTypeMeasurement, Topic{Target: "8.8.8.8", Probes: []string{"ping"}}, nil)
+	client.Publish(MessageTypeSpeedTestProgress, Topic{Probes: []string{"speedtest"}}, nil)
+	client.Publish(MessageTypeMeasurement, Topic{Target: "1.1.1.1", Probes: []string{"ping", "speedtest"}}, nil)
+
+	message := readMessage(t, conn)
+	if message.Type != MessageTypeMeasurement || message.Seq != 3 {
+		t.Errorf("expected only the subscribed measurement, got %s %d", message.Type, message.Seq)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	client, conn := newTestConnection(t)
+
+	for range 3 {
+		client.Publish(MessageTypeMeasurement, Topic{}, nil)
+	}
+	for range 3 {
+		readMessage(t, conn)
+	}
+
+	err := conn.WriteJSON(Message{Type: MessageTypeBackfill, Version: ProtocolVersion, ID: "backfill", Payload: json.RawMessage(`{"afterSeq":1}`)})
+	if err != nil {
+		t.Fatalf("failed to send backfill: %v", err)
+	}
+
+	for _, expected := range []uint64{2, 3} {
+		if message := readMessage(t, conn); message.Seq != expected {
+			t.Errorf("expected replayed seq %d, got %d", expected, message.Seq)
+		}
+	}
+
+	message := readMessage(t, conn)
+	var result struct {
+		Result BackfillResult `json:"result"`
+	}
+	if err := json.Unmarshal(message.Payload, &result); err != nil {
+		t.Fatalf("failed to unmarshal backfill result: %v", err)
+	}
+	if result.Result.Replayed != 2 || !result.Result.Complete {
+		t.Errorf("unexpected backfill result %+v", result.Result)
+	}
+}
+
+func TestCommandSentOnConnect(t *testing.T) {
+	_, conn := dialTestClient(t)
+
+	// The client is subscribed before its commands are read, so a command
+	// sent straight away is answered after the hello.
+	err := conn.WriteJSON(Message{Type: MessageTypeRunProbe, Version: ProtocolVersion, ID: "run", Payload: json.RawMessage(`{"probe":"ping"}`)})
+	if err != nil {
+		t.Fatalf("failed to send command: %v", err)
+	}
+	if message := readMessage(t, conn); message.Type != MessageTypeHello {
+		t.Fatalf("expected hello, got %s", message.Type)
+	}
+	if message := readMessage(t, conn); message.Type != MessageTypeCommandResult {
+		t.Errorf("expected command result, got %s", message.Type)
+	}
+}
+
+func TestAfterListen(t *testing.T) {
+	client := NewWebsocketClient(slog.New(slog.NewTextHandler(io.Discard, nil)), types.ServerHello{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	client.Listen(ctx)
+
+	done := make(chan error)
+	go func() {
+		done <- client.Publish(MessageTypeMeasurement, Topic{}, nil)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("failed to publish: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish blocked after listen returned")
+	}
+
+	if _, _, err := client.(*websocketClient).subscribe("test", Subscription{}, nil); !errors.Is(err, pubsub.ErrClosed) {
+		t.Errorf("expected new clients to be refused, got %v", err)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	_, conn := newTestConnection(t)
+
+	result := sendCommand(t, conn, MessageTypeRunProbe, "run", `{"probe":"ping"}`)
+	if result.Error != "" || result.Result.(map[string]any)["id"] != "run-1" {
+		t.Errorf("unexpected run probe result %+v", result)
+	}
+
+	result = sendCommand(t, conn, MessageTypeRunProbe, "bad", `{"probe":"traceroute"}`)
+	if result.Error == "" {
+		t.Error("expected run probe error to be returned")
+	}
+
+	result = sendCommand(t, conn, MessageTypeMeasurement, "measurement", `{}`)
+	if result.Error == "" {
+		t.Error("expected error for a message type that isn't a command")
+	}
+
+	// Replies to commands the server doesn't understand still have their ID,
+	// so the client can stop waiting.
+	result = sendCommand(t, conn, "status", "unknown", `{}`)
+	if !strings.Contains(result.Error, "unknown message type") {
+		t.Errorf("expected unknown type error, got %+v", result)
+	}
+	if err := conn.WriteJSON(Message{Type: MessageTypeSubscribe, Version: ProtocolVersion + 1, ID: "future", Payload: json.RawMessage(`{}`)}); err != nil {
+		t.Fatalf("failed to send command: %v", err)
+	}
+	var reply CommandResult
+	if err := json.Unmarshal(readMessage(t, conn).Payload, &reply); err != nil {
+		t.Fatalf("failed to unmarshal command result: %v", err)
+	}
+	if reply.ID != "future" || !strings.Contains(reply.Error, "unsupported protocol version") {
+		t.Errorf("expected unsupported version error for future, got %+v", reply)
+	}
+}
+
+// Returns a measurement payload for stored measurements with the sequence
+// numbers.
+func measurements(seqs ...int64) *types.NetworkInfoBatch {
+	batch := &types.NetworkInfoBatch{}
+	for _, seq := range seqs {
+		batch.Seqs = append(batch.Seqs, seq)
+		batch.Timestamps = append(batch.Timestamps, seq*1000)
+		batch.PingValues = append(batch.PingValues, true)
+		batch.UploadValues = append(batch.UploadValues, optional.Empty[float64]())
+		batch.DownloadValues = append(batch.DownloadValues, optional.Empty[float64]())
+		batch.TrafficValues = append(batch.TrafficValues, optional.Empty[float64]())
+		batch.Targets = append(batch.Targets, "1.1.1.1")
+		batch.RTTValues = append(batch.RTTValues, optional.New(10))
+		batch.PacketLossValues = append(batch.PacketLossValues, 0)
+	}
+	return batch
+}
+
+// Opens an event stream and returns its lines other than data and blank lines.
+func openStream(t *testing.T, ctx context.Context, url string, lastEventID string) <-chan string {
+	t.Helper()
+
+	request, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if lastEventID != "" {
+		request.Header.Set("Last-Event-ID", lastEventID)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+
+	if contentType := response.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("expected event stream, got %s", contentType)
+	}
+
+	lines := make(chan string, 16)
+	go func() {
+		buffer := make([]byte, 4096)
+		var pending string
+		for {
+			n, err := response.Body.Read(buffer)
+			pending += string(buffer[:n])
+			for {
+				line, rest, found := strings.Cut(pending, "\n")
+				if !found {
+					break
+				}
+				pending = rest
+				if line != "" && !strings.HasPrefix(line, "data:") {
+					lines <- line
+				}
+			}
+			if err != nil {
+				close(lines)
+				return
+			}
+		}
+	}()
+	return lines
+}
+
+func expectLines(t *testing.T, lines <-chan string, expected ...string) {
+	t.Helper()
+	for _, want := range expected {
+		select {
+		case line := <-lines:
+			if line != want {
+				t.Fatalf("expected %q, got %q", want, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	client := NewWebsocketClient(slog.New(slog.NewTextHandler(io.Discard, nil)), types.ServerHello{})
+
+	// Measurements 1 to 4 are stored, but only 2 was published before the
+	// client reconnects.
+	var requestedAfter []int64
+	stored := func(ctx context.Context, afterSeq int64, limit int) (*types.NetworkInfoBatch, error) {
+		requestedAfter = append(requestedAfter, afterSeq)
+		if afterSeq >= 4 {
+			return measurements(), nil
+		}
+		seqs := []int64{}
+		for seq := afterSeq + 1; seq <= 4; seq++ {
+			seqs = append(seqs, seq)
+		}
+		return measurements(seqs...), nil
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client.HandleStream(w, r, stored)
+	}))
+	defer server.Close()
+
+	// Cancelled first, so the streams end before the server closes.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Listen(ctx)
+
+	client.Publish(MessageTypeMeasurement, Topic{}, measurements(2))
+	client.Publish(MessageTypeIncident, Topic{}, nil)
+
+	// The hello, then the stored measurements after the last event ID, then
+	// live measurements that weren't already sent.
+	lines := openStream(t, ctx, server.URL+"?types=measurement", "2")
+	expectLines(t, lines, "event: hello", "id: 3", "event: measurement", "id: 4", "event: measurement")
+	client.Publish(MessageTypeMeasurement, Topic{}, measurements(4))
+	client.Publish(MessageTypeMeasurement, Topic{}, measurements(5))
+	expectLines(t, lines, "id: 5", "event: measurement")
+	if len(requestedAfter) != 1 || requestedAfter[0] != 2 {
+		t.Errorf("expected stored measurements after 2, got %v", requestedAfter)
+	}
+
+	// New streams start from the last measurement published, and other events
+	// have no ID.
+	lines = openStream(t, ctx, server.URL, "")
+	expectLines(t, lines, "id: 5", "event: hello")
+	client.Publish(MessageTypeIncident, Topic{}, nil)
+	expectLines(t, lines, "event: incident")
+}
@@ -0,0 +1,175 @@
+const testBytes = 25 * 1024 * 1024;
+const echoCount = 10;
+const historyRows = 20;
+
+const elements = {
+    startButton: null,
+    status: null,
+    down: null,
+    up: null,
+    latency: null,
+    wanDown: null,
+    wanUp: null,
+    wanLatency: null,
+    history: null,
+};
+
+const toMbps = (bytes, ms) => (bytes * 8) / (ms * 1000);
+
+const runDownload = async () => {
+    const start = performance.now();
+    const res = await fetch(`/api/v1/lan/download?bytes=${testBytes}`, { cache: "no-store" });
+    if (res.status !== 200) {
+        throw new Error(`download: ${res.status}, ${res.statusText}`);
+    }
+
+    const reader = res.body.getReader();
+    let received = 0;
+    for (;;) {
+        const { done, value } = await reader.read();
+        if (done) {
+            break;
+        }
+        received += value.length;
+    }
+
+    return toMbps(received, performance.now() - start);
+}
+
+const runUpload = async () => {
+    const body = new Blob([new Uint8Array(testBytes)]);
+    const start = performance.now();
+    const res = await fetch("/api/v1/lan/upload", { method: "POST", body });
+    if (res.status !== 200) {
+        throw new Error(`upload: ${res.status}, ${res.statusText}`);
+    }
+
+    const json = await res.json();
+    return toMbps(json["bytes"], performance.now() - start);
+}
+
+/**
+ * Sends a series of messages over the echo websocket and returns the median
+ * round trip time in milliseconds.
+ */
+const runLatency = () => new Promise((resolve, reject) => {
+    const protocol = window.location.protocol === "https:" ? "wss:" : "ws:";
+    const socket = new WebSocket(`${protocol}//${window.location.host}/api/v1/lan/echo`);
+    const samples = [];
+    let sentAt = 0;
+
+    const send = () => {
+        sentAt = performance.now();
+        socket.send(`${samples.length}`);
+    }
+
+    socket.onopen = send;
+    socket.onerror = () => reject(new Error("echo websocket failed"));
+    socket.onmessage = () => {
+        samples.push(performance.now() - sentAt);
+        if (samples.length < echoCount) {
+            send();
+            return;
+        }
+
+        socket.close();
+        samples.sort((a, b) => a - b);
+        resolve(samples[Math.floor(samples.length / 2)]);
+    }
+});
+
+const loadLatestWAN = async () => {
+    const res = await fetch("/api/v1/speedtest/history");
+    if (res.status !== 200) {
+        console.error(`/api/v1/speedtest/history: ${res.status}, ${res.statusText}`);
+        return;
+    }
+
+    const history = await res.json();
+    if (history.length === 0) {
+        return;
+    }
+
+    const latest = history[history.length - 1];
+    elements.wanDown.innerHTML = Math.floor(latest["download"]);
+    elements.wanUp.innerHTML = Math.floor(latest["upload"]);
+    elements.wanLatency.innerHTML = latest["server"]["latencyMS"];
+}
+
+const loadHistory = async () => {
+    const res = await fetch("/api/v1/lan/results");
+    if (res.status !== 200) {
+        console.error(`/api/v1/lan/results: ${res.status}, ${res.statusText}`);
+        return;
+    }
+
+    const results = await res.json();
+    elements.history.replaceChildren();
+    for (const result of results.slice(-historyRows).reverse()) {
+        const row = document.createElement("tr");
+        const cells = [
+            new Date(result["timestamp"]).toLocaleString(),
+            result["clientIP"],
+            `${Math.floor(result["download"])} Mbps`,
+            `${Math.floor(result["upload"])} Mbps`,
+            `${result["latencyMS"].toFixed(1)} ms`,
+        ];
+        for (const text of cells) {
+            const cell = document.createElement("td");
+            cell.textContent = text;
+            row.appendChild(cell);
+        }
+        row.title = result["userAgent"];
+        elements.history.appendChild(row);
+    }
+}
+
+const runTest = async () => {
+    elements.startButton.disabled = true;
+    try {
+        elements.status.innerHTML = "Measuring latency...";
+        const latency = await runLatency();
+        elements.latency.innerHTML = latency.toFixed(1);
+
+        elements.status.innerHTML = "Measuring download...";
+        const download = await runDownload();
+        elements.down.innerHTML = Math.floor(download);
+
+        elements.status.innerHTML = "Measuring upload...";
+        const upload = await runUpload();
+        elements.up.innerHTML = Math.floor(upload);
+
+        const res = await fetch("/api/v1/lan/results", {
+            method: "POST",
+            headers: { "Content-Type": "application/json" },
+            body: JSON.stringify({ download, upload, latencyMS: latency }),
+        });
+        if (res.status !== 201) {
+            throw new Error(`saving result: ${res.status}, ${res.statusText}`);
+        }
+
+        elements.status.innerHTML = "Done";
+        await loadHistory();
+    } catch (error) {
+        console.error(error);
+        elements.status.innerHTML = "Test failed";
+    } finally {
+        elements.startButton.disabled = false;
+    }
+}
+
+window.onload = async () => {
+    elements.startButton = document.getElementById("lan_start_button");
+    elements.status = document.getElementById("lan_status");
+    elements.down = document.getElementById("lan_down");
+    elements.up = document.getElementById("lan_up");
+    elements.latency = document.getElementById("lan_latency");
+    elements.wanDown = document.getElementById("wan_down");
+    elements.wanUp = document.getElementById("wan_up");
+    elements.wanLatency = document.getElementById("wan_latency");
+    elements.history = document.getElementById("lan_history");
+
+    elements.startButton.onclick = runTest;
+
+    await Promise.all([loadLatestWAN(), loadHistory()]);
+}
@@ -1,5 +1,3 @@
-let lastTimestamp = 1742842731;
-
 const elements = {
     legendText: null,
     legendDate: null,
@@ -7,13 +5,55 @@ const elements = {
     legendDown: null,
     legendUp: null,
     legendPing: null,
+    legendTraffic: null,
+    legendLoss: null,
+    legendRTT: null,
+    seriesToggles: null,
+
+    rangePreset: null,
+    rangeCustom: null,
+    rangeFrom: null,
+    rangeTo: null,
+
+    statsWindow: null,
+    statsAvailability: null,
+    statsMeasurements: null,
+    statsOutages: null,
+    statsDowntime: null,
+    statsMTTR: null,
+    statsMTBF: null,
+    statsRTT: null,
+    statsRTTTail: null,
+    statsLoss: null,
+    statsLossTail: null,
+    statsDownload: null,
+    statsUpload: null,
+
+    heatmap: null,
+    heatmapMetric: null,
+    heatmapWindow: null,
+
+    usageUsed: null,
+    usageBudget: null,
+    usageReset: null,
+
+    planName: null,
+    planSpeeds: null,
+    planRecent: null,
+
+    incidents: null,
+
+    exportKind: null,
+    exportRange: null,
+    exportFormat: null,
+
+    runSpeedtestButton: null,
+    runSpeedtestStatus: null,
 
-    latestDate: null,
-    latestTime: null,
-    latestUp: null,
-    latestDown: null,
-    latestPingCircle: null,
-    latestPingText: null,
+    speedtestProgress: null,
+    speedtestPhase: null,
+    speedtestMbps: null,
+    speedtestBar: null,
 };
 
 const gmtToTimeZone = {
@@ -28,26 +68,161 @@ const gmtToTimeZone = {
 };
 
 const maxDataPoints = 10000;
+const probePollInterval = 2000;
+const protocolVersion = 1;
 
-const getPingValue = x => x ? 0.2 : 0;
+// Height of a successful ping on the chart, scaled by the fraction received
+// for aggregated points.
+const pingSuccessValue = 0.2;
+const getPingValue = x => x ? pingSuccessValue : 0;
+// Number of incidents shown under recent issues.
+const maxIncidents = 5;
 
 let chart;
 
+let socket;
+// Sequence number of the last broadcast message received.
+let lastSeq = 0;
+// Sequence numbers [after, until] being replayed by a backfill, or null.
+let backfillWindow = null;
+let nextCommandID = 0;
+const pendingCommands = new Map();
+// Sequence number of the last stored measurement added to the chart.
+let lastMeasurementSeq = 0;
+// Live measurements received while filling a gap, or null if not filling.
+let pendingMeasurements = null;
+
+// Length of each range preset in milliseconds. Presets end now and follow live
+// measurements, while custom ranges are fixed.
+const rangePresets = {
+    "1h": 60 * 60 * 1000,
+    "6h": 6 * 60 * 60 * 1000,
+    "24h": 24 * 60 * 60 * 1000,
+    "7d": 7 * 24 * 60 * 60 * 1000,
+    "30d": 30 * 24 * 60 * 60 * 1000,
+    "1y": 365 * 24 * 60 * 60 * 1000,
+};
+const defaultRangePreset = "24h";
+// Shortest range that can be zoomed into.
+const minZoomRange = 60 * 1000;
+// Selected chart range, with from and to set for custom ranges.
+let chartRange = { preset: defaultRangePreset, from: 0, to: 0 };
+// Incremented by each chart load, so that slower earlier loads are discarded.
+let chartLoadCount = 0;
+// Minimum time between reloading a live range, which replaces the measurements
+// added since with aggregated points.
+const chartReloadInterval = 5 * 60 * 1000;
+let lastChartLoad = 0;
+let chartBucketMS = 0;
+
+const minReconnectDelay = 1000;
+const maxReconnectDelay = 30000;
+let reconnectDelay = minReconnectDelay;
+const measurementsPageSize = 1000;
+// Minimum time between reloading the statistics as measurements arrive.
+const statsRefreshInterval = 60000;
+let lastStatsLoad = 0;
+// Rows of the heatmap from Monday, as indexes into the days from the API, which
+// start on Sunday.
+const heatmapDays = [[1, "Mon"], [2, "Tue"], [3, "Wed"], [4, "Thu"], [5, "Fri"], [6, "Sat"], [0, "Sun"]];
+// How to show each heatmap metric, and whether higher values are worse.
+const heatmapMetrics = {
+    "medianRTTMS": { format: x => `${Math.round(x)} ms`, higherIsWorse: true },
+    "lossPercent": { format: x => `${x.toFixed(1)}% loss`, higherIsWorse: true },
+    "medianDownloadMbps": { format: x => `${Math.floor(x)} Mbps`, higherIsWorse: false },
+};
+// Index of the packet loss series, followed by a round trip time series for
+// each target in chartTargets.
+const lossSeries = 13;
+const firstTargetSeries = 14;
+// Names of the targets with a series on the chart, in series order.
+const chartTargets = [];
+const targetColors = ["#00897b", "#c2185b", "#5d4037", "#546e7a", "#9e9d24"];
+// Outages shaded on the chart, as [start, end] with a null end while ongoing.
+let outages = [];
+let showOutages = true;
+const outageColor = "#e5393526";
+// Chart series shown or hidden together by each legend toggle. Targets are
+// added as they appear.
+const seriesToggles = [
+    { label: "Download", color: "green", series: [1, 7, 8] },
+    { label: "Upload", color: "blue", series: [2, 9, 10] },
+    { label: "Ping", color: "#8e4fdb", series: [3] },
+    { label: "Traffic", color: "#e08a1e", series: [4, 11, 12] },
+    { label: "Plan", color: "gray", series: [5, 6] },
+    { label: "Packet loss", color: "#e53935", series: [lossSeries] },
+    { label: "Outages", color: outageColor, outages: true },
+];
+// Configured internet plans, oldest first.
+let plans = [];
+// Incidents by ID, updated as they open and close.
+const incidents = new Map();
+
+// Fits an axis to its longest label.
+function axisSize(self, values, axisIdx, cycleNum) {
+    let axis = self.axes[axisIdx];
+
+    // bail out, force convergence
+    if (cycleNum > 1)
+        return axis._size;
+
+    let axisSize = axis.ticks.size + axis.gap;
+
+    // find longest value
+    let longestVal = (values ?? []).reduce((acc, val) => (
+        val.length > acc.length ? val : acc
+    ), "");
+
+    if (longestVal != "") {
+        self.ctx.font = axis.font[0];
+        axisSize += self.ctx.measureText(longestVal).width / devicePixelRatio;
+    }
+    return Math.ceil(axisSize);
+}
+
+const targetSeries = index => ({
+    show: true,
+    spanGaps: true,
+    scale: "ms",
+    stroke: targetColors[index % targetColors.length],
+    width: 1,
+    points: { show: false }
+});
+
+const bandSeries = {
+    show: true,
+    spanGaps: true,
+    scale: "mbps",
+    stroke: "transparent",
+    points: { show: false }
+};
+
 const chartOptions = {
     width: 500,
     height: 250,
     scales: {
         "mbps": {
-            auto: false,
-            range: [0, 1000],
+            auto: true,
+            // Leaves room above the fastest result or plan line.
+            range: (_, min, max) => [0, max > 0 ? Math.ceil(max * 1.1) : 100],
         },
         "boolean": {
             auto: false,
             range: [0, 1],
         },
+        "ms": {
+            auto: true,
+            range: (_, min, max) => [0, max > 0 ? Math.ceil(max * 1.2) : 100],
+        },
+        "percent": {
+            auto: false,
+            range: [0, 100],
+        },
         x: {
             auto: true,
-            visible: false
+            visible: false,
+            // Shows the whole range, even where there are no measurements.
+            range: () => rangeBounds(),
         }
     },
     axes: [
@@ -56,27 +231,16 @@ const chartOptions = {
             scale: "mbps",
             side: 1,
             values: (_, ticks) => ticks.map(rawValue => `${rawValue} Mbps`),
-            size(self, values, axisIdx, cycleNum) {
-                let axis = self.axes[axisIdx];
-
-                // bail out, force convergence
-                if (cycleNum > 1)
-                    return axis._size;
-
-                let axisSize = axis.ticks.size + axis.gap;
-
-                // find longest value
-                let longestVal = (values ?? []).reduce((acc, val) => (
-                    val.length > acc.length ? val : acc
-                ), "");
-
-                if (longestVal != "") {
-                    self.ctx.font = axis.font[0];
-                    axisSize += self.ctx.measureText(longestVal).width / devicePixelRatio;
-                }
-                return Math.ceil(axisSize);
-            },
+            size: axisSize,
+            font: "12px monospace",
+        },
+        {
+            scale: "ms",
+            side: 3,
+            values: (_, ticks) => ticks.map(rawValue => `${rawValue} ms`),
+            size: axisSize,
             font: "12px monospace",
+            grid: { show: false },
         },
         {
             scale: "boolean",
@@ -108,20 +272,62 @@ const chartOptions = {
             scale: "boolean",
             stroke: "#8e4fdb",
             points: { show: false }
-        }
+        },
+        {
+            show: true,
+            spanGaps: true,
+            scale: "mbps",
+            stroke: "#e08a1e",
+            points: { show: false }
+        },
+        {
+            show: true,
+            spanGaps: false,
+            scale: "mbps",
+            stroke: "green",
+            dash: [6, 4],
+            width: 1,
+            points: { show: false }
+        },
+        {
+            show: true,
+            spanGaps: false,
+            scale: "mbps",
+            stroke: "blue",
+            dash: [6, 4],
+            width: 1,
+            points: { show: false }
+        },
+        // Minimum and maximum of aggregated download, upload and traffic,
+        // drawn as bands rather than lines.
+        bandSeries, bandSeries,
+        bandSeries, bandSeries,
+        bandSeries, bandSeries,
+        {
+            show: true,
+            scale: "percent",
+            stroke: "#e53935",
+            fill: "#e5393566",
+            paths: uPlot.paths.bars({ size: [0.9, 8] }),
+            points: { show: false }
+        },
+    ],
+    bands: [
+        { series: [8, 7], fill: "#4caf5033" },
+        { series: [10, 9], fill: "#4c7daf33" },
+        { series: [12, 11], fill: "#e08a1e33" },
     ],
     legend: {
         show: false,
     },
     hooks: {
         setLegend: [ u => updateLegend(u) ],
+        setSelect: [ u => zoomToSelection(u) ],
+        drawClear: [ u => drawOutages(u) ],
     },
     cursor: {
         y: false,
-        drag: { setScale: false }
-    },
-    select: {
-        show: false
+        drag: { x: true, y: false, setScale: false }
     },
 };
 
@@ -145,77 +351,514 @@ const updateLegend = u => {
 
     elements.legendDown.innerHTML = Math.floor(u.data[1][i[1]]);
     elements.legendUp.innerHTML = Math.floor(u.data[2][i[2]]);
-    elements.legendPing.innerHTML = u.data[3][i[3]] > 0 ? "received" : "failed";
+    const ping = u.data[3][i[3]] / pingSuccessValue;
+    elements.legendPing.innerHTML = ping === 1 ? "received" : ping === 0 ? "failed" : `${Math.round(ping * 100)}% received`;
+    const traffic = u.data[4][i[4]];
+    elements.legendTraffic.innerHTML = traffic === undefined ? "-" : traffic.toFixed(1);
+    const loss = u.data[lossSeries][i[lossSeries]];
+    elements.legendLoss.innerHTML = loss === undefined || loss === null ? "-" : loss.toFixed(1);
+    elements.legendRTT.innerHTML = chartTargets
+        .map((name, t) => [name, u.data[firstTargetSeries + t][i[firstTargetSeries + t]]])
+        .filter(([_, rtt]) => rtt !== undefined && rtt !== null)
+        .map(([name, rtt]) => `${name} ${Math.round(rtt)} ms`)
+        .join(", ");
 }
 
-const updateLatestSummary = () => {
-    const endIndex = chart.data[0].length - 1;
-    const timestamp = chart.data[0][endIndex];
-    let download = chart.data[1][endIndex];
-    let upload = chart.data[2][endIndex];
-    const ping = chart.data[3][endIndex] > 0;
+/**
+ * Shades the outages behind the series.
+ */
+const drawOutages = u => {
+    if (!showOutages) {
+        return;
+    }
+    u.ctx.save();
+    u.ctx.fillStyle = outageColor;
+    for (const [start, end] of outages) {
+        const left = Math.max(start, u.scales.x.min);
+        const right = Math.min(end ?? Date.now(), u.scales.x.max);
+        if (right <= left) {
+            continue;
+        }
+        const x = u.valToPos(left, "x", true);
+        u.ctx.fillRect(x, u.bbox.top, Math.max(u.valToPos(right, "x", true) - x, 1), u.bbox.height);
+    }
+    u.ctx.restore();
+}
 
-    let i = endIndex;
-    while (download === undefined && i >= 0) {
-        i -= 1;
-        download = chart.data[1][i];
+/**
+ * Follows outages in live measurements, which like the server's start at a
+ * failed ping and end at the next successful one.
+ */
+const trackOutage = (timestamp, pingSuccessful) => {
+    const last = outages[outages.length - 1];
+    const ongoing = last !== undefined && last[1] === null;
+    if (!pingSuccessful && !ongoing) {
+        outages.push([timestamp, null]);
+    } else if (pingSuccessful && ongoing) {
+        last[1] = timestamp;
     }
+}
 
-    i = endIndex;
-    while (upload === undefined && i >= 0) {
-        i -= 1;
-        upload = chart.data[2][i];
+const addSeriesToggle = toggle => {
+    const label = document.createElement("label");
+    const checkbox = document.createElement("input");
+    checkbox.type = "checkbox";
+    checkbox.checked = true;
+    checkbox.onchange = () => {
+        if (toggle.outages) {
+            showOutages = checkbox.checked;
+            chart.redraw();
+        }
+        (toggle.series ?? []).forEach(i => chart.setSeries(i, { show: checkbox.checked }));
+    };
+    const swatch = document.createElement("span");
+    swatch.className = "series_swatch";
+    swatch.style.background = toggle.color;
+    label.append(checkbox, swatch, toggle.label);
+    elements.seriesToggles.append(label);
+}
+
+/**
+ * Adds a round trip time series and its toggle for each target not already on
+ * the chart.
+ */
+const addTargets = names => {
+    for (const name of names) {
+        if (chartTargets.includes(name)) {
+            continue;
+        }
+        const index = chartTargets.length;
+        chartTargets.push(name);
+        chart.data.push(chart.data[0].map(() => undefined));
+        chart.addSeries(targetSeries(index), firstTargetSeries + index);
+        addSeriesToggle({
+            label: `${name} RTT`,
+            color: targetColors[index % targetColors.length],
+            series: [firstTargetSeries + index],
+        });
     }
+}
 
-    const date = new Date(timestamp);
+const formatDuration = ms => {
+    const minutes = Math.round(ms / 60000);
+    if (minutes < 1) {
+        return `${Math.round(ms / 1000)}s`;
+    } else if (minutes < 60) {
+        return `${minutes}m`;
+    } else if (minutes < 24 * 60) {
+        return `${Math.floor(minutes / 60)}h ${minutes % 60}m`;
+    }
+    return `${Math.floor(minutes / (24 * 60))}d ${Math.floor(minutes / 60) % 24}h`;
+}
 
-    elements.latestDate.innerHTML = date.toLocaleDateString();
-    elements.latestTime.innerHTML = date.toLocaleTimeString();
-    const gmt = date.toString().match(/GMT-\d+/g);
-    if (gmt && gmt.length === 1 && gmtToTimeZone[gmt[0]]) {
-        elements.latestTime.innerHTML += ` ${gmtToTimeZone[gmt[0]]}`;
+const loadStats = async () => {
+    lastStatsLoad = Date.now();
+    const res = await fetch(`/api/v1/stats?window=${elements.statsWindow.value}`);
+    if (res.status !== 200) {
+        console.error(`/api/v1/stats: ${res.status}, ${res.statusText}`);
+        return;
     }
 
-    elements.latestDown.innerHTML = Math.floor(download);
-    elements.latestUp.innerHTML = Math.floor(upload);
+    const stats = await res.json();
+    const availability = stats["availabilityPercent"];
+    elements.statsAvailability.innerHTML = availability === null ? "-" : `${availability.toFixed(availability === 100 ? 0 : 2)}%`;
+    elements.statsMeasurements.innerHTML = `${stats["measurements"]} measurements`;
+    elements.statsOutages.innerHTML = stats["outages"];
+    elements.statsDowntime.innerHTML = `${formatDuration(stats["downtimeMS"])} down`;
+    elements.statsMTTR.innerHTML = stats["mttrMS"] === null ? "-" : formatDuration(stats["mttrMS"]);
+    elements.statsMTBF.innerHTML = stats["mtbfMS"] === null ? "MTBF -" : `MTBF ${formatDuration(stats["mtbfMS"])}`;
+
+    const rtt = stats["rttMS"];
+    elements.statsRTT.innerHTML = rtt === null ? "-" : `${Math.round(rtt["p50"])} ms`;
+    elements.statsRTTTail.innerHTML = rtt === null ? "-" : `p95 ${Math.round(rtt["p95"])} / p99 ${Math.round(rtt["p99"])} ms`;
+    const loss = stats["packetLossPercent"];
+    elements.statsLoss.innerHTML = loss === null ? "-" : `${loss["p95"].toFixed(1)}%`;
+    elements.statsLossTail.innerHTML = loss === null ? "-" : `p99 ${loss["p99"].toFixed(1)}%`;
+    const download = stats["downloadMbps"];
+    const upload = stats["uploadMbps"];
+    elements.statsDownload.innerHTML = download === null ? "-" : `${Math.floor(download["p50"])} Mbps`;
+    elements.statsUpload.innerHTML = upload === null ? "No speed tests" : `Upload p50 ${Math.floor(upload["p50"])} Mbps`;
+}
+
+/**
+ * Shades each hour of the week from green for the best value to red for the
+ * worst, in the browser's time zone.
+ */
+const loadHeatmap = async () => {
+    const params = new URLSearchParams({
+        window: elements.heatmapWindow.value,
+        tz: Intl.DateTimeFormat().resolvedOptions().timeZone,
+    });
+    const res = await fetch(`/api/v1/heatmap?${params}`);
+    if (res.status !== 200) {
+        console.error(`/api/v1/heatmap: ${res.status}, ${res.statusText}`);
+        return;
+    }
+
+    const heatmap = await res.json();
+    const metric = elements.heatmapMetric.value;
+    const { format, higherIsWorse } = heatmapMetrics[metric];
+    const values = heatmap["days"].flat().map(cell => cell[metric]).filter(x => x !== null);
+    const min = Math.min(...values);
+    const max = Math.max(...values);
+
+    let html = "<tr><th></th>";
+    for (let hour = 0; hour < 24; hour++) {
+        html += `<th>${hour % 3 === 0 ? hour : ""}</th>`;
+    }
+    html += "</tr>";
+    for (const [day, name] of heatmapDays) {
+        html += `<tr><th>${name}</th>`;
+        heatmap["days"][day].forEach((cell, hour) => {
+            const value = cell[metric];
+            if (value === null) {
+                html += `<td title="${name} ${hour}:00, no data"></td>`;
+                return;
+            }
+            const fraction = max > min ? (value - min) / (max - min) : 0;
+            const badness = higherIsWorse ? fraction : 1 - fraction;
+            html += `<td style="background-color: hsl(${Math.round(120 * (1 - badness))}, 60%, 70%)" ` +
+                `title="${name} ${hour}:00, ${format(value)}, ${cell["measurements"]} measurements"></td>`;
+        });
+        html += "</tr>";
+    }
+    elements.heatmap.innerHTML = html;
+}
+
+/**
+ * Returns the plan in effect at the time, or null if there was none.
+ */
+const planAt = timestamp => {
+    for (let i = plans.length - 1; i >= 0; i--) {
+        if (plans[i]["effectiveFrom"] <= timestamp) {
+            return plans[i];
+        }
+    }
+    return null;
+}
+
+const loadPlan = async () => {
+    const res = await fetch("/api/v1/plan");
+    if (res.status !== 200) {
+        console.error(`/api/v1/plan: ${res.status}, ${res.statusText}`);
+        return;
+    }
+
+    const status = await res.json();
+    plans = status["plans"];
+    const current = status["current"];
+    elements.planName.innerHTML = current === null ? "None" : current["name"] || "Unnamed";
+    elements.planSpeeds.innerHTML = current === null ? "-" : `${current["downloadMbps"]} / ${current["uploadMbps"]} Mbps`;
+
+    const download = status["recentDownloadPercent"];
+    const upload = status["recentUploadPercent"];
+    elements.planRecent.innerHTML = download === null ? "-" : `${Math.round(download)}% / ${Math.round(upload)}%`;
+    elements.planRecent.classList.toggle("below_plan", status["belowPlan"]);
+}
+
+const formatIncident = incident => {
+    const start = new Date(incident["start"]).toLocaleString();
+    const end = incident["end"];
+    const duration = end === null ? "ongoing" : formatDuration(end - incident["start"]);
+    return `<tr><td>${start}</td><td>${incident["description"]} (${duration})</td></tr>`;
+}
+
+const renderIncidents = () => {
+    const newest = [...incidents.values()]
+        .sort((a, b) => b["start"] - a["start"])
+        .slice(0, maxIncidents);
+    elements.incidents.innerHTML = newest.length === 0
+        ? "<tr><td>None</td><td></td></tr>"
+        : newest.map(formatIncident).join("");
+}
+
+const loadIncidents = async () => {
+    const res = await fetch("/api/v1/incidents");
+    if (res.status !== 200) {
+        console.error(`/api/v1/incidents: ${res.status}, ${res.statusText}`);
+        return;
+    }
+
+    (await res.json()).forEach(incident => incidents.set(incident["id"], incident));
+    renderIncidents();
+}
+
+/**
+ * Shows incidents as they open and close. Speed tests falling below the plan
+ * also change the plan summary.
+ */
+const handleIncident = incident => {
+    incidents.set(incident["id"], incident);
+    renderIncidents();
+    if (incident["kind"] === "belowPlan") {
+        loadPlan();
+    }
+}
+
+/**
+ * Returns the start and end of the selected range in unix milliseconds.
+ */
+const rangeBounds = () => {
+    if (chartRange.preset === "custom") {
+        return [chartRange.from, chartRange.to];
+    }
+    const now = Date.now();
+    return [now - rangePresets[chartRange.preset], now];
+}
+
+const isLiveRange = () => chartRange.preset !== "custom";
+
+// Formats a time as the value of a datetime-local input, in local time.
+const toDateTimeLocal = ms => new Date(ms - new Date(ms).getTimezoneOffset() * 60000).toISOString().slice(0, 16);
+
+/**
+ * Reads the range from the page URL, either a preset as "range" or a custom
+ * range as "from" and "to" in unix milliseconds.
+ */
+const rangeFromURL = () => {
+    const params = new URLSearchParams(window.location.search);
+    const from = Number(params.get("from"));
+    const to = Number(params.get("to"));
+    if (params.has("from") && params.has("to") && from >= 0 && to > from) {
+        return { preset: "custom", from, to };
+    }
+    const preset = params.get("range");
+    return { preset: preset in rangePresets ? preset : defaultRangePreset, from: 0, to: 0 };
+}
+
+// Updates the range controls to match the selected range.
+const showRange = () => {
+    elements.rangePreset.value = chartRange.preset;
+    elements.rangeCustom.classList.toggle("hidden", isLiveRange());
+    if (!isLiveRange()) {
+        elements.rangeFrom.value = toDateTimeLocal(chartRange.from);
+        elements.rangeTo.value = toDateTimeLocal(chartRange.to);
+    }
+}
 
-    if (ping) {
-        elements.latestPingCircle.classList.remove("red_dot");
-        elements.latestPingCircle.classList.add("green_dot");
-        elements.latestPingText.innerHTML = "Success";
+/**
+ * Selects and loads a range, keeping it in the page URL so that it survives
+ * reloads and can be shared. Zooming adds a history entry, so that going back
+ * zooms out again.
+ */
+const setRange = (range, addHistory = false) => {
+    chartRange = range;
+    const params = new URLSearchParams(window.location.search);
+    ["range", "from", "to"].forEach(name => params.delete(name));
+    if (isLiveRange()) {
+        params.set("range", range.preset);
     } else {
-        elements.latestPingCircle.classList.remove("green_dot");
-        elements.latestPingCircle.classList.add("red_dot");
-        elements.latestPingText.innerHTML = "Failure";
+        params.set("from", range.from);
+        params.set("to", range.to);
+    }
+    const url = `${window.location.pathname}?${params}`;
+    if (addHistory) {
+        history.pushState(null, "", url);
+    } else {
+        history.replaceState(null, "", url);
+    }
+
+    showRange();
+    loadChartData();
+}
+
+/**
+ * Loads a preset as soon as it's picked. Custom ranges start from the range
+ * shown and are loaded with the apply button.
+ */
+const selectRangePreset = () => {
+    const preset = elements.rangePreset.value;
+    if (preset !== "custom") {
+        setRange({ preset, from: 0, to: 0 });
+        return;
+    }
+
+    const [from, to] = rangeBounds();
+    elements.rangeFrom.value = toDateTimeLocal(from);
+    elements.rangeTo.value = toDateTimeLocal(to);
+    elements.rangeCustom.classList.remove("hidden");
+}
+
+const applyCustomRange = () => {
+    const from = new Date(elements.rangeFrom.value).getTime();
+    const to = new Date(elements.rangeTo.value).getTime();
+    if (isNaN(from) || isNaN(to) || to - from < minZoomRange) {
+        return;
     }
+    setRange({ preset: "custom", from, to }, true);
 }
 
 /**
+ * Zooms into the range dragged across the chart. It's loaded from the server
+ * again rather than scaled, so that it's shown at a resolution to match.
+ */
+const zoomToSelection = u => {
+    if (u.select.width === 0) {
+        return;
+    }
+    const from = Math.round(u.posToVal(u.select.left, "x"));
+    const to = Math.round(u.posToVal(u.select.left + u.select.width, "x"));
+    u.setSelect({ left: 0, top: 0, width: 0, height: 0 }, false);
+    if (to - from >= minZoomRange) {
+        setRange({ preset: "custom", from, to }, true);
+    }
+}
+
+/**
+ * Loads the selected range, aggregated by the server to about one point per
+ * pixel. Points are drawn at their mean, with a band from their minimum to
+ * maximum so that spikes aren't averaged away. Live measurements that arrive
+ * meanwhile are held back so the chart stays in order.
+ *
  * Uses undefined to fill in missing values for speed series. Using null adds a gap,
  * which makes this series useless since all data points are surrounded by nulls.
  * https://github.com/leeoniya/uPlot/issues/850#issuecomment-1602969828
  */
-const loadInitialData = async () => {
-    const res = await fetch("/batch");
+const loadChartData = async () => {
+    const load = ++chartLoadCount;
+    lastChartLoad = Date.now();
+    pendingMeasurements ??= [];
+    try {
+        const [from, to] = rangeBounds();
+        const params = new URLSearchParams({ from, to, points: Math.round(chart.width) });
+        const [res, incidentsRes] = await Promise.all([
+            fetch(`/api/v1/measurements/aggregate?${params}`),
+            fetch(`/api/v1/incidents?${new URLSearchParams({ from, to })}`),
+        ]);
+        if (res.status !== 200) {
+            throw new Error(`${res.status}, ${res.statusText}`);
+        }
+        if (incidentsRes.status !== 200) {
+            throw new Error(`${incidentsRes.status}, ${incidentsRes.statusText}`);
+        }
+
+        const json = await res.json();
+        const loadedIncidents = await incidentsRes.json();
+        if (load !== chartLoadCount) {
+            return;
+        }
+        outages = loadedIncidents
+            .filter(incident => incident["kind"] === "outage")
+            .map(incident => [incident["start"], incident["end"]]);
+
+        addTargets(json["targets"].map(target => target["name"]));
+        const values = x => x.map(y => y === null ? undefined : y);
+        const timestamps = json["timestamps"];
+        const targetRTTs = new Map(json["targets"].map(target => [target["name"], values(target["rttMS"]["mean"])]));
+        chart.setData([
+            timestamps,
+            values(json["download"]["mean"]),
+            values(json["upload"]["mean"]),
+            json["ping"].map(x => x * pingSuccessValue),
+            values(json["traffic"]["mean"]),
+            timestamps.map(x => planAt(x)?.["downloadMbps"] ?? null),
+            timestamps.map(x => planAt(x)?.["uploadMbps"] ?? null),
+            values(json["download"]["min"]),
+            values(json["download"]["max"]),
+            values(json["upload"]["min"]),
+            values(json["upload"]["max"]),
+            values(json["traffic"]["min"]),
+            values(json["traffic"]["max"]),
+            json["packetLoss"],
+            ...chartTargets.map(name => targetRTTs.get(name) ?? timestamps.map(() => undefined)),
+        ]);
+        chartBucketMS = json["bucketMS"];
+        lastMeasurementSeq = Math.max(lastMeasurementSeq, json["lastSeq"]);
+    } catch (error) {
+        console.error("Failed to load measurements: ", error);
+    } finally {
+        if (load === chartLoadCount) {
+            flushPendingMeasurements();
+        }
+    }
+}
+
+// Drops points that have moved out of a live range.
+const trimChartData = () => {
+    const [from] = rangeBounds();
+    let count = chart.data[0].findIndex(timestamp => timestamp >= from);
+    if (count === -1) {
+        count = chart.data[0].length;
+    }
+    count = Math.max(count, chart.data[0].length - maxDataPoints);
+    if (count > 0) {
+        chart.data.forEach(values => values.splice(0, count));
+    }
+}
+
+const formatBytes = bytes => {
+    const units = ["B", "KB", "MB", "GB", "TB"];
+    let i = 0;
+    while (bytes >= 1000 && i < units.length - 1) {
+        bytes /= 1000;
+        i += 1;
+    }
+    return `${bytes.toFixed(i === 0 ? 0 : 1)} ${units[i]}`;
+}
+
+const loadUsage = async () => {
+    const res = await fetch("/api/v1/usage");
     if (res.status !== 200) {
-        console.error(`/batch: ${res.status}, ${res.statusText}`);
+        console.error(`/api/v1/usage: ${res.status}, ${res.statusText}`);
         return;
     }
 
-    const json = await res.json();
-    chart.data[0] = json["timestamps"];
-    chart.data[1] = json["download"].map(x => x === null ? undefined : x);
-    chart.data[2] = json["upload"].map(x => x === null ? undefined : x);
-    chart.data[3] = json["ping"].map(getPingValue);
+    const usage = await res.json();
+    elements.usageUsed.innerHTML = formatBytes(usage["bytesDownloaded"] + usage["bytesUploaded"]);
+    elements.usageBudget.innerHTML = usage["budgetBytes"] > 0 ? formatBytes(usage["budgetBytes"]) : "None";
+    elements.usageReset.innerHTML = new Date(usage["periodEnd"]).toLocaleDateString();
+    elements.usageUsed.classList.toggle("usage_exceeded", usage["exceeded"]);
+}
+
+/**
+ * Starts a speed test and polls until it finishes. The result itself arrives
+ * over the websocket like scheduled results.
+ */
+const runSpeedTest = async () => {
+    elements.runSpeedtestButton.disabled = true;
+    elements.runSpeedtestStatus.textContent = "Running...";
+
+    try {
+        const res = await fetch("/api/v1/probes/speedtest/run", { method: "POST" });
+        if (res.status === 403) {
+            elements.runSpeedtestStatus.textContent = "Running speed tests requires the admin role";
+            return;
+        }
+        if (res.status !== 202) {
+            throw new Error(`${res.status}, ${res.statusText}`);
+        }
 
-    if (chart.data[0].length > maxDataPoints) {
-        for (let i = 0; i < chart.data.length; i++) {
-            chart.data[i].splice(0, chart.data[0].length - maxDataPoints);
+        let run = await res.json();
+        while (run["status"] === "running") {
+            await new Promise(resolve => setTimeout(resolve, probePollInterval));
+            const poll = await fetch(`/api/v1/probes/runs/${run["id"]}`);
+            if (poll.status !== 200) {
+                throw new Error(`${poll.status}, ${poll.statusText}`);
+            }
+            run = await poll.json();
         }
+
+        elements.runSpeedtestStatus.textContent = run["status"] === "succeeded" ? "" : run["error"];
+    } catch (error) {
+        console.error("Speed test failed: ", error);
+        elements.runSpeedtestStatus.textContent = "Failed to run speed test";
+    } finally {
+        elements.runSpeedtestButton.disabled = false;
     }
+}
 
-    chart.setData(chart.data);
-    updateLatestSummary();
+/**
+ * Downloads the selected rows. The server sends them as an attachment, so the
+ * page stays open.
+ */
+const downloadExport = () => {
+    const days = Number(elements.exportRange.value);
+    const params = new URLSearchParams({
+        kind: elements.exportKind.value,
+        format: elements.exportFormat.value,
+        from: days > 0 ? Date.now() - days * 24 * 60 * 60 * 1000 : 0,
+    });
+    window.location.href = `/api/v1/export?${params}`;
 }
 
 const setConnectionStatus = status => {
@@ -236,30 +879,274 @@ const setConnectionStatus = status => {
     }
 }
 
+/**
+ * Reconnects after the websocket closes, waiting longer after each failed
+ * attempt.
+ */
+const scheduleReconnect = () => {
+    const delay = reconnectDelay * (0.5 + Math.random() / 2);
+    reconnectDelay = Math.min(reconnectDelay * 2, maxReconnectDelay);
+    setTimeout(connectToWebSocket, delay);
+};
+
+/**
+ * Loads the measurements stored since the last one received, for example while
+ * the websocket was disconnected. Live measurements that arrive meanwhile are
+ * held back so the chart stays in order.
+ */
+const fillMeasurementGap = async () => {
+    pendingMeasurements ??= [];
+    try {
+        let count = measurementsPageSize;
+        while (count === measurementsPageSize) {
+            const res = await fetch(`/api/v1/measurements?after_seq=${lastMeasurementSeq}&limit=${measurementsPageSize}`);
+            if (res.status !== 200) {
+                throw new Error(`${res.status}, ${res.statusText}`);
+            }
+            const batch = await res.json();
+            count = batch["seqs"].length;
+            addNetworkInfo(batch, true);
+        }
+    } catch (error) {
+        console.error("Failed to load missed measurements: ", error);
+    } finally {
+        flushPendingMeasurements();
+    }
+};
+
+// Adds the live measurements held back while loading.
+const flushPendingMeasurements = () => {
+    const pending = pendingMeasurements ?? [];
+    pendingMeasurements = null;
+    pending.forEach(batch => addNetworkInfo(batch));
+};
+
+/**
+ * Sends a command over the websocket. The returned promise resolves with the
+ * command's result, or rejects with its error.
+ */
+const sendCommand = (type, payload) => {
+    const id = `${++nextCommandID}`;
+    socket.send(JSON.stringify({ type, version: protocolVersion, id, payload }));
+    return new Promise((resolve, reject) => pendingCommands.set(id, { resolve, reject }));
+};
+
+const handleCommandResult = result => {
+    const pending = pendingCommands.get(result["id"]);
+    if (!pending) {
+        return;
+    }
+    pendingCommands.delete(result["id"]);
+    if (result["error"]) {
+        pending.reject(new Error(result["error"]));
+    } else {
+        pending.resolve(result["result"]);
+    }
+};
+
+/**
+ * Asks the server to replay the broadcast messages missed while disconnected,
+ * such as incidents and probe statuses. Measurements are also loaded from the
+ * stored sequence, so only incidents need reloading if the replay is
+ * incomplete.
+ */
+const backfill = async (after, until) => {
+    backfillWindow = [after, until];
+    try {
+        const result = await sendCommand("backfill", { afterSeq: after });
+        if (!result["complete"]) {
+            await loadIncidents();
+        }
+    } catch (error) {
+        console.error("Failed to backfill missed messages: ", error);
+    } finally {
+        backfillWindow = null;
+    }
+};
+
+// Whether a broadcast message hasn't been handled yet. Replayed messages are
+// older than the live ones that may arrive before them, and messages published
+// after the hello are sent both live and replayed.
+const isNewBroadcast = seq => {
+    if (seq > lastSeq) {
+        lastSeq = seq;
+        return true;
+    }
+    return backfillWindow !== null && seq > backfillWindow[0] && seq <= backfillWindow[1];
+};
+
 const connectToWebSocket = () => {
-    const socket = new WebSocket("/ws");
+    socket = new WebSocket("/ws");
     setConnectionStatus("connecting");
 
-    socket.onopen = () => setConnectionStatus("connected");
-    socket.onclose = () => setConnectionStatus("not connected");
+    socket.onopen = () => {
+        setConnectionStatus("connected");
+        reconnectDelay = minReconnectDelay;
+    };
+    socket.onclose = () => {
+        setConnectionStatus("not connected");
+        for (const pending of pendingCommands.values()) {
+            pending.reject(new Error("websocket closed"));
+        }
+        pendingCommands.clear();
+        scheduleReconnect();
+    };
     socket.onerror = error => console.error(`Websocket connection error: `, error);
 
     socket.onmessage = event => {
-        const info = JSON.parse(event.data);
-        chart.data[0].push(info["timestamps"][0]);
-        chart.data[1].push(info["download"][0] === null ? undefined : info["download"]);
-        chart.data[2].push(info["upload"][0] === null ? undefined : info["upload"]);
-        chart.data[3].push(getPingValue(info["ping"][0]));
-
-        if (chart.data[0].length > maxDataPoints) {
-            for (let i = 0; i < chart.data.length; i++) {
-                chart.data[i].splice(0, chart.data[0].length - maxDataPoints);
-            }
+        const message = JSON.parse(event.data);
+        if (message["version"] !== protocolVersion) {
+            console.error(`Unsupported websocket protocol version ${message["version"]}`);
+            return;
         }
 
+        const broadcast = message["seq"] > 0 && message["type"] !== "hello";
+        if (broadcast && !isNewBroadcast(message["seq"])) {
+            return;
+        }
+
+        const handler = messageHandlers[message["type"]];
+        if (handler) {
+            handler(message["payload"], message);
+        } else {
+            console.warn(`Unknown websocket message type \"${message["type"]}\"`);
+        }
+    }
+};
+
+const handleHello = (hello, message) => {
+    // The message sequence restarts with the server. If it carried on from the
+    // last message received, the missed messages are replayed, otherwise
+    // incidents are reloaded. Stored measurements have their own sequence, used
+    // to fill the gap in a live range, or the whole range if nothing has been
+    // loaded yet.
+    const missedAfter = lastSeq;
+    lastSeq = message["seq"];
+    if (missedAfter > 0 && message["seq"] > missedAfter) {
+        backfill(missedAfter, message["seq"]);
+    } else if (missedAfter > message["seq"]) {
+        loadIncidents();
+    }
+    if (isLiveRange()) {
+        if (lastMeasurementSeq > 0) {
+            fillMeasurementGap();
+        } else {
+            loadChartData();
+        }
+    }
+};
+
+/**
+ * Shows the status of on demand probe runs, including ones started from other
+ * browsers.
+ */
+const handleProbeStatus = run => {
+    if (run["probe"] !== "speedtest") {
+        return;
+    }
+    if (run["status"] === "failed") {
+        elements.runSpeedtestStatus.textContent = run["error"];
+    }
+};
+
+const speedTestPhaseNames = {
+    "server": "Selecting server",
+    "latency": "Measuring latency",
+    "download": "Download",
+    "upload": "Upload",
+};
+
+/**
+ * Shows the progress of a running speed test, whether it was scheduled or run
+ * from the button.
+ */
+const updateSpeedTestProgress = progress => {
+    const phase = progress["phase"];
+    if (phase === "complete" || phase === "failed") {
+        elements.speedtestProgress.classList.add("hidden");
+        return;
+    }
+
+    elements.speedtestProgress.classList.remove("hidden");
+    elements.speedtestPhase.innerHTML = speedTestPhaseNames[phase] ?? phase;
+    elements.speedtestMbps.innerHTML = phase === "download" || phase === "upload" ? `${progress["mbps"].toFixed(1)} Mbps` : "";
+    elements.speedtestBar.style.width = `${progress["percent"]}%`;
+};
+
+/**
+ * Adds a batch of measurements to the chart if a live range is shown, skipping
+ * any already added. Live measurements are queued while the chart is loading.
+ */
+const addNetworkInfo = (info, filling = false) => {
+    if (pendingMeasurements !== null && !filling) {
+        pendingMeasurements.push(info);
+        return;
+    }
+
+    const live = isLiveRange();
+    let speedTest = false;
+    for (let i = 0; i < info["seqs"].length; i++) {
+        if (info["seqs"][i] <= lastMeasurementSeq) {
+            continue;
+        }
+        lastMeasurementSeq = info["seqs"][i];
+        speedTest ||= info["download"][i] !== null;
+        if (!live) {
+            continue;
+        }
+
+        addTargets([info["targets"][i]]);
+        trackOutage(info["timestamps"][i], info["ping"][i]);
+        const download = info["download"][i] === null ? undefined : info["download"][i];
+        const upload = info["upload"][i] === null ? undefined : info["upload"][i];
+        const traffic = info["traffic"][i] === null ? undefined : info["traffic"][i];
+        chart.data[0].push(info["timestamps"][i]);
+        chart.data[1].push(download);
+        chart.data[2].push(upload);
+        chart.data[3].push(getPingValue(info["ping"][i]));
+        chart.data[4].push(traffic);
+        chart.data[5].push(planAt(info["timestamps"][i])?.["downloadMbps"] ?? null);
+        chart.data[6].push(planAt(info["timestamps"][i])?.["uploadMbps"] ?? null);
+        // A single measurement is its own minimum and maximum.
+        chart.data[7].push(download);
+        chart.data[8].push(download);
+        chart.data[9].push(upload);
+        chart.data[10].push(upload);
+        chart.data[11].push(traffic);
+        chart.data[12].push(traffic);
+        chart.data[lossSeries].push(info["packetLoss"][i]);
+        chartTargets.forEach((name, t) => {
+            const rtt = name === info["targets"][i] ? info["rttMS"][i] : null;
+            chart.data[firstTargetSeries + t].push(rtt === null ? undefined : rtt);
+        });
+    }
+
+    if (live) {
+        trimChartData();
         chart.setData(chart.data);
-        updateLatestSummary();
+        if (!filling && Date.now() - lastChartLoad >= Math.max(chartBucketMS, chartReloadInterval)) {
+            loadChartData();
+        }
+    }
+
+    if (speedTest) {
+        loadUsage();
+        loadPlan();
+        loadHeatmap();
     }
+    if (speedTest || Date.now() - lastStatsLoad >= statsRefreshInterval) {
+        loadStats();
+    }
+};
+
+// Handlers for each websocket message type, see internal/websocket/message.go.
+const messageHandlers = {
+    "hello": handleHello,
+    "measurement": addNetworkInfo,
+    "incident": handleIncident,
+    "probeStatus": handleProbeStatus,
+    "speedTestProgress": updateSpeedTestProgress,
+    "commandResult": handleCommandResult,
 };
 
 window.onload = async () => {
@@ -269,23 +1156,93 @@ window.onload = async () => {
     elements.legendDown = document.getElementById("legend_down");
     elements.legendUp = document.getElementById("legend_up");
     elements.legendPing = document.getElementById("legend_ping");
+    elements.legendTraffic = document.getElementById("legend_traffic");
+    elements.legendLoss = document.getElementById("legend_loss");
+    elements.legendRTT = document.getElementById("legend_rtt");
+    elements.seriesToggles = document.getElementById("series_toggles");
+
+    elements.rangePreset = document.getElementById("range_preset");
+    elements.rangeCustom = document.getElementById("range_custom");
+    elements.rangeFrom = document.getElementById("range_from");
+    elements.rangeTo = document.getElementById("range_to");
+    elements.rangePreset.onchange = selectRangePreset;
+    document.getElementById("range_apply").onclick = applyCustomRange;
 
-    elements.latestDate = document.getElementById("latest_date");
-    elements.latestTime = document.getElementById("latest_time");
-    elements.latestUp = document.getElementById("latest_up");
-    elements.latestDown = document.getElementById("latest_down");
-    elements.latestPingCircle = document.getElementById("latest_ping_circle");
-    elements.latestPingText = document.getElementById("latest_ping_text");
+    elements.statsWindow = document.getElementById("stats_window");
+    elements.statsAvailability = document.getElementById("stats_availability");
+    elements.statsMeasurements = document.getElementById("stats_measurements");
+    elements.statsOutages = document.getElementById("stats_outages");
+    elements.statsDowntime = document.getElementById("stats_downtime");
+    elements.statsMTTR = document.getElementById("stats_mttr");
+    elements.statsMTBF = document.getElementById("stats_mtbf");
+    elements.statsRTT = document.getElementById("stats_rtt");
+    elements.statsRTTTail = document.getElementById("stats_rtt_tail");
+    elements.statsLoss = document.getElementById("stats_loss");
+    elements.statsLossTail = document.getElementById("stats_loss_tail");
+    elements.statsDownload = document.getElementById("stats_download");
+    elements.statsUpload = document.getElementById("stats_upload");
+    elements.statsWindow.onchange = loadStats;
+
+    elements.heatmap = document.getElementById("heatmap");
+    elements.heatmapMetric = document.getElementById("heatmap_metric");
+    elements.heatmapWindow = document.getElementById("heatmap_window");
+    elements.heatmapMetric.onchange = loadHeatmap;
+    elements.heatmapWindow.onchange = loadHeatmap;
+
+    elements.usageUsed = document.getElementById("usage_used");
+    elements.usageBudget = document.getElementById("usage_budget");
+    elements.usageReset = document.getElementById("usage_reset");
+
+    elements.planName = document.getElementById("plan_name");
+    elements.planSpeeds = document.getElementById("plan_speeds");
+    elements.planRecent = document.getElementById("plan_recent");
+
+    elements.incidents = document.getElementById("incidents");
+
+    elements.runSpeedtestButton = document.getElementById("run_speedtest_button");
+    elements.runSpeedtestStatus = document.getElementById("run_speedtest_status");
+    elements.runSpeedtestButton.onclick = runSpeedTest;
+
+    elements.exportKind = document.getElementById("export_kind");
+    elements.exportRange = document.getElementById("export_range");
+    elements.exportFormat = document.getElementById("export_format");
+    document.getElementById("export_button").onclick = downloadExport;
+
+    elements.speedtestProgress = document.getElementById("speedtest_progress");
+    elements.speedtestPhase = document.getElementById("speedtest_phase");
+    elements.speedtestMbps = document.getElementById("speedtest_mbps");
+    elements.speedtestBar = document.getElementById("speedtest_bar");
 
     const data = [
         [], // x-values (timestamps)
         [], // y-values (download speed)
         [], // y-values (upload speed)
         [], // y-values (ping success)
+        [], // y-values (interface traffic)
+        [], // y-values (plan download speed)
+        [], // y-values (plan upload speed)
+        [], // y-values (minimum download speed)
+        [], // y-values (maximum download speed)
+        [], // y-values (minimum upload speed)
+        [], // y-values (maximum upload speed)
+        [], // y-values (minimum interface traffic)
+        [], // y-values (maximum interface traffic)
+        [], // y-values (packet loss)
     ];
     chart = new uPlot(chartOptions, data, document.getElementById("chart"));
+    seriesToggles.forEach(addSeriesToggle);
+
+    chartRange = rangeFromURL();
+    showRange();
+    window.onpopstate = () => {
+        chartRange = rangeFromURL();
+        showRange();
+        loadChartData();
+    };
 
     setConnectionStatus("not connected");
-    await loadInitialData();
+    // The plan lines are drawn from the measurement timestamps.
+    await loadPlan();
+    await Promise.all([loadChartData(), loadUsage(), loadStats(), loadIncidents(), loadHeatmap()]);
     connectToWebSocket();
 }